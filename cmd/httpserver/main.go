@@ -1,163 +1,233 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
+	"embed"
+	"flag"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/digest"
+	"httpfromtcp/internal/fileserver"
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/proxy"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
 )
 
 const port = 42069
 
+const shutdownTimeout = 10 * time.Second
+
+// upstreams maps path prefixes to the servers requests under them are
+// proxied to, from repeated -upstream prefix=url,url... flags.
+type upstreams map[string][]string
+
+func (u upstreams) String() string {
+	var pairs []string
+	for prefix, urls := range u {
+		pairs = append(pairs, prefix+"="+strings.Join(urls, ","))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (u upstreams) Set(v string) error {
+	prefix, urls, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || urls == "" {
+		return fmt.Errorf("want /prefix=url[,url...], got %q", v)
+	}
+	u[strings.TrimSuffix(prefix, "/")] = strings.Split(urls, ",")
+	return nil
+}
+
+// balancer returns the balancer named by the -balance flag.
+func balancer(name string) (proxy.Balancer, error) {
+	kind, arg, _ := strings.Cut(name, ":")
+	switch {
+	case kind == "round-robin":
+		return proxy.RoundRobin(), nil
+	case kind == "least-conn":
+		return proxy.LeastConnections(), nil
+	case kind == "weighted":
+		return proxy.Weighted(), nil
+	case kind == "header" && arg != "":
+		return proxy.HashHeader(arg), nil
+	case kind == "cookie" && arg != "":
+		return proxy.HashCookie(arg), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// backends parses upstream URLs, each optionally followed by "*weight".
+func backends(urls []string) ([]proxy.BackendConfig, error) {
+	var configs []proxy.BackendConfig
+	for _, u := range urls {
+		u, w, ok := strings.Cut(u, "*")
+		weight := 1
+		if ok {
+			var err error
+			if weight, err = strconv.Atoi(w); err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", u+"*"+w)
+			}
+		}
+		configs = append(configs, proxy.BackendConfig{URL: u, Weight: weight})
+	}
+	return configs, nil
+}
+
 func main() {
-	server, err := server.Serve(port, handler)
+	proxied := upstreams{}
+	flag.Var(proxied, "upstream", "proxy requests under `/prefix=url[*weight],...` to the urls (repeatable)")
+	balance := flag.String("balance", "round-robin", "how to spread requests over an upstream's urls: round-robin, least-conn, weighted, header:`name` or cookie:name")
+	healthPath := flag.String("health-check", "", "path requested from each upstream url to check it is up")
+	retries := flag.Int("retries", 2, "how many times to retry idempotent requests an upstream failed")
+	cacheSize := flag.Int64("cache-size", proxy.DefaultMemoryStoreBytes, "`bytes` of upstream responses to cache, 0 for no cache")
+	cacheDir := flag.String("cache-dir", "", "keep cached upstream responses in `dir` instead of in memory")
+	adminPort := flag.Int("admin-port", 0, "serve the admin endpoints, the cache purge and upstream status, on this `port` of 127.0.0.1; off if 0")
+	flag.Parse()
+	if len(proxied) == 0 {
+		proxied["/httpbin"] = []string{"https://httpbin.org"}
+	}
+
+	r := router.New()
+	r.Use(middleware.Recovery(), middleware.RequestID(), middleware.AccessLog(log.Default()))
+	// the admin endpoints change what the server does, so they are only
+	// served when asked for, on a listener of their own that takes
+	// connections from this machine alone
+	var admin *router.Router
+	if *adminPort != 0 {
+		admin = router.New()
+		admin.Use(middleware.Recovery(), middleware.AccessLog(log.Default()))
+	}
+	var cache *proxy.Cache
+	if *cacheSize > 0 {
+		var store proxy.Store = proxy.NewMemoryStore(*cacheSize)
+		if *cacheDir != "" {
+			disk, err := proxy.NewDiskStore(*cacheDir, *cacheSize)
+			if err != nil {
+				log.Fatalf("Error configuring cache: %v", err)
+			}
+			store = disk
+		}
+		cache = proxy.NewCache(proxy.CacheConfig{Store: store})
+		if admin != nil {
+			admin.Post("/admin/cache/purge", cache.PurgeHandler)
+		}
+	}
+	for prefix, urls := range proxied {
+		b, err := balancer(*balance)
+		if err != nil {
+			log.Fatalf("Error configuring upstream: %v", err)
+		}
+		configs, err := backends(urls)
+		if err != nil {
+			log.Fatalf("Error configuring upstream: %v", err)
+		}
+		pool, err := proxy.NewPool(proxy.PoolConfig{
+			Backends:    configs,
+			Balancer:    b,
+			HealthCheck: proxy.HealthCheck{Path: *healthPath},
+			SlowStart:   30 * time.Second,
+			Retry:       proxy.RetryPolicy{Attempts: *retries + 1},
+		})
+		if err != nil {
+			log.Fatalf("Error configuring upstream: %v", err)
+		}
+		defer pool.Close()
+		p, err := proxy.New(proxy.Config{Pool: pool, StripPrefix: prefix, Cache: cache})
+		if err != nil {
+			log.Fatalf("Error configuring upstream: %v", err)
+		}
+		// digests of what the upstream sent, hashed as it streams through
+		withDigests := digest.Trailers(digest.Options{Content: []digest.Algorithm{digest.SHA256}})
+		// upload bodies checked against their digests, which go upstream
+		verified := digest.Verify(digest.VerifyOptions{Report: []digest.Algorithm{digest.SHA256}})
+		r.Any(prefix+"/{path...}", server.Chain(verified, withDigests)(p.ServeHTTP))
+		if admin != nil {
+			admin.Get("/admin/upstreams"+prefix, pool.AdminHandler)
+		}
+	}
+	r.Any("/yourproblem", handler400)
+	r.Any("/myproblem", handler500)
+	r.Any("/{path...}", siteHandler())
+
+	var adminServer *server.Server
+	if admin != nil {
+		var err error
+		adminServer, err = server.ServeConfig(server.Config{Host: "127.0.0.1", Port: *adminPort}, admin.ServeHTTP)
+		if err != nil {
+			log.Fatalf("Error starting admin server: %v", err)
+		}
+		log.Println("Admin server started on 127.0.0.1 port", *adminPort)
+	}
+	server, err := server.Serve(port, r.ServeHTTP)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down admin server: %v", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		proxyHandler(w, req)
-		return
-	}
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handler400(w, req)
-		return
+// assets holds the site, served with a fallback to its index.html for
+// any route, and the pages for error responses.
+//
+//go:embed site errors
+var assets embed.FS
+
+// siteHandler serves the embedded site in SPA mode, so every route
+// without a file of its own gets the index page.
+func siteHandler() server.Handler {
+	site, err := fs.Sub(assets, "site")
+	if err != nil {
+		log.Fatalf("Error loading site: %v", err)
 	}
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		handler500(w, req)
-		return
+	h, err := fileserver.NewFS(site, fileserver.Options{SPA: true, CacheControl: "no-cache"})
+	if err != nil {
+		log.Fatalf("Error loading site: %v", err)
 	}
-	handler200(w, req)
-	return
+	return h
 }
 
 func handler400(w *response.Writer, _ *request.Request) {
-	w.WriteStatusLine(response.BadRequest)
-	body := []byte(`<html>
-<head>
-<title>400 Bad Request</title>
-</head>
-<body>
-<h1>Bad Request</h1>
-<p>Your request honestly kinda sucked.</p>
-</body>
-</html>
-`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
-	w.WriteHeaders(h)
-	w.WriteBody(body)
-	return
+	writePage(w, response.BadRequest, "errors/400.html")
 }
 
 func handler500(w *response.Writer, _ *request.Request) {
-	w.WriteStatusLine(response.InternalServerError)
-	body := []byte(`<html>
-<head>
-<title>500 Internal Server Error</title>
-</head>
-<body>
-<h1>Internal Server Error</h1>
-<p>Okay, you know what? This one is on me.</p>
-</body>
-</html>
-`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+	writePage(w, response.InternalServerError, "errors/500.html")
 }
 
-func handler200(w *response.Writer, _ *request.Request) {
-	w.WriteStatusLine(response.OK)
-	body := []byte(`<html>
-<head>
-<title>200 OK</title>
-</head>
-<body>
-<h1>Success!</h1>
-<p>Your request was an absolute banger.</p>
-</body>
-</html>
-`)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
-	w.WriteHeaders(h)
-	w.WriteBody(body)
-	return
-}
-
-func proxyHandler(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	url := "https://httpbin.org/" + target
-	fmt.Println("Proxying to", url)
-	resp, err := http.Get(url)
+// writePage sends the embedded page name as the body of a response with
+// the given status.
+func writePage(w *response.Writer, statusCode response.StatusCode, name string) {
+	body, err := assets.ReadFile(name)
 	if err != nil {
-		handler500(w, req)
-		return
+		log.Printf("Error reading page %s: %v", name, err)
+		body = []byte(response.StatusText(statusCode) + "\n")
 	}
-	defer resp.Body.Close()
-
-	w.WriteStatusLine(response.OK)
 	h := response.GetDefaultHeaders(0)
-	h.Override("Transfer-Encoding", "chunked")
-	h.Override("Trailer", "X-Content-SHA256, X-Content-Length")
-	h.Remove("Content-Length")
-	w.WriteHeaders(h)
-
-	fullBody := make([]byte, 0)
-
-	const maxChunkSize = 1024
-	buffer := make([]byte, maxChunkSize)
-	for {
-		n, err := resp.Body.Read(buffer)
-		fmt.Println("Read", n, "bytes")
-		if n > 0 {
-			_, err = w.WriteChunkedBody(buffer[:n])
-			if err != nil {
-				fmt.Println("Error writing chunked body:", err)
-				break
-			}
-			fullBody = append(fullBody, buffer[:n]...)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			break
-		}
-	}
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		fmt.Println("Error writing chunked body done:", err)
-	}
-	trailers := headers.NewHeaders()
-	sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
-	trailers.Override("X-Content-SHA256", sha256)
-	trailers.Override("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		fmt.Println("Error writing trailers:", err)
-	}
-	fmt.Println("Wrote trailers")
+	h.Override("Content-Type", "text/html")
+	response.NewAutoWriter(w, statusCode, h).Write(body)
 }
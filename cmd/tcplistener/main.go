@@ -36,8 +36,8 @@ func main() {
 			fmt.Printf("- Version: %s\n", rl.HttpVersion)
 			headers := req.Headers
 			fmt.Println("Headers:")
-			for k, v := range headers {
-				fmt.Printf("- %s: %s\n", k, v)
+			for _, k := range headers.Names() {
+				fmt.Printf("- %s: %s\n", k, headers.Get(k))
 			}
 			fmt.Println("Body:")
 			fmt.Printf("%s\n", req.Body)
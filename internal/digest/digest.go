@@ -0,0 +1,161 @@
+// Package digest computes and checks the integrity fields of RFC 9530:
+// Content-Digest and Repr-Digest, with the sha-256 and sha-512
+// algorithms, and the Want-Content-Digest and Want-Repr-Digest fields
+// clients use to ask for them.
+package digest
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Field names, RFC 9530 sections 2 to 4.
+const (
+	ContentDigest     = "Content-Digest"
+	ReprDigest        = "Repr-Digest"
+	WantContentDigest = "Want-Content-Digest"
+	WantReprDigest    = "Want-Repr-Digest"
+)
+
+// Algorithm is a key of the Hash Algorithms for HTTP Digest Fields
+// registry, RFC 9530 section 7.2.
+type Algorithm string
+
+const (
+	SHA256 Algorithm = "sha-256"
+	SHA512 Algorithm = "sha-512"
+)
+
+// supported lists the algorithms this package computes, strongest
+// first.
+var supported = []Algorithm{SHA512, SHA256}
+
+// Supported reports whether a is an algorithm this package computes.
+func (a Algorithm) Supported() bool {
+	return slices.Contains(supported, a)
+}
+
+// New returns a hash for a, or nil if it isn't supported.
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case SHA512:
+		return sha512.New()
+	}
+	return nil
+}
+
+// Digest is one member of a Content-Digest or Repr-Digest field.
+type Digest struct {
+	Algorithm Algorithm
+	Sum       []byte
+}
+
+// Format returns digests as a field value, a Structured Fields
+// dictionary of byte sequences: sha-256=:base64:, sha-512=:base64:.
+func Format(digests []Digest) string {
+	members := make([]string, 0, len(digests))
+	for _, d := range digests {
+		members = append(members, string(d.Algorithm)+"=:"+base64.StdEncoding.EncodeToString(d.Sum)+":")
+	}
+	return strings.Join(members, ", ")
+}
+
+// Parse parses a Content-Digest or Repr-Digest field value. Members
+// for algorithms that aren't supported are returned too, for the caller
+// to skip; parameters are ignored.
+func Parse(value string) ([]Digest, error) {
+	var digests []Digest
+	for _, member := range splitMembers(value) {
+		key, v, ok := strings.Cut(member, "=")
+		if !ok || !validKey(key) {
+			return nil, fmt.Errorf("digest: malformed member %q", member)
+		}
+		v, _, _ = strings.Cut(v, ";")
+		v = strings.TrimSpace(v)
+		if len(v) < 2 || v[0] != ':' || v[len(v)-1] != ':' {
+			return nil, fmt.Errorf("digest: %s is not a byte sequence", key)
+		}
+		sum, err := base64.StdEncoding.DecodeString(v[1 : len(v)-1])
+		if err != nil {
+			return nil, fmt.Errorf("digest: %s: %w", key, err)
+		}
+		digests = append(digests, Digest{Algorithm: Algorithm(key), Sum: sum})
+	}
+	return digests, nil
+}
+
+// ParseWant parses a Want-Content-Digest or Want-Repr-Digest field
+// value, a dictionary of algorithms and preferences from 0 to 10, and
+// returns the supported algorithms the client accepts, most preferred
+// first. Preference 0 means not acceptable. Malformed members are
+// ignored.
+func ParseWant(value string) []Algorithm {
+	type want struct {
+		alg  Algorithm
+		pref int
+	}
+	var wants []want
+	for _, member := range splitMembers(value) {
+		key, v, ok := strings.Cut(member, "=")
+		if !ok {
+			continue
+		}
+		v, _, _ = strings.Cut(v, ";")
+		pref, err := strconv.Atoi(strings.TrimSpace(v))
+		alg := Algorithm(key)
+		if err != nil || pref <= 0 || pref > 10 || !alg.Supported() {
+			continue
+		}
+		wants = append(wants, want{alg, pref})
+	}
+	slices.SortStableFunc(wants, func(a, b want) int {
+		if c := cmp.Compare(b.pref, a.pref); c != 0 {
+			return c
+		}
+		// stronger first between equals
+		return cmp.Compare(slices.Index(supported, a.alg), slices.Index(supported, b.alg))
+	})
+	algs := make([]Algorithm, 0, len(wants))
+	for _, w := range wants {
+		if !slices.Contains(algs, w.alg) {
+			algs = append(algs, w.alg)
+		}
+	}
+	return algs
+}
+
+// splitMembers splits a dictionary into its trimmed, non-empty members.
+// Neither byte sequences nor integers contain commas.
+func splitMembers(value string) []string {
+	var members []string
+	for _, member := range strings.Split(value, ",") {
+		if member = strings.TrimSpace(member); member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// validKey reports whether key is a Structured Fields key: a lowercase
+// letter or "*", then lowercase letters, digits, "_", "-", "." or "*".
+func validKey(key string) bool {
+	if key == "" || !(key[0] >= 'a' && key[0] <= 'z' || key[0] == '*') {
+		return false
+	}
+	for i := 1; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("_-.*", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+func TestFormatParse(t *testing.T) {
+	// Test: the example of RFC 9530 section 2 round-trips
+	sum256 := sha256.Sum256([]byte(`{"hello": "world"}`))
+	value := Format([]Digest{{SHA256, sum256[:]}})
+	assert.Equal(t, "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:", value)
+	digests, err := Parse(value + ", unixsum=:AAA=:;x=1")
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+	assert.Equal(t, Digest{SHA256, sum256[:]}, digests[0])
+	assert.Equal(t, Algorithm("unixsum"), digests[1].Algorithm)
+	assert.False(t, digests[1].Algorithm.Supported())
+
+	// Test: malformed values are errors
+	for _, v := range []string{"sha-256", "sha-256=abc", "sha-256=:!!:", "SHA-256=:AAA=:"} {
+		_, err := Parse(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestParseWant(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []Algorithm
+	}{
+		{"sha-256=1", []Algorithm{SHA256}},
+		{"sha-512=3, sha-256=10", []Algorithm{SHA256, SHA512}},
+		{"sha-256=5, sha-512=5", []Algorithm{SHA512, SHA256}},
+		{"sha-256=0, sha-512=2", []Algorithm{SHA512}},
+		{"md5=10, sha-256=11, sha-512", []Algorithm{}},
+		{"unixcksum=2, sha-512=1;x=y", []Algorithm{SHA512}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ParseWant(tt.value), tt.value)
+	}
+}
+
+// serve runs h behind Trailers(opts) for a raw request and returns what
+// it writes.
+func serve(t *testing.T, opts Options, h server.Handler, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	Trailers(opts)(h)(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+// fixed answers with a fixed-length body written in two pieces.
+func fixed(status response.StatusCode, extra ...string) server.Handler {
+	return func(w *response.Writer, _ *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "11")
+		for i := 0; i+1 < len(extra); i += 2 {
+			h.Set(extra[i], extra[i+1])
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("hello "))
+		w.WriteBody([]byte("world"))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	sum256 := sha256.Sum256([]byte("hello world"))
+	sum512 := sha512.Sum512([]byte("hello world"))
+	content256 := "content-digest: " + Format([]Digest{{SHA256, sum256[:]}})
+	defaults := Options{Content: []Algorithm{SHA256}, Repr: []Algorithm{SHA256, SHA512}}
+
+	// Test: a fixed-length body streams out chunked, with its digests in
+	// the trailers
+	out := serve(t, defaults, fixed(response.OK), "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"transfer-encoding: chunked\r\n"+
+		"trailer: Content-Digest, Repr-Digest\r\n"+
+		"\r\n"+
+		"6\r\nhello \r\n5\r\nworld\r\n0\r\n"+
+		content256+"\r\n"+
+		"repr-digest: "+Format([]Digest{{SHA256, sum256[:]}, {SHA512, sum512[:]}})+"\r\n"+
+		"\r\n", out)
+
+	// Test: the client's preference wins, and preference 0 turns a
+	// digest off
+	out = serve(t, defaults, fixed(response.OK), "GET / HTTP/1.1\r\nHost: x\r\nWant-Content-Digest: sha-256=1, sha-512=9\r\nWant-Repr-Digest: sha-256=0\r\n\r\n")
+	assert.Contains(t, out, "trailer: Content-Digest\r\n")
+	assert.Contains(t, out, "0\r\ncontent-digest: "+Format([]Digest{{SHA512, sum512[:]}})+"\r\n\r\n")
+	assert.NotContains(t, out, "repr-digest")
+
+	// Test: with no defaults, only a client that asks gets a digest
+	out = serve(t, Options{}, fixed(response.OK), "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	out = serve(t, Options{}, fixed(response.OK), "GET / HTTP/1.1\r\nHost: x\r\nWant-Content-Digest: sha-256=1\r\n\r\n")
+	assert.Contains(t, out, "0\r\n"+content256+"\r\n\r\n")
+
+	// Test: a partial response gets no Repr-Digest
+	out = serve(t, defaults, fixed(response.PartialContent), "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Contains(t, out, "trailer: Content-Digest\r\n")
+	assert.NotContains(t, out, "repr-digest")
+
+	// Test: a digest the handler sends itself is left alone
+	out = serve(t, defaults, fixed(response.OK, "Repr-Digest", "sha-256=:AAA=:"), "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Contains(t, out, "repr-digest: sha-256=:AAA=:\r\n")
+	assert.Contains(t, out, "trailer: Content-Digest\r\n")
+
+	// Test: HEAD requests, HTTP/1.0 clients and bodiless responses are
+	// untouched
+	out = serve(t, defaults, fixed(response.OK), "HEAD / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 11\r\n\r\n", out)
+	out = serve(t, defaults, fixed(response.OK), "GET / HTTP/1.0\r\n\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.NotContains(t, out, "trailer")
+	out = serve(t, defaults, func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.NoContent)
+		w.WriteHeaders(headers.NewHeaders())
+	}, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", out)
+}
+
+func TestWriter_Chunked(t *testing.T) {
+	// Test: a chunked body keeps its own trailers next to the digests,
+	// and the handler can see the digests it is sending
+	var digests []Digest
+	h := func(w *response.Writer, req *request.Request) {
+		dw := NewWriter(w, req, Options{Content: []Algorithm{SHA256}})
+		hs := headers.NewHeaders()
+		hs.Set("Transfer-Encoding", "chunked")
+		hs.Set("Trailer", "X-Count")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(hs)
+		w.WriteChunkedBody([]byte("abc"))
+		w.WriteChunkedBody([]byte("def"))
+		w.WriteChunkedBodyDone()
+		digests = dw.Digests()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "2")
+		w.WriteTrailers(trailers)
+	}
+	out := serve(t, Options{}, h, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	sum := sha256.Sum256([]byte("abcdef"))
+	assert.Equal(t, []Digest{{SHA256, sum[:]}}, digests)
+	assert.Contains(t, out, "trailer: X-Count, Content-Digest\r\n")
+	assert.Contains(t, out, "0\r\nx-count: 2\r\ncontent-digest: "+Format(digests)+"\r\n\r\n")
+}
+
+// verify runs a handler that records the Content-Digest it sees behind
+// Verify(opts) for a raw request, and returns what it writes.
+func verify(t *testing.T, opts VerifyOptions, raw string) (string, string, bool) {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	var seen string
+	called := false
+	Verify(opts)(func(w *response.Writer, req *request.Request) {
+		called = true
+		seen = req.Headers.Get(ContentDigest)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String(), seen, called
+}
+
+func TestVerify(t *testing.T) {
+	sum256 := sha256.Sum256([]byte("hello world"))
+	sum512 := sha512.Sum512([]byte("hello world"))
+	good := Format([]Digest{{SHA256, sum256[:]}})
+	post := func(fields string) string {
+		return "POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n" + fields + "\r\nhello world"
+	}
+
+	// Test: a matching digest, with an unknown algorithm next to it, is
+	// let through
+	out, seen, called := verify(t, VerifyOptions{}, post("Content-Digest: unixsum=:AAA=:, "+good+"\r\n"))
+	assert.True(t, called)
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, "unixsum=:AAA=:, "+good, seen)
+
+	// Test: a mismatch in either field is rejected before the handler
+	for _, name := range []string{ContentDigest, ReprDigest} {
+		out, _, called = verify(t, VerifyOptions{}, post(name+": "+good+", sha-512=:"+"AAAA"+":\r\n"))
+		assert.False(t, called, name)
+		assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+		assert.Contains(t, out, "want-content-digest: sha-512=10, sha-256=5\r\n")
+		assert.Contains(t, out, "digest: mismatch: "+name+" sha-512")
+	}
+
+	// Test: a malformed digest is rejected
+	_, _, called = verify(t, VerifyOptions{}, post("Content-Digest: sha-256=abc\r\n"))
+	assert.False(t, called)
+
+	// Test: digests in the trailers of a chunked body are checked too
+	chunked := func(trailer string) string {
+		return "POST /upload HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTrailer: Content-Digest\r\n\r\n" +
+			"6\r\nhello \r\n5\r\nworld\r\n0\r\n" + trailer + "\r\n"
+	}
+	_, _, called = verify(t, VerifyOptions{}, chunked("Content-Digest: "+Format([]Digest{{SHA512, sum512[:]}})+"\r\n"))
+	assert.True(t, called)
+	out, _, called = verify(t, VerifyOptions{}, chunked("Content-Digest: sha-256=:AAAA:\r\n"))
+	assert.False(t, called)
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: with Require, a body without a supported digest is rejected,
+	// but a request without a body isn't
+	out, _, called = verify(t, VerifyOptions{Require: true}, post("Content-Digest: unixsum=:AAA=:\r\n"))
+	assert.False(t, called)
+	assert.Contains(t, out, "digest: missing")
+	_, _, called = verify(t, VerifyOptions{Require: true}, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, called)
+
+	// Test: Report hands the handler the computed digests
+	_, seen, called = verify(t, VerifyOptions{Report: []Algorithm{SHA256, SHA512}}, post(""))
+	assert.True(t, called)
+	assert.Equal(t, Format([]Digest{{SHA256, sum256[:]}, {SHA512, sum512[:]}}), seen)
+}
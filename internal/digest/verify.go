@@ -0,0 +1,111 @@
+package digest
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// ErrMismatch is returned when a digest a request carries isn't that of
+// its body.
+var ErrMismatch = errors.New("digest: mismatch")
+
+// ErrMissing is returned when a request must carry a digest of its body
+// and doesn't have one for a supported algorithm.
+var ErrMissing = errors.New("digest: missing")
+
+// Compute returns the digests of body for algs.
+func Compute(body []byte, algs ...Algorithm) []Digest {
+	digests := make([]Digest, 0, len(algs))
+	for _, alg := range algs {
+		h := alg.New()
+		if h == nil {
+			continue
+		}
+		h.Write(body)
+		digests = append(digests, Digest{Algorithm: alg, Sum: h.Sum(nil)})
+	}
+	return digests
+}
+
+// VerifyRequest checks the Content-Digest and Repr-Digest of req, from
+// its headers and its trailers, against its body, and returns the
+// digests it checked. Members for algorithms that aren't supported are
+// skipped. The body is read first, so a client waiting on 100 Continue
+// is told to send it.
+//
+// As with responses, the content is the representation, so both fields
+// are checked against the body as it arrived.
+func VerifyRequest(req *request.Request, require bool) ([]Digest, error) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	var checked []Digest
+	for _, fields := range []*headers.Headers{req.Headers, req.Trailers} {
+		if fields == nil {
+			continue
+		}
+		for _, name := range []string{ContentDigest, ReprDigest} {
+			if !fields.Has(name) {
+				continue
+			}
+			digests, err := Parse(fields.Get(name))
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range digests {
+				if !d.Algorithm.Supported() {
+					continue
+				}
+				sum := Compute(body, d.Algorithm)[0].Sum
+				if subtle.ConstantTimeCompare(sum, d.Sum) != 1 {
+					return nil, fmt.Errorf("%w: %s %s", ErrMismatch, name, d.Algorithm)
+				}
+				checked = append(checked, d)
+			}
+		}
+	}
+	if require && len(checked) == 0 && len(body) > 0 {
+		return nil, ErrMissing
+	}
+	return checked, nil
+}
+
+// VerifyOptions configures Verify.
+type VerifyOptions struct {
+	// Require rejects requests with a body but no digest of it.
+	Require bool
+	// Report lists algorithms whose digests of the body replace the
+	// Content-Digest of requests with a body for the handler, whether or
+	// not the client sent one, so the handler can store, log or forward
+	// them. With none, the request is left as the client sent it.
+	Report []Algorithm
+}
+
+// Verify returns middleware that checks request bodies against the
+// digests they carry, as VerifyRequest does, before the handler sees
+// them. A request whose body doesn't match, or that has a malformed
+// digest, or none when one is required, is rejected with 400 and a
+// Want-Content-Digest saying which algorithms are understood.
+func Verify(opts VerifyOptions) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if _, err := VerifyRequest(req, opts.Require); err != nil {
+				h := headers.NewHeaders()
+				h.Set(WantContentDigest, "sha-512=10, sha-256=5")
+				response.WriteStatus(w, response.BadRequest, h, err.Error())
+				return
+			}
+			if len(opts.Report) > 0 && len(req.Body) > 0 {
+				req.Headers.Override(ContentDigest, Format(Compute(req.Body, opts.Report...)))
+			}
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package digest
+
+import (
+	"hash"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Options configures the digests a Writer sends.
+type Options struct {
+	// Content lists the algorithms of the Content-Digest sent to clients
+	// that don't ask for one with Want-Content-Digest. With none, only
+	// clients that ask get one.
+	Content []Algorithm
+	// Repr is the same for Repr-Digest and Want-Repr-Digest.
+	Repr []Algorithm
+}
+
+// Writer hashes a response body as it is written and sends its digests
+// in trailers, so the body streams through without being buffered. The
+// response is switched to chunked transfer coding to carry them.
+//
+// A client that sends Want-Content-Digest or Want-Repr-Digest gets the
+// algorithm it prefers most of those supported, or no digest if it
+// accepts none of them; other clients get the Options' algorithms. As
+// this server doesn't apply content codings itself, the content is the
+// representation, and both digests are over the body as written; a 206
+// Partial Content gets no Repr-Digest, as it has only part of the
+// representation. Digests the handler already sends are left alone, and
+// responses without a body, to HEAD requests or HTTP/1.0 clients, which
+// can't receive trailers, get none.
+type Writer struct {
+	w       *response.Writer
+	content []Algorithm
+	repr    []Algorithm
+	hashes  map[Algorithm]hash.Hash
+	fields  map[string][]Algorithm
+}
+
+// NewWriter installs a Writer on w for the response to req. It must be
+// called before the handler writes its headers.
+func NewWriter(w *response.Writer, req *request.Request, opts Options) *Writer {
+	dw := &Writer{
+		w:       w,
+		content: choose(req, WantContentDigest, opts.Content),
+		repr:    choose(req, WantReprDigest, opts.Repr),
+	}
+	if req.RequestLine.Method == "HEAD" || req.RequestLine.HttpVersion == "1.0" ||
+		len(dw.content) == 0 && len(dw.repr) == 0 {
+		return dw
+	}
+	w.Intercept(response.Interceptor{
+		Headers:  dw.interceptHeaders,
+		Body:     dw.interceptBody,
+		Trailers: dw.interceptTrailers,
+	})
+	return dw
+}
+
+// choose returns the algorithms to send in a digest field: the one the
+// client prefers if it said, or the defaults.
+func choose(req *request.Request, want string, defaults []Algorithm) []Algorithm {
+	if !req.Headers.Has(want) {
+		return defaults
+	}
+	algs := ParseWant(req.Headers.Get(want))
+	if len(algs) == 0 {
+		return nil
+	}
+	return algs[:1]
+}
+
+// Trailers returns middleware that sends digest trailers with every
+// response, as a Writer does.
+func Trailers(opts Options) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			NewWriter(w, req, opts)
+			next(w, req)
+		}
+	}
+}
+
+// Digests returns the digests of the body written so far, for the
+// algorithms being sent.
+func (dw *Writer) Digests() []Digest {
+	var digests []Digest
+	for _, alg := range supported {
+		if h, ok := dw.hashes[alg]; ok {
+			digests = append(digests, Digest{Algorithm: alg, Sum: h.Sum(nil)})
+		}
+	}
+	return digests
+}
+
+func (dw *Writer) interceptHeaders(next response.HeadersFunc, h *headers.Headers) error {
+	status := dw.w.StatusCode()
+	if status < response.OK || status == response.NoContent || status == response.NotModified {
+		return next(h)
+	}
+	declared := strings.ToLower(h.Get("Trailer"))
+	dw.fields = make(map[string][]Algorithm)
+	add := func(name string, algs []Algorithm) {
+		if len(algs) > 0 && !h.Has(name) && !strings.Contains(declared, strings.ToLower(name)) {
+			dw.fields[name] = algs
+		}
+	}
+	add(ContentDigest, dw.content)
+	if status != response.PartialContent {
+		add(ReprDigest, dw.repr)
+	}
+	if len(dw.fields) == 0 {
+		return next(h)
+	}
+
+	dw.hashes = make(map[Algorithm]hash.Hash)
+	h = h.Clone()
+	h.Remove("Content-Length")
+	if !strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked") {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	for _, name := range []string{ContentDigest, ReprDigest} {
+		algs, ok := dw.fields[name]
+		if !ok {
+			continue
+		}
+		h.Set("Trailer", name)
+		for _, alg := range algs {
+			if _, ok := dw.hashes[alg]; !ok {
+				dw.hashes[alg] = alg.New()
+			}
+		}
+	}
+	return next(h)
+}
+
+func (dw *Writer) interceptBody(next response.BodyFunc, p []byte) (int, error) {
+	n, err := next(p)
+	if err == nil {
+		for _, h := range dw.hashes {
+			h.Write(p)
+		}
+	}
+	return n, err
+}
+
+func (dw *Writer) interceptTrailers(next response.HeadersFunc, h *headers.Headers) error {
+	if len(dw.fields) == 0 {
+		return next(h)
+	}
+	h = h.Clone()
+	for _, name := range []string{ContentDigest, ReprDigest} {
+		algs, ok := dw.fields[name]
+		if !ok {
+			continue
+		}
+		digests := make([]Digest, 0, len(algs))
+		for _, alg := range algs {
+			digests = append(digests, Digest{Algorithm: alg, Sum: dw.hashes[alg].Sum(nil)})
+		}
+		h.Set(name, Format(digests))
+	}
+	return next(h)
+}
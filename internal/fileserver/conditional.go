@@ -0,0 +1,96 @@
+package fileserver
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(headers.TimeFormat)
+}
+
+// validators are what conditional requests are checked against. HTTP
+// dates only have second precision, so modTime is truncated to match.
+// A zero modTime means the file has none, and dates are ignored.
+type validators struct {
+	etag    string
+	modTime time.Time
+}
+
+// validators returns the validators of the file called name, using its
+// precomputed entity-tag if there is one.
+func (fsrv *fileServer) validators(name string, info fs.FileInfo) validators {
+	etag, ok := fsrv.etags[name]
+	if !ok {
+		etag = fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	}
+	return validators{etag: etag, modTime: info.ModTime().Truncate(time.Second)}
+}
+
+// checkPreconditions evaluates the conditional headers in the order of
+// RFC 9110 section 13.2.2, and returns 304 or 412 if one fails, or 0 if
+// the request should go ahead. If-Range is left to the range handling.
+func checkPreconditions(req *request.Request, v validators) response.StatusCode {
+	h := req.Headers
+	if h.Has("If-Match") {
+		if !matchETag(h.Values("If-Match"), v.etag, false) {
+			return response.PreconditionFailed
+		}
+	} else if t, ok := headers.ParseTime(h.Get("If-Unmodified-Since")); ok && !v.modTime.IsZero() && v.modTime.After(t) {
+		return response.PreconditionFailed
+	}
+
+	if h.Has("If-None-Match") {
+		if matchETag(h.Values("If-None-Match"), v.etag, true) {
+			return response.NotModified
+		}
+	} else if t, ok := headers.ParseTime(h.Get("If-Modified-Since")); ok && !v.modTime.IsZero() && !v.modTime.After(t) {
+		return response.NotModified
+	}
+	return 0
+}
+
+// ifRangeMatches reports whether a Range should be honored: always
+// without If-Range, and otherwise only if its entity-tag or date is
+// exactly the current one, since a range of a different version of the
+// file would be spliced into the wrong bytes.
+func ifRangeMatches(req *request.Request, v validators) bool {
+	value := strings.TrimSpace(req.Headers.Get("If-Range"))
+	switch {
+	case value == "":
+		return true
+	case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/"):
+		return !strings.HasPrefix(value, "W/") && value == v.etag
+	}
+	t, ok := headers.ParseTime(value)
+	return ok && !v.modTime.IsZero() && t.Equal(v.modTime)
+}
+
+// matchETag reports whether etag is in a list of entity-tags, or the
+// list is "*". A weak comparison ignores the W/ prefix on either side.
+func matchETag(values []string, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return true
+			}
+			if weak {
+				tag = strings.TrimPrefix(tag, "W/")
+			}
+			if tag == etag && !strings.HasPrefix(tag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,432 @@
+// Package fileserver serves the files under a directory or in an
+// fs.FS, with the validators, conditional requests and range requests
+// that browsers and caches rely on.
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Options configures a file server.
+type Options struct {
+	// Prefix is removed from the request path before it is looked up
+	// under the root, for a server mounted at something like "/static/".
+	// Requests outside it get a 404.
+	Prefix string
+	// Index is the file served for a directory. It defaults to
+	// index.html.
+	Index string
+	// NoIndex turns off serving Index for directories.
+	NoIndex bool
+	// Listing renders an HTML listing for directories without an index
+	// file. Without it they get a 404.
+	Listing bool
+	// SPA serves the root's Index in place of a 404 for paths that
+	// don't exist, so a single-page app can route them client-side.
+	// Paths whose last segment has an extension still get a 404, as
+	// they are missing assets rather than routes.
+	SPA bool
+	// CacheControl, if set, is sent with every file.
+	CacheControl string
+}
+
+type fileServer struct {
+	fsys fs.FS
+	opts Options
+	// etags holds the precomputed entity-tag of every file of a file
+	// system that doesn't change, by name. Without it, entity-tags are
+	// made from each file's modification time and size.
+	etags map[string]string
+}
+
+// New returns a handler serving the files under root to GET and HEAD
+// requests.
+//
+// Request paths are cleaned and resolved under root, and symbolic links
+// are followed only as long as they stay inside it. Each file gets a
+// Last-Modified and an ETag made from its modification time and size,
+// which If-Match, If-None-Match, If-Modified-Since, If-Unmodified-Since
+// and If-Range are checked against. Range requests get a 206, as
+// multipart/byteranges when they ask for several ranges. A client that
+// accepts gzip is sent the precompressed "name.gz" next to a file when
+// there is one.
+//
+// Directories are redirected to a path ending in "/", then served
+// through their index file or, if enabled, a listing.
+func New(root string, opts Options) server.Handler {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return newFileServer(dirFS(root), opts, nil).serve
+}
+
+// NewFS returns a handler serving the files of fsys the way New does
+// for a directory. It is meant for file systems that don't change, like
+// an embed.FS: every file is read once up front to give it an ETag from
+// a hash of its content, which stays the same from one build of the
+// binary to the next as long as the file does. Files without a
+// modification time, as embedded ones are, get no Last-Modified.
+func NewFS(fsys fs.FS, opts Options) (server.Handler, error) {
+	etags := map[string]string{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sum := sha256.New()
+		if _, err := io.Copy(sum, f); err != nil {
+			return err
+		}
+		etags[name] = fmt.Sprintf(`"%x"`, sum.Sum(nil)[:16])
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fileserver: hashing files: %w", err)
+	}
+	return newFileServer(fsys, opts, etags).serve, nil
+}
+
+func newFileServer(fsys fs.FS, opts Options, etags map[string]string) *fileServer {
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	return &fileServer{fsys: fsys, opts: opts, etags: etags}
+}
+
+func (fsrv *fileServer) serve(w *response.Writer, req *request.Request) {
+	if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		response.WriteStatus(w, response.MethodNotAllowed, h)
+		return
+	}
+	urlPath, ok := fsrv.trimPrefix(req.URL.Path)
+	if !ok {
+		response.WriteStatus(w, response.NotFound, nil)
+		return
+	}
+	name := fsName(urlPath)
+	info, err := fs.Stat(fsrv.fsys, name)
+	if err != nil {
+		if notExist(err) && fsrv.opts.SPA && path.Ext(name) == "" {
+			fsrv.serveIndex(w, req, ".")
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if !info.IsDir() {
+		fsrv.serveFile(w, req, name, info)
+		return
+	}
+
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		redirect(w, req, path.Base(req.URL.Path)+"/")
+		return
+	}
+	if !fsrv.opts.NoIndex && fsrv.serveIndex(w, req, name) {
+		return
+	}
+	if !fsrv.opts.Listing {
+		response.WriteStatus(w, response.NotFound, nil)
+		return
+	}
+	listDir(w, req, fsrv.fsys, name)
+}
+
+// serveIndex serves the index file of the directory dir, and reports
+// false if it has none.
+func (fsrv *fileServer) serveIndex(w *response.Writer, req *request.Request, dir string) bool {
+	index := path.Join(dir, fsrv.opts.Index)
+	info, err := fs.Stat(fsrv.fsys, index)
+	switch {
+	case err == nil && !info.IsDir():
+		fsrv.serveFile(w, req, index, info)
+	case err != nil && !notExist(err):
+		writeError(w, err)
+	default:
+		if dir != "." || !fsrv.opts.SPA {
+			return false
+		}
+		// an SPA without its index has nothing to fall back on
+		response.WriteStatus(w, response.NotFound, nil)
+	}
+	return true
+}
+
+// trimPrefix strips the configured prefix from a request path, and
+// reports whether the path was under it at all.
+func (fsrv *fileServer) trimPrefix(urlPath string) (string, bool) {
+	prefix := fsrv.opts.Prefix
+	if prefix == "" {
+		return urlPath, true
+	}
+	rest, ok := strings.CutPrefix(urlPath, prefix)
+	if !ok || rest != "" && !strings.HasSuffix(prefix, "/") && !strings.HasPrefix(rest, "/") {
+		// "/static" is not a prefix of "/staticfiles"
+		return "", false
+	}
+	return rest, true
+}
+
+// fsName turns a request path into an fs.FS name: cleaned as if it
+// were absolute, so ".." can't climb above the root, and without the
+// leading slash.
+func fsName(urlPath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// dirFS is the file system of a directory on disk. Unlike os.DirFS it
+// refuses symbolic links that lead outside the directory.
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	p, err := dir.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.Open(p)
+}
+
+// resolve maps a slash-separated name to a path under the directory.
+// The name is cleaned as if it were absolute, and the result has its
+// symbolic links evaluated so one pointing outside the directory is
+// refused as if it didn't exist.
+func (dir dirFS) resolve(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fs.ErrNotExist
+	}
+	root, err := filepath.EvalSymlinks(string(dir))
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fs.ErrNotExist
+	}
+	return real, nil
+}
+
+// serveFile sends the file called name, or its precompressed sibling if
+// the client accepts gzip.
+func (fsrv *fileServer) serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) {
+	h := headers.NewHeaders()
+	gzName := name + ".gz"
+	gzInfo, err := fs.Stat(fsrv.fsys, gzName)
+	hasGzip := err == nil && gzInfo.Mode().IsRegular()
+	encoded := hasGzip && acceptsGzip(req.Headers)
+	sent := name
+	if encoded {
+		sent, info = gzName, gzInfo
+	}
+
+	f, err := fsrv.fsys.Open(sent)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+	content, err := readSeeker(f)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.Set("Content-Type", contentType(name, content, encoded))
+	if encoded {
+		h.Set("Content-Encoding", "gzip")
+	}
+	if hasGzip {
+		h.Set("Vary", "Accept-Encoding")
+	}
+	h.Set("Accept-Ranges", "bytes")
+	v := fsrv.validators(sent, info)
+	if !v.modTime.IsZero() {
+		h.Set("Last-Modified", formatTime(v.modTime))
+	}
+	h.Set("ETag", v.etag)
+	if fsrv.opts.CacheControl != "" {
+		h.Set("Cache-Control", fsrv.opts.CacheControl)
+	}
+
+	switch checkPreconditions(req, v) {
+	case response.NotModified:
+		// a 304 carries the validators, not the representation's metadata
+		h.Remove("Content-Type")
+		h.Remove("Content-Encoding")
+		h.Remove("Accept-Ranges")
+		h.Remove("Last-Modified")
+		w.WriteStatusLine(response.NotModified)
+		w.WriteHeaders(h)
+		return
+	case response.PreconditionFailed:
+		response.WriteStatus(w, response.PreconditionFailed, nil)
+		return
+	}
+
+	size := info.Size()
+	if req.Headers.Has("Range") && ifRangeMatches(req, v) {
+		ranges, err := parseRange(req.Headers.Get("Range"), size)
+		switch {
+		case errors.Is(err, errUnsatisfiable):
+			eh := headers.NewHeaders()
+			eh.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			response.WriteStatus(w, response.RangeNotSatisfiable, eh)
+			return
+		case err == nil && len(ranges) == 1:
+			serveRange(w, h, content, ranges[0], size)
+			return
+		case err == nil && len(ranges) > 1:
+			serveMultipart(w, h, content, ranges, size)
+			return
+		}
+		// a malformed Range is ignored, and the whole file is sent
+	}
+
+	h.Set("Content-Length", fmt.Sprintf("%d", size))
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	// the Content-Length bounds the copy; the file goes to ReadFrom as
+	// it is, not through io.Copy, which would hide it behind
+	// os.File.WriteTo, so it can be sent with zero copies
+	w.ReadFrom(content)
+}
+
+// readSeeker returns f itself if it can seek, as files on disk and in
+// an embed.FS can, and otherwise reads it into memory so ranges of it
+// can still be served.
+func readSeeker(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// sniffLen is how much of a file is looked at to guess its type when
+// its extension doesn't say.
+const sniffLen = 512
+
+// contentType picks the Content-Type of name from its extension, and
+// failing that from whether content starts like text. An encoded file
+// can't be looked into.
+func contentType(name string, content io.ReadSeeker, encoded bool) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	if encoded {
+		return "application/octet-stream"
+	}
+	buf := make([]byte, sniffLen)
+	n, _ := io.ReadFull(content, buf)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+	buf = buf[:n]
+	if n == sniffLen {
+		// a multibyte character may have been cut off at the end
+		for i := 0; i < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); i++ {
+			buf = buf[:len(buf)-1]
+		}
+	}
+	if utf8.Valid(buf) && !strings.ContainsRune(string(buf), 0) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, either by
+// name or through "*", with a non-zero weight.
+func acceptsGzip(h *headers.Headers) bool {
+	accepted := false
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, item := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			ok := !zeroWeight(params)
+			if coding != "*" {
+				// an explicit gzip wins over the wildcard
+				return ok
+			}
+			accepted = ok
+		}
+	}
+	return accepted
+}
+
+// zeroWeight reports whether params give a weight of q=0.
+func zeroWeight(params string) bool {
+	for _, p := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(name, "q") {
+			value = strings.TrimRight(strings.TrimSpace(value), "0")
+			return value == "" || value == "0." || value == "0"
+		}
+	}
+	return false
+}
+
+func redirect(w *response.Writer, req *request.Request, location string) {
+	if req.URL.RawQuery != "" {
+		location += "?" + req.URL.RawQuery
+	}
+	h := headers.NewHeaders()
+	h.Set("Location", location)
+	response.WriteStatus(w, response.MovedPermanently, h)
+}
+
+func notExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// writeError answers with the status that best describes a failure to
+// open a file.
+func writeError(w *response.Writer, err error) {
+	statusCode := response.InternalServerError
+	switch {
+	case notExist(err):
+		statusCode = response.NotFound
+	case errors.Is(err, fs.ErrPermission):
+		statusCode = response.Forbidden
+	}
+	response.WriteStatus(w, statusCode, nil)
+}
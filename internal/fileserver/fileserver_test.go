@@ -0,0 +1,418 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+var modTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testRoot lays out files under a temporary directory, each with the
+// same modification time.
+func testRoot(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(p, modTime, modTime))
+	}
+	return root
+}
+
+type testResponse struct {
+	status  int
+	headers map[string]string
+	body    string
+}
+
+// get runs a request through h, with the extra header lines given,
+// and parses the response.
+func get(t *testing.T, h server.Handler, method, target string, fields ...string) testResponse {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(fields, "\r\n")
+	if len(fields) > 0 {
+		raw += "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	if method == "HEAD" {
+		w.DiscardBody()
+	}
+	h(w, req)
+	require.NoError(t, w.Finish())
+
+	head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	status, err := strconv.Atoi(strings.Fields(lines[0])[1])
+	require.NoError(t, err)
+	resp := testResponse{status: status, headers: map[string]string{}, body: body}
+	for _, line := range lines[1:] {
+		name, value, _ := strings.Cut(line, ": ")
+		resp.headers[name] = value
+	}
+	return resp
+}
+
+func TestFileServer_Files(t *testing.T) {
+	root := testRoot(t, map[string]string{
+		"hello.txt":      "hello, world",
+		"style.css":      "body {}",
+		"notes":          "plain text without an extension",
+		"blob":           "\x00\x01\x02",
+		"sub/index.html": "<p>sub</p>",
+		"empty/.keep":    "",
+	})
+	h := New(root, Options{})
+
+	// Test: a file gets its type, length and validators
+	resp := get(t, h, "GET", "/hello.txt")
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, "hello, world", resp.body)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.headers["content-type"])
+	assert.Equal(t, "12", resp.headers["content-length"])
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", resp.headers["last-modified"])
+	assert.Equal(t, fmt.Sprintf(`"%x-c"`, modTime.UnixNano()), resp.headers["etag"])
+	assert.Equal(t, "bytes", resp.headers["accept-ranges"])
+
+	assert.Equal(t, "text/css; charset=utf-8", get(t, h, "GET", "/style.css").headers["content-type"])
+
+	// Test: without an extension the content decides the type
+	assert.Equal(t, "text/plain; charset=utf-8", get(t, h, "GET", "/notes").headers["content-type"])
+	assert.Equal(t, "application/octet-stream", get(t, h, "GET", "/blob").headers["content-type"])
+
+	// Test: HEAD gets the headers alone
+	resp = get(t, h, "HEAD", "/hello.txt")
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, "12", resp.headers["content-length"])
+	assert.Empty(t, resp.body)
+
+	// Test: a directory is redirected to its slash, keeping the query
+	resp = get(t, h, "GET", "/sub?x=1")
+	assert.Equal(t, 301, resp.status)
+	assert.Equal(t, "sub/?x=1", resp.headers["location"])
+
+	// Test: then served through its index file
+	resp = get(t, h, "GET", "/sub/")
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, "<p>sub</p>", resp.body)
+	assert.Equal(t, "text/html; charset=utf-8", resp.headers["content-type"])
+
+	// Test: a directory with no index and no listing is not found
+	assert.Equal(t, 404, get(t, h, "GET", "/empty/").status)
+	assert.Equal(t, 404, get(t, h, "GET", "/missing.txt").status)
+	assert.Equal(t, 404, get(t, h, "GET", "/hello.txt/x").status)
+
+	// Test: other methods aren't allowed
+	resp = get(t, h, "POST", "/hello.txt")
+	assert.Equal(t, 405, resp.status)
+	assert.Equal(t, "GET, HEAD", resp.headers["allow"])
+}
+
+func TestFileServer_Traversal(t *testing.T) {
+	outside := testRoot(t, map[string]string{"secret.txt": "secret"})
+	root := testRoot(t, map[string]string{"public.txt": "public"})
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink("public.txt", filepath.Join(root, "alias.txt")))
+	h := New(root, Options{})
+
+	// Test: the request parser already refuses paths that climb out,
+	// so ".." has to be checked at the resolver
+	dir := dirFS(root)
+	for _, name := range []string{
+		"../" + filepath.Base(outside) + "/secret.txt",
+		"/a/../../" + filepath.Base(outside) + "/secret.txt",
+		"public.txt\x00",
+		"escape.txt",
+		"escape/secret.txt",
+	} {
+		_, err := dir.resolve(name)
+		assert.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	require.NoError(t, err)
+	p, err := dir.resolve("..")
+	require.NoError(t, err)
+	assert.Equal(t, realRoot, p)
+
+	// Test: links out of the root look like missing files
+	for _, target := range []string{"/escape.txt", "/escape/secret.txt", "/escape/"} {
+		resp := get(t, h, "GET", target)
+		assert.Equal(t, 404, resp.status, target)
+		assert.NotContains(t, resp.body, "secret", target)
+	}
+
+	// Test: a link that stays inside the root is followed
+	assert.Equal(t, "public", get(t, h, "GET", "/alias.txt").body)
+}
+
+func TestFileServer_Prefix(t *testing.T) {
+	root := testRoot(t, map[string]string{"app.js": "run()"})
+	h := New(root, Options{Prefix: "/static"})
+
+	assert.Equal(t, "run()", get(t, h, "GET", "/static/app.js").body)
+	assert.Equal(t, 404, get(t, h, "GET", "/app.js").status)
+	assert.Equal(t, 404, get(t, h, "GET", "/staticapp.js").status)
+	assert.Equal(t, "static/", get(t, h, "GET", "/static").headers["location"])
+}
+
+func TestFileServer_Listing(t *testing.T) {
+	root := testRoot(t, map[string]string{
+		"docs/a.txt":       "a",
+		"docs/<b>.txt":     "b",
+		"docs/c:d.txt":     "c",
+		"docs/nested/x.md": "x",
+		"index.html":       "home",
+	})
+	h := New(root, Options{Listing: true, NoIndex: true})
+
+	resp := get(t, h, "GET", "/docs/")
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, "text/html; charset=utf-8", resp.headers["content-type"])
+	assert.Contains(t, resp.body, `<title>Index of /docs/</title>`)
+	assert.Contains(t, resp.body, `<a href="../">../</a>`)
+	assert.Contains(t, resp.body, `<a href="a.txt">a.txt</a>`)
+	assert.Contains(t, resp.body, `<a href="%3Cb%3E.txt">&lt;b&gt;.txt</a>`)
+	assert.Contains(t, resp.body, `<a href="./c:d.txt">c:d.txt</a>`)
+	assert.Contains(t, resp.body, `<a href="nested/">nested/</a>`)
+
+	// Test: NoIndex lists the root rather than serving index.html
+	resp = get(t, h, "GET", "/")
+	assert.Contains(t, resp.body, `<a href="index.html">index.html</a>`)
+	assert.NotContains(t, resp.body, `href="../"`)
+
+	// Test: a custom index file
+	h = New(root, Options{Index: "a.txt"})
+	assert.Equal(t, "a", get(t, h, "GET", "/docs/").body)
+}
+
+func TestFileServer_Conditional(t *testing.T) {
+	root := testRoot(t, map[string]string{"hello.txt": "hello, world"})
+	h := New(root, Options{})
+	etag := get(t, h, "GET", "/hello.txt").headers["etag"]
+	lastModified := "Wed, 01 May 2024 12:00:00 GMT"
+
+	tests := []struct {
+		name   string
+		fields []string
+		status int
+	}{
+		{"If-None-Match matches", []string{"If-None-Match: " + etag}, 304},
+		{"If-None-Match matches weakly", []string{"If-None-Match: \"x\", W/" + etag}, 304},
+		{"If-None-Match star", []string{"If-None-Match: *"}, 304},
+		{"If-None-Match differs", []string{`If-None-Match: "other"`}, 200},
+		{"If-Modified-Since same time", []string{"If-Modified-Since: " + lastModified}, 304},
+		{"If-Modified-Since RFC 850", []string{"If-Modified-Since: Wednesday, 01-May-24 12:00:00 GMT"}, 304},
+		{"If-Modified-Since asctime", []string{"If-Modified-Since: Wed May  1 12:00:00 2024"}, 304},
+		{"If-Modified-Since earlier", []string{"If-Modified-Since: Wed, 01 May 2024 11:59:59 GMT"}, 200},
+		{"If-Modified-Since invalid", []string{"If-Modified-Since: yesterday"}, 200},
+		{"If-None-Match wins over If-Modified-Since", []string{`If-None-Match: "other"`, "If-Modified-Since: " + lastModified}, 200},
+		{"If-Match matches", []string{"If-Match: " + etag}, 200},
+		{"If-Match differs", []string{`If-Match: "other"`}, 412},
+		{"If-Match weak never matches", []string{"If-Match: W/" + etag}, 412},
+		{"If-Unmodified-Since earlier", []string{"If-Unmodified-Since: Wed, 01 May 2024 11:59:59 GMT"}, 412},
+		{"If-Unmodified-Since same time", []string{"If-Unmodified-Since: " + lastModified}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, h, "GET", "/hello.txt", tt.fields...)
+			assert.Equal(t, tt.status, resp.status)
+			if tt.status == 304 {
+				assert.Empty(t, resp.body)
+				assert.Equal(t, etag, resp.headers["etag"])
+				assert.NotContains(t, resp.headers, "content-type")
+			}
+		})
+	}
+}
+
+func TestFileServer_Range(t *testing.T) {
+	root := testRoot(t, map[string]string{"digits.txt": "0123456789"})
+	h := New(root, Options{})
+	etag := get(t, h, "GET", "/digits.txt").headers["etag"]
+
+	tests := []struct {
+		name         string
+		fields       []string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"first bytes", []string{"Range: bytes=0-3"}, 206, "0123", "bytes 0-3/10"},
+		{"open ended", []string{"Range: bytes=7-"}, 206, "789", "bytes 7-9/10"},
+		{"suffix", []string{"Range: bytes=-2"}, 206, "89", "bytes 8-9/10"},
+		{"past the end is shortened", []string{"Range: bytes=8-100"}, 206, "89", "bytes 8-9/10"},
+		{"suffix longer than the file", []string{"Range: bytes=-100"}, 206, "0123456789", "bytes 0-9/10"},
+		{"unsatisfiable", []string{"Range: bytes=10-"}, 416, "Range Not Satisfiable\n", "bytes */10"},
+		{"malformed is ignored", []string{"Range: bytes=5-2"}, 200, "0123456789", ""},
+		{"other unit is ignored", []string{"Range: lines=1-2"}, 200, "0123456789", ""},
+		{"overlapping ranges are ignored", []string{"Range: bytes=0-8,1-9"}, 200, "0123456789", ""},
+		{"If-Range matching ETag", []string{"Range: bytes=0-0", "If-Range: " + etag}, 206, "0", "bytes 0-0/10"},
+		{"If-Range stale ETag", []string{"Range: bytes=0-0", `If-Range: "old"`}, 200, "0123456789", ""},
+		{"If-Range weak ETag", []string{"Range: bytes=0-0", "If-Range: W/" + etag}, 200, "0123456789", ""},
+		{"If-Range matching date", []string{"Range: bytes=0-0", "If-Range: Wed, 01 May 2024 12:00:00 GMT"}, 206, "0", "bytes 0-0/10"},
+		{"If-Range other date", []string{"Range: bytes=0-0", "If-Range: Wed, 01 May 2024 11:00:00 GMT"}, 200, "0123456789", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, h, "GET", "/digits.txt", tt.fields...)
+			assert.Equal(t, tt.status, resp.status)
+			assert.Equal(t, tt.body, resp.body)
+			assert.Equal(t, tt.contentRange, resp.headers["content-range"])
+			assert.Equal(t, strconv.Itoa(len(tt.body)), resp.headers["content-length"])
+		})
+	}
+
+	// Test: several ranges come back as multipart/byteranges
+	resp := get(t, h, "GET", "/digits.txt", "Range: bytes=0-1, -2")
+	assert.Equal(t, 206, resp.status)
+	boundary, ok := strings.CutPrefix(resp.headers["content-type"], "multipart/byteranges; boundary=")
+	require.True(t, ok, resp.headers["content-type"])
+	want := "--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-1/10\r\n\r\n01\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 8-9/10\r\n\r\n89\r\n" +
+		"--" + boundary + "--\r\n"
+	assert.Equal(t, want, resp.body)
+	assert.Equal(t, strconv.Itoa(len(want)), resp.headers["content-length"])
+	assert.NotContains(t, resp.headers, "content-range")
+}
+
+func TestFileServer_Precompressed(t *testing.T) {
+	root := testRoot(t, map[string]string{
+		"app.js":    "plain",
+		"app.js.gz": "gzipped",
+		"solo.css":  "solo",
+	})
+	h := New(root, Options{})
+
+	// Test: a client that takes gzip gets the .gz sibling, typed as the
+	// original
+	resp := get(t, h, "GET", "/app.js", "Accept-Encoding: br, gzip")
+	assert.Equal(t, "gzipped", resp.body)
+	assert.Equal(t, "gzip", resp.headers["content-encoding"])
+	assert.Equal(t, "text/javascript; charset=utf-8", resp.headers["content-type"])
+	assert.Equal(t, "Accept-Encoding", resp.headers["vary"])
+	gzipETag := resp.headers["etag"]
+
+	// Test: others get the original, which varies too
+	resp = get(t, h, "GET", "/app.js")
+	assert.Equal(t, "plain", resp.body)
+	assert.NotContains(t, resp.headers, "content-encoding")
+	assert.Equal(t, "Accept-Encoding", resp.headers["vary"])
+	assert.NotEqual(t, gzipETag, resp.headers["etag"])
+
+	for _, ae := range []string{"gzip;q=0", "*;q=0", "identity", "*, gzip;q=0"} {
+		assert.Equal(t, "plain", get(t, h, "GET", "/app.js", "Accept-Encoding: "+ae).body, ae)
+	}
+	for _, ae := range []string{"*", "GZIP;q=0.5", "*;q=0, gzip"} {
+		assert.Equal(t, "gzipped", get(t, h, "GET", "/app.js", "Accept-Encoding: "+ae).body, ae)
+	}
+
+	// Test: a range applies to the encoded bytes
+	resp = get(t, h, "GET", "/app.js", "Accept-Encoding: gzip", "Range: bytes=0-3")
+	assert.Equal(t, "gzip", resp.body)
+	assert.Equal(t, "bytes 0-3/7", resp.headers["content-range"])
+
+	// Test: a file without a sibling doesn't vary
+	resp = get(t, h, "GET", "/solo.css", "Accept-Encoding: gzip")
+	assert.Equal(t, "solo", resp.body)
+	assert.NotContains(t, resp.headers, "vary")
+}
+
+func TestFileServer_FS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":         {Data: []byte("<p>app</p>")},
+		"assets/app.js":      {Data: []byte("run()")},
+		"assets/app.js.gz":   {Data: []byte("gzipped")},
+		"assets/logo.svg":    {Data: []byte("<svg/>")},
+		"docs/guide/a.txt":   {Data: []byte("a")},
+		"dated.txt":          {Data: []byte("dated"), ModTime: modTime},
+		"copy-of-index.html": {Data: []byte("<p>app</p>")},
+	}
+	h, err := NewFS(fsys, Options{CacheControl: "no-cache"})
+	require.NoError(t, err)
+
+	// Test: entity-tags come from the content, and files without a
+	// modification time get no Last-Modified
+	resp := get(t, h, "GET", "/assets/app.js")
+	assert.Equal(t, "run()", resp.body)
+	sum := sha256.Sum256([]byte("run()"))
+	assert.Equal(t, fmt.Sprintf(`"%x"`, sum[:16]), resp.headers["etag"])
+	assert.NotContains(t, resp.headers, "last-modified")
+	assert.Equal(t, "no-cache", resp.headers["cache-control"])
+	assert.Equal(t, get(t, h, "GET", "/").headers["etag"], get(t, h, "GET", "/copy-of-index.html").headers["etag"])
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", get(t, h, "GET", "/dated.txt").headers["last-modified"])
+
+	// Test: the precompressed sibling has its own hash
+	resp = get(t, h, "GET", "/assets/app.js", "Accept-Encoding: gzip")
+	assert.Equal(t, "gzipped", resp.body)
+	sum = sha256.Sum256([]byte("gzipped"))
+	assert.Equal(t, fmt.Sprintf(`"%x"`, sum[:16]), resp.headers["etag"])
+
+	// Test: revalidation works on the hash, and dates alone can't
+	// match a file without one
+	etag := get(t, h, "GET", "/assets/logo.svg").headers["etag"]
+	resp = get(t, h, "GET", "/assets/logo.svg", "If-None-Match: "+etag)
+	assert.Equal(t, 304, resp.status)
+	assert.Equal(t, "no-cache", resp.headers["cache-control"])
+	assert.Equal(t, 200, get(t, h, "GET", "/assets/logo.svg", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT").status)
+	assert.Equal(t, "<s", get(t, h, "GET", "/assets/logo.svg", "Range: bytes=0-1", "If-Range: "+etag).body)
+
+	// Test: without SPA mode unknown paths are not found
+	assert.Equal(t, 404, get(t, h, "GET", "/users/42").status)
+	assert.Equal(t, 404, get(t, h, "GET", "/docs/").status)
+}
+
+func TestFileServer_SPA(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":       {Data: []byte("<p>app</p>")},
+		"assets/app.js":    {Data: []byte("run()")},
+		"docs/index.html":  {Data: []byte("<p>docs</p>")},
+		"empty/readme.txt": {Data: []byte("readme")},
+	}
+	h, err := NewFS(fsys, Options{SPA: true})
+	require.NoError(t, err)
+
+	// Test: unknown routes get the root index
+	for _, target := range []string{"/users/42", "/users/42/", "/settings?tab=a"} {
+		resp := get(t, h, "GET", target)
+		assert.Equal(t, 200, resp.status, target)
+		assert.Equal(t, "<p>app</p>", resp.body, target)
+		assert.Equal(t, "text/html; charset=utf-8", resp.headers["content-type"], target)
+	}
+
+	// Test: files and directory indexes are still served as themselves
+	assert.Equal(t, "run()", get(t, h, "GET", "/assets/app.js").body)
+	assert.Equal(t, "<p>docs</p>", get(t, h, "GET", "/docs/").body)
+
+	// Test: missing assets are still missing
+	assert.Equal(t, 404, get(t, h, "GET", "/assets/missing.js").status)
+
+	// Test: a directory without an index is not a route
+	assert.Equal(t, 404, get(t, h, "GET", "/empty/").status)
+
+	// Test: without an index there is nothing to fall back on
+	h, err = NewFS(fstest.MapFS{"a.txt": {Data: []byte("a")}}, Options{SPA: true})
+	require.NoError(t, err)
+	assert.Equal(t, 404, get(t, h, "GET", "/users/42").status)
+}
@@ -0,0 +1,49 @@
+package fileserver
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// listDir sends an HTML page linking to the entries of the directory
+// dir of fsys, subdirectories marked with a trailing "/". Links are
+// relative, so the listing works wherever the server is mounted.
+func listDir(w *response.Writer, req *request.Request, fsys fs.FS, dir string) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	title := html.EscapeString("Index of " + req.URL.Path)
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if req.URL.Path != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		// a URL with only a path escapes it, and guards a name like
+		// "a:b" against being read as a scheme
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", fmt.Sprintf("%d", b.Len()))
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
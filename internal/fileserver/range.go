@@ -0,0 +1,170 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+)
+
+var (
+	// errUnsatisfiable means no range in a Range header overlaps the
+	// file, which gets a 416.
+	errUnsatisfiable = errors.New("range not satisfiable")
+	// errBadRange means a Range header is malformed or not worth
+	// honoring, so it is ignored and the whole file sent instead.
+	errBadRange = errors.New("invalid range")
+)
+
+// maxRanges caps how many ranges one request can ask for, as asking
+// for many tiny ones costs the server far more than the client.
+const maxRanges = 32
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a "bytes=" Range header, RFC 9110 section 14.1.2,
+// into the ranges of a file of the given size it selects. Ranges past
+// the end are dropped and ones running over it are shortened. Requests
+// whose ranges add up to more than the file are refused with
+// errBadRange, since sending the whole file once is cheaper.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	unit, spec, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errBadRange
+	}
+	var ranges []byteRange
+	var total int64
+	count := 0
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if count++; count > maxRanges {
+			return nil, errBadRange
+		}
+		first, last, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil, errBadRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// a suffix range: the last n bytes
+			n, err := parseOffset(last)
+			if err != nil {
+				return nil, errBadRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := parseOffset(first)
+			if err != nil {
+				return nil, errBadRange
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parseOffset(last); err != nil || end < start {
+					return nil, errBadRange
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+	if count == 0 {
+		return nil, errBadRange
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	if total > size {
+		return nil, errBadRange
+	}
+	return ranges, nil
+}
+
+func parseOffset(s string) (int64, error) {
+	if s == "" || s[0] == '+' {
+		return 0, errBadRange
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// serveRange sends one range of f as a 206 Partial Content.
+func serveRange(w *response.Writer, h *headers.Headers, f io.ReadSeeker, r byteRange, size int64) {
+	h.Set("Content-Range", r.contentRange(size))
+	h.Set("Content-Length", fmt.Sprintf("%d", r.length))
+	w.WriteStatusLine(response.PartialContent)
+	w.WriteHeaders(h)
+	if _, err := f.Seek(r.start, io.SeekStart); err != nil {
+		return
+	}
+	w.ReadFrom(f)
+}
+
+// serveMultipart sends several ranges of f as a 206 Partial Content
+// with a multipart/byteranges body, RFC 9110 section 14.6. Each part's
+// headers are built up front so the Content-Length is known.
+func serveMultipart(w *response.Writer, h *headers.Headers, f io.ReadSeeker, ranges []byteRange, size int64) {
+	boundary := newBoundary()
+	ctype := h.Get("Content-Type")
+	parts := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		delim := "--" + boundary
+		if i > 0 {
+			delim = "\r\n" + delim
+		}
+		parts[i] = fmt.Sprintf("%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", delim, ctype, r.contentRange(size))
+		length += int64(len(parts[i])) + r.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	h.Override("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", fmt.Sprintf("%d", length))
+	w.WriteStatusLine(response.PartialContent)
+	w.WriteHeaders(h)
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, parts[i]); err != nil {
+			return
+		}
+		if _, err := f.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		// the part stops short of the Content-Length, so it needs a
+		// limit of its own, which the writer keeps in place of its own
+		if _, err := w.ReadFrom(io.LimitReader(f, r.length)); err != nil {
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+func newBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
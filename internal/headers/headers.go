@@ -3,18 +3,30 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const crlf = "\r\n"
 
-type Headers map[string]string
+// Headers is an ordered list of header fields. Names are stored
+// lowercased and fields keep the order they were added in, so they are
+// written back out in the same order they were set.
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
-func NewHeaders() Headers {
-	return map[string]string{}
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	// print the data with crlf encoding
 
 	idx := bytes.Index(data, []byte(crlf))
@@ -28,6 +40,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("malformed header line, no colon: %q", data[:idx])
+	}
 	key := strings.ToLower(string(parts[0]))
 
 	if key != strings.TrimRight(key, " ") {
@@ -43,32 +58,121 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	return idx + 2, false, nil
 }
 
-func (h Headers) Get(key string) (string, bool) {
+// Get returns every value for key joined with ", ", or the empty string
+// if the header is not set. Use Values for fields like Set-Cookie that
+// cannot be combined.
+func (h *Headers) Get(key string) string {
+	return strings.Join(h.Values(key), ", ")
+}
+
+// Values returns each value set for key, in the order they were added.
+func (h *Headers) Values(key string) []string {
 	key = strings.ToLower(key)
-	v, ok := h[key]
-	return v, ok
+	var values []string
+	for _, f := range h.fields {
+		if f.name == key {
+			values = append(values, f.value)
+		}
+	}
+	return values
 }
 
-func (h Headers) Set(key, value string) {
+// Has reports whether key has been set.
+func (h *Headers) Has(key string) bool {
 	key = strings.ToLower(key)
-	v, ok := h[key]
-	if ok {
-		value = strings.Join([]string{
-			v,
-			value,
-		}, ", ")
+	for _, f := range h.fields {
+		if f.name == key {
+			return true
+		}
 	}
-	h[key] = value
+	return false
 }
 
-func (h Headers) Override(key, value string) {
+// Set adds value to key, keeping any values already present.
+func (h *Headers) Set(key, value string) {
 	key = strings.ToLower(key)
-	h[key] = value
+	h.fields = append(h.fields, field{name: key, value: value})
 }
 
-func (h Headers) Remove(key string) {
+// Override replaces every value of key with value. An existing header
+// keeps its position; a new one is added at the end.
+func (h *Headers) Override(key, value string) {
 	key = strings.ToLower(key)
-	delete(h, key)
+	fields := h.fields[:0]
+	replaced := false
+	for _, f := range h.fields {
+		if f.name != key {
+			fields = append(fields, f)
+			continue
+		}
+		if !replaced {
+			fields = append(fields, field{name: key, value: value})
+			replaced = true
+		}
+	}
+	h.fields = fields
+	if !replaced {
+		h.fields = append(h.fields, field{name: key, value: value})
+	}
+}
+
+func (h *Headers) Remove(key string) {
+	key = strings.ToLower(key)
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if f.name != key {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// Names returns each distinct header name in the order it was first set.
+func (h *Headers) Names() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, f := range h.fields {
+		if !seen[f.name] {
+			seen[f.name] = true
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Len returns the number of distinct header names.
+func (h *Headers) Len() int {
+	return len(h.Names())
+}
+
+// Clone returns a copy of h that can be changed independently.
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: append([]field(nil), h.fields...)}
+}
+
+var canonicalExceptions = map[string]string{
+	"etag":             "ETag",
+	"te":               "TE",
+	"www-authenticate": "WWW-Authenticate",
+	"dnt":              "DNT",
+}
+
+// CanonicalName returns name in Title-Case, e.g. "content-type" becomes
+// "Content-Type".
+func CanonicalName(name string) string {
+	name = strings.ToLower(name)
+	if c, ok := canonicalExceptions[name]; ok {
+		return c
+	}
+	b := []byte(name)
+	upper := true
+	for i, c := range b {
+		if upper && c >= 'a' && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
 }
 
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
@@ -76,13 +180,65 @@ var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^',
 // validTokens checks if the data contains only valid tokens
 // or characters that are allowed in a token
 func validTokens(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
 	for _, c := range data {
 		if !(c >= 'A' && c <= 'Z' ||
 			c >= 'a' && c <= 'z' ||
 			c >= '0' && c <= '9' ||
-			c == '-') {
+			bytes.IndexByte(tokenChars, c) != -1) {
 			return false
 		}
 	}
 	return true
 }
+
+// ValidName reports whether name is a field name as defined by the
+// RFC 9110 token grammar.
+func ValidName(name string) bool {
+	return validTokens([]byte(name))
+}
+
+// ValidValue reports whether value can be sent as a field value without
+// ending the field early. CR and LF would start a new header line (or
+// the body), and NUL is rejected by most recipients.
+func ValidValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
+
+// ParseContentLength parses a Content-Length value, which is 1*DIGIT,
+// RFC 9110 section 8.6: unlike strconv.ParseInt, no sign is accepted,
+// so there is only one way to read a length.
+func ParseContentLength(value string) (int64, error) {
+	if value == "" || strings.TrimLeft(value, "0123456789") != "" {
+		return 0, fmt.Errorf("malformed Content-Length: %q", value)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed Content-Length: %w", err)
+	}
+	return n, nil
+}
+
+// TimeFormat is the IMF-fixdate format HTTP dates are sent in.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// timeFormats are the date formats a recipient has to accept, RFC 9110
+// section 5.6.7: IMF-fixdate, and the obsolete RFC 850 and asctime ones.
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ParseTime parses an HTTP date in any of the formats a recipient has to
+// accept. It reports false if value isn't a date.
+func ParseTime(value string) (time.Time, bool) {
+	for _, layout := range timeFormats {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
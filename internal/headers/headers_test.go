@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestHeaders_Parse_ValidSingleHeader(t *testing.T) {
@@ -41,7 +42,8 @@ func TestHeaders_Parse_ValidSingleHeaderExtraWhitespace(t *testing.T) {
 
 func TestHeaders_Parse_Valid2Headers(t *testing.T) {
 	// Test: Valid 2 headers with existing headers
-	headers := Headers(map[string]string{"host": "localhost:42069"})
+	headers := NewHeaders()
+	headers.Set("host", "localhost:42069")
 
 	data := []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err := headers.Parse(data)
@@ -73,7 +75,8 @@ func TestHeaders_Parse_CaseInsensitive(t *testing.T) {
 }
 
 func TestHeaders_Parse_HandlesDuplicateHeaders(t *testing.T) {
-	headers := Headers(map[string]string{"set-person": "lane-loves-go"})
+	headers := NewHeaders()
+	headers.Set("set-person", "lane-loves-go")
 	data := []byte("Set-Person: prime-loves-zig\r\n\r\n")
 
 	n, done, err := headers.Parse(data)
@@ -96,6 +99,90 @@ func TestHeaders_Parse_RequiresValidTokenCharacterSet(t *testing.T) {
 	assert.False(t, done)
 }
 
+func TestHeaders_Parse_MissingColon(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host localhost:42069\r\n\r\n")
+
+	n, done, err := headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, headers.Len())
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHeaders_OrderAndValues(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Content-Type", "text/plain")
+	headers.Set("Set-Cookie", "a=1")
+	headers.Set("Content-Length", "0")
+	headers.Set("set-cookie", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+
+	assert.Equal(t, []string{"content-type", "set-cookie", "content-length"}, headers.Names())
+	assert.Equal(t, []string{"a=1", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT"}, headers.Values("Set-Cookie"))
+	assert.Nil(t, headers.Values("X-Missing"))
+	assert.True(t, headers.Has("CONTENT-TYPE"))
+	assert.False(t, headers.Has("X-Missing"))
+
+	// Test: Override keeps the original position
+	headers.Override("Set-Cookie", "c=3")
+	assert.Equal(t, []string{"content-type", "set-cookie", "content-length"}, headers.Names())
+	assert.Equal(t, []string{"c=3"}, headers.Values("set-cookie"))
+
+	// Test: Remove drops every value
+	headers.Remove("content-type")
+	assert.Equal(t, []string{"set-cookie", "content-length"}, headers.Names())
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Clone is independent
+	clone := headers.Clone()
+	clone.Set("X-Extra", "1")
+	assert.False(t, headers.Has("X-Extra"))
+}
+
+func TestCanonicalName(t *testing.T) {
+	assert.Equal(t, "Content-Type", CanonicalName("content-type"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalName("X-CONTENT-SHA256"))
+	assert.Equal(t, "ETag", CanonicalName("etag"))
+	assert.Equal(t, "Host", CanonicalName("host"))
+}
+
+func TestHeaders_ValidNameAndValue(t *testing.T) {
+	assert.True(t, ValidName("X-Custom_Header.v2"))
+	assert.True(t, ValidName("!#$%&'*+-.^_`|~"))
+	assert.False(t, ValidName(""))
+	assert.False(t, ValidName("X Header"))
+	assert.False(t, ValidName("X-Header:"))
+	assert.False(t, ValidName("(User)-Agent"))
+
+	assert.True(t, ValidValue("text/html; charset=utf-8"))
+	assert.True(t, ValidValue("a\tb"))
+	assert.False(t, ValidValue("a\r\nb: c"))
+	assert.False(t, ValidValue("a\nb"))
+	assert.False(t, ValidValue("a\x00b"))
+}
+
+func TestParseContentLength(t *testing.T) {
+	n, err := ParseContentLength("0042")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+	for _, v := range []string{"", "+5", "-0", " 5", "5 ", "0x5", "5, 5", "99999999999999999999"} {
+		_, err := ParseContentLength(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, v := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		got, ok := ParseTime(v)
+		require.True(t, ok, v)
+		assert.True(t, want.Equal(got), v)
+	}
+	_, ok := ParseTime("yesterday")
+	assert.False(t, ok)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", want.Format(TimeFormat))
+}
+
 //func TestShit(t *testing.T) {
 //
 //	a := "3f324f9914742e62cf082861ba03b207282dba781c3349bee9d7c1b5ef8e0bfe"
@@ -0,0 +1,339 @@
+// Package hpack implements HPACK, the header compression format for
+// HTTP/2 from RFC 7541.
+//
+// The Decoder handles everything a peer may send: indexed fields, all
+// three kinds of literals, Huffman-coded strings and dynamic table size
+// updates. The Encoder never adds to the peer's dynamic table; it only
+// refers to the static table and Huffman codes strings when that is
+// shorter, which keeps it stateless.
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCompression is wrapped by every decoding error. In HTTP/2 it is a
+// connection error of type COMPRESSION_ERROR.
+var ErrCompression = errors.New("hpack: compression error")
+
+// ErrHeaderListTooLarge is returned for a header block that decodes to
+// more than the maximum header list size. It isn't a compression error:
+// the dynamic table is still kept in step with the peer's, so in HTTP/2
+// only the stream has to end, with ENHANCE_YOUR_CALM.
+var ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+
+// DefaultTableSize is the initial size of the dynamic table, in bytes.
+const DefaultTableSize = 4096
+
+// HeaderField is a name-value pair. Sensitive fields are never added to
+// a dynamic table, by us or by intermediaries.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the size of the field in a dynamic table, per RFC 7541
+// section 4.1.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// Decoder decodes header blocks. It keeps the dynamic table between
+// blocks, so one Decoder is used for every block a connection receives.
+type Decoder struct {
+	// entries holds the dynamic table, oldest first
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+	// allowedMaxSize is the limit we advertised, which size updates
+	// from the peer can't exceed
+	allowedMaxSize uint32
+	// maxStringLen bounds each decoded name and value
+	maxStringLen int
+	// maxListSize bounds the sum of the sizes of a block's fields
+	maxListSize uint32
+}
+
+// NewDecoder returns a Decoder whose dynamic table may grow to
+// maxTableSize bytes, the value advertised to the peer.
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		maxSize:        maxTableSize,
+		allowedMaxSize: maxTableSize,
+		maxStringLen:   defaultMaxStringLen,
+		maxListSize:    defaultMaxListSize,
+	}
+}
+
+const (
+	defaultMaxStringLen = 1 << 20
+	defaultMaxListSize  = 1 << 20
+)
+
+// SetMaxStringLength bounds the length of any decoded name or value.
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLen = n
+}
+
+// SetMaxHeaderListSize bounds the header list a block decodes to, as
+// the sum of the fields' sizes, RFC 9113 section 6.5.2. It is the value
+// advertised as SETTINGS_MAX_HEADER_LIST_SIZE.
+func (d *Decoder) SetMaxHeaderListSize(n uint32) {
+	d.maxListSize = n
+}
+
+// Decode decodes a complete header block. A block that decodes to more
+// than the maximum header list size is still decoded to the end, to
+// keep the dynamic table right, but gives ErrHeaderListTooLarge rather
+// than its fields, which are dropped as soon as they go over.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint64
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		var f HeaderField
+		switch {
+		case b&0x80 != 0:
+			// indexed field
+			var idx uint64
+			if idx, block, err = ReadInt(block, 7); err != nil {
+				return nil, err
+			}
+			if f, err = d.at(idx); err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.add(f)
+		case b&0xe0 == 0x20:
+			// dynamic table size update, only allowed before any field
+			if listSize > 0 {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrCompression)
+			}
+			var size uint64
+			if size, block, err = ReadInt(block, 5); err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d over limit %d", ErrCompression, size, d.allowedMaxSize)
+			}
+			d.maxSize = uint32(size)
+			d.evict()
+			continue
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			sensitive := b&0x10 != 0
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+		}
+		// fields are counted even once the list is over, and a table size
+		// update after any of them is still caught above
+		if listSize += uint64(f.Size()); listSize <= uint64(d.maxListSize) {
+			fields = append(fields, f)
+		}
+	}
+	if listSize > uint64(d.maxListSize) {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// at returns the field at idx across the static and dynamic tables.
+func (d *Decoder) at(idx uint64) (HeaderField, error) {
+	switch {
+	case idx == 0:
+		return HeaderField{}, fmt.Errorf("%w: index 0", ErrCompression)
+	case idx <= uint64(len(staticTable)):
+		return staticTable[idx-1], nil
+	case idx-uint64(len(staticTable)) <= uint64(len(d.entries)):
+		return d.entries[len(d.entries)-int(idx-uint64(len(staticTable)))], nil
+	}
+	return HeaderField{}, fmt.Errorf("%w: index %d out of range", ErrCompression, idx)
+}
+
+// readLiteral reads a literal field whose name index has an n-bit
+// prefix. A zero index means the name follows as a string.
+func (d *Decoder) readLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	idx, block, err := ReadInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var f HeaderField
+	if idx == 0 {
+		if f.Name, block, err = d.readString(block); err != nil {
+			return HeaderField{}, nil, err
+		}
+	} else {
+		named, err := d.at(idx)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	}
+	if f.Value, block, err = d.readString(block); err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, block, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	return ReadString(block, 7, d.maxStringLen)
+}
+
+// ReadString reads a string literal whose length has an n-bit prefix,
+// with the Huffman flag in the bit above it, and returns the rest of p.
+// Strings that would decode to more than maxLen bytes are an error.
+// QPACK uses the same encoding with other prefixes.
+func ReadString(p []byte, n uint8, maxLen int) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	huffman := p[0]&(1<<n) != 0
+	length, p, err := ReadInt(p, n)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(p)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	raw, rest := p[:length], p[length:]
+	if !huffman {
+		if len(raw) > maxLen {
+			return "", nil, fmt.Errorf("%w: string too long", ErrCompression)
+		}
+		return string(raw), rest, nil
+	}
+	// Huffman coding shrinks text by at most 8/5
+	if len(raw)*8/5 > maxLen {
+		return "", nil, fmt.Errorf("%w: string too long", ErrCompression)
+	}
+	decoded, err := huffmanDecode(make([]byte, 0, len(raw)*8/5), raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), rest, nil
+}
+
+func (d *Decoder) add(f HeaderField) {
+	f.Sensitive = false
+	d.entries = append(d.entries, f)
+	d.size += f.Size()
+	// a field bigger than the whole table just empties it
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	i := 0
+	for d.size > d.maxSize && i < len(d.entries) {
+		d.size -= d.entries[i].Size()
+		i++
+	}
+	if i > 0 {
+		d.entries = append(d.entries[:0], d.entries[i:]...)
+	}
+}
+
+// ReadInt reads an integer with an n-bit prefix from RFC 7541 section
+// 5.1 and returns the rest of p.
+func ReadInt(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		if len(p) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+		}
+		if shift > 56 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrCompression)
+		}
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+}
+
+// AppendInt appends v with an n-bit prefix, keeping the high bits of
+// first as the representation's pattern.
+func AppendInt(dst []byte, first byte, n uint8, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendString(dst []byte, s string) []byte {
+	return AppendString(dst, 0, 7, s)
+}
+
+// AppendString appends s with its length in an n-bit prefix after the
+// high bits of first, Huffman coding it when that is shorter and
+// setting the flag in the bit above the prefix to say so.
+func AppendString(dst []byte, first byte, n uint8, s string) []byte {
+	if hl := huffmanEncodedLen(s); hl < len(s) {
+		dst = AppendInt(dst, first|1<<n, n, uint64(hl))
+		return huffmanEncode(dst, s)
+	}
+	dst = AppendInt(dst, first, n, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Encoder encodes header blocks. It keeps no state, so it is safe to
+// share, and it is unaffected by the peer's SETTINGS_HEADER_TABLE_SIZE.
+type Encoder struct{}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// AppendFields appends the encoding of fields to dst. Names must
+// already be lowercase.
+func (e *Encoder) AppendFields(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		dst = e.appendField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	if !f.Sensitive {
+		if idx, ok := staticByField[staticKey{f.Name, f.Value}]; ok {
+			return AppendInt(dst, 0x80, 7, uint64(idx))
+		}
+	}
+	// literal without indexing, or never indexed for sensitive fields
+	first := byte(0x00)
+	if f.Sensitive {
+		first = 0x10
+	}
+	if idx, ok := staticByName[f.Name]; ok {
+		dst = AppendInt(dst, first, 4, uint64(idx))
+	} else {
+		dst = append(dst, first)
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
@@ -0,0 +1,196 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestInteger(t *testing.T) {
+	// Test: RFC 7541 C.1 examples
+	tests := []struct {
+		v       uint64
+		n       uint8
+		encoded string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.encoded, hex.EncodeToString(AppendInt(nil, 0, tt.n, tt.v)))
+		v, rest, err := ReadInt(unhex(t, tt.encoded), tt.n)
+		require.NoError(t, err)
+		assert.Equal(t, tt.v, v)
+		assert.Empty(t, rest)
+	}
+
+	// Test: Truncated and overflowing integers
+	_, _, err := ReadInt(unhex(t, "1f9a"), 5)
+	require.ErrorIs(t, err, ErrCompression)
+	_, _, err = ReadInt(unhex(t, "1fffffffffffffffffffff01"), 5)
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestDecoder_RFCExamples(t *testing.T) {
+	request1 := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}
+	request2 := append(append([]HeaderField(nil), request1...), HeaderField{Name: "cache-control", Value: "no-cache"})
+	request3 := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+
+	tests := []struct {
+		name   string
+		blocks []string
+	}{
+		{"C.3 without Huffman", []string{
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		}},
+		{"C.4 with Huffman", []string{
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(DefaultTableSize)
+			for i, want := range [][]HeaderField{request1, request2, request3} {
+				fields, err := d.Decode(unhex(t, tt.blocks[i]))
+				require.NoError(t, err)
+				assert.Equal(t, want, fields)
+			}
+			// www.example.com, cache-control and custom-key
+			assert.Len(t, d.entries, 3)
+			assert.Equal(t, uint32(164), d.size)
+		})
+	}
+}
+
+func TestDecoder_Eviction(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	// Test: Size update at the start of a block shrinks the table
+	_, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(55), d.size)
+	fields, err := d.Decode(unhex(t, "20 82"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: ":method", Value: "GET"}}, fields)
+	assert.Empty(t, d.entries)
+
+	// Test: Size update after a field
+	_, err = d.Decode(unhex(t, "82 20"))
+	require.ErrorIs(t, err, ErrCompression)
+
+	// Test: Size update over the advertised limit
+	_, err = d.Decode(append([]byte(nil), AppendInt(nil, 0x20, 5, DefaultTableSize+1)...))
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+	}{
+		{"index 0", "80"},
+		{"index past dynamic table", "be"},
+		{"truncated string", "0003 6162"},
+		{"EOS in string", "0083 ffffff"},
+		{"padding too long", "0082 1fff"},
+		{"padding not ones", "0081 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, tt.block))
+			require.ErrorIs(t, err, ErrCompression)
+		})
+	}
+
+	// Test: Strings over the limit
+	d := NewDecoder(DefaultTableSize)
+	d.SetMaxStringLength(4)
+	_, err := d.Decode(unhex(t, "0003 6162 6305 6162 6364 65"))
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestDecoder_MaxHeaderListSize(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	d.SetMaxHeaderListSize(100)
+	// Test: Fields up to the limit, each counted with its 32 bytes of
+	// overhead
+	fields, err := d.Decode(unhex(t, "82 82"))
+	require.NoError(t, err)
+	assert.Len(t, fields, 2)
+
+	// Test: Over the limit
+	_, err = d.Decode(unhex(t, "82 82 82"))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+	assert.NotErrorIs(t, err, ErrCompression)
+
+	// Test: The dynamic table is kept right past the limit, so the next
+	// block can still refer to it
+	_, err = d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572 82 82"))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+	fields, err = d.Decode(unhex(t, "be"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "custom-key", Value: "custom-header"}}, fields)
+
+	// Test: A size update after fields that went over is still an error
+	_, err = d.Decode(unhex(t, "82 82 82 20"))
+	require.ErrorIs(t, err, ErrCompression)
+
+	// Test: Empty cookie crumbs, one byte each, are stopped by the
+	// default limit
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte(strings.Repeat("\xa0", 30000)))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "418"},
+		{Name: "content-type", Value: "text/html; charset=utf-8"},
+		{Name: "x-custom", Value: "value"},
+		{Name: "x-empty", Value: ""},
+		{Name: "set-cookie", Value: "id=1; HttpOnly", Sensitive: true},
+		{Name: "x-binary", Value: "\x00\xff\x7f"},
+	}
+	block := NewEncoder().AppendFields(nil, fields)
+	decoded, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Exact static matches are a single byte
+	assert.Equal(t, []byte{0x88}, NewEncoder().AppendFields(nil, fields[:1]))
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "a", "www.example.com", "no-cache", strings.Repeat("\xff", 10), "Mon, 21 Oct 2013 20:13:21 GMT"} {
+		encoded := huffmanEncode(nil, s)
+		assert.Len(t, encoded, huffmanEncodedLen(s))
+		decoded, err := huffmanDecode(nil, encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(decoded))
+	}
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(huffmanEncode(nil, "www.example.com")))
+}
@@ -0,0 +1,98 @@
+package hpack
+
+import (
+	"fmt"
+	"sync"
+)
+
+type huffmanCode struct {
+	code uint32
+	bits uint8
+}
+
+// huffmanNode is a node of the decoding tree. Leaves have no children
+// and hold a symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanRootOnce sync.Once
+)
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{}
+	for sym, c := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+	}
+}
+
+// huffmanDecode appends the decoding of src to dst. Padding must be a
+// prefix of the EOS code, so at most seven one bits.
+func huffmanDecode(dst, src []byte) ([]byte, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+	n := huffmanRoot
+	// depth and ones track the bits read since the last symbol, to check
+	// the padding once the input runs out
+	depth, ones := 0, true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			n = n.children[bit]
+			if n == nil {
+				// only EOS, which is all ones, falls off the tree
+				return nil, fmt.Errorf("%w: invalid Huffman code", ErrCompression)
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.children[0] == nil && n.children[1] == nil {
+				dst = append(dst, n.sym)
+				n, depth, ones = huffmanRoot, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return nil, fmt.Errorf("%w: invalid Huffman padding", ErrCompression)
+	}
+	return dst, nil
+}
+
+// huffmanEncodedLen returns the length of s once Huffman encoded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends the Huffman encoding of s to dst, padded with
+// the high bits of EOS.
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += int(c.bits)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		acc = acc<<(8-n) | (1<<(8-n) - 1)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,168 @@
+package http2
+
+import (
+	"fmt"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+)
+
+// connectionSpecific are the fields HTTP/2 forbids, per RFC 9113
+// section 8.2.2. They are dropped from responses and make requests
+// malformed.
+var connectionSpecific = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// RequestFields is a request's header section, split into its
+// pseudo-headers and regular fields. HTTP/3 has the same rules for
+// these as HTTP/2, so it shares them.
+type RequestFields struct {
+	Method    string
+	Scheme    string
+	Authority string
+	Path      string
+	Headers   *headers.Headers
+	// ContentLength is -1 when the request doesn't declare one.
+	ContentLength int64
+	// Trailers holds the trailer section that followed the body, if the
+	// request had one.
+	Trailers *headers.Headers
+}
+
+// ParseRequestFields checks a request's decoded header section, per
+// RFC 9113 section 8.3 and RFC 9114 section 4.3. Cookie crumbs are
+// joined back together, and :authority becomes Host when the request
+// has none.
+func ParseRequestFields(fields []hpack.HeaderField) (*RequestFields, error) {
+	rf := &RequestFields{Headers: headers.NewHeaders(), ContentLength: -1}
+	seen := map[string]bool{}
+	var cookies []string
+	regular := false
+	for _, f := range fields {
+		if name, ok := strings.CutPrefix(f.Name, ":"); ok {
+			if regular {
+				return nil, malformed("pseudo-header %s after regular fields", f.Name)
+			}
+			if seen[name] {
+				return nil, malformed("repeated pseudo-header %s", f.Name)
+			}
+			seen[name] = true
+			switch name {
+			case "method":
+				rf.Method = f.Value
+			case "scheme":
+				rf.Scheme = f.Value
+			case "authority":
+				rf.Authority = f.Value
+			case "path":
+				rf.Path = f.Value
+			default:
+				return nil, malformed("unknown pseudo-header %s", f.Name)
+			}
+			continue
+		}
+		regular = true
+		switch {
+		case !headers.ValidName(f.Name) || f.Name != strings.ToLower(f.Name):
+			return nil, malformed("invalid field name %q", f.Name)
+		case !headers.ValidValue(f.Value):
+			return nil, malformed("invalid value for %s", f.Name)
+		case connectionSpecific[f.Name]:
+			return nil, malformed("connection-specific field %s", f.Name)
+		case f.Name == "te" && f.Value != "trailers":
+			return nil, malformed("TE other than trailers")
+		case f.Name == "cookie":
+			// cookies may be split into crumbs, and are rejoined with
+			// "; " rather than a comma
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		rf.Headers.Set(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		rf.Headers.Set("cookie", strings.Join(cookies, "; "))
+	}
+
+	if !headers.ValidName(rf.Method) {
+		return nil, malformed("invalid :method %q", rf.Method)
+	}
+	if rf.Method == "CONNECT" {
+		if rf.Authority == "" || seen["scheme"] || seen["path"] {
+			return nil, malformed("CONNECT needs :authority and no :scheme or :path")
+		}
+	} else if rf.Scheme == "" || rf.Path == "" {
+		return nil, malformed("missing :scheme or :path")
+	}
+	if rf.Authority != "" {
+		if host := rf.Headers.Get("host"); host != "" && host != rf.Authority {
+			return nil, malformed(":authority %q and Host %q differ", rf.Authority, host)
+		}
+		if !rf.Headers.Has("host") {
+			rf.Headers.Set("host", rf.Authority)
+		}
+	}
+	if rf.Headers.Has("content-length") {
+		n, err := headers.ParseContentLength(rf.Headers.Get("content-length"))
+		if err != nil {
+			return nil, malformed("invalid Content-Length")
+		}
+		rf.ContentLength = n
+	}
+	return rf, nil
+}
+
+// ParseTrailerFields checks the fields of a request's trailer section,
+// which has the rules of regular fields and no pseudo-headers, RFC 9113
+// section 8.1. An empty section gives nil.
+func ParseTrailerFields(fields []hpack.HeaderField) (*headers.Headers, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		switch {
+		case strings.HasPrefix(f.Name, ":"):
+			return nil, malformed("pseudo-header %s in trailers", f.Name)
+		case !headers.ValidName(f.Name) || f.Name != strings.ToLower(f.Name):
+			return nil, malformed("invalid field name %q", f.Name)
+		case !headers.ValidValue(f.Value):
+			return nil, malformed("invalid value for %s", f.Name)
+		case connectionSpecific[f.Name]:
+			return nil, malformed("connection-specific field %s", f.Name)
+		}
+		h.Set(f.Name, f.Value)
+	}
+	return h, nil
+}
+
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("malformed request: "+format, args...)
+}
+
+// Target is the request-target the pseudo-headers describe.
+func (rf *RequestFields) Target() string {
+	if rf.Method == "CONNECT" {
+		return rf.Authority
+	}
+	return rf.Path
+}
+
+// AppendResponseFields appends the fields of h to fields, leaving out
+// the ones that only make sense in HTTP/1.x.
+func AppendResponseFields(fields []hpack.HeaderField, h *headers.Headers) []hpack.HeaderField {
+	for _, name := range h.Names() {
+		if connectionSpecific[name] {
+			continue
+		}
+		for _, v := range h.Values(name) {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: v})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,210 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what every HTTP/2 client sends first, before its
+// SETTINGS frame.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// FrameType is the type of a frame, from RFC 9113 section 6.
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+// Flags are the frame flags. Their meaning depends on the frame type.
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+const frameHeaderLen = 9
+
+// Limits from RFC 9113.
+const (
+	minMaxFrameSize   = 1 << 14
+	maxMaxFrameSize   = 1<<24 - 1
+	maxWindowSize     = 1<<31 - 1
+	initialWindowSize = 65535
+)
+
+// Frame is one frame as read off the wire.
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// ReadFrame reads one frame from r. A frame longer than maxSize is a
+// connection error of type FRAME_SIZE_ERROR.
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	f := &Frame{
+		Type:     FrameType(hdr[3]),
+		Flags:    Flags(hdr[4]),
+		StreamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return nil, connError(ErrCodeFrameSize, "%s frame of %d bytes over limit %d", f.Type, length, maxSize)
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// AppendFrame appends a frame with the given header and payload to dst.
+func AppendFrame(dst []byte, t FrameType, flags Flags, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(t), byte(flags))
+	dst = binary.BigEndian.AppendUint32(dst, streamID&(1<<31-1))
+	return append(dst, payload...)
+}
+
+// unpadded returns the payload of a DATA or HEADERS frame without any
+// padding.
+func (f *Frame) unpadded() ([]byte, error) {
+	p := f.Payload
+	if !f.Flags.Has(FlagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, connError(ErrCodeProtocol, "%s frame padding too long", f.Type)
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
+
+// headerBlock returns the header block fragment of a HEADERS frame,
+// without padding and priority fields.
+func (f *Frame) headerBlock() ([]byte, error) {
+	p, err := f.unpadded()
+	if err != nil {
+		return nil, err
+	}
+	if f.Flags.Has(FlagPriority) {
+		if len(p) < 5 {
+			return nil, connError(ErrCodeFrameSize, "HEADERS frame too short for priority")
+		}
+		if binary.BigEndian.Uint32(p)&(1<<31-1) == f.StreamID {
+			// a stream error in theory, but the block would still have to
+			// be decoded to keep the HPACK state in step
+			return nil, connError(ErrCodeProtocol, "stream %d depends on itself", f.StreamID)
+		}
+		p = p[5:]
+	}
+	return p, nil
+}
+
+// SettingID identifies a setting in a SETTINGS frame.
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Setting is one parameter of a SETTINGS frame.
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// ParseSettings parses the payload of a SETTINGS frame, or the decoded
+// HTTP2-Settings header of an upgrade request.
+func ParseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS payload of %d bytes", len(p))
+	}
+	settings := make([]Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		s := Setting{ID: SettingID(binary.BigEndian.Uint16(p)), Value: binary.BigEndian.Uint32(p[2:])}
+		if err := s.valid(); err != nil {
+			return nil, err
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func (s Setting) valid() error {
+	switch s.ID {
+	case SettingEnablePush:
+		if s.Value > 1 {
+			return connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", s.Value)
+		}
+	case SettingInitialWindowSize:
+		if s.Value > maxWindowSize {
+			return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", s.Value)
+		}
+	case SettingMaxFrameSize:
+		if s.Value < minMaxFrameSize || s.Value > maxMaxFrameSize {
+			return connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", s.Value)
+		}
+	}
+	return nil
+}
+
+// AppendSettings appends a SETTINGS payload to dst.
+func AppendSettings(dst []byte, settings ...Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
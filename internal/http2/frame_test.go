@@ -0,0 +1,113 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	raw := AppendFrame(nil, FrameHeaders, FlagEndStream|FlagEndHeaders, 7, []byte("block"))
+	assert.Equal(t, []byte{0, 0, 5, 1, 5, 0, 0, 0, 7}, raw[:frameHeaderLen])
+
+	f, err := ReadFrame(bytes.NewReader(raw), minMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, FrameHeaders, f.Type)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+	assert.True(t, f.Flags.Has(FlagEndHeaders))
+	assert.False(t, f.Flags.Has(FlagPadded))
+	assert.Equal(t, uint32(7), f.StreamID)
+	assert.Equal(t, "block", string(f.Payload))
+
+	// Test: The reserved bit is ignored
+	raw[5] |= 0x80
+	f, err = ReadFrame(bytes.NewReader(raw), minMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), f.StreamID)
+
+	// Test: Truncated payload
+	_, err = ReadFrame(bytes.NewReader(raw[:len(raw)-1]), minMaxFrameSize)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Oversized frame
+	raw = AppendFrame(nil, FrameData, 0, 1, make([]byte, minMaxFrameSize+1))
+	_, err = ReadFrame(bytes.NewReader(raw), minMaxFrameSize)
+	var ce ConnError
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+}
+
+func TestFrame_Padding(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   Flags
+		payload []byte
+		want    string
+		err     bool
+	}{
+		{"unpadded", 0, []byte("data"), "data", false},
+		{"padded", FlagPadded, []byte("\x02datapp"), "data", false},
+		{"all padding", FlagPadded, []byte("\x02pp"), "", false},
+		{"padding too long", FlagPadded, []byte("\x05data"), "", true},
+		{"empty", FlagPadded, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Frame{Type: FrameData, Flags: tt.flags, StreamID: 1, Payload: tt.payload}
+			p, err := f.unpadded()
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(p))
+		})
+	}
+
+	// Test: Priority fields are skipped in HEADERS
+	f := &Frame{Type: FrameHeaders, Flags: FlagPadded | FlagPriority, StreamID: 3, Payload: []byte("\x01\x00\x00\x00\x01\x10blockp")}
+	block, err := f.headerBlock()
+	require.NoError(t, err)
+	assert.Equal(t, "block", string(block))
+
+	// Test: A stream can't depend on itself
+	f = &Frame{Type: FrameHeaders, Flags: FlagPriority, StreamID: 3, Payload: []byte("\x00\x00\x00\x03\x10block")}
+	_, err = f.headerBlock()
+	require.Error(t, err)
+}
+
+func TestSettings(t *testing.T) {
+	payload := AppendSettings(nil, Setting{SettingMaxFrameSize, 1 << 20}, Setting{SettingInitialWindowSize, 0})
+	settings, err := ParseSettings(payload)
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingMaxFrameSize, 1 << 20}, {SettingInitialWindowSize, 0}}, settings)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		code    ErrCode
+	}{
+		{"bad length", []byte{0, 1, 0}, ErrCodeFrameSize},
+		{"push", AppendSettings(nil, Setting{SettingEnablePush, 2}), ErrCodeProtocol},
+		{"window", AppendSettings(nil, Setting{SettingInitialWindowSize, 1 << 31}), ErrCodeFlowControl},
+		{"small frames", AppendSettings(nil, Setting{SettingMaxFrameSize, 1 << 10}), ErrCodeProtocol},
+		{"large frames", AppendSettings(nil, Setting{SettingMaxFrameSize, 1 << 24}), ErrCodeProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSettings(tt.payload)
+			var ce ConnError
+			require.True(t, errors.As(err, &ce), "%v", err)
+			assert.Equal(t, tt.code, ce.Code)
+		})
+	}
+
+	// Test: Unknown settings are kept and ignored
+	settings, err = ParseSettings(AppendSettings(nil, Setting{0x99, 1}))
+	require.NoError(t, err)
+	assert.Len(t, settings, 1)
+}
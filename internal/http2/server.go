@@ -0,0 +1,783 @@
+// Package http2 serves HTTP/2 (RFC 9113) over an established
+// connection: frames, HPACK header compression, stream multiplexing,
+// flow control and SETTINGS. Each stream becomes a request.Request and
+// a response.Writer for an ordinary handler, so the same handlers serve
+// HTTP/1.x and HTTP/2.
+//
+// Server push and stream priorities are not implemented; PRIORITY
+// frames are accepted and ignored, and push is never used.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// DefaultMaxConcurrentStreams is the stream limit used when
+// Server.MaxConcurrentStreams is zero.
+const DefaultMaxConcurrentStreams = 100
+
+// goAwayTimeout is how long a connection that sent a graceful GOAWAY
+// waits for the client to close it once its last stream is done.
+const goAwayTimeout = time.Second
+
+// DefaultMaxBodyBytes is the request body cap used when
+// Server.MaxBodyBytes is zero.
+const DefaultMaxBodyBytes = 10 << 20
+
+// maxHeaderBlockSize bounds a compressed header block, across all its
+// CONTINUATION frames.
+const maxHeaderBlockSize = 1 << 20
+
+// maxHeaderListSize bounds a decoded header list, as the sum of its
+// fields' sizes. It is advertised in SETTINGS.
+const maxHeaderListSize = 1 << 20
+
+// Server holds the settings for serving HTTP/2 connections. Zero values
+// fall back to defaults.
+type Server struct {
+	Handler func(w *response.Writer, req *request.Request)
+	// MaxConcurrentStreams is how many streams a client may have open on
+	// one connection. It is advertised in SETTINGS, and streams past it
+	// are refused.
+	MaxConcurrentStreams uint32
+	// IdleTimeout closes a connection that has had no open streams for
+	// this long. Zero means no timeout.
+	IdleTimeout time.Duration
+	// WriteBufferSize is the size of each response's body buffer.
+	WriteBufferSize int
+	// MaxBodyBytes caps the request body buffered for each stream, so a
+	// connection holds at most MaxConcurrentStreams of them. A stream
+	// whose body goes past it is reset with ENHANCE_YOUR_CALM.
+	MaxBodyBytes int64
+
+	mu           sync.Mutex
+	conns        map[*serverConn]struct{}
+	shuttingDown bool
+}
+
+// Shutdown sends a GOAWAY to every connection being served, and to any
+// served from now on. Streams the client already opened run to
+// completion, later ones are refused, and each connection closes once
+// its last stream is done. Shutdown doesn't wait for that; callers
+// wait for ServeConn to return.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	for _, sc := range conns {
+		sc.shutdown()
+	}
+}
+
+// track registers sc for Shutdown and reports whether a shutdown has
+// already started.
+func (s *Server) track(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = map[*serverConn]struct{}{}
+	}
+	s.conns[sc] = struct{}{}
+	return s.shuttingDown
+}
+
+func (s *Server) untrack(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+}
+
+// ServeConnOpts describes how a connection got to HTTP/2.
+type ServeConnOpts struct {
+	// Reader, if set, is read from in place of the connection, to
+	// replay bytes that were read while detecting the protocol.
+	Reader io.Reader
+	// Upgrade is the HTTP/1.1 request of an "Upgrade: h2c" exchange,
+	// after the 101 response has been sent. It is served as stream 1.
+	Upgrade *request.Request
+	// Settings are the client's settings from the HTTP2-Settings header
+	// of the upgrade request.
+	Settings []Setting
+}
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// ServeConn serves HTTP/2 on conn until the client goes away, the
+// connection fails or is idle for too long. It starts by sending the
+// server's SETTINGS and then expects the client preface.
+func (s *Server) ServeConn(conn net.Conn, opts ServeConnOpts) error {
+	r := opts.Reader
+	if r == nil {
+		r = conn
+	}
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		br:                bufio.NewReader(r),
+		bw:                bufio.NewWriter(conn),
+		enc:               hpack.NewEncoder(),
+		dec:               hpack.NewDecoder(hpack.DefaultTableSize),
+		streams:           map[uint32]*stream{},
+		maxStreams:        s.MaxConcurrentStreams,
+		sendWindow:        initialWindowSize,
+		recvWindow:        initialWindowSize,
+		maxBody:           s.MaxBodyBytes,
+		peerInitialWindow: initialWindowSize,
+		peerMaxFrameSize:  minMaxFrameSize,
+	}
+	if sc.maxStreams == 0 {
+		sc.maxStreams = DefaultMaxConcurrentStreams
+	}
+	if sc.maxBody == 0 {
+		sc.maxBody = DefaultMaxBodyBytes
+	}
+	sc.dec.SetMaxHeaderListSize(maxHeaderListSize)
+	sc.cond = sync.NewCond(&sc.mu)
+	defer sc.close()
+	return sc.serve(opts)
+}
+
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+	br   *bufio.Reader
+
+	// wmu serializes frames onto the connection
+	wmu sync.Mutex
+	bw  *bufio.Writer
+	enc *hpack.Encoder
+
+	// dec and the header block being assembled are only used by the
+	// reading goroutine
+	dec             *hpack.Decoder
+	headerStreamID  uint32
+	headerEndStream bool
+	headerBlock     []byte
+	// recvWindow is how much DATA the client may still send on the
+	// connection, and maxBody caps each stream's buffered body
+	recvWindow int64
+	maxBody    int64
+
+	// mu guards the fields below, and cond signals changes to send
+	// windows and stream state to handlers waiting to write
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	maxStreams        uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	closed            bool
+	// goingAway is set once a GOAWAY has been sent; streams after
+	// goAwayID are refused from then on
+	goingAway bool
+	goAwayID  uint32
+}
+
+func (sc *serverConn) serve(opts ServeConnOpts) error {
+	err := sc.writeFrame(FrameSettings, 0, 0, AppendSettings(nil,
+		Setting{SettingMaxConcurrentStreams, sc.maxStreams},
+		Setting{SettingEnablePush, 0},
+		Setting{SettingMaxHeaderListSize, maxHeaderListSize},
+	))
+	if err != nil {
+		return err
+	}
+	if opts.Upgrade != nil {
+		// the 101 response acknowledged these settings
+		if err := sc.applySettings(opts.Settings); err != nil {
+			return sc.fail(err)
+		}
+		st := sc.newStream(1)
+		st.remoteClosed = true
+		sc.mu.Lock()
+		sc.streams[1] = st
+		sc.lastStreamID = 1
+		sc.mu.Unlock()
+		sc.dispatch(st, opts.Upgrade)
+	}
+	// the GOAWAY of a shutdown can only follow our SETTINGS, and has to
+	// cover the upgraded stream
+	defer sc.srv.untrack(sc)
+	if sc.srv.track(sc) {
+		sc.shutdown()
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if !bytes.Equal(preface, []byte(ClientPreface)) {
+		return sc.fail(connError(ErrCodeProtocol, "bad client preface"))
+	}
+
+	for first := true; ; first = false {
+		sc.setIdleDeadline()
+		f, err := ReadFrame(sc.br, minMaxFrameSize)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if !sc.isGoingAway() {
+					sc.goAway(ErrCodeNo, "idle")
+				}
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return sc.fail(err)
+		}
+		if first && (f.Type != FrameSettings || f.Flags.Has(FlagAck)) {
+			return sc.fail(connError(ErrCodeProtocol, "first frame is %s, not SETTINGS", f.Type))
+		}
+		if err := sc.processFrame(f); err != nil {
+			var se StreamError
+			if errors.As(err, &se) {
+				sc.resetStream(se)
+				continue
+			}
+			return sc.fail(err)
+		}
+	}
+}
+
+// setIdleDeadline sets a read deadline while no streams are open, so an
+// idle connection is closed after Server.IdleTimeout, or soon after its
+// last stream once it is going away.
+func (sc *serverConn) setIdleDeadline() {
+	sc.mu.Lock()
+	idle := len(sc.streams) == 0
+	goingAway := sc.goingAway
+	sc.mu.Unlock()
+	switch {
+	case idle && goingAway:
+		sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+	case sc.srv.IdleTimeout <= 0:
+	case idle:
+		sc.conn.SetReadDeadline(time.Now().Add(sc.srv.IdleTimeout))
+	default:
+		sc.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// shutdown sends a GOAWAY with no error, after which the connection
+// finishes the streams it has and refuses new ones.
+func (sc *serverConn) shutdown() {
+	if sc.isGoingAway() {
+		return
+	}
+	sc.goAway(ErrCodeNo, "shutting down")
+	sc.mu.Lock()
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+	if idle {
+		// wake the reader so it stops waiting on the idle timeout
+		sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+	}
+}
+
+func (sc *serverConn) isGoingAway() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goingAway
+}
+
+// fail ends the connection for err, sending a GOAWAY if it is a
+// connection error.
+func (sc *serverConn) fail(err error) error {
+	var ce ConnError
+	if errors.As(err, &ce) {
+		sc.goAway(ce.Code, ce.Reason)
+	}
+	return err
+}
+
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) processFrame(f *Frame) error {
+	if sc.headerStreamID != 0 && (f.Type != FrameContinuation || f.StreamID != sc.headerStreamID) {
+		return connError(ErrCodeProtocol, "%s frame in the middle of a header block", f.Type)
+	}
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.Payload) != 5 {
+			return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY payload of %d bytes", len(f.Payload))
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case FramePing:
+		if f.StreamID != 0 {
+			return connError(ErrCodeProtocol, "PING on stream %d", f.StreamID)
+		}
+		if len(f.Payload) != 8 {
+			return connError(ErrCodeFrameSize, "PING payload of %d bytes", len(f.Payload))
+		}
+		if f.Flags.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(FramePing, FlagAck, 0, f.Payload)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.StreamID)
+		}
+		// streams in flight finish; the client closes the connection
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	// unknown frame types are ignored
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *Frame) error {
+	id := f.StreamID
+	if id == 0 || id%2 == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream %d", id)
+	}
+	block, err := f.headerBlock()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	st := sc.streams[id]
+	closed := st == nil && id <= sc.lastStreamID
+	if st == nil && !closed {
+		sc.lastStreamID = id
+	}
+	sc.mu.Unlock()
+	switch {
+	case closed:
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	case st != nil && st.remoteClosed:
+		return connError(ErrCodeStreamClosed, "HEADERS on half-closed stream %d", id)
+	}
+	sc.headerStreamID = id
+	sc.headerEndStream = f.Flags.Has(FlagEndStream)
+	sc.headerBlock = append(sc.headerBlock[:0], block...)
+	if f.Flags.Has(FlagEndHeaders) {
+		return sc.endHeaders()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(f *Frame) error {
+	if sc.headerStreamID == 0 {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	sc.headerBlock = append(sc.headerBlock, f.Payload...)
+	if len(sc.headerBlock) > maxHeaderBlockSize {
+		return connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", maxHeaderBlockSize)
+	}
+	if f.Flags.Has(FlagEndHeaders) {
+		return sc.endHeaders()
+	}
+	return nil
+}
+
+// endHeaders decodes a complete header block, which either opens a
+// stream or carries its trailers.
+func (sc *serverConn) endHeaders() error {
+	id, endStream := sc.headerStreamID, sc.headerEndStream
+	sc.headerStreamID = 0
+	fields, err := sc.dec.Decode(sc.headerBlock)
+	if errors.Is(err, hpack.ErrHeaderListTooLarge) {
+		// the decoder kept its table right, so only the stream ends
+		return streamError(id, ErrCodeEnhanceYourCalm, "header list over %d bytes", maxHeaderListSize)
+	}
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	open := len(sc.streams)
+	refused := st == nil && sc.goingAway && id > sc.goAwayID
+	sc.mu.Unlock()
+
+	if st != nil {
+		// trailers
+		if !endStream {
+			return streamError(id, ErrCodeProtocol, "trailers without END_STREAM")
+		}
+		if st.fields.Trailers, err = ParseTrailerFields(fields); err != nil {
+			return streamError(id, ErrCodeProtocol, "%v", err)
+		}
+		st.remoteClosed = true
+		return sc.endRequest(st)
+	}
+
+	if refused {
+		return streamError(id, ErrCodeRefusedStream, "connection is going away")
+	}
+	if uint32(open) >= sc.maxStreams {
+		return streamError(id, ErrCodeRefusedStream, "over %d concurrent streams", sc.maxStreams)
+	}
+	st = sc.newStream(id)
+	if st.fields, err = ParseRequestFields(fields); err != nil {
+		return streamError(id, ErrCodeProtocol, "%v", err)
+	}
+	if st.fields.ContentLength > sc.maxBody {
+		return streamError(id, ErrCodeEnhanceYourCalm, "Content-Length over %d bytes", sc.maxBody)
+	}
+	sc.mu.Lock()
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	if endStream {
+		st.remoteClosed = true
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(f *Frame) error {
+	id := f.StreamID
+	if id == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	// the whole frame, padding included, counts against the connection
+	// window even if the stream is gone. Bodies are capped per stream
+	// rather than by holding the connection window back, so it is handed
+	// straight back.
+	length := int64(len(f.Payload))
+	if length > sc.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA frame of %d bytes over the window of %d", length, sc.recvWindow)
+	}
+	if length > 0 {
+		sc.recvWindow -= length
+		if err := sc.writeWindowUpdate(0, uint32(length)); err != nil {
+			return err
+		}
+		sc.recvWindow += length
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	idle := st == nil && id > sc.lastStreamID
+	sc.mu.Unlock()
+	switch {
+	case idle:
+		return connError(ErrCodeProtocol, "DATA on idle stream %d", id)
+	case st == nil || st.remoteClosed || st.reset:
+		return streamError(id, ErrCodeStreamClosed, "DATA on closed stream")
+	case length > st.recvWindow:
+		return streamError(id, ErrCodeFlowControl, "DATA frame of %d bytes over the window of %d", length, st.recvWindow)
+	}
+	st.recvWindow -= length
+
+	data, err := f.unpadded()
+	if err != nil {
+		return err
+	}
+	if int64(len(st.body)+len(data)) > sc.maxBody {
+		return streamError(id, ErrCodeEnhanceYourCalm, "body over %d bytes", sc.maxBody)
+	}
+	st.body = append(st.body, data...)
+	if cl := st.fields.ContentLength; cl >= 0 && int64(len(st.body)) > cl {
+		return streamError(id, ErrCodeProtocol, "body longer than Content-Length")
+	}
+	if f.Flags.Has(FlagEndStream) {
+		st.remoteClosed = true
+		return sc.endRequest(st)
+	}
+	// the stream's window is topped up no further than a byte past the
+	// cap: enough for the reset that a longer body gets, so a client that
+	// keeps to the window never stalls, and one that doesn't is caught
+	window := min(initialWindowSize, sc.maxBody+1-int64(len(st.body)))
+	if increment := window - st.recvWindow; increment > 0 {
+		st.recvWindow += increment
+		return sc.writeWindowUpdate(id, uint32(increment))
+	}
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM payload of %d bytes", len(f.Payload))
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if f.StreamID > sc.lastStreamID {
+			return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+		}
+		return nil
+	}
+	st.reset = true
+	if !st.dispatched {
+		delete(sc.streams, st.id)
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.StreamID)
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := ParseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+}
+
+// applySettings takes on the settings that affect what we send. The
+// encoder never uses the dynamic table, so the header table size
+// doesn't matter, and push is never used.
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		if err := s.valid(); err != nil {
+			return err
+		}
+		switch s.ID {
+		case SettingInitialWindowSize:
+			delta := int64(s.Value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError(ErrCodeFlowControl, "stream %d window over the maximum", st.id)
+				}
+			}
+			sc.peerInitialWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *Frame) error {
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE payload of %d bytes", len(f.Payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window over the maximum")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if f.StreamID > sc.lastStreamID {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+		}
+		return nil
+	}
+	if increment == 0 {
+		return streamError(f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.StreamID, ErrCodeFlowControl, "window over the maximum")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// endRequest runs the handler for a stream whose request is complete.
+func (sc *serverConn) endRequest(st *stream) error {
+	if cl := st.fields.ContentLength; cl >= 0 && int64(len(st.body)) != cl {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes, Content-Length %d", len(st.body), cl)
+	}
+	req, err := request.NewRequest(st.fields.Method, st.fields.Target(), 2, 0, st.fields.Headers, st.body)
+	if err != nil {
+		sc.dispatchError(st, err)
+		return nil
+	}
+	req.Trailers = st.fields.Trailers
+	sc.dispatch(st, req)
+	return nil
+}
+
+func (sc *serverConn) dispatch(st *stream, req *request.Request) {
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = sc.conn.RemoteAddr().String()
+		if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+	}
+	sc.mu.Lock()
+	st.dispatched = true
+	sc.mu.Unlock()
+	go func() {
+		defer sc.closeStream(st)
+		w := response.NewFramedWriterSize(st, sc.writeBufferSize())
+		if req.RequestLine.Method == "HEAD" {
+			w.DiscardBody()
+		}
+		sc.srv.Handler(w, req)
+		if err := w.Finish(); err != nil {
+			log.Printf("Error finishing response: %v", err)
+		}
+	}()
+}
+
+// dispatchError answers a request that can't be turned into a
+// request.Request with a 400, as the HTTP/1.x server does.
+func (sc *serverConn) dispatchError(st *stream, err error) {
+	sc.mu.Lock()
+	st.dispatched = true
+	sc.mu.Unlock()
+	go func() {
+		defer sc.closeStream(st)
+		w := response.NewFramedWriterSize(st, sc.writeBufferSize())
+		body := []byte("Error parsing request: " + err.Error())
+		w.WriteStatusLine(response.BadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		w.Finish()
+	}()
+}
+
+func (sc *serverConn) writeBufferSize() int {
+	if sc.srv.WriteBufferSize > 0 {
+		return sc.srv.WriteBufferSize
+	}
+	return response.DefaultBufferSize
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	delete(sc.streams, st.id)
+	drained := sc.goingAway && len(sc.streams) == 0
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	if drained {
+		sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+	}
+}
+
+func (sc *serverConn) resetStream(e StreamError) {
+	sc.mu.Lock()
+	if st := sc.streams[e.StreamID]; st != nil {
+		st.reset = true
+		if !st.dispatched {
+			delete(sc.streams, st.id)
+		}
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(FrameRSTStream, 0, e.StreamID, binary.BigEndian.AppendUint32(nil, uint32(e.Code)))
+}
+
+func (sc *serverConn) goAway(code ErrCode, debug string) {
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.goingAway = true
+	sc.goAwayID = last
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(FrameGoAway, 0, 0, append(payload, debug...))
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID, increment uint32) error {
+	return sc.writeFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+// writeFrame writes one frame and flushes it.
+func (sc *serverConn) writeFrame(t FrameType, flags Flags, streamID uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if _, err := sc.bw.Write(AppendFrame(nil, t, flags, streamID, payload)); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+// writeHeaderBlock writes fields as a HEADERS frame followed by as many
+// CONTINUATION frames as the peer's frame size calls for. They go out
+// back to back, as the protocol requires.
+func (sc *serverConn) writeHeaderBlock(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	block := sc.enc.AppendFields(nil, fields)
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	t, flags := FrameHeaders, Flags(0)
+	if endStream {
+		flags |= FlagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if _, err := sc.bw.Write(AppendFrame(nil, t, flags, streamID, chunk)); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return sc.bw.Flush()
+		}
+		t, flags = FrameContinuation, 0
+	}
+}
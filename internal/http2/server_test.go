@@ -0,0 +1,542 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// listen serves srv on a loopback listener and returns its address.
+func listen(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn, ServeConnOpts{})
+		}
+	}()
+	return l.Addr().String()
+}
+
+// h2cClient is a net/http client that speaks HTTP/2 with prior
+// knowledge over cleartext.
+func h2cClient() *http.Client {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+// echo replies with the method, path, selected headers and body.
+func echo(w *response.Writer, req *request.Request) {
+	body := fmt.Sprintf("%s %s host=%s cookie=%s body=%s",
+		req.RequestLine.Method, req.URL.Path, req.Host(), req.Headers.Get("Cookie"), req.Body)
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Set-Cookie", "a=1")
+	h.Set("Set-Cookie", "b=2")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func TestServer_NetHTTPClient(t *testing.T) {
+	addr := listen(t, &Server{Handler: echo})
+	client := h2cClient()
+
+	// Test: Simple GET
+	req, err := http.NewRequest("GET", "http://"+addr+"/hello?x=1", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "c1", Value: "v1"})
+	req.AddCookie(&http.Cookie{Name: "c2", Value: "v2"})
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "GET /hello host="+addr+" cookie=c1=v1; c2=v2 body=", string(body))
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.Empty(t, resp.Header.Get("Connection"))
+
+	// Test: POST with a body
+	resp, err = client.Post("http://"+addr+"/submit", "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "POST /submit host="+addr+" cookie= body=payload", string(body))
+
+	// Test: HEAD has headers only
+	resp, err = client.Head("http://" + addr + "/head")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, body)
+	assert.Equal(t, int64(len("HEAD /head host="+addr+" cookie= body=")), resp.ContentLength)
+}
+
+func TestServer_Multiplexing(t *testing.T) {
+	// every handler waits until all of them have started, which only
+	// works if the streams run concurrently on one connection
+	const n = 10
+	var started sync.WaitGroup
+	started.Add(n)
+	addr := listen(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		started.Done()
+		started.Wait()
+		response.NewAutoWriter(w, response.OK, nil).Write([]byte(req.URL.Path))
+	}})
+	client := h2cClient()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(fmt.Sprintf("http://%s/%d", addr, i))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, fmt.Sprintf("/%d", i), string(body))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServer_LargeBodyAndTrailers(t *testing.T) {
+	// a body well past the 64KiB initial windows needs WINDOW_UPDATEs
+	// from the client, and is sent in several frames
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	addr := listen(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Length")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		for p := payload; len(p) > 0; p = p[100000:] {
+			w.WriteChunkedBody(p[:min(len(p), 100000)])
+			if len(p) <= 100000 {
+				break
+			}
+		}
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Length", strconv.Itoa(len(payload)))
+		w.WriteTrailers(trailers)
+	}})
+	resp, err := h2cClient().Get("http://" + addr + "/big")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, len(payload), len(body))
+	assert.True(t, bytes.Equal(payload, body))
+	assert.Empty(t, resp.Header.Get("Transfer-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(payload)), resp.Trailer.Get("X-Length"))
+
+	// Test: A large request body
+	addr = listen(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		response.NewAutoWriter(w, response.OK, nil).Write([]byte(strconv.Itoa(len(req.Body))))
+	}})
+	resp, err = h2cClient().Post("http://"+addr+"/upload", "application/octet-stream", bytes.NewReader(payload))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, strconv.Itoa(len(payload)), string(body))
+
+	// Test: Request trailers reach the handler
+	addr = listen(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		var got string
+		if req.Trailers != nil {
+			got = req.Trailers.Get("X-Length")
+		}
+		response.NewAutoWriter(w, response.OK, nil).Write([]byte(got))
+	}})
+	req, err := http.NewRequest("POST", "http://"+addr+"/upload", bytes.NewReader(payload[:10]))
+	require.NoError(t, err)
+	req.Trailer = http.Header{"X-Length": {"10"}}
+	resp, err = h2cClient().Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "10", string(body))
+}
+
+// testConn drives a server with raw frames.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+}
+
+// dialRaw connects to srv, sends the preface with settings and reads
+// the server's SETTINGS.
+func dialRaw(t *testing.T, srv *Server, settings ...Setting) *testConn {
+	conn, err := net.Dial("tcp", listen(t, srv))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := &testConn{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	_, err = io.WriteString(conn, ClientPreface)
+	require.NoError(t, err)
+	tc.writeFrame(FrameSettings, 0, 0, AppendSettings(nil, settings...))
+	f := tc.readFrame()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Flags.Has(FlagAck))
+	tc.writeFrame(FrameSettings, FlagAck, 0, nil)
+	return tc
+}
+
+func (tc *testConn) writeFrame(ft FrameType, flags Flags, streamID uint32, payload []byte) {
+	_, err := tc.conn.Write(AppendFrame(nil, ft, flags, streamID, payload))
+	require.NoError(tc.t, err)
+}
+
+// readFrame reads the next frame, skipping SETTINGS acknowledgements.
+func (tc *testConn) readFrame() *Frame {
+	for {
+		f, err := ReadFrame(tc.br, maxMaxFrameSize)
+		require.NoError(tc.t, err)
+		if f.Type != FrameSettings || !f.Flags.Has(FlagAck) {
+			return f
+		}
+	}
+}
+
+func (tc *testConn) writeHeaders(streamID uint32, endStream bool, fields ...string) {
+	var hf []hpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		hf = append(hf, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	tc.writeFrame(FrameHeaders, flags, streamID, tc.enc.AppendFields(nil, hf))
+}
+
+func (tc *testConn) get(streamID uint32, path string) {
+	tc.writeHeaders(streamID, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost")
+}
+
+// expectGoAway reads frames until a GOAWAY and returns its error code.
+func (tc *testConn) expectGoAway() ErrCode {
+	for {
+		f := tc.readFrame()
+		if f.Type == FrameGoAway {
+			return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+		}
+	}
+}
+
+// expectReset reads frames until a RST_STREAM and returns its stream and
+// error code.
+func (tc *testConn) expectReset() (uint32, ErrCode) {
+	for {
+		f := tc.readFrame()
+		if f.Type == FrameRSTStream {
+			return f.StreamID, ErrCode(binary.BigEndian.Uint32(f.Payload))
+		}
+	}
+}
+
+func hello(w *response.Writer, req *request.Request) {
+	response.NewAutoWriter(w, response.OK, nil).Write([]byte("hello"))
+}
+
+func TestServer_FlowControl(t *testing.T) {
+	// the client allows only 3 bytes per stream until it says otherwise
+	tc := dialRaw(t, &Server{Handler: hello}, Setting{SettingInitialWindowSize, 3})
+	tc.get(1, "/")
+
+	f := tc.readFrame()
+	require.Equal(t, FrameHeaders, f.Type)
+	fields, err := tc.dec.Decode(f.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, hpack.HeaderField{Name: ":status", Value: "200"}, fields[0])
+
+	f = tc.readFrame()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "hel", string(f.Payload))
+
+	// nothing more until the window opens
+	tc.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = tc.br.Peek(1)
+	require.Error(t, err)
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	tc.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+	f = tc.readFrame()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, "lo", string(f.Payload))
+	f = tc.readFrame()
+	require.Equal(t, FrameData, f.Type)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+}
+
+func TestServer_BodyLimit(t *testing.T) {
+	post := []string{":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost"}
+
+	// Test: A body over the cap is reset
+	tc := dialRaw(t, &Server{Handler: hello, MaxBodyBytes: 10})
+	tc.writeHeaders(1, false, post...)
+	tc.writeFrame(FrameData, 0, 1, []byte("0123456789x"))
+	id, code := tc.expectReset()
+	assert.Equal(t, uint32(1), id)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, code)
+
+	// Test: So is one whose Content-Length is over it, before any DATA
+	tc.writeHeaders(3, false, append(post, "content-length", "11")...)
+	id, code = tc.expectReset()
+	assert.Equal(t, uint32(3), id)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, code)
+
+	// Test: The stream window is only topped up to a byte past the cap
+	tc.writeHeaders(5, false, post...)
+	tc.writeFrame(FrameData, 0, 5, []byte("0123"))
+	f := tc.readFrame()
+	require.Equal(t, FrameWindowUpdate, f.Type)
+	assert.Equal(t, uint32(0), f.StreamID)
+	tc.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := tc.br.Peek(1)
+	require.Error(t, err)
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: A client that sends past the window, here with padding that
+	// doesn't add to the body, gets FLOW_CONTROL_ERROR
+	padded := append([]byte{255}, make([]byte, 255)...)
+	for range initialWindowSize/len(padded) + 1 {
+		tc.writeFrame(FrameData, FlagPadded, 5, padded)
+	}
+	id, code = tc.expectReset()
+	assert.Equal(t, uint32(5), id)
+	assert.Equal(t, ErrCodeFlowControl, code)
+}
+
+func TestServer_HeaderListSize(t *testing.T) {
+	tc := dialRaw(t, &Server{Handler: hello})
+	// empty cookie crumbs, one byte each from the static table, that
+	// decode to far more than the block
+	block := tc.enc.AppendFields(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+	})
+	block = append(block, bytes.Repeat([]byte{0xa0}, 2*minMaxFrameSize)...)
+	tc.writeFrame(FrameHeaders, FlagEndStream, 1, block[:minMaxFrameSize])
+	tc.writeFrame(FrameContinuation, 0, 1, block[minMaxFrameSize:2*minMaxFrameSize])
+	tc.writeFrame(FrameContinuation, FlagEndHeaders, 1, block[2*minMaxFrameSize:])
+	id, code := tc.expectReset()
+	assert.Equal(t, uint32(1), id)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, code)
+
+	// Test: The connection is still usable
+	tc.get(3, "/")
+	f := tc.readFrame()
+	assert.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(3), f.StreamID)
+}
+
+func TestServer_PingAndSettings(t *testing.T) {
+	tc := dialRaw(t, &Server{Handler: hello, MaxConcurrentStreams: 7})
+
+	tc.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := tc.readFrame()
+	require.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+
+	tc.writeFrame(FrameSettings, 0, 0, AppendSettings(nil, Setting{SettingMaxFrameSize, 1 << 15}))
+	f, err := ReadFrame(tc.br, maxMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, FrameSettings, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+}
+
+func TestServer_StreamErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+	}{
+		{"missing path", []string{":method", "GET", ":scheme", "http"}},
+		{"uppercase name", []string{":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1"}},
+		{"connection header", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"}},
+		{"pseudo after regular", []string{":method", "GET", ":scheme", "http", "accept", "*/*", ":path", "/"}},
+		{"unknown pseudo", []string{":method", "GET", ":scheme", "http", ":path", "/", ":protocol", "x"}},
+		{"te", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"}},
+		{"signed content-length", []string{":method", "POST", ":scheme", "http", ":path", "/", "content-length", "+5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := dialRaw(t, &Server{Handler: hello})
+			tc.writeHeaders(1, true, tt.fields...)
+			id, code := tc.expectReset()
+			assert.Equal(t, uint32(1), id)
+			assert.Equal(t, ErrCodeProtocol, code)
+
+			// Test: The connection is still usable
+			tc.get(3, "/")
+			f := tc.readFrame()
+			assert.Equal(t, FrameHeaders, f.Type)
+			assert.Equal(t, uint32(3), f.StreamID)
+		})
+	}
+
+	// Test: Body shorter than Content-Length
+	tc := dialRaw(t, &Server{Handler: hello})
+	tc.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "10")
+	tc.writeFrame(FrameData, FlagEndStream, 1, []byte("short"))
+	id, code := tc.expectReset()
+	assert.Equal(t, uint32(1), id)
+	assert.Equal(t, ErrCodeProtocol, code)
+
+	// Test: Bad request-target gets a 400
+	tc.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/../etc", ":authority", "localhost")
+	f := tc.readFrame()
+	require.Equal(t, FrameHeaders, f.Type)
+	fields, err := tc.dec.Decode(f.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, "400", fields[0].Value)
+}
+
+func TestServer_ConcurrencyLimit(t *testing.T) {
+	tc := dialRaw(t, &Server{Handler: hello, MaxConcurrentStreams: 1})
+	// stream 1 stays open waiting for its body
+	tc.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	tc.get(3, "/")
+	id, code := tc.expectReset()
+	assert.Equal(t, uint32(3), id)
+	assert.Equal(t, ErrCodeRefusedStream, code)
+
+	// Test: Once stream 1 is done, new streams are accepted
+	tc.writeFrame(FrameData, FlagEndStream, 1, nil)
+	for f := tc.readFrame(); !(f.Type == FrameData && f.Flags.Has(FlagEndStream)); f = tc.readFrame() {
+	}
+	time.Sleep(20 * time.Millisecond)
+	tc.get(5, "/")
+	f := tc.readFrame()
+	assert.Equal(t, FrameHeaders, f.Type)
+	assert.Equal(t, uint32(5), f.StreamID)
+}
+
+func TestServer_ConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(tc *testConn)
+		code ErrCode
+	}{
+		{"DATA on idle stream", func(tc *testConn) { tc.writeFrame(FrameData, 0, 1, []byte("x")) }, ErrCodeProtocol},
+		{"even stream", func(tc *testConn) { tc.get(2, "/") }, ErrCodeProtocol},
+		{"push promise", func(tc *testConn) { tc.writeFrame(FramePushPromise, FlagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		{"bad HPACK", func(tc *testConn) { tc.writeFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0x80}) }, ErrCodeCompression},
+		{"interrupted header block", func(tc *testConn) {
+			tc.writeFrame(FrameHeaders, 0, 1, tc.enc.AppendFields(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+			tc.writeFrame(FramePing, 0, 0, make([]byte, 8))
+		}, ErrCodeProtocol},
+		{"oversized frame", func(tc *testConn) { tc.writeFrame(FrameData, 0, 1, make([]byte, minMaxFrameSize+1)) }, ErrCodeFrameSize},
+		{"window overflow", func(tc *testConn) {
+			tc.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, ErrCodeFlowControl},
+		{"reused stream", func(tc *testConn) {
+			tc.get(3, "/")
+			tc.get(1, "/")
+		}, ErrCodeStreamClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := dialRaw(t, &Server{Handler: hello})
+			tt.send(tc)
+			assert.Equal(t, tt.code, tc.expectGoAway())
+		})
+	}
+
+	// Test: Bad preface
+	conn, err := net.Dial("tcp", listen(t, &Server{Handler: hello}))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	tc := &testConn{t: t, conn: conn, br: bufio.NewReader(conn)}
+	assert.Equal(t, ErrCodeProtocol, tc.expectGoAway())
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	tc := dialRaw(t, &Server{Handler: hello, IdleTimeout: 50 * time.Millisecond})
+	assert.Equal(t, ErrCodeNo, tc.expectGoAway())
+	_, err := tc.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	srv := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		hello(w, req)
+	}}
+	tc := dialRaw(t, srv)
+	tc.get(1, "/")
+	<-started
+	srv.Shutdown()
+
+	// Test: GOAWAY names the last stream that will be served
+	f := tc.readFrame()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.Payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+
+	// Test: Later streams are refused
+	tc.get(3, "/")
+	id, code := tc.expectReset()
+	assert.Equal(t, uint32(3), id)
+	assert.Equal(t, ErrCodeRefusedStream, code)
+
+	// Test: The stream in flight finishes, then the connection closes
+	close(release)
+	var body string
+	for {
+		f := tc.readFrame()
+		if f.Type == FrameData && f.StreamID == 1 {
+			body += string(f.Payload)
+			if f.Flags.Has(FlagEndStream) {
+				break
+			}
+		}
+	}
+	assert.Equal(t, "hello", body)
+	_, err := tc.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections that arrive later are told to go away at once
+	tc = dialRaw(t, srv)
+	assert.Equal(t, ErrCodeNo, tc.expectGoAway())
+}
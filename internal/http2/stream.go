@@ -0,0 +1,121 @@
+package http2
+
+import (
+	"strconv"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/response"
+)
+
+// stream is one request and response exchange. The reading goroutine
+// fills in the request; once it is complete the handler's goroutine
+// writes the response through the stream, which is its
+// response.Framer.
+type stream struct {
+	sc *serverConn
+	id uint32
+
+	// request, owned by the reading goroutine; recvWindow is how much
+	// DATA the client may still send
+	fields       *RequestFields
+	body         []byte
+	remoteClosed bool
+	recvWindow   int64
+
+	// guarded by sc.mu
+	sendWindow int64
+	dispatched bool
+	reset      bool
+
+	// owned by the handler's goroutine
+	ended bool
+}
+
+var _ response.Framer = (*stream)(nil)
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return &stream{
+		sc:         sc,
+		id:         id,
+		sendWindow: sc.peerInitialWindow,
+		recvWindow: initialWindowSize,
+	}
+}
+
+// WriteHeaders sends the status and header fields in a HEADERS frame,
+// leaving out fields that only make sense in HTTP/1.x.
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h *headers.Headers) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	return st.sc.writeHeaderBlock(st.id, AppendResponseFields(fields, h), false)
+}
+
+// Write sends p in DATA frames, waiting for flow-control window as
+// needed.
+func (st *stream) Write(p []byte) (int, error) {
+	sc := st.sc
+	n := 0
+	for len(p) > 0 {
+		sc.mu.Lock()
+		for !st.reset && !sc.closed && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.reset || sc.closed {
+			sc.mu.Unlock()
+			return n, errStreamClosed
+		}
+		chunk := min(int64(len(p)), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= chunk
+		sc.sendWindow -= chunk
+		sc.mu.Unlock()
+
+		if err := sc.writeFrame(FrameData, 0, st.id, p[:chunk]); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// WriteTrailers sends the trailer fields in a HEADERS frame that ends
+// the stream.
+func (st *stream) WriteTrailers(h *headers.Headers) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	st.ended = true
+	return st.sc.writeHeaderBlock(st.id, AppendResponseFields(nil, h), true)
+}
+
+// Flush does nothing, since every frame is flushed as it is written.
+func (st *stream) Flush() error {
+	return nil
+}
+
+// Close ends the stream with an empty DATA frame, unless trailers
+// already ended it.
+func (st *stream) Close() error {
+	if st.ended {
+		return nil
+	}
+	if err := st.check(); err != nil {
+		return err
+	}
+	st.ended = true
+	return st.sc.writeFrame(FrameData, FlagEndStream, st.id, nil)
+}
+
+func (st *stream) check() error {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	if st.reset || st.sc.closed {
+		return errStreamClosed
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package http3
+
+import "fmt"
+
+// ErrCode is an HTTP/3 error code, used to close connections and
+// reset streams.
+type ErrCode uint64
+
+const (
+	ErrCodeNo                   ErrCode = 0x100
+	ErrCodeGeneralProtocol      ErrCode = 0x101
+	ErrCodeInternal             ErrCode = 0x102
+	ErrCodeStreamCreation       ErrCode = 0x103
+	ErrCodeClosedCriticalStream ErrCode = 0x104
+	ErrCodeFrameUnexpected      ErrCode = 0x105
+	ErrCodeFrame                ErrCode = 0x106
+	ErrCodeExcessiveLoad        ErrCode = 0x107
+	ErrCodeID                   ErrCode = 0x108
+	ErrCodeSettings             ErrCode = 0x109
+	ErrCodeMissingSettings      ErrCode = 0x10a
+	ErrCodeRequestRejected      ErrCode = 0x10b
+	ErrCodeRequestCancelled     ErrCode = 0x10c
+	ErrCodeRequestIncomplete    ErrCode = 0x10d
+	ErrCodeMessage              ErrCode = 0x10e
+	ErrCodeConnect              ErrCode = 0x10f
+	ErrCodeVersionFallback      ErrCode = 0x110
+	ErrCodeQPACKDecompression   ErrCode = 0x200
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                   "H3_NO_ERROR",
+	ErrCodeGeneralProtocol:      "H3_GENERAL_PROTOCOL_ERROR",
+	ErrCodeInternal:             "H3_INTERNAL_ERROR",
+	ErrCodeStreamCreation:       "H3_STREAM_CREATION_ERROR",
+	ErrCodeClosedCriticalStream: "H3_CLOSED_CRITICAL_STREAM",
+	ErrCodeFrameUnexpected:      "H3_FRAME_UNEXPECTED",
+	ErrCodeFrame:                "H3_FRAME_ERROR",
+	ErrCodeExcessiveLoad:        "H3_EXCESSIVE_LOAD",
+	ErrCodeID:                   "H3_ID_ERROR",
+	ErrCodeSettings:             "H3_SETTINGS_ERROR",
+	ErrCodeMissingSettings:      "H3_MISSING_SETTINGS",
+	ErrCodeRequestRejected:      "H3_REQUEST_REJECTED",
+	ErrCodeRequestCancelled:     "H3_REQUEST_CANCELLED",
+	ErrCodeRequestIncomplete:    "H3_REQUEST_INCOMPLETE",
+	ErrCodeMessage:              "H3_MESSAGE_ERROR",
+	ErrCodeConnect:              "H3_CONNECT_ERROR",
+	ErrCodeVersionFallback:      "H3_VERSION_FALLBACK",
+	ErrCodeQPACKDecompression:   "QPACK_DECOMPRESSION_FAILED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint64(c))
+}
+
+// ConnError is an error that closes the whole QUIC connection.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http3: connection error: %s: %s", e.Code, e.Reason)
+}
+
+// StreamError is an error that ends one request stream.
+type StreamError struct {
+	StreamID uint64
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http3: stream %d error: %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) ConnError {
+	return ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamError(id uint64, code ErrCode, format string, args ...any) StreamError {
+	return StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,170 @@
+package http3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"httpfromtcp/internal/quic"
+)
+
+// FrameType is the type of an HTTP/3 frame, RFC 9114 section 7.2.
+type FrameType uint64
+
+const (
+	FrameData        FrameType = 0x0
+	FrameHeaders     FrameType = 0x1
+	FrameCancelPush  FrameType = 0x3
+	FrameSettings    FrameType = 0x4
+	FramePushPromise FrameType = 0x5
+	FrameGoAway      FrameType = 0x7
+	FrameMaxPushID   FrameType = 0xd
+)
+
+// reservedHTTP2Frame reports whether t is an HTTP/2 frame type with no
+// HTTP/3 equivalent, which is an error to receive.
+func reservedHTTP2Frame(t FrameType) bool {
+	switch t {
+	case 0x2, 0x6, 0x8, 0x9:
+		return true
+	}
+	return false
+}
+
+// Unidirectional stream types, RFC 9114 section 6.2 and RFC 9204
+// section 4.2.
+const (
+	StreamControl      = 0x00
+	StreamPush         = 0x01
+	StreamQPACKEncoder = 0x02
+	StreamQPACKDecoder = 0x03
+)
+
+// Setting identifiers, RFC 9114 section 7.2.4.1 and RFC 9204 section 5.
+const (
+	SettingQPACKMaxTableCapacity = 0x01
+	SettingMaxFieldSectionSize   = 0x06
+	SettingQPACKBlockedStreams   = 0x07
+)
+
+// AppendFrame appends a frame with the given type and payload.
+func AppendFrame(dst []byte, t FrameType, payload []byte) []byte {
+	dst = quic.AppendVarint(dst, uint64(t))
+	dst = quic.AppendVarint(dst, uint64(len(payload)))
+	return append(dst, payload...)
+}
+
+// appendFrameHeader appends just the type and length of a frame whose
+// payload is written separately.
+func appendFrameHeader(dst []byte, t FrameType, length int) []byte {
+	dst = quic.AppendVarint(dst, uint64(t))
+	return quic.AppendVarint(dst, uint64(length))
+}
+
+// ReadVarint reads a QUIC variable-length integer from r.
+func ReadVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// readFrameHeader reads a frame's type and length. io.EOF means the
+// stream ended cleanly between frames.
+func readFrameHeader(r *bufio.Reader) (FrameType, uint64, error) {
+	t, err := ReadVarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := ReadVarint(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return FrameType(t), length, err
+}
+
+// readPayload reads a frame payload of length bytes, refusing ones
+// over limit.
+func readPayload(r *bufio.Reader, length, limit uint64) ([]byte, error) {
+	if length > limit {
+		return nil, connError(ErrCodeExcessiveLoad, "frame of %d bytes over the %d byte limit", length, limit)
+	}
+	p := make([]byte, length)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, connError(ErrCodeFrame, "truncated frame")
+	}
+	return p, nil
+}
+
+// Setting is one SETTINGS parameter.
+type Setting struct {
+	ID    uint64
+	Value uint64
+}
+
+// AppendSettings appends a SETTINGS frame.
+func AppendSettings(dst []byte, settings []Setting) []byte {
+	var payload []byte
+	for _, s := range settings {
+		payload = quic.AppendVarint(payload, s.ID)
+		payload = quic.AppendVarint(payload, s.Value)
+	}
+	return AppendFrame(dst, FrameSettings, payload)
+}
+
+// parseSettings parses a SETTINGS payload, rejecting repeats and the
+// HTTP/2 settings that have no meaning here.
+func parseSettings(p []byte) ([]Setting, error) {
+	var settings []Setting
+	seen := map[uint64]bool{}
+	for len(p) > 0 {
+		id, n := quic.ReadVarint(p)
+		if n < 0 {
+			return nil, connError(ErrCodeFrame, "truncated SETTINGS")
+		}
+		p = p[n:]
+		v, n := quic.ReadVarint(p)
+		if n < 0 {
+			return nil, connError(ErrCodeFrame, "truncated SETTINGS")
+		}
+		p = p[n:]
+		if id >= 0x2 && id <= 0x5 {
+			return nil, connError(ErrCodeSettings, "HTTP/2 setting 0x%x", id)
+		}
+		if seen[id] {
+			return nil, connError(ErrCodeSettings, "setting 0x%x repeated", id)
+		}
+		seen[id] = true
+		settings = append(settings, Setting{id, v})
+	}
+	return settings, nil
+}
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "DATA"
+	case FrameHeaders:
+		return "HEADERS"
+	case FrameCancelPush:
+		return "CANCEL_PUSH"
+	case FrameSettings:
+		return "SETTINGS"
+	case FramePushPromise:
+		return "PUSH_PROMISE"
+	case FrameGoAway:
+		return "GOAWAY"
+	case FrameMaxPushID:
+		return "MAX_PUSH_ID"
+	}
+	return fmt.Sprintf("UNKNOWN(0x%x)", uint64(t))
+}
@@ -0,0 +1,444 @@
+// Package http3 serves HTTP/3 (RFC 9114) over QUIC connections from
+// package quic. Like package http2, it turns each request stream into a
+// request.Request and a response.Writer for an ordinary handler, so the
+// same handlers serve every HTTP version.
+//
+// This is experimental. QPACK runs without a dynamic table, and server
+// push and extended CONNECT are not implemented.
+package http3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/qpack"
+	"httpfromtcp/internal/quic"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// NextProto is the ALPN protocol ID for HTTP/3.
+const NextProto = "h3"
+
+// maxFieldSectionSize bounds a header section, both as encoded and as
+// the sum of its decoded fields' sizes, which is what it means when it
+// is advertised in SETTINGS.
+const maxFieldSectionSize = 1 << 20
+
+// Server holds the settings for serving HTTP/3 connections. How many
+// requests a client may have open at once is a QUIC transport setting,
+// quic.Config.MaxIncomingStreams.
+type Server struct {
+	Handler func(w *response.Writer, req *request.Request)
+	// WriteBufferSize is the size of each response's body buffer.
+	WriteBufferSize int
+
+	mu           sync.Mutex
+	conns        map[*serverConn]struct{}
+	shuttingDown bool
+}
+
+// Serve accepts connections from l and serves each of them until l is
+// closed.
+func (s *Server) Serve(l *quic.Listener) error {
+	for {
+		c, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// Shutdown sends a GOAWAY to every connection being served, and to any
+// served from now on. Requests already open run to completion, later
+// ones are rejected, and each connection closes once its last request
+// is done.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	for _, sc := range conns {
+		sc.shutdown()
+	}
+}
+
+// track registers sc for Shutdown and reports whether a shutdown is
+// already under way.
+func (s *Server) track(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = map[*serverConn]struct{}{}
+	}
+	s.conns[sc] = struct{}{}
+	return s.shuttingDown
+}
+
+func (s *Server) untrack(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+}
+
+// ServeConn serves HTTP/3 on c until it closes. A connection closed
+// with H3_NO_ERROR, by either end, returns nil.
+func (s *Server) ServeConn(c *quic.Conn) error {
+	sc := &serverConn{srv: s, conn: c, enc: qpack.NewEncoder(), dec: qpack.NewDecoder()}
+	sc.dec.SetMaxFieldSectionSize(maxFieldSectionSize)
+	return sc.serve()
+}
+
+type serverConn struct {
+	srv  *Server
+	conn *quic.Conn
+	enc  *qpack.Encoder
+	dec  *qpack.Decoder
+
+	// wmu serializes writes to the control stream
+	wmu     sync.Mutex
+	control *quic.Stream
+
+	mu          sync.Mutex
+	peerControl bool
+	active      int
+	// nextStreamID is one past the last request stream accepted, which
+	// a GOAWAY tells the client is the first one it won't serve
+	nextStreamID uint64
+	goingAway    bool
+	goAwayID     uint64
+}
+
+func (sc *serverConn) serve() error {
+	control, err := sc.conn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	sc.control = control
+	settings := AppendSettings([]byte{StreamControl}, []Setting{{SettingMaxFieldSectionSize, maxFieldSectionSize}})
+	if _, err := control.Write(settings); err != nil {
+		return err
+	}
+	defer sc.srv.untrack(sc)
+	if sc.srv.track(sc) {
+		sc.shutdown()
+	}
+	go sc.acceptUni()
+
+	for {
+		st, err := sc.conn.AcceptStream(context.Background())
+		if err != nil {
+			break
+		}
+		sc.mu.Lock()
+		refused := sc.goingAway && st.ID() >= sc.goAwayID
+		if !refused {
+			sc.active++
+			sc.nextStreamID = st.ID() + 4
+		}
+		sc.mu.Unlock()
+		if refused {
+			st.CloseRead(uint64(ErrCodeRequestRejected))
+			st.Reset(uint64(ErrCodeRequestRejected))
+			continue
+		}
+		go sc.serveRequest(st)
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(sc.conn.Err(), &appErr) && appErr.Code == uint64(ErrCodeNo) {
+		return nil
+	}
+	return sc.conn.Err()
+}
+
+// shutdown sends a GOAWAY, closing the connection right away if no
+// request is open.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.goAwayID = sc.nextStreamID
+	idle := sc.active == 0
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	sc.control.Write(AppendFrame(nil, FrameGoAway, quic.AppendVarint(nil, sc.goAwayID)))
+	sc.wmu.Unlock()
+	if idle {
+		go sc.conn.CloseWithError(uint64(ErrCodeNo), "")
+	}
+}
+
+func (sc *serverConn) requestDone() {
+	sc.mu.Lock()
+	sc.active--
+	drained := sc.goingAway && sc.active == 0
+	sc.mu.Unlock()
+	if drained {
+		sc.conn.CloseWithError(uint64(ErrCodeNo), "")
+	}
+}
+
+// fail closes the connection because of err.
+func (sc *serverConn) fail(err error) {
+	var ce ConnError
+	if !errors.As(err, &ce) {
+		ce = connError(ErrCodeInternal, "%v", err)
+	}
+	sc.conn.CloseWithError(uint64(ce.Code), ce.Reason)
+}
+
+func (sc *serverConn) acceptUni() {
+	for {
+		st, err := sc.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go sc.serveUni(st)
+	}
+}
+
+// serveUni handles a unidirectional stream the client opened, by the
+// type it starts with.
+func (sc *serverConn) serveUni(st *quic.Stream) {
+	br := bufio.NewReader(st)
+	typ, err := ReadVarint(br)
+	if err != nil {
+		return
+	}
+	switch typ {
+	case StreamControl:
+		sc.mu.Lock()
+		dup := sc.peerControl
+		sc.peerControl = true
+		sc.mu.Unlock()
+		if dup {
+			sc.fail(connError(ErrCodeStreamCreation, "second control stream"))
+			return
+		}
+		sc.fail(sc.readControl(br))
+	case StreamPush:
+		sc.fail(connError(ErrCodeStreamCreation, "push stream from a client"))
+	case StreamQPACKEncoder, StreamQPACKDecoder:
+		// with a table capacity of zero there is nothing for these to
+		// say that matters
+		io.Copy(io.Discard, br)
+	default:
+		// unknown stream types are for extensions we don't speak
+		st.CloseRead(uint64(ErrCodeStreamCreation))
+	}
+}
+
+// readControl reads the client's control stream, which has to start
+// with SETTINGS and must never end.
+func (sc *serverConn) readControl(br *bufio.Reader) error {
+	first := true
+	for {
+		t, length, err := readFrameHeader(br)
+		if err != nil {
+			return connError(ErrCodeClosedCriticalStream, "control stream closed")
+		}
+		if first != (t == FrameSettings) {
+			if first {
+				return connError(ErrCodeMissingSettings, "control stream starts with %s", t)
+			}
+			return connError(ErrCodeFrameUnexpected, "second SETTINGS")
+		}
+		switch {
+		case t == FrameData, t == FrameHeaders, t == FramePushPromise, reservedHTTP2Frame(t):
+			return connError(ErrCodeFrameUnexpected, "%s on the control stream", t)
+		}
+		p, err := readPayload(br, length, maxFieldSectionSize)
+		if err != nil {
+			return err
+		}
+		if t == FrameSettings {
+			// nothing the client sets changes what we send
+			if _, err := parseSettings(p); err != nil {
+				return err
+			}
+		}
+		// GOAWAY, MAX_PUSH_ID and CANCEL_PUSH only concern push, and
+		// unknown frame types are ignored
+		first = false
+	}
+}
+
+// serveRequest reads the request on a stream and runs the handler.
+func (sc *serverConn) serveRequest(st *quic.Stream) {
+	defer sc.requestDone()
+	rf, body, err := sc.readRequest(st)
+	if err != nil {
+		var se StreamError
+		if errors.As(err, &se) {
+			st.CloseRead(uint64(se.Code))
+			st.Reset(uint64(se.Code))
+			return
+		}
+		sc.fail(err)
+		return
+	}
+
+	w := response.NewFramedWriterSize(&requestStream{sc: sc, st: st}, sc.writeBufferSize())
+	req, err := request.NewRequest(rf.Method, rf.Target(), 3, 0, rf.Headers, body)
+	if err != nil {
+		// answered with a 400, as the other versions do
+		body := []byte("Error parsing request: " + err.Error())
+		w.WriteStatusLine(response.BadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		w.Finish()
+		return
+	}
+	req.Trailers = rf.Trailers
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	state := sc.conn.ConnectionState()
+	req.TLS = &state
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	sc.srv.Handler(w, req)
+	if err := w.Finish(); err != nil {
+		log.Printf("Error finishing response: %v", err)
+	}
+}
+
+// readRequest reads the frames of a request stream: HEADERS, any DATA,
+// and optional trailers.
+func (sc *serverConn) readRequest(st *quic.Stream) (*http2.RequestFields, []byte, error) {
+	br := bufio.NewReader(st)
+	var rf *http2.RequestFields
+	var body bytes.Buffer
+	trailers := false
+	for {
+		t, length, err := readFrameHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, streamError(st.ID(), ErrCodeRequestIncomplete, "%v", err)
+		}
+		switch {
+		case t == FrameHeaders:
+			if trailers {
+				return nil, nil, connError(ErrCodeFrameUnexpected, "HEADERS after trailers")
+			}
+			p, err := readPayload(br, length, maxFieldSectionSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields, err := sc.dec.Decode(p)
+			if errors.Is(err, qpack.ErrFieldSectionTooLarge) {
+				return nil, nil, streamError(st.ID(), ErrCodeExcessiveLoad, "%v", err)
+			}
+			if err != nil {
+				return nil, nil, connError(ErrCodeQPACKDecompression, "%v", err)
+			}
+			if rf != nil {
+				trailers = true
+				if rf.Trailers, err = http2.ParseTrailerFields(fields); err != nil {
+					return nil, nil, streamError(st.ID(), ErrCodeMessage, "%v", err)
+				}
+				continue
+			}
+			if rf, err = http2.ParseRequestFields(fields); err != nil {
+				return nil, nil, streamError(st.ID(), ErrCodeMessage, "%v", err)
+			}
+		case t == FrameData:
+			if rf == nil || trailers {
+				return nil, nil, connError(ErrCodeFrameUnexpected, "DATA outside a message body")
+			}
+			if n, err := io.CopyN(&body, br, int64(length)); err != nil || uint64(n) != length {
+				return nil, nil, streamError(st.ID(), ErrCodeRequestIncomplete, "truncated DATA")
+			}
+		case t == FrameCancelPush, t == FrameSettings, t == FrameGoAway, t == FrameMaxPushID,
+			t == FramePushPromise, reservedHTTP2Frame(t):
+			return nil, nil, connError(ErrCodeFrameUnexpected, "%s on a request stream", t)
+		default:
+			if _, err := br.Discard(int(length)); err != nil {
+				return nil, nil, streamError(st.ID(), ErrCodeRequestIncomplete, "truncated frame")
+			}
+		}
+	}
+	if rf == nil {
+		return nil, nil, streamError(st.ID(), ErrCodeRequestIncomplete, "no HEADERS")
+	}
+	if rf.ContentLength >= 0 && int64(body.Len()) != rf.ContentLength {
+		return nil, nil, streamError(st.ID(), ErrCodeMessage, "body of %d bytes, Content-Length %d", body.Len(), rf.ContentLength)
+	}
+	return rf, body.Bytes(), nil
+}
+
+func (sc *serverConn) writeBufferSize() int {
+	if sc.srv.WriteBufferSize > 0 {
+		return sc.srv.WriteBufferSize
+	}
+	return response.DefaultBufferSize
+}
+
+// requestStream is the response.Framer of one request.
+type requestStream struct {
+	sc    *serverConn
+	st    *quic.Stream
+	ended bool
+}
+
+// WriteHeaders sends the status and header fields in a HEADERS frame,
+// leaving out fields that only make sense in HTTP/1.x.
+func (rs *requestStream) WriteHeaders(statusCode response.StatusCode, h *headers.Headers) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	return rs.writeFields(http2.AppendResponseFields(fields, h))
+}
+
+func (rs *requestStream) writeFields(fields []hpack.HeaderField) error {
+	_, err := rs.st.Write(AppendFrame(nil, FrameHeaders, rs.sc.enc.AppendFields(nil, fields)))
+	return err
+}
+
+// Write sends p in a DATA frame.
+func (rs *requestStream) Write(p []byte) (int, error) {
+	if _, err := rs.st.Write(appendFrameHeader(nil, FrameData, len(p))); err != nil {
+		return 0, err
+	}
+	return rs.st.Write(p)
+}
+
+// WriteTrailers sends the trailer fields in a HEADERS frame and ends
+// the stream.
+func (rs *requestStream) WriteTrailers(h *headers.Headers) error {
+	if err := rs.writeFields(http2.AppendResponseFields(nil, h)); err != nil {
+		return err
+	}
+	rs.ended = true
+	return rs.st.Close()
+}
+
+// Flush does nothing; QUIC sends stream data as soon as it can.
+func (rs *requestStream) Flush() error {
+	return nil
+}
+
+// Close ends the stream, unless trailers already did.
+func (rs *requestStream) Close() error {
+	if rs.ended {
+		return nil
+	}
+	rs.ended = true
+	return rs.st.Close()
+}
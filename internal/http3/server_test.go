@@ -0,0 +1,322 @@
+package http3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/qpack"
+	"httpfromtcp/internal/quic"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// testTLSConfigs returns matching server and client configs for a
+// self-signed certificate for 127.0.0.1, offering h3.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{NextProto},
+	}
+	client = &tls.Config{RootCAs: pool, NextProtos: []string{NextProto}}
+	return server, client
+}
+
+// echo replies with the method, path, host and body, and a trailer.
+func echo(w *response.Writer, req *request.Request) {
+	body := fmt.Sprintf("%s %s %s host=%s body=%s",
+		req.RequestLine.Method, req.URL.Path, req.RequestLine.HttpVersion, req.Host(), req.Body)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte(body))
+	w.WriteChunkedBodyDone()
+	tr := headers.NewHeaders()
+	tr.Set("X-Done", "yes")
+	w.WriteTrailers(tr)
+}
+
+// serve starts srv on a loopback QUIC listener and dials it with a
+// minimal HTTP/3 client.
+func serve(t *testing.T, srv *Server) *testClient {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l, err := quic.Listen("127.0.0.1:0", serverTLS, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go srv.Serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.Dial(ctx, l.Addr().String(), clientTLS, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	control, err := conn.OpenUniStream()
+	require.NoError(t, err)
+	_, err = control.Write(AppendSettings([]byte{StreamControl}, nil))
+	require.NoError(t, err)
+	return &testClient{t: t, conn: conn, addr: l.Addr().String()}
+}
+
+type testClient struct {
+	t    *testing.T
+	conn *quic.Conn
+	addr string
+}
+
+type testResponse struct {
+	fields   map[string]string
+	body     string
+	trailers map[string]string
+}
+
+func fieldMap(fs []qpack.HeaderField) map[string]string {
+	m := map[string]string{}
+	for _, f := range fs {
+		m[f.Name] = f.Value
+	}
+	return m
+}
+
+// send writes the given frames on a new request stream and ends it.
+func (c *testClient) send(frames ...[]byte) *quic.Stream {
+	st, err := c.conn.OpenStream()
+	require.NoError(c.t, err)
+	for _, f := range frames {
+		_, err := st.Write(f)
+		require.NoError(c.t, err)
+	}
+	require.NoError(c.t, st.Close())
+	return st
+}
+
+func headersFrame(fields ...string) []byte {
+	var fs []qpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		fs = append(fs, qpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return AppendFrame(nil, FrameHeaders, qpack.NewEncoder().AppendFields(nil, fs))
+}
+
+// readResponse reads a response's frames to the end of the stream.
+func (c *testClient) readResponse(st *quic.Stream) (testResponse, error) {
+	br := bufio.NewReader(st)
+	var resp testResponse
+	var body strings.Builder
+	for {
+		t, length, err := readFrameHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return resp, err
+		}
+		p, err := readPayload(br, length, 1<<20)
+		if err != nil {
+			return resp, err
+		}
+		switch t {
+		case FrameHeaders:
+			fs, err := qpack.NewDecoder().Decode(p)
+			require.NoError(c.t, err)
+			if resp.fields == nil {
+				resp.fields = fieldMap(fs)
+			} else {
+				resp.trailers = fieldMap(fs)
+			}
+		case FrameData:
+			body.Write(p)
+		}
+	}
+	resp.body = body.String()
+	return resp, nil
+}
+
+func (c *testClient) get(path string) testResponse {
+	st := c.send(headersFrame(":method", "GET", ":scheme", "https", ":authority", c.addr, ":path", path))
+	resp, err := c.readResponse(st)
+	require.NoError(c.t, err)
+	return resp
+}
+
+func TestServer_Requests(t *testing.T) {
+	c := serve(t, &Server{Handler: echo})
+
+	// Test: GET gets its headers, body and trailers
+	resp := c.get("/hello")
+	assert.Equal(t, "200", resp.fields[":status"])
+	assert.Equal(t, "text/plain", resp.fields["content-type"])
+	assert.Equal(t, "GET /hello 3.0 host="+c.addr+" body=", resp.body)
+	assert.Equal(t, map[string]string{"x-done": "yes"}, resp.trailers)
+
+	// Test: a POST body split over DATA frames, with an unknown frame
+	// type in between
+	st := c.send(
+		headersFrame(":method", "POST", ":scheme", "https", ":authority", c.addr, ":path", "/up", "content-length", "6"),
+		AppendFrame(nil, FrameData, []byte("abc")),
+		AppendFrame(nil, 0x21, []byte("grease")),
+		AppendFrame(nil, FrameData, []byte("def")),
+	)
+	resp, err := c.readResponse(st)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /up 3.0 host="+c.addr+" body=abcdef", resp.body)
+
+	// Test: HEAD leaves out the body
+	st = c.send(headersFrame(":method", "HEAD", ":scheme", "https", ":authority", c.addr, ":path", "/"))
+	resp, err = c.readResponse(st)
+	require.NoError(t, err)
+	assert.Equal(t, "200", resp.fields[":status"])
+	assert.Empty(t, resp.body)
+
+	// Test: a Host that doesn't match :authority is malformed
+	st = c.send(headersFrame(":method", "GET", ":scheme", "https", ":authority", c.addr, ":path", "/", "host", "other"))
+	_, err = c.readResponse(st)
+	var se *quic.StreamError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, uint64(ErrCodeMessage), se.Code)
+
+	// Test: a body that doesn't match Content-Length is malformed
+	st = c.send(
+		headersFrame(":method", "POST", ":scheme", "https", ":authority", c.addr, ":path", "/", "content-length", "10"),
+		AppendFrame(nil, FrameData, []byte("abc")),
+	)
+	_, err = c.readResponse(st)
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, uint64(ErrCodeMessage), se.Code)
+
+	// Test: cookie crumbs that decode to more than the advertised
+	// field section size end the stream
+	section := qpack.NewEncoder().AppendFields(nil, []qpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"}, {Name: ":path", Value: "/"},
+	})
+	section = append(section, bytes.Repeat([]byte{0xc5}, 30000)...)
+	st = c.send(AppendFrame(nil, FrameHeaders, section))
+	_, err = c.readResponse(st)
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, uint64(ErrCodeExcessiveLoad), se.Code)
+
+	// Test: a bad request-target gets a 400
+	resp = c.get("no-slash")
+	assert.Equal(t, "400", resp.fields[":status"])
+
+	// Test: the connection is still usable after all of that
+	assert.Equal(t, "200", c.get("/again").fields[":status"])
+}
+
+func TestServer_ConnectionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   ErrCode
+	}{
+		{
+			name:   "DATA before HEADERS",
+			frames: [][]byte{AppendFrame(nil, FrameData, []byte("x"))},
+			code:   ErrCodeFrameUnexpected,
+		},
+		{
+			name:   "SETTINGS on a request stream",
+			frames: [][]byte{AppendSettings(nil, nil)},
+			code:   ErrCodeFrameUnexpected,
+		},
+		{
+			name:   "HTTP/2 frame type",
+			frames: [][]byte{AppendFrame(nil, 0x8, nil)},
+			code:   ErrCodeFrameUnexpected,
+		},
+		{
+			name:   "dynamic table reference",
+			frames: [][]byte{AppendFrame(nil, FrameHeaders, []byte{0x02, 0x00, 0x80})},
+			code:   ErrCodeQPACKDecompression,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serve(t, &Server{Handler: echo})
+			c.send(tt.frames...)
+			select {
+			case <-c.conn.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection not closed")
+			}
+			var appErr *quic.ApplicationError
+			require.ErrorAs(t, c.conn.Err(), &appErr)
+			assert.Equal(t, uint64(tt.code), appErr.Code)
+		})
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	srv := &Server{Handler: echo}
+	c := serve(t, srv)
+	require.Equal(t, "200", c.get("/").fields[":status"])
+
+	// Test: the server's control stream starts with SETTINGS, then a
+	// GOAWAY naming the first stream it won't serve
+	control, err := c.conn.AcceptUniStream(context.Background())
+	require.NoError(t, err)
+	br := bufio.NewReader(control)
+	typ, err := ReadVarint(br)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(StreamControl), typ)
+	ft, length, err := readFrameHeader(br)
+	require.NoError(t, err)
+	assert.Equal(t, FrameSettings, ft)
+	_, err = readPayload(br, length, 1<<10)
+	require.NoError(t, err)
+
+	srv.Shutdown()
+	ft, length, err = readFrameHeader(br)
+	require.NoError(t, err)
+	assert.Equal(t, FrameGoAway, ft)
+	p, err := readPayload(br, length, 8)
+	require.NoError(t, err)
+	id, _ := quic.ReadVarint(p)
+	assert.Equal(t, uint64(4), id)
+
+	// Test: with no request open the connection closes cleanly
+	select {
+	case <-c.conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	var appErr *quic.ApplicationError
+	require.ErrorAs(t, c.conn.Err(), &appErr)
+	assert.Equal(t, uint64(ErrCodeNo), appErr.Code)
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// AccessLog logs one line per request once its response has finished:
+// method, target, status, body bytes, duration and request ID if any.
+func AccessLog(logger *log.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.OnFinish(func() {
+				logger.Printf("%s %s %d %d %s %s",
+					req.RequestLine.Method,
+					req.RequestLine.RequestTarget,
+					w.StatusCode(),
+					w.BytesWritten(),
+					time.Since(start),
+					req.Headers.Get(RequestIDHeader),
+				)
+			})
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"errors"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// BodyLimit rejects requests whose body is larger than limit bytes with
+// 413. A body deferred behind 100-continue is read here, under the
+// limit, so a client declaring too large a Content-Length is turned
+// away without ever sending its body, and a chunked one as soon as its
+// chunks go past the limit. A body that was read with the request can
+// only be checked afterwards; Config.MaxBodyBytes on the server caps
+// those as they are parsed.
+func BodyLimit(limit int64) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.ExpectsContinue() {
+				req.SetMaxBodySize(limit)
+				if _, err := req.ReadBody(); err != nil {
+					if errors.Is(err, request.ErrBodyTooLarge) {
+						response.WriteStatus(w, response.ContentTooLarge, nil)
+					} else {
+						response.WriteStatus(w, response.BadRequest, nil)
+					}
+					return
+				}
+			}
+			if int64(len(req.Body)) > limit {
+				response.WriteStatus(w, response.ContentTooLarge, nil)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
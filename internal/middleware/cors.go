@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to make requests; "*"
+	// allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods is sent in preflight responses. It defaults to
+	// GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers allowed beyond the
+	// CORS-safelisted ones.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers scripts may read.
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long a preflight response may be cached.
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests from allowed origins with 204, and adds
+// the Access-Control-* headers to every other response for them.
+// Requests from other origins are passed through untouched, which
+// browsers treat as a refusal.
+func CORS(opts CORSOptions) server.Middleware {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			origin := req.Headers.Get("Origin")
+			if origin == "" || !opts.allowsOrigin(origin) {
+				next(w, req)
+				return
+			}
+
+			if req.RequestLine.Method == "OPTIONS" && req.Headers.Has("Access-Control-Request-Method") {
+				h := response.GetDefaultHeaders(0)
+				h.Remove("Content-Length")
+				h.Remove("Content-Type")
+				opts.setOrigin(h, origin)
+				h.Set("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+				if len(opts.AllowedHeaders) > 0 {
+					h.Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+				}
+				if opts.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(opts.MaxAge.Seconds())))
+				}
+				w.WriteStatusLine(response.NoContent)
+				w.WriteHeaders(h)
+				return
+			}
+
+			w.Intercept(response.Interceptor{
+				Headers: func(next response.HeadersFunc, h *headers.Headers) error {
+					h = h.Clone()
+					opts.setOrigin(h, origin)
+					if len(opts.ExposedHeaders) > 0 {
+						h.Override("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+					}
+					return next(h)
+				},
+			})
+			next(w, req)
+		}
+	}
+}
+
+func (opts CORSOptions) allowsOrigin(origin string) bool {
+	return slices.Contains(opts.AllowedOrigins, "*") || slices.Contains(opts.AllowedOrigins, origin)
+}
+
+// setOrigin allows origin on h. Credentialed responses can't use the
+// "*" wildcard, so the origin is echoed back for them.
+func (opts CORSOptions) setOrigin(h *headers.Headers, origin string) {
+	if slices.Contains(opts.AllowedOrigins, "*") && !opts.AllowCredentials {
+		h.Override("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Override("Access-Control-Allow-Origin", origin)
+		h.Set("Vary", "Origin")
+	}
+	if opts.AllowCredentials {
+		h.Override("Access-Control-Allow-Credentials", "true")
+	}
+}
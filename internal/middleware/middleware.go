@@ -0,0 +1,4 @@
+// Package middleware provides server.Middleware for concerns shared by
+// every handler: panic recovery, request IDs, access logs, timeouts,
+// body limits and CORS.
+package middleware
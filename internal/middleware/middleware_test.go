@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+// serve runs req through h the way the server does and returns the raw
+// response.
+func serve(t *testing.T, h server.Handler, req *request.Request) string {
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	h(w, req)
+	w.Finish()
+	return buf.String()
+}
+
+func ok(body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name)
+				next(w, req)
+			}
+		}
+	}
+	h := server.Chain(tag("a"), tag("b"), tag("c"))(ok("hi"))
+	resp := serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, []string{"a", "b", "c"}, calls)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhi"))
+}
+
+func TestRecovery(t *testing.T) {
+	boom := func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	}
+	resp := serve(t, Recovery()(boom), newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+
+	// Test: A response already under way is left alone
+	late := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		panic("boom")
+	}
+	resp = serve(t, Recovery()(late), newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", resp)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID()(func(w *response.Writer, req *request.Request) {
+		seen = req.Headers.Get(RequestIDHeader)
+		ok("hi")(w, req)
+	})
+
+	// Test: A new ID is generated
+	resp := serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Len(t, seen, 32)
+	assert.Contains(t, resp, "x-request-id: "+seen+"\r\n")
+
+	// Test: The client's ID is kept
+	resp = serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: abc-123\r\n\r\n"))
+	assert.Equal(t, "abc-123", seen)
+	assert.Contains(t, resp, "x-request-id: abc-123\r\n")
+}
+
+func TestAccessLog(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := log.New(out, "", 0)
+	h := server.Chain(RequestID(), AccessLog(logger))(func(w *response.Writer, req *request.Request) {
+		response.NewAutoWriter(w, response.Created, nil).Write([]byte("made it"))
+	})
+	serve(t, h, newRequest(t, "POST /things HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: r1\r\n\r\n"))
+	line := out.String()
+	assert.True(t, strings.HasPrefix(line, "POST /things 201 7 "), line)
+	assert.True(t, strings.HasSuffix(line, " r1\n"), line)
+}
+
+func TestTimeout(t *testing.T) {
+	// Test: Fast handler's response is passed through
+	h := Timeout(time.Second)(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		hs := headers.NewHeaders()
+		hs.Set("Transfer-Encoding", "chunked")
+		hs.Set("Trailer", "X-Done")
+		w.WriteHeaders(hs)
+		w.WriteChunkedBody([]byte("hello"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Done", "yes")
+		w.WriteTrailers(trailers)
+	})
+	resp := serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"transfer-encoding: chunked\r\ntrailer: X-Done\r\n\r\n"+
+		"5\r\nhello\r\n0\r\nx-done: yes\r\n\r\n", resp)
+
+	// Test: Slow handler gets a 503 and its late writes fail
+	release := make(chan struct{})
+	lateErr := make(chan error, 1)
+	h = Timeout(10 * time.Millisecond)(func(w *response.Writer, req *request.Request) {
+		<-release
+		lateErr <- w.WriteStatusLine(response.OK)
+	})
+	resp = serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 503 Service Unavailable\r\n"), resp)
+	assert.Contains(t, resp, "connection: close\r\n")
+	close(release)
+	assert.ErrorIs(t, <-lateErr, ErrHandlerTimeout)
+
+	// Test: Panics reach the caller
+	h = Recovery()(Timeout(time.Second)(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	}))
+	resp = serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+}
+
+func TestBodyLimit(t *testing.T) {
+	h := BodyLimit(5)(ok("accepted"))
+
+	resp := serve(t, h, newRequest(t, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+
+	resp = serve(t, h, newRequest(t, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\nhello!"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 413 Content Too Large\r\n"), resp)
+
+	// Test: The client is never told to continue
+	req := newRequest(t, "PUT / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n")
+	continued := false
+	req.SetContinueHook(func() error {
+		continued = true
+		return nil
+	})
+	resp = serve(t, h, req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 413 Content Too Large\r\n"), resp)
+	assert.False(t, continued)
+
+	// Test: A deferred chunked body is turned away at the chunk that
+	// goes over the limit
+	req = newRequest(t, "PUT / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"4\r\nhell\r\n4\r\no wo\r\n0\r\n\r\n")
+	resp = serve(t, h, req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 413 Content Too Large\r\n"), resp)
+
+	// Test: A deferred body within the limit reaches the handler
+	req = newRequest(t, "PUT / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello")
+	resp = serve(t, h, req)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Equal(t, "hello", string(req.Body))
+}
+
+func TestCORS(t *testing.T) {
+	h := CORS(CORSOptions{
+		AllowedOrigins: []string{"https://app.example"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type"},
+		ExposedHeaders: []string{"X-Request-Id"},
+		MaxAge:         10 * time.Minute,
+	})(ok("hi"))
+
+	// Test: Preflight
+	resp := serve(t, h, newRequest(t, "OPTIONS /things HTTP/1.1\r\nHost: localhost\r\n"+
+		"Origin: https://app.example\r\n"+
+		"Access-Control-Request-Method: PUT\r\n\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 204 No Content\r\n"), resp)
+	assert.Contains(t, resp, "access-control-allow-origin: https://app.example\r\n")
+	assert.Contains(t, resp, "access-control-allow-methods: GET, PUT\r\n")
+	assert.Contains(t, resp, "access-control-allow-headers: Content-Type\r\n")
+	assert.Contains(t, resp, "access-control-max-age: 600\r\n")
+	assert.NotContains(t, resp, "content-length")
+
+	// Test: Simple request
+	resp = serve(t, h, newRequest(t, "GET /things HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example\r\n\r\n"))
+	assert.Contains(t, resp, "access-control-allow-origin: https://app.example\r\n")
+	assert.Contains(t, resp, "vary: Origin\r\n")
+	assert.Contains(t, resp, "access-control-expose-headers: X-Request-Id\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhi"))
+
+	// Test: Other origins get nothing
+	resp = serve(t, h, newRequest(t, "GET /things HTTP/1.1\r\nHost: localhost\r\nOrigin: https://evil.example\r\n\r\n"))
+	assert.NotContains(t, resp, "access-control")
+
+	// Test: Wildcard without credentials
+	h = CORS(CORSOptions{AllowedOrigins: []string{"*"}})(ok("hi"))
+	resp = serve(t, h, newRequest(t, "GET / HTTP/1.1\r\nHost: localhost\r\nOrigin: https://any.example\r\n\r\n"))
+	assert.Contains(t, resp, "access-control-allow-origin: *\r\n")
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"log"
+	"runtime/debug"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Recovery turns a panic in the handler into a 500. If the response had
+// already started there is nothing sensible left to send, so the panic
+// is only logged and the connection closes as usual.
+func Recovery() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, rec, debug.Stack())
+				if w.StatusCode() == 0 {
+					response.WriteStatus(w, response.InternalServerError, nil)
+				}
+			}()
+			next(w, req)
+		}
+	}
+}
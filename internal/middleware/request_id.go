@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen caps how much of a client-supplied ID is trusted.
+const maxRequestIDLen = 128
+
+// RequestID gives every request an ID, reusing the client's X-Request-Id
+// if it sent a reasonable one. The ID is set on the request headers for
+// the handler and echoed in the response headers.
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id := req.Headers.Get(RequestIDHeader)
+			if id == "" || len(id) > maxRequestIDLen || !headers.ValidValue(id) {
+				id = newRequestID()
+				req.Headers.Override(RequestIDHeader, id)
+			}
+			w.Intercept(response.Interceptor{
+				Headers: func(next response.HeadersFunc, h *headers.Headers) error {
+					h = h.Clone()
+					h.Override(RequestIDHeader, id)
+					return next(h)
+				},
+			})
+			next(w, req)
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// ErrHandlerTimeout is returned to a handler that tries to write after
+// the Timeout middleware has given up on it.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// Timeout answers with 503 if the handler hasn't finished within d.
+// Handlers can't be stopped from outside, so the handler runs on its own
+// goroutine against a recording writer, and its response is only copied
+// to the connection if it finishes in time. That means the response is
+// buffered in full and Flush has no effect inside the handler. A panic in
+// the handler is re-raised on the caller's goroutine. The 503 closes the
+// connection, as the request may still be in use.
+func Timeout(d time.Duration) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			rec := newRecorder()
+			// the handler may still send 100 Continue on the real
+			// writer, so that has to stop once the 503 goes out
+			req.SetContinueHook(func() error {
+				rec.mu.Lock()
+				defer rec.mu.Unlock()
+				if rec.stopped {
+					return ErrHandlerTimeout
+				}
+				return w.WriteContinue()
+			})
+
+			done := make(chan any, 1)
+			go func() {
+				defer func() { done <- recover() }()
+				next(rec.w, req)
+				rec.w.Finish()
+			}()
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case p := <-done:
+				if p != nil {
+					panic(p)
+				}
+				rec.replay(w)
+			case <-timer.C:
+				rec.mu.Lock()
+				rec.stopped = true
+				// the handler may still be reading the body, so the
+				// server mustn't look at req to find the next request
+				h := headers.NewHeaders()
+				h.Set("Connection", "close")
+				response.WriteStatus(w, response.ServiceUnavailable, h)
+				rec.mu.Unlock()
+			}
+		}
+	}
+}
+
+// recorder captures each phase a handler writes so it can be replayed
+// onto another writer later. The recording writer runs its full state
+// machine against io.Discard, so handlers see the same errors they would
+// on a real connection.
+type recorder struct {
+	w       *response.Writer
+	mu      sync.Mutex
+	stopped bool
+	ops     []func(w *response.Writer) error
+}
+
+func newRecorder() *recorder {
+	rec := &recorder{w: response.NewWriter(io.Discard)}
+	rec.w.Intercept(response.Interceptor{
+		StatusLine: func(next response.StatusLineFunc, statusCode response.StatusCode, reasonPhrase string) error {
+			return rec.record(next(statusCode, reasonPhrase), func(w *response.Writer) error {
+				return w.WriteStatusLineWithReason(statusCode, reasonPhrase)
+			})
+		},
+		Headers: func(next response.HeadersFunc, h *headers.Headers) error {
+			h = h.Clone()
+			return rec.record(next(h), func(w *response.Writer) error {
+				return w.WriteHeaders(h)
+			})
+		},
+		Body: func(next response.BodyFunc, p []byte) (int, error) {
+			n, err := next(p)
+			p = append([]byte(nil), p...)
+			return n, rec.record(err, func(w *response.Writer) error {
+				_, err := w.Write(p)
+				return err
+			})
+		},
+		Trailers: func(next response.HeadersFunc, h *headers.Headers) error {
+			h = h.Clone()
+			return rec.record(next(h), func(w *response.Writer) error {
+				if _, err := w.WriteChunkedBodyDone(); err != nil {
+					return err
+				}
+				return w.WriteTrailers(h)
+			})
+		},
+	})
+	return rec
+}
+
+// record keeps op if the write it stands for succeeded, and turns the
+// write into an error once the recorder has been stopped.
+func (rec *recorder) record(err error, op func(w *response.Writer) error) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.stopped {
+		return ErrHandlerTimeout
+	}
+	if err == nil {
+		rec.ops = append(rec.ops, op)
+	}
+	return err
+}
+
+func (rec *recorder) replay(w *response.Writer) error {
+	for _, op := range rec.ops {
+		if err := op(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"httpfromtcp/internal/request"
+)
+
+// Balancer chooses the backend of a pool that serves a request.
+type Balancer interface {
+	// Pick returns one of backends, which are the pool's available
+	// backends in pool order and never empty.
+	Pick(backends []*Backend, req *request.Request) *Backend
+}
+
+// RoundRobin returns a balancer that sends requests to each backend in
+// turn, ignoring their weights. Backends in slow start get their share
+// of turns.
+func RoundRobin() Balancer {
+	return &smoothWeighted{current: make(map[*Backend]float64)}
+}
+
+// Weighted returns a balancer that spreads requests in proportion to
+// the backends' weights, interleaving them rather than sending runs to
+// the heaviest backend: weights 5, 1 and 1 give a a b a c a a.
+func Weighted() Balancer {
+	return &smoothWeighted{weighted: true, current: make(map[*Backend]float64)}
+}
+
+// smoothWeighted is the smooth weighted round-robin of nginx: every
+// pick, each backend's current weight grows by its weight, and the
+// backend with the highest current weight is picked and set back by the
+// total.
+type smoothWeighted struct {
+	weighted bool
+
+	mu      sync.Mutex
+	current map[*Backend]float64
+}
+
+func (s *smoothWeighted) Pick(backends []*Backend, _ *request.Request) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *Backend
+	total := 0.0
+	for _, b := range backends {
+		w := b.SlowStartFactor()
+		if s.weighted {
+			w *= float64(b.weight)
+		}
+		s.current[b] += w
+		total += w
+		if best == nil || s.current[b] > s.current[best] {
+			best = b
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// LeastConnections returns a balancer that sends each request to the
+// backend serving the fewest requests for its weight, so slower
+// backends, which hold on to requests longer, get fewer of them. Ties
+// go to each tied backend in turn.
+func LeastConnections() Balancer {
+	return &leastConnections{}
+}
+
+type leastConnections struct {
+	next atomic.Uint64
+}
+
+func (lc *leastConnections) Pick(backends []*Backend, _ *request.Request) *Backend {
+	start := int(lc.next.Add(1) % uint64(len(backends)))
+	var best *Backend
+	bestLoad := 0.0
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		// counting the request being placed makes a backend in slow
+		// start look busier even when idle
+		load := float64(b.ActiveRequests()+1) / (float64(b.weight) * b.SlowStartFactor())
+		if best == nil || load < bestLoad {
+			best, bestLoad = b, load
+		}
+	}
+	return best
+}
+
+// HashHeader returns a balancer that sends requests with the same value
+// of the named header to the same backend, with consistent hashing so
+// that a backend leaving or joining the pool only moves the keys that
+// were or will be its own. Requests without the header are balanced
+// round-robin.
+func HashHeader(name string) Balancer {
+	return newConsistentHash(func(req *request.Request) string {
+		return req.Headers.Get(name)
+	})
+}
+
+// HashCookie is HashHeader for the value of the named cookie, for
+// sticky sessions.
+func HashCookie(name string) Balancer {
+	return newConsistentHash(func(req *request.Request) string {
+		return cookieValue(req, name)
+	})
+}
+
+// pointsPerWeight is how many points of the ring a backend gets for
+// each unit of weight; more spreads keys more evenly.
+const pointsPerWeight = 100
+
+// maxRings bounds the rings kept for the sets of available backends
+// seen, which is usually the full pool and a few partial ones.
+const maxRings = 16
+
+type consistentHash struct {
+	key      func(req *request.Request) string
+	fallback Balancer
+
+	mu    sync.Mutex
+	rings map[string]*ring
+}
+
+func newConsistentHash(key func(req *request.Request) string) *consistentHash {
+	return &consistentHash{key: key, fallback: RoundRobin(), rings: make(map[string]*ring)}
+}
+
+func (ch *consistentHash) Pick(backends []*Backend, req *request.Request) *Backend {
+	key := ch.key(req)
+	if key == "" {
+		return ch.fallback.Pick(backends, req)
+	}
+	return ch.ring(backends).lookup(hashString(key))
+}
+
+// ring returns the ring for a set of backends. A backend's points are
+// the same in every ring, so dropping a backend only moves its keys.
+func (ch *consistentHash) ring(backends []*Backend) *ring {
+	var id strings.Builder
+	for _, b := range backends {
+		id.WriteString(b.url.String())
+		id.WriteByte(' ')
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if r, ok := ch.rings[id.String()]; ok {
+		return r
+	}
+	if len(ch.rings) >= maxRings {
+		clear(ch.rings)
+	}
+	r := newRing(backends)
+	ch.rings[id.String()] = r
+	return r
+}
+
+type ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+func newRing(backends []*Backend) *ring {
+	r := &ring{}
+	for _, b := range backends {
+		name := b.url.String()
+		for i := range b.weight * pointsPerWeight {
+			r.points = append(r.points, ringPoint{hashString(name + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return r
+}
+
+// lookup returns the backend of the first point at or after h, going
+// round the ring.
+func (r *ring) lookup(h uint64) *Backend {
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].backend
+}
+
+// hashString is 64-bit FNV-1a with a final mix, as FNV alone leaves
+// similar strings like the point names close together.
+func hashString(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// cookieValue returns the value of the named cookie, or "" if the
+// request doesn't have it.
+func cookieValue(req *request.Request, name string) string {
+	for _, line := range req.Headers.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && k == name {
+				return strings.Trim(v, `"`)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import "time"
+
+// Defaults for the CircuitBreaker fields left zero.
+const (
+	DefaultBreakerFailureRatio     = 0.5
+	DefaultBreakerMinRequests      = 10
+	DefaultBreakerWindow           = 10 * time.Second
+	DefaultBreakerOpenTimeout      = 30 * time.Second
+	DefaultBreakerHalfOpenRequests = 3
+)
+
+// CircuitBreaker configures the circuit breaker each backend of a pool
+// has. The breaker starts closed, letting requests through, and counts
+// their outcomes over a Window: once at least MinRequests have been
+// made in it and FailureRatio of them failed, it opens, and the backend
+// gets no requests for OpenTimeout. Then it is half-open: up to
+// HalfOpenRequests trial requests go through, and the breaker closes if
+// they all succeed, and opens again as soon as one fails. Failures are
+// what they are to outlier detection: connection errors and 5xx
+// responses.
+type CircuitBreaker struct {
+	// Disabled turns the breakers off.
+	Disabled         bool
+	FailureRatio     float64
+	MinRequests      int
+	Window           time.Duration
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.FailureRatio == 0 {
+		cb.FailureRatio = DefaultBreakerFailureRatio
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = DefaultBreakerMinRequests
+	}
+	if cb.Window == 0 {
+		cb.Window = DefaultBreakerWindow
+	}
+	if cb.OpenTimeout == 0 {
+		cb.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = DefaultBreakerHalfOpenRequests
+	}
+	return cb
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker is the state of one backend's circuit breaker. Its methods
+// are called with the pool's lock held.
+type breaker struct {
+	state breakerState
+	// windowStart, requests and failures count outcomes while closed
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// closedAt is when the breaker last closed after being open, for
+	// slow start
+	closedAt time.Time
+	// trials and successes count requests while half-open
+	trials    int
+	successes int
+	opens     int64
+}
+
+// stateAt returns the breaker's state, moving an open breaker whose
+// timeout has passed to half-open.
+func (br *breaker) stateAt(config CircuitBreaker, now time.Time) breakerState {
+	if br.state == breakerOpen && now.Sub(br.openedAt) >= config.OpenTimeout {
+		br.state = breakerHalfOpen
+		br.trials, br.successes = 0, 0
+	}
+	return br.state
+}
+
+// allows reports whether the breaker lets a request through.
+func (br *breaker) allows(config CircuitBreaker, now time.Time) bool {
+	if config.Disabled {
+		return true
+	}
+	switch br.stateAt(config, now) {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return br.trials < config.HalfOpenRequests
+	}
+	return true
+}
+
+// admit lets a request through if the breaker allows it, counting it as
+// a trial if the breaker is half-open.
+func (br *breaker) admit(config CircuitBreaker, now time.Time) bool {
+	if !br.allows(config, now) {
+		return false
+	}
+	if br.state == breakerHalfOpen {
+		br.trials++
+	}
+	return true
+}
+
+// record counts the outcome of a request the breaker let through, and
+// reports whether that opened it.
+func (br *breaker) record(config CircuitBreaker, now time.Time, failed bool) bool {
+	if config.Disabled {
+		return false
+	}
+	switch br.stateAt(config, now) {
+	case breakerHalfOpen:
+		if failed {
+			br.open(now)
+			return true
+		}
+		br.successes++
+		if br.successes >= config.HalfOpenRequests {
+			br.state = breakerClosed
+			br.closedAt = now
+			br.windowStart, br.requests, br.failures = now, 0, 0
+		}
+	case breakerClosed:
+		if now.Sub(br.windowStart) >= config.Window {
+			br.windowStart, br.requests, br.failures = now, 0, 0
+		}
+		br.requests++
+		if failed {
+			br.failures++
+		}
+		if br.requests >= config.MinRequests && float64(br.failures) >= config.FailureRatio*float64(br.requests) {
+			br.open(now)
+			return true
+		}
+	}
+	// an open breaker is still told of requests it let through before
+	// it opened; they don't change anything
+	return false
+}
+
+func (br *breaker) open(now time.Time) {
+	br.state = breakerOpen
+	br.openedAt = now
+	br.opens++
+}
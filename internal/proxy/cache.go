@@ -0,0 +1,702 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// DefaultMaxEntryBytes is the largest body a Cache stores if its config
+// doesn't say.
+const DefaultMaxEntryBytes = 8 << 20
+
+// Heuristic freshness, RFC 9111 section 4.2.2: a response with a
+// Last-Modified and nothing more explicit stays fresh for a tenth of
+// the time since it was last modified, up to a day.
+const (
+	heuristicFraction = 10
+	maxHeuristic      = 24 * time.Hour
+)
+
+// cacheName is how a Cache identifies itself in Cache-Status.
+const cacheName = proxyName
+
+// CacheConfig configures a Cache.
+type CacheConfig struct {
+	// Store holds the cached responses. Defaults to a MemoryStore of
+	// DefaultMemoryStoreBytes.
+	Store Store
+	// MaxEntryBytes is the largest body stored; bigger responses are
+	// relayed without being stored. Defaults to DefaultMaxEntryBytes.
+	MaxEntryBytes int64
+}
+
+// Cache is a shared HTTP cache, RFC 9111, for the responses a Proxy
+// relays.
+//
+// Responses to GET requests are stored when Cache-Control, Expires or
+// their status allow it, and not if either side says no-store or the
+// response is private. They are kept per URL and Host, and separately
+// for each value of the request headers named in their Vary. A response
+// is fresh for its s-maxage, max-age, the time to its Expires, or, with
+// only a Last-Modified, a tenth of its age when it was received. While
+// fresh it answers GET and HEAD requests with an Age header, within the
+// limits of the request's own Cache-Control; a stale one is revalidated
+// upstream with If-None-Match and If-Modified-Since first, and freshened
+// if the upstream answers 304 Not Modified.
+//
+// Unless a response says must-revalidate, its stale-while-revalidate
+// lets it be served stale while it is revalidated in the background,
+// and its stale-if-error, or the request's, lets it be served stale if
+// the upstream fails. Requests that change a URL, successfully, remove
+// what is stored for it.
+//
+// Every response through the cache carries a Cache-Status, RFC 9211,
+// saying whether it was a hit and, if not, why it went upstream.
+type Cache struct {
+	config CacheConfig
+	now    func() time.Time
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+	background   sync.WaitGroup
+}
+
+// NewCache returns a Cache with config.
+func NewCache(config CacheConfig) *Cache {
+	if config.Store == nil {
+		config.Store = NewMemoryStore(0)
+	}
+	if config.MaxEntryBytes == 0 {
+		config.MaxEntryBytes = DefaultMaxEntryBytes
+	}
+	return &Cache{config: config, now: time.Now, revalidating: make(map[string]bool)}
+}
+
+// fetchFunc gets a response from upstream for the request being
+// served, with edit applied to the headers that go out.
+type fetchFunc func(edit func(h *headers.Headers)) (*Response, error)
+
+// serve answers req from the cache if it can, and with fetch otherwise.
+func (c *Cache) serve(w *response.Writer, req *request.Request, fetch fetchFunc) {
+	key := cacheKey(req)
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		resp, err := fetch(nil)
+		if err == nil && !isSafe(method) && resp.StatusCode < 400 {
+			c.config.Store.Delete(key)
+		}
+		if err == nil {
+			resp.Headers.Set("Cache-Status", cacheName+"; fwd=method")
+		}
+		respond(w, resp, err)
+		return
+	}
+	if req.Headers.Has("Range") {
+		// ranges aren't cached; the upstream answers them
+		c.forward(w, req, key, nil, fetch, "bypass")
+		return
+	}
+
+	reqCC := requestCacheControl(req.Headers)
+	entry, fwd := c.lookup(key, req)
+	now := c.now()
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			writeCacheStatus(w, response.GatewayTimeout, cacheName+"; fwd="+fwd)
+			return
+		}
+		c.forward(w, req, key, nil, fetch, fwd)
+		return
+	}
+	age, lifetime := entry.age(now), entry.lifetime()
+	respCC := parseCacheControl(entry.Headers.Values("Cache-Control"))
+	ttl := lifetime - age
+	if usable(reqCC, respCC, age, lifetime) {
+		c.write(w, req, entry, now, fmt.Sprintf("%s; hit; ttl=%d", cacheName, int(ttl/time.Second)))
+		return
+	}
+	if reqCC.has("only-if-cached") {
+		writeCacheStatus(w, response.GatewayTimeout, cacheName+"; fwd=stale")
+		return
+	}
+	if ttl <= 0 && !reqCC.has("no-cache") && !respCC.has("no-cache") && !mustRevalidate(respCC) {
+		if swr, ok := respCC.seconds("stale-while-revalidate"); ok && -ttl <= swr {
+			c.revalidateInBackground(req, key, entry, fetch)
+			c.write(w, req, entry, now, fmt.Sprintf("%s; hit; ttl=%d; detail=stale-while-revalidate", cacheName, int(ttl/time.Second)))
+			return
+		}
+	}
+	fwd = "stale"
+	if ttl > 0 {
+		fwd = "request"
+	}
+	c.forward(w, req, key, entry, fetch, fwd)
+}
+
+// forward gets a response from upstream and relays it, storing it if
+// it can be. With a stored entry, the request is made conditional on
+// its validators, and the entry is used if they still hold or, as its
+// stale-if-error allows, if the upstream fails.
+func (c *Cache) forward(w *response.Writer, req *request.Request, key string, entry *Entry, fetch fetchFunc, fwd string) {
+	var edit func(h *headers.Headers)
+	if entry != nil {
+		edit = conditional(entry)
+	}
+	requestTime := c.now()
+	resp, err := fetch(edit)
+	responseTime := c.now()
+	status := cacheName + "; fwd=" + fwd
+
+	if entry != nil && (err != nil || isServerError(resp.StatusCode)) && c.staleIfError(req, entry, responseTime) {
+		if err == nil {
+			status += "; fwd-status=" + strconv.Itoa(int(resp.StatusCode))
+			resp.Body.Close()
+		}
+		c.write(w, req, entry, responseTime, status+"; detail=stale-if-error")
+		return
+	}
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	status += "; fwd-status=" + strconv.Itoa(int(resp.StatusCode))
+	if edit != nil && resp.StatusCode == response.NotModified {
+		resp.Body.Close()
+		fresh := entry.freshen(resp, requestTime, responseTime)
+		c.store(key, req, fresh)
+		c.write(w, req, fresh, responseTime, status)
+		return
+	}
+
+	if !c.storable(req, resp) {
+		resp.Headers.Set("Cache-Status", status)
+		respond(w, resp, nil)
+		return
+	}
+	body := &captureBody{ReadCloser: resp.Body, max: c.config.MaxEntryBytes}
+	resp.Body = body
+	resp.Headers.Set("Cache-Status", status+"; stored")
+	defer resp.Body.Close()
+	if err := relay(w, resp); err != nil {
+		log.Printf("Error relaying response: %v", err)
+		return
+	}
+	if body.complete() {
+		c.store(key, req, newEntry(resp, body.buf.Bytes(), requestTime, responseTime))
+	}
+}
+
+// revalidateInBackground revalidates entry upstream, or fetches its
+// replacement, without holding up the response, unless that is already
+// being done for key.
+func (c *Cache) revalidateInBackground(req *request.Request, key string, entry *Entry, fetch fetchFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return
+	}
+	c.revalidating[key] = true
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		edit := conditional(entry)
+		requestTime := c.now()
+		resp, err := fetch(edit)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		responseTime := c.now()
+		switch {
+		case edit != nil && resp.StatusCode == response.NotModified:
+			c.store(key, req, entry.freshen(resp, requestTime, responseTime))
+		case c.storable(req, resp):
+			body, err := io.ReadAll(io.LimitReader(resp.Body, c.config.MaxEntryBytes+1))
+			if err == nil && int64(len(body)) <= c.config.MaxEntryBytes {
+				c.store(key, req, newEntry(resp, body, requestTime, responseTime))
+			}
+		}
+	}()
+}
+
+// write answers req with entry, or with 304 Not Modified if req is
+// conditional and the entry's validators match.
+func (c *Cache) write(w *response.Writer, req *request.Request, entry *Entry, now time.Time, status string) {
+	h := entry.Headers.Clone()
+	h.Override("Age", strconv.Itoa(int(entry.age(now)/time.Second)))
+	h.Set("Cache-Status", status)
+	resp := &Response{StatusCode: entry.StatusCode, Reason: entry.Reason, Headers: h}
+	switch {
+	case entry.StatusCode == response.OK && notModified(req, entry):
+		resp.StatusCode, resp.Reason = response.NotModified, ""
+	case entry.StatusCode != response.NoContent:
+		h.Override("Content-Length", strconv.Itoa(len(entry.Body)))
+		resp.ContentLength = int64(len(entry.Body))
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+	}
+	if resp.Body == nil {
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+	}
+	if err := relay(w, resp); err != nil {
+		log.Printf("Error writing cached response: %v", err)
+	}
+}
+
+// lookup returns the entry stored for req, or nil and why there isn't
+// one, as a Cache-Status fwd value.
+func (c *Cache) lookup(key string, req *request.Request) (*Entry, string) {
+	entry := c.config.Store.Get(key)
+	if entry == nil {
+		return nil, "uri-miss"
+	}
+	if entry.StatusCode == 0 {
+		entry = c.config.Store.Get(variantKey(key, entry.Vary, req))
+		if entry == nil {
+			return nil, "vary-miss"
+		}
+	}
+	return entry, ""
+}
+
+// store stores entry as the response to req, under a key of its own if
+// it varies on request headers.
+func (c *Cache) store(key string, req *request.Request, entry *Entry) {
+	var vary []string
+	for _, v := range entry.Headers.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	if len(vary) == 0 {
+		if old := c.config.Store.Get(key); old != nil && old.StatusCode == 0 {
+			c.config.Store.Delete(key)
+		}
+		c.config.Store.Put(key, entry)
+		return
+	}
+	slices.Sort(vary)
+	c.config.Store.Put(key, &Entry{Vary: vary, ResponseTime: entry.ResponseTime})
+	c.config.Store.Put(variantKey(key, vary, req), entry)
+}
+
+// storable reports whether resp, the response to req, may be stored,
+// RFC 9111 section 3.
+func (c *Cache) storable(req *request.Request, resp *Response) bool {
+	// partial responses and errors upstream aren't worth keeping
+	if req.RequestLine.Method != "GET" || !isFinalStatus(resp.StatusCode) ||
+		resp.StatusCode == response.PartialContent || resp.StatusCode == response.NotModified || isServerError(resp.StatusCode) {
+		return false
+	}
+	if resp.ContentLength > c.config.MaxEntryBytes || resp.Headers.Has("Trailer") {
+		return false
+	}
+	reqCC := requestCacheControl(req.Headers)
+	respCC := parseCacheControl(resp.Headers.Values("Cache-Control"))
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if req.Headers.Has("Authorization") && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	for _, v := range resp.Headers.Values("Vary") {
+		if strings.Contains(v, "*") {
+			return false
+		}
+	}
+	explicit := respCC.has("public") || respCC.has("max-age") || respCC.has("s-maxage") || resp.Headers.Has("Expires")
+	if !explicit && !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	// something has to make it worth keeping
+	return explicit || resp.Headers.Has("ETag") || resp.Headers.Has("Last-Modified")
+}
+
+// staleIfError reports whether entry may be served stale because the
+// upstream failed, as its stale-if-error or the request's allows.
+func (c *Cache) staleIfError(req *request.Request, entry *Entry, now time.Time) bool {
+	respCC := parseCacheControl(entry.Headers.Values("Cache-Control"))
+	if mustRevalidate(respCC) {
+		return false
+	}
+	staleness := entry.age(now) - entry.lifetime()
+	for _, cc := range []cacheControl{requestCacheControl(req.Headers), respCC} {
+		if d, ok := cc.seconds("stale-if-error"); ok && staleness <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeHandler removes stored responses: those for the request-target
+// in the path query parameter, with any query it has, for every Host,
+// or those for every request-target that starts with the prefix
+// parameter. Either is normalized as request-targets are, so any of the
+// forms of a URL purges it. It answers with JSON counting the entries
+// removed.
+func (c *Cache) PurgeHandler(w *response.Writer, req *request.Request) {
+	path, prefix := req.URL.Query.Get("path"), req.URL.Query.Get("prefix")
+	key, isPath := path, path != ""
+	if !isPath {
+		key = prefix
+	}
+	u, err := request.ParseRequestTarget("GET", key)
+	if err != nil || u.Form != request.OriginForm {
+		response.WriteStatus(w, response.BadRequest, nil)
+		return
+	}
+	key = targetKey(u)
+	if isPath {
+		key += " "
+	}
+	purged := c.config.Store.Delete(key)
+	body, err := json.Marshal(map[string]int{"purged": purged})
+	if err != nil {
+		response.WriteStatus(w, response.InternalServerError, nil)
+		return
+	}
+	body = append(body, '\n')
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Cache-Control", "no-store")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// cacheKey is the key the responses to req are stored under: its
+// request-target, so purges by path reach every Host, then its Host.
+// The newline ends it, so one key is never the start of another's
+// except for the keys of its variants.
+func cacheKey(req *request.Request) string {
+	return targetKey(req.URL) + " " + strings.ToLower(req.Host()) + "\n"
+}
+
+// targetKey is the request-target of u as it goes into a cache key: its
+// normalized path, escaped again as it is sent upstream, so every form
+// of a URL shares one entry, and its query.
+func targetKey(u *request.URL) string {
+	target := escapePath(u.Path)
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return target
+}
+
+// variantKey is the key of the response to req among those stored
+// under key that vary on the request headers named in vary.
+func variantKey(key string, vary []string, req *request.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		values := req.Headers.Values(name)
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, strings.Join(values, ", "))
+	}
+	return b.String()
+}
+
+// newEntry is the entry for resp, with body, that was requested at
+// requestTime and arrived at responseTime.
+func newEntry(resp *Response, body []byte, requestTime, responseTime time.Time) *Entry {
+	h := resp.Headers.Clone()
+	removeHopByHop(h)
+	h.Remove("Content-Length")
+	h.Remove("X-Proxy-Attempts")
+	h.Remove("Cache-Status")
+	return &Entry{
+		StatusCode:   resp.StatusCode,
+		Reason:       resp.Reason,
+		Headers:      h,
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+}
+
+// freshen returns a copy of e updated with the headers of a 304 Not
+// Modified that revalidated it, RFC 9111 section 3.2.
+func (e *Entry) freshen(resp *Response, requestTime, responseTime time.Time) *Entry {
+	updated := newEntry(resp, nil, requestTime, responseTime)
+	h := e.Headers.Clone()
+	for _, name := range updated.Headers.Names() {
+		h.Remove(name)
+		for _, v := range updated.Headers.Values(name) {
+			h.Set(name, v)
+		}
+	}
+	updated.StatusCode, updated.Reason = e.StatusCode, e.Reason
+	updated.Headers, updated.Body = h, e.Body
+	return updated
+}
+
+// date is when the origin generated e, from its Date, or when it was
+// received if it has none.
+func (e *Entry) date() time.Time {
+	if t, ok := headers.ParseTime(e.Headers.Get("Date")); ok {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// age is the current age of e, RFC 9111 section 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	ageValue, _ := strconv.Atoi(strings.TrimSpace(e.Headers.Get("Age")))
+	correctedAge := time.Duration(max(0, ageValue))*time.Second + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+// lifetime is how long e is fresh for, RFC 9111 section 4.2.1.
+func (e *Entry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Headers.Values("Cache-Control"))
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if e.Headers.Has("Expires") {
+		// an invalid date means already expired
+		t, ok := headers.ParseTime(e.Headers.Get("Expires"))
+		if !ok {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if lastModified, ok := headers.ParseTime(e.Headers.Get("Last-Modified")); ok && cacheableStatus[e.StatusCode] {
+		return min(max(0, e.date().Sub(lastModified)/heuristicFraction), maxHeuristic)
+	}
+	return 0
+}
+
+// usable reports whether a stored response of age and lifetime may be
+// served without going upstream, given the request's and its own
+// Cache-Control, RFC 9111 sections 4.2 and 5.2.1.
+func usable(reqCC, respCC cacheControl, age, lifetime time.Duration) bool {
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < d {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	if !reqCC.has("max-stale") || mustRevalidate(respCC) {
+		return false
+	}
+	d, ok := reqCC.seconds("max-stale")
+	// without a value, any staleness will do
+	return !ok && reqCC["max-stale"] == "" || ok && age-lifetime <= d
+}
+
+// mustRevalidate reports whether a response may never be served stale
+// by a shared cache, RFC 9111 sections 5.2.2.2, 5.2.2.8 and 5.2.2.10.
+func mustRevalidate(cc cacheControl) bool {
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+}
+
+// conditional returns an edit that makes a request conditional on the
+// validators of e, replacing the client's own conditions, which the
+// cache checks itself. It is nil if e has no validators.
+func conditional(e *Entry) func(h *headers.Headers) {
+	etag, lastModified := e.Headers.Get("ETag"), e.Headers.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	return func(h *headers.Headers) {
+		for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+			h.Remove(name)
+		}
+		if etag != "" {
+			h.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			h.Set("If-Modified-Since", lastModified)
+		}
+	}
+}
+
+// notModified reports whether a conditional GET or HEAD is satisfied
+// by entry, so 304 Not Modified is the answer, RFC 9110 section 13.1.
+func notModified(req *request.Request, entry *Entry) bool {
+	if req.Headers.Has("If-None-Match") {
+		etag := strings.TrimPrefix(entry.Headers.Get("ETag"), "W/")
+		for _, v := range req.Headers.Values("If-None-Match") {
+			for _, tag := range strings.Split(v, ",") {
+				tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+				if tag == "*" || etag != "" && tag == etag {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	since, ok := headers.ParseTime(req.Headers.Get("If-Modified-Since"))
+	lastModified, lok := headers.ParseTime(entry.Headers.Get("Last-Modified"))
+	return ok && lok && !lastModified.After(since)
+}
+
+// captureBody keeps a copy of a body as it is read, up to max bytes.
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+	eof      bool
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.max {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// complete reports whether the whole body was read and kept.
+func (b *captureBody) complete() bool {
+	return b.eof && !b.overflow
+}
+
+// writeCacheStatus sends a response the cache generated, with its
+// Cache-Status.
+func writeCacheStatus(w *response.Writer, statusCode response.StatusCode, status string) {
+	h := headers.NewHeaders()
+	h.Set("Cache-Status", status)
+	response.WriteStatus(w, statusCode, h)
+}
+
+// cacheableStatus are the status codes whose responses may be stored
+// without explicit freshness, RFC 9110 section 15.1, less 206, as
+// ranges aren't cached.
+var cacheableStatus = map[response.StatusCode]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+func isFinalStatus(code response.StatusCode) bool {
+	return code >= 200 && code < 600
+}
+
+func isServerError(code response.StatusCode) bool {
+	return code >= 500 && code != response.NotImplemented
+}
+
+// isSafe reports whether method is one of the safe methods, RFC 9110
+// section 9.2.1, which don't change what is stored for a URL.
+func isSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// cacheControl holds Cache-Control directives by lowercase name, with
+// their unquoted values.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for len(v) > 0 {
+			var directive string
+			directive, v = nextDirective(v)
+			name, value, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = strings.ReplaceAll(value[1:len(value)-1], `\`, "")
+			}
+			if _, ok := cc[name]; !ok {
+				cc[name] = value
+			}
+		}
+	}
+	return cc
+}
+
+// nextDirective splits off the first comma-separated directive of v,
+// minding commas in quoted strings like no-cache="a, b".
+func nextDirective(v string) (string, string) {
+	quoted := false
+	for i := 0; i < len(v); i++ {
+		switch {
+		case v[i] == '\\' && quoted:
+			i++
+		case v[i] == '"':
+			quoted = !quoted
+		case v[i] == ',' && !quoted:
+			return v[:i], v[i+1:]
+		}
+	}
+	return v, ""
+}
+
+// requestCacheControl is the Cache-Control of a request, with the
+// obsolete Pragma: no-cache standing in for no-cache if there is none,
+// RFC 9111 section 5.4.
+func requestCacheControl(h *headers.Headers) cacheControl {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if !h.Has("Cache-Control") && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive. A value that
+// isn't a number counts as 0, the safe reading of all of them.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok || v == "" {
+		return 0, ok && name != "max-stale"
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	// past 2^31 seconds is forever, RFC 9111 section 1.2.2
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
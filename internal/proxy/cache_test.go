@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// testCache returns a proxy to an upstream that answers with h, behind
+// a cache whose clock reads clock.
+func testCache(t *testing.T, clock *time.Time, h server.Handler) (*Proxy, *Cache) {
+	c := NewCache(CacheConfig{})
+	c.now = func() time.Time { return *clock }
+	return newProxy(t, Config{Upstream: upstream(t, h), Cache: c}), c
+}
+
+// origin answers with a body numbering its calls, the Date of clock, an
+// ETag of "v1" and the extra fields, and with 304 Not Modified to a
+// request for "v1" unless it is failing with an error status.
+type origin struct {
+	clock  *time.Time
+	calls  atomic.Int32
+	status response.StatusCode
+	extra  []string
+}
+
+func (o *origin) serve(w *response.Writer, req *request.Request) {
+	n := o.calls.Add(1)
+	h := headers.NewHeaders()
+	h.Set("Date", o.clock.UTC().Format(headers.TimeFormat))
+	h.Set("ETag", `"v1"`)
+	for i := 0; i+1 < len(o.extra); i += 2 {
+		h.Set(o.extra[i], o.extra[i+1])
+	}
+	if o.status < 500 && req.Headers.Get("If-None-Match") == `"v1"` {
+		w.WriteStatusLine(response.NotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	status := o.status
+	if status == 0 {
+		status = response.OK
+	}
+	body := fmt.Sprintf("call %d", n)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func get(target string, fields ...string) string {
+	raw := "GET " + target + " HTTP/1.1\r\nHost: cache.example\r\n"
+	for i := 0; i+1 < len(fields); i += 2 {
+		raw += fields[i] + ": " + fields[i+1] + "\r\n"
+	}
+	return raw + "\r\n"
+}
+
+func TestCache_Freshness(t *testing.T) {
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	o := &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=60"}}
+	p, _ := testCache(t, &clock, o.serve)
+
+	// Test: a miss goes upstream and is stored
+	resp := do(t, p, get("/a"), "")
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "httpfromtcp; fwd=uri-miss; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+
+	// Test: while fresh, GET and HEAD are answered from the cache with
+	// their Age
+	clock = clock.Add(10 * time.Second)
+	resp = do(t, p, get("/a"), "")
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "10", resp.headers.Get("Age"))
+	assert.Equal(t, "6", resp.headers.Get("Content-Length"))
+	assert.Equal(t, "httpfromtcp; hit; ttl=50", resp.headers.Get("Cache-Status"))
+	resp = do(t, p, "HEAD /a HTTP/1.1\r\nHost: cache.example\r\n\r\n", "")
+	assert.Equal(t, "", resp.body)
+	assert.Equal(t, "6", resp.headers.Get("Content-Length"))
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: a conditional request whose validator matches gets 304
+	resp = do(t, p, get("/a", "If-None-Match", `W/"v1"`), "")
+	assert.Equal(t, "HTTP/1.1 304 Not Modified", resp.statusLine)
+	assert.Equal(t, `"v1"`, resp.headers.Get("ETag"))
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: the request's max-age can refuse the stored response, which
+	// is revalidated rather than fetched again
+	resp = do(t, p, get("/a", "Cache-Control", "max-age=5"), "")
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "httpfromtcp; fwd=request; fwd-status=304", resp.headers.Get("Cache-Status"))
+	assert.Equal(t, "0", resp.headers.Get("Age"))
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	// Test: once stale it is revalidated, and fresh again after
+	clock = clock.Add(61 * time.Second)
+	resp = do(t, p, get("/a"), "")
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", resp.headers.Get("Cache-Status"))
+	resp = do(t, p, get("/a"), "")
+	assert.Equal(t, "httpfromtcp; hit; ttl=60", resp.headers.Get("Cache-Status"))
+	assert.Equal(t, int32(3), o.calls.Load())
+
+	// Test: with max-stale the client takes a response that stale, and
+	// no staler
+	clock = clock.Add(70 * time.Second)
+	resp = do(t, p, get("/a", "Cache-Control", "max-stale=20"), "")
+	assert.Equal(t, "httpfromtcp; hit; ttl=-10", resp.headers.Get("Cache-Status"))
+	resp = do(t, p, get("/a", "Cache-Control", "max-stale=5"), "")
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", resp.headers.Get("Cache-Status"))
+
+	// Test: another Host is another entry; only-if-cached gets 504
+	// without one
+	resp = do(t, p, "GET /a HTTP/1.1\r\nHost: other.example\r\nCache-Control: only-if-cached\r\n\r\n", "")
+	assert.Equal(t, "HTTP/1.1 504 Gateway Timeout", resp.statusLine)
+	assert.Equal(t, "httpfromtcp; fwd=uri-miss", resp.headers.Get("Cache-Status"))
+
+	// Test: a successful unsafe request removes what is stored
+	resp = do(t, p, "DELETE /a HTTP/1.1\r\nHost: cache.example\r\n\r\n", "")
+	assert.Equal(t, "httpfromtcp; fwd=method", resp.headers.Get("Cache-Status"))
+	resp = do(t, p, get("/a"), "")
+	assert.Equal(t, "httpfromtcp; fwd=uri-miss; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+}
+
+func TestCache_Vary(t *testing.T) {
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p, _ := testCache(t, &clock, func(w *response.Writer, req *request.Request) {
+		body := "lang=" + req.Headers.Get("Accept-Language")
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Vary", "Accept-Language")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	})
+
+	// Test: each value of the Vary headers gets its own response
+	resp := do(t, p, get("/v", "Accept-Language", "en"), "")
+	assert.Equal(t, "httpfromtcp; fwd=uri-miss; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+	resp = do(t, p, get("/v", "Accept-Language", "fr"), "")
+	assert.Equal(t, "httpfromtcp; fwd=vary-miss; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+	for _, lang := range []string{"en", "fr"} {
+		resp = do(t, p, get("/v", "Accept-Language", lang), "")
+		assert.Equal(t, "lang="+lang, resp.body)
+		assert.Equal(t, "httpfromtcp; hit; ttl=60", resp.headers.Get("Cache-Status"))
+	}
+	resp = do(t, p, get("/v"), "")
+	assert.Equal(t, "httpfromtcp; fwd=vary-miss; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+}
+
+func TestCache_Stale(t *testing.T) {
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Test: within stale-while-revalidate the stale response is served
+	// and replaced in the background
+	o := &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=10, stale-while-revalidate=30"}}
+	p, c := testCache(t, &clock, func(w *response.Writer, req *request.Request) {
+		req.Headers.Remove("If-None-Match")
+		o.serve(w, req)
+	})
+	do(t, p, get("/swr"), "")
+	clock = clock.Add(20 * time.Second)
+	resp := do(t, p, get("/swr"), "")
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "httpfromtcp; hit; ttl=-10; detail=stale-while-revalidate", resp.headers.Get("Cache-Status"))
+	c.background.Wait()
+	assert.Equal(t, int32(2), o.calls.Load())
+	resp = do(t, p, get("/swr"), "")
+	assert.Equal(t, "call 2", resp.body)
+	assert.Equal(t, "httpfromtcp; hit; ttl=10", resp.headers.Get("Cache-Status"))
+
+	// Test: past it, the client waits for a new response
+	clock = clock.Add(50 * time.Second)
+	resp = do(t, p, get("/swr"), "")
+	assert.Equal(t, "call 3", resp.body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=200; stored", resp.headers.Get("Cache-Status"))
+
+	// Test: within stale-if-error a failing upstream is covered for
+	o = &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=10, stale-if-error=60"}}
+	p, _ = testCache(t, &clock, o.serve)
+	do(t, p, get("/sie"), "")
+	o.status = response.InternalServerError
+	o.extra = nil
+	clock = clock.Add(30 * time.Second)
+	resp = do(t, p, get("/sie"), "")
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "call 1", resp.body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=500; detail=stale-if-error", resp.headers.Get("Cache-Status"))
+
+	// Test: past it, the error comes through
+	clock = clock.Add(60 * time.Second)
+	resp = do(t, p, get("/sie"), "")
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=500", resp.headers.Get("Cache-Status"))
+
+	// Test: the request's stale-if-error counts too, but not against
+	// must-revalidate
+	resp = do(t, p, get("/sie", "Cache-Control", "stale-if-error=600"), "")
+	assert.Equal(t, "call 1", resp.body)
+	o = &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=10, must-revalidate, stale-if-error=60"}}
+	p, _ = testCache(t, &clock, o.serve)
+	do(t, p, get("/mr"), "")
+	o.status = response.InternalServerError
+	clock = clock.Add(30 * time.Second)
+	resp = do(t, p, get("/mr"), "")
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+}
+
+func TestCache_Storable(t *testing.T) {
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		status response.StatusCode
+		extra  []string
+		fields []string
+		stored bool
+	}{
+		{"max-age", response.OK, []string{"Cache-Control", "max-age=60"}, nil, true},
+		{"Expires", response.OK, []string{"Expires", clock.Add(time.Minute).Format(headers.TimeFormat)}, nil, true},
+		{"heuristic", response.OK, []string{"Last-Modified", clock.Add(-10 * time.Hour).Format(headers.TimeFormat)}, nil, true},
+		{"404", response.NotFound, []string{"Cache-Control", "max-age=60"}, nil, true},
+		{"500", response.InternalServerError, []string{"Cache-Control", "max-age=60"}, nil, false},
+		{"no-store", response.OK, []string{"Cache-Control", "max-age=60, no-store"}, nil, false},
+		{"private", response.OK, []string{"Cache-Control", "private, max-age=60"}, nil, false},
+		{"request no-store", response.OK, []string{"Cache-Control", "max-age=60"}, []string{"Cache-Control", "no-store"}, false},
+		{"Authorization", response.OK, []string{"Cache-Control", "max-age=60"}, []string{"Authorization", "Basic eDp5"}, false},
+		{"Authorization public", response.OK, []string{"Cache-Control", "public, max-age=60"}, []string{"Authorization", "Basic eDp5"}, true},
+		{"Vary *", response.OK, []string{"Cache-Control", "max-age=60", "Vary", "*"}, nil, false},
+	}
+	for _, tt := range tests {
+		o := &origin{clock: &clock, status: tt.status, extra: tt.extra}
+		p, _ := testCache(t, &clock, func(w *response.Writer, req *request.Request) {
+			req.Headers.Remove("If-None-Match")
+			o.serve(w, req)
+		})
+		do(t, p, get("/s", tt.fields...), "")
+		resp := do(t, p, get("/s", tt.fields...), "")
+		assert.Equal(t, tt.stored, strings.Contains(resp.headers.Get("Cache-Status"), "; hit"), tt.name)
+	}
+
+	// Test: bodies over the limit are relayed but not stored
+	o := &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=60"}}
+	c := NewCache(CacheConfig{MaxEntryBytes: 3})
+	p := newProxy(t, Config{Upstream: upstream(t, o.serve), Cache: c})
+	do(t, p, get("/big"), "")
+	resp := do(t, p, get("/big"), "")
+	assert.Equal(t, "call 2", resp.body)
+}
+
+func TestCache_Purge(t *testing.T) {
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	o := &origin{clock: &clock, extra: []string{"Cache-Control", "max-age=60"}}
+	p, c := testCache(t, &clock, o.serve)
+	for _, target := range []string{"/a/1", "/a/1?x=y", "/a/2", "/b"} {
+		do(t, p, get(target), "")
+	}
+	purge := func(query string) string {
+		req, err := request.RequestFromReader(strings.NewReader("POST /admin/cache/purge?" + query + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		c.PurgeHandler(w, req)
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+	hit := func(target string) bool {
+		return strings.Contains(do(t, p, get(target), "").headers.Get("Cache-Status"), "; hit")
+	}
+
+	// Test: a path purges that request-target only
+	assert.Contains(t, purge("path=/a/1"), "\r\n\r\n{\"purged\":1}\n")
+	assert.False(t, hit("/a/1"))
+	assert.True(t, hit("/a/1?x=y"))
+
+	// Test: a prefix purges everything under it
+	assert.Contains(t, purge("prefix=/a/"), `{"purged":3}`)
+	assert.False(t, hit("/a/2"))
+	assert.True(t, hit("/b"))
+
+	// Test: the forms of a URL share one entry, and purge it
+	assert.True(t, hit("//b"))
+	assert.True(t, hit("/a/%2e%2e/b"))
+	assert.Contains(t, purge("path=/x/../b"), `{"purged":1}`)
+	assert.False(t, hit("/b"))
+
+	// Test: one of them is needed
+	assert.Contains(t, purge("x=1"), "400 Bad Request")
+}
+
+// entry is a stored 200 OK with body.
+func entry(body string) *Entry {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	return &Entry{StatusCode: response.OK, Reason: "OK", Headers: h, Body: []byte(body),
+		RequestTime: time.Unix(100, 0).UTC(), ResponseTime: time.Unix(101, 0).UTC()}
+}
+
+func TestMemoryStore(t *testing.T) {
+	size := int64(len("k1")) + entry("aaaa").size()
+	s := NewMemoryStore(2 * size)
+
+	// Test: the least recently used entry makes room for a new one
+	s.Put("k1", entry("aaaa"))
+	s.Put("k2", entry("bbbb"))
+	assert.Equal(t, 2*size, s.Bytes())
+	assert.Equal(t, "aaaa", string(s.Get("k1").Body))
+	s.Put("k3", entry("cccc"))
+	assert.Nil(t, s.Get("k2"))
+	assert.NotNil(t, s.Get("k1"))
+	assert.NotNil(t, s.Get("k3"))
+
+	// Test: an entry bigger than the budget isn't kept
+	s.Put("k4", entry(strings.Repeat("x", int(2*size))))
+	assert.Nil(t, s.Get("k4"))
+	assert.NotNil(t, s.Get("k1"))
+
+	// Test: deleting by prefix
+	assert.Equal(t, 2, s.Delete("k"))
+	assert.Zero(t, s.Bytes())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir, 0)
+	require.NoError(t, err)
+
+	// Test: entries survive a new store on the same directory
+	s.Put("/a host\n", entry("hello"))
+	s.Put("/a host\naccept: x\n", entry("variant"))
+	s.Put("/b host\n", &Entry{Vary: []string{"accept"}, ResponseTime: time.Unix(5, 0).UTC()})
+	s, err = NewDiskStore(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, entry("hello"), s.Get("/a host\n"))
+	assert.Equal(t, []string{"accept"}, s.Get("/b host\n").Vary)
+	assert.Nil(t, s.Get("/c host\n"))
+
+	// Test: deleting by prefix removes the files
+	assert.Equal(t, 2, s.Delete("/a "))
+	assert.Nil(t, s.Get("/a host\naccept: x\n"))
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// Test: the budget evicts the least recently used
+	s, err = NewDiskStore(t.TempDir(), 2500)
+	require.NoError(t, err)
+	s.Put("k1", entry(strings.Repeat("a", 1000)))
+	s.Put("k2", entry(strings.Repeat("b", 1000)))
+	s.Get("k1")
+	s.Put("k3", entry(strings.Repeat("c", 1000)))
+	assert.NotNil(t, s.Get("k1"))
+	assert.Nil(t, s.Get("k2"))
+	assert.NotNil(t, s.Get("k3"))
+}
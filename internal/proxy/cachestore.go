@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+)
+
+// Defaults for the store budgets left zero.
+const (
+	DefaultMemoryStoreBytes = 64 << 20
+	DefaultDiskStoreBytes   = 1 << 30
+)
+
+// entryOverhead is what an entry is counted as taking besides its key,
+// headers and body.
+const entryOverhead = 256
+
+// Entry is a response stored by a Cache. Entries aren't changed once
+// they are stored; a revalidated response is stored as a new one.
+type Entry struct {
+	StatusCode response.StatusCode
+	Reason     string
+	// Headers are the response's end-to-end headers, without the ones
+	// that frame its body.
+	Headers *headers.Headers
+	Body    []byte
+	// RequestTime and ResponseTime are when the request was sent and
+	// the response to it arrived, to work out the response's age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary is set on the entries without a status that stand in for
+	// the responses to a URL that vary on request headers: it lists the
+	// headers, and each response is stored under its own key, made from
+	// their values.
+	Vary []string
+}
+
+// size is roughly how many bytes e takes up.
+func (e *Entry) size() int64 {
+	n := int64(entryOverhead + len(e.Reason) + len(e.Body))
+	for _, name := range e.Vary {
+		n += int64(len(name))
+	}
+	if e.Headers != nil {
+		for _, name := range e.Headers.Names() {
+			for _, v := range e.Headers.Values(name) {
+				n += int64(len(name) + len(v) + 4)
+			}
+		}
+	}
+	return n
+}
+
+// Store holds a Cache's entries by key. A Store may drop entries
+// whenever it needs to, to stay within its budget, and must be safe for
+// concurrent use.
+type Store interface {
+	// Get returns the entry stored under key, or nil.
+	Get(key string) *Entry
+	// Put stores e under key, replacing any entry there.
+	Put(key string, e *Entry)
+	// Delete removes the entries whose keys start with prefix, and
+	// returns how many there were.
+	Delete(prefix string) int
+}
+
+// lru orders keys from most to least recently used and keeps the bytes
+// stored under them within a budget, evicting from the least recently
+// used end. It isn't safe for concurrent use.
+type lru struct {
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+	// entry is the entry itself for a MemoryStore; a DiskStore keeps
+	// entries in files.
+	entry *Entry
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the item under key, making it the most recently used.
+func (l *lru) get(key string) *lruItem {
+	el, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem)
+}
+
+// add makes item the most recently used, replacing any under its key,
+// and returns the items evicted to make room for it. An item bigger
+// than the whole budget isn't added, and is returned as evicted.
+func (l *lru) add(item *lruItem) []*lruItem {
+	var evicted []*lruItem
+	if old := l.remove(item.key); old != nil {
+		evicted = append(evicted, old)
+	}
+	if item.size > l.maxBytes {
+		return append(evicted, item)
+	}
+	l.items[item.key] = l.order.PushFront(item)
+	l.bytes += item.size
+	for l.bytes > l.maxBytes {
+		evicted = append(evicted, l.remove(l.order.Back().Value.(*lruItem).key))
+	}
+	return evicted
+}
+
+// remove removes and returns the item under key, or returns nil.
+func (l *lru) remove(key string) *lruItem {
+	el, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	item := el.Value.(*lruItem)
+	l.bytes -= item.size
+	return item
+}
+
+// keys returns the keys that start with prefix.
+func (l *lru) keys(prefix string) []string {
+	var keys []string
+	for key := range l.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// MemoryStore is a Store that keeps entries in memory, up to a budget
+// of bytes, evicting the least recently used to make room.
+type MemoryStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+// NewMemoryStore returns a MemoryStore that holds up to maxBytes, or
+// DefaultMemoryStoreBytes if that is 0.
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	if maxBytes == 0 {
+		maxBytes = DefaultMemoryStoreBytes
+	}
+	return &MemoryStore{lru: newLRU(maxBytes)}
+}
+
+func (s *MemoryStore) Get(key string) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item := s.lru.get(key); item != nil {
+		return item.entry
+	}
+	return nil
+}
+
+func (s *MemoryStore) Put(key string, e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.add(&lruItem{key: key, size: int64(len(key)) + e.size(), entry: e})
+}
+
+func (s *MemoryStore) Delete(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.keys(prefix)
+	for _, key := range keys {
+		s.lru.remove(key)
+	}
+	return len(keys)
+}
+
+// Bytes returns how many bytes the stored entries take up.
+func (s *MemoryStore) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.bytes
+}
+
+// DiskStore is a Store that keeps each entry in a file of a directory,
+// up to a budget of bytes, evicting the least recently used to make
+// room. Entries written by an earlier DiskStore on the same directory
+// are picked up, oldest first in line for eviction.
+//
+// A file holds a line of JSON with the entry's key and everything but
+// its body, then the body.
+type DiskStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *lru
+}
+
+// diskEntry is the metadata line of a DiskStore file.
+type diskEntry struct {
+	Key          string      `json:"key"`
+	StatusCode   int         `json:"status,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	Headers      [][2]string `json:"headers,omitempty"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	Vary         []string    `json:"vary,omitempty"`
+}
+
+// diskFileExt marks DiskStore files; anything else in the directory is
+// left alone.
+const diskFileExt = ".entry"
+
+// NewDiskStore returns a DiskStore on dir, creating it if needed, that
+// holds up to maxBytes, or DefaultDiskStoreBytes if that is 0.
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if maxBytes == 0 {
+		maxBytes = DefaultDiskStoreBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("proxy: cache directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: cache directory: %w", err)
+	}
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var entries []found
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != diskFileExt {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		meta, err := readDiskMeta(path)
+		if err != nil || diskFileName(meta.Key) != f.Name() {
+			log.Printf("Removing unreadable cache file %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		entries = append(entries, found{meta.Key, info.Size(), info.ModTime()})
+	}
+	// oldest first, so the newest end up the most recently used
+	slices.SortFunc(entries, func(a, b found) int { return a.modTime.Compare(b.modTime) })
+	s := &DiskStore{dir: dir, lru: newLRU(maxBytes)}
+	for _, e := range entries {
+		s.evict(s.lru.add(&lruItem{key: e.key, size: e.size}), "")
+	}
+	return s, nil
+}
+
+// diskFileName is the name of the file key is stored in.
+func diskFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskFileExt
+}
+
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, diskFileName(key))
+}
+
+// readDiskMeta reads the metadata line of the file at path.
+func readDiskMeta(path string) (*diskEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var meta diskEntry
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *DiskStore) Get(key string) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lru.get(key) == nil {
+		return nil
+	}
+	data, err := os.ReadFile(s.path(key))
+	var meta diskEntry
+	if err == nil {
+		line, body, ok := bytes.Cut(data, []byte("\n"))
+		if err = json.Unmarshal(line, &meta); err == nil && (!ok || meta.Key != key) {
+			err = io.ErrUnexpectedEOF
+		}
+		data = body
+	}
+	if err != nil {
+		log.Printf("Error reading cache entry for %q: %v", key, err)
+		s.evict([]*lruItem{s.lru.remove(key)}, "")
+		return nil
+	}
+	e := &Entry{
+		StatusCode:   response.StatusCode(meta.StatusCode),
+		Reason:       meta.Reason,
+		RequestTime:  meta.RequestTime,
+		ResponseTime: meta.ResponseTime,
+		Vary:         meta.Vary,
+		Body:         data,
+	}
+	if e.StatusCode != 0 {
+		e.Headers = headers.NewHeaders()
+		for _, f := range meta.Headers {
+			e.Headers.Set(f[0], f[1])
+		}
+	}
+	return e
+}
+
+func (s *DiskStore) Put(key string, e *Entry) {
+	meta := diskEntry{
+		Key:          key,
+		StatusCode:   int(e.StatusCode),
+		Reason:       e.Reason,
+		RequestTime:  e.RequestTime,
+		ResponseTime: e.ResponseTime,
+		Vary:         e.Vary,
+	}
+	if e.Headers != nil {
+		for _, name := range e.Headers.Names() {
+			for _, v := range e.Headers.Values(name) {
+				meta.Headers = append(meta.Headers, [2]string{name, v})
+			}
+		}
+	}
+	line, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("Error storing cache entry for %q: %v", key, err)
+		return
+	}
+	data := append(append(line, '\n'), e.Body...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// write to a temporary file and rename it into place, so a reader
+	// never sees half an entry
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), s.path(key))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Error storing cache entry for %q: %v", key, err)
+		s.evict([]*lruItem{s.lru.remove(key)}, "")
+		return
+	}
+	s.evict(s.lru.add(&lruItem{key: key, size: int64(len(data))}), key)
+}
+
+func (s *DiskStore) Delete(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.keys(prefix)
+	for _, key := range keys {
+		s.evict([]*lruItem{s.lru.remove(key)}, "")
+	}
+	return len(keys)
+}
+
+// evict removes the files of items, except that of keep, whose item
+// was replaced rather than evicted. It is called with s.mu held.
+func (s *DiskStore) evict(items []*lruItem, keep string) {
+	for _, item := range items {
+		if item == nil || item.key == keep && s.lru.items[keep] != nil {
+			continue
+		}
+		if err := os.Remove(s.path(item.key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing cache entry for %q: %v", item.key, err)
+		}
+	}
+}
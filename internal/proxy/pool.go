@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Defaults for the PoolConfig fields left zero.
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+	DefaultConsecutiveFailures = 5
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 50
+)
+
+// slowStartMinFactor is the share of its weight a backend gets at the
+// start of its slow start.
+const slowStartMinFactor = 0.1
+
+// healthCheckMaxBody is how much of a health check response is read to
+// keep its connection for the next check.
+const healthCheckMaxBody = 64 << 10
+
+// BackendConfig is one upstream server of a pool.
+type BackendConfig struct {
+	// URL is the base URL requests are forwarded to, as for
+	// Config.Upstream.
+	URL string
+	// Weight is the backend's share of traffic relative to the others,
+	// for the balancers that take weights into account. It defaults
+	// to 1.
+	Weight int
+}
+
+// HealthCheck configures active health checks, which request Path from
+// every backend each Interval. A backend is taken out of rotation after
+// UnhealthyThreshold failed checks in a row, and put back after
+// HealthyThreshold good ones. A check is good if it gets a 2xx or 3xx
+// response within Timeout.
+type HealthCheck struct {
+	// Path turns active checks on; with none, backends are only judged
+	// by the requests they serve.
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetection configures passive ejection of backends that fail
+// the requests they are sent: a connection error or a 5xx response
+// counts as a failure, and ConsecutiveFailures of them in a row eject
+// the backend for BaseEjectionTime, times the number of times it has
+// been ejected, up to MaxEjectionTime. No more than MaxEjectionPercent
+// of the backends are ejected at once, so a pool never ejects itself
+// empty.
+type OutlierDetection struct {
+	// Disabled turns passive ejection off.
+	Disabled            bool
+	ConsecutiveFailures int
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  int
+}
+
+// PoolConfig configures a Pool. Zero values fall back to defaults.
+type PoolConfig struct {
+	Backends []BackendConfig
+	// Balancer picks the backend for each request. It defaults to
+	// RoundRobin.
+	Balancer    Balancer
+	HealthCheck HealthCheck
+	Outlier     OutlierDetection
+	// SlowStart is how long a backend that comes back, after failing
+	// health checks or being ejected, takes to ramp up to its full
+	// weight. Its weight starts at a tenth and grows linearly.
+	SlowStart time.Duration
+	// CircuitBreaker configures the breaker of each backend.
+	CircuitBreaker CircuitBreaker
+	// Retry configures retries of failed requests, which are off by
+	// default.
+	Retry RetryPolicy
+	// Transport sends the health checks. It defaults to one with the
+	// health check timeout for dialing and awaiting responses.
+	Transport *Transport
+}
+
+// Pool is a set of backends that serve the same content, with the
+// state load balancing needs: which backends are healthy, how busy
+// they are, and which have been ejected for failing.
+type Pool struct {
+	config   PoolConfig
+	backends []*Backend
+	balancer Balancer
+
+	// mu guards the state of every backend
+	mu    sync.Mutex
+	now   func() time.Time
+	stats stats
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Backend is one server of a pool, and its state. Its methods are safe
+// to call from balancers while the pool is in use.
+type Backend struct {
+	pool   *Pool
+	url    *url.URL
+	weight int
+
+	healthy bool
+	// healthySince is when the backend last passed health checks after
+	// failing them; zero if it never failed them
+	healthySince time.Time
+	checkStreak  int
+	active       int
+	requests     int64
+	failures     int64
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+	breaker      breaker
+}
+
+// NewPool returns a pool of the configured backends, all of them
+// healthy to start with, and starts its health checks if there are
+// any. Close stops them.
+func NewPool(config PoolConfig) (*Pool, error) {
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("proxy: pool has no backends")
+	}
+	config.HealthCheck = config.HealthCheck.withDefaults()
+	config.Outlier = config.Outlier.withDefaults()
+	config.CircuitBreaker = config.CircuitBreaker.withDefaults()
+	config.Retry = config.Retry.withDefaults()
+	if config.Balancer == nil {
+		config.Balancer = RoundRobin()
+	}
+	if config.Transport == nil {
+		config.Transport = &Transport{
+			DialTimeout:           config.HealthCheck.Timeout,
+			ResponseHeaderTimeout: config.HealthCheck.Timeout,
+		}
+	}
+	p := &Pool{config: config, balancer: config.Balancer, now: time.Now, stop: make(chan struct{})}
+	for _, bc := range config.Backends {
+		u, err := parseUpstream(bc.URL)
+		if err != nil {
+			return nil, err
+		}
+		weight := max(bc.Weight, 1)
+		p.backends = append(p.backends, &Backend{pool: p, url: u, weight: weight, healthy: true})
+	}
+	if config.HealthCheck.Path != "" {
+		p.wg.Add(1)
+		go p.healthChecks()
+	}
+	return p, nil
+}
+
+func (hc HealthCheck) withDefaults() HealthCheck {
+	if hc.Interval == 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = DefaultHealthCheckTimeout
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	return hc
+}
+
+func (od OutlierDetection) withDefaults() OutlierDetection {
+	if od.ConsecutiveFailures == 0 {
+		od.ConsecutiveFailures = DefaultConsecutiveFailures
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = DefaultBaseEjectionTime
+	}
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	return od
+}
+
+// Close stops the health checks and closes their connections.
+func (p *Pool) Close() error {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	p.wg.Wait()
+	p.config.Transport.CloseIdleConnections()
+	return nil
+}
+
+// Backends returns every backend of the pool, available or not.
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// pick chooses a backend for req among the available ones, preferring
+// those not already tried, and counts it as busy until release is
+// called. It returns nil if none is available.
+func (p *Pool) pick(req *request.Request, tried ...*Backend) *Backend {
+	for {
+		p.mu.Lock()
+		now := p.now()
+		var available, untried []*Backend
+		for _, b := range p.backends {
+			if b.availableAt(now) {
+				available = append(available, b)
+				if !slices.Contains(tried, b) {
+					untried = append(untried, b)
+				}
+			}
+		}
+		p.mu.Unlock()
+		if len(available) == 0 {
+			return nil
+		}
+		if len(untried) > 0 {
+			available = untried
+		}
+		b := p.balancer.Pick(available, req)
+		if b == nil {
+			return nil
+		}
+		p.mu.Lock()
+		// a half-open breaker's trials may have been taken since
+		admitted := b.breaker.admit(p.config.CircuitBreaker, p.now())
+		if admitted {
+			b.active++
+			b.requests++
+		}
+		p.mu.Unlock()
+		if admitted {
+			return b
+		}
+	}
+}
+
+// release marks a request to b as done, and counts it towards outlier
+// detection as a success or a failure.
+func (p *Pool) release(b *Backend, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+	now := p.now()
+	if b.breaker.record(p.config.CircuitBreaker, now, failed) {
+		log.Printf("Circuit breaker of backend %s opened", b.url.Host)
+	}
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	od := p.config.Outlier
+	if od.Disabled || b.consecutive < od.ConsecutiveFailures || now.Before(b.ejectedUntil) {
+		return
+	}
+	ejected := 0
+	for _, other := range p.backends {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > od.MaxEjectionPercent*len(p.backends) {
+		return
+	}
+	if !b.ejectedUntil.IsZero() && now.Sub(b.ejectedUntil) > od.MaxEjectionTime {
+		// it behaved for long enough that this is a fresh start
+		b.ejections = 0
+	}
+	b.ejections++
+	b.ejectedUntil = now.Add(min(od.BaseEjectionTime*time.Duration(b.ejections), od.MaxEjectionTime))
+	b.consecutive = 0
+	log.Printf("Ejecting backend %s until %s after %d failures", b.url.Host, b.ejectedUntil.Format(time.TimeOnly), od.ConsecutiveFailures)
+}
+
+// availableAt reports whether b can be sent requests: it passes health
+// checks, isn't ejected, and its breaker lets requests through. The
+// caller holds p.mu.
+func (b *Backend) availableAt(now time.Time) bool {
+	return b.healthy && !now.Before(b.ejectedUntil) && b.breaker.allows(b.pool.config.CircuitBreaker, now)
+}
+
+// URL returns the backend's base URL.
+func (b *Backend) URL() *url.URL {
+	return b.url
+}
+
+// Weight returns the backend's configured weight.
+func (b *Backend) Weight() int {
+	return b.weight
+}
+
+// ActiveRequests returns how many requests the backend is serving.
+func (b *Backend) ActiveRequests() int {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+	return b.active
+}
+
+// SlowStartFactor returns the fraction of its weight the backend gets
+// while it ramps back up after being out of rotation, or 1 once it has.
+func (b *Backend) SlowStartFactor() float64 {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+	return b.slowStartFactor(b.pool.now())
+}
+
+func (b *Backend) slowStartFactor(now time.Time) float64 {
+	window := b.pool.config.SlowStart
+	since := b.healthySince
+	if b.ejectedUntil.After(since) {
+		since = b.ejectedUntil
+	}
+	if b.breaker.closedAt.After(since) {
+		since = b.breaker.closedAt
+	}
+	if window <= 0 || since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= window {
+		return 1
+	}
+	return max(slowStartMinFactor, float64(elapsed)/float64(window))
+}
+
+// healthChecks checks every backend each interval until the pool is
+// closed.
+func (p *Pool) healthChecks() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.config.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		p.checkAll()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.recordCheck(b, p.check(b))
+		}()
+	}
+	wg.Wait()
+}
+
+// check requests the health check path from b and reports whether the
+// answer was good.
+func (p *Pool) check(b *Backend) bool {
+	h := headers.NewHeaders()
+	h.Set("Host", b.url.Host)
+	h.Set("User-Agent", "httpfromtcp-health-check")
+	req, err := request.NewRequest("GET", joinPath(b.url.EscapedPath(), p.config.HealthCheck.Path), 1, 1, h, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.config.Transport.RoundTrip(b.url, req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	// read the body so the connection can be reused for the next check
+	io.Copy(io.Discard, io.LimitReader(resp.Body, healthCheckMaxBody))
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// recordCheck counts a health check result towards the thresholds that
+// move b in or out of rotation.
+func (p *Pool) recordCheck(b *Backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hc := p.config.HealthCheck
+	if ok != b.healthy {
+		b.checkStreak++
+	} else {
+		b.checkStreak = 0
+	}
+	switch {
+	case b.healthy && b.checkStreak >= hc.UnhealthyThreshold:
+		b.healthy = false
+		b.checkStreak = 0
+		log.Printf("Backend %s failed %d health checks", b.url.Host, hc.UnhealthyThreshold)
+	case !b.healthy && b.checkStreak >= hc.HealthyThreshold:
+		b.healthy = true
+		b.checkStreak = 0
+		b.healthySince = p.now()
+		log.Printf("Backend %s is healthy again", b.url.Host)
+	}
+}
+
+// BackendStatus is a snapshot of a backend's state, as the admin view
+// shows it.
+type BackendStatus struct {
+	URL                 string     `json:"url"`
+	Weight              int        `json:"weight"`
+	Healthy             bool       `json:"healthy"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	Ejections           int        `json:"ejections"`
+	Circuit             string     `json:"circuit"`
+	CircuitOpens        int64      `json:"circuit_opens"`
+	SlowStartFactor     float64    `json:"slow_start_factor"`
+	ActiveRequests      int        `json:"active_requests"`
+	Requests            int64      `json:"requests"`
+	Failures            int64      `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// Status returns a snapshot of every backend's state.
+func (p *Pool) Status() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	statuses := make([]BackendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		s := BackendStatus{
+			URL:                 b.url.String(),
+			Weight:              b.weight,
+			Healthy:             b.healthy,
+			Ejected:             now.Before(b.ejectedUntil),
+			Ejections:           b.ejections,
+			Circuit:             b.breaker.stateAt(p.config.CircuitBreaker, now).String(),
+			CircuitOpens:        b.breaker.opens,
+			SlowStartFactor:     b.slowStartFactor(now),
+			ActiveRequests:      b.active,
+			Requests:            b.requests,
+			Failures:            b.failures,
+			ConsecutiveFailures: b.consecutive,
+		}
+		if s.Ejected {
+			until := b.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// Stats returns the counts of what happened to the pool's requests.
+func (p *Pool) Stats() PoolStats {
+	return p.stats.snapshot()
+}
+
+// AdminHandler serves the state of every backend and the pool's stats
+// as JSON, for operators to see which backends are in rotation and why.
+func (p *Pool) AdminHandler(w *response.Writer, _ *request.Request) {
+	body, err := json.MarshalIndent(map[string]any{"backends": p.Status(), "stats": p.Stats()}, "", "  ")
+	if err != nil {
+		response.WriteStatus(w, response.InternalServerError, nil)
+		return
+	}
+	body = append(body, '\n')
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	h.Set("Cache-Control", "no-store")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// testPool returns a pool of backends a, b, c... with the given
+// weights, and a clock the test moves by hand.
+func testPool(t *testing.T, config PoolConfig, weights ...int) (*Pool, *time.Time) {
+	for i, w := range weights {
+		config.Backends = append(config.Backends, BackendConfig{URL: fmt.Sprintf("http://%c.test", 'a'+i), Weight: w})
+	}
+	p, err := NewPool(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func testRequest(t *testing.T, fields ...string) *request.Request {
+	h := headers.NewHeaders()
+	h.Set("Host", "proxy.test")
+	for i := 0; i+1 < len(fields); i += 2 {
+		h.Set(fields[i], fields[i+1])
+	}
+	req, err := request.NewRequest("GET", "/", 1, 1, h, nil)
+	require.NoError(t, err)
+	return req
+}
+
+// picks picks n times, releasing each pick, and returns the backends'
+// hosts without the domain.
+func picks(t *testing.T, p *Pool, n int, fields ...string) string {
+	var b strings.Builder
+	for range n {
+		backend := p.pick(testRequest(t, fields...))
+		require.NotNil(t, backend)
+		b.WriteString(strings.TrimSuffix(backend.url.Host, ".test"))
+		p.release(backend, false)
+	}
+	return b.String()
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	// Test: weights are ignored
+	p, _ := testPool(t, PoolConfig{}, 5, 1, 1)
+	assert.Equal(t, "abcabc", picks(t, p, 6))
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	// Test: the heavy backend's turns are spread out
+	p, _ := testPool(t, PoolConfig{Balancer: Weighted()}, 5, 1, 1)
+	assert.Equal(t, "aabacaa", picks(t, p, 7))
+}
+
+func TestBalancer_LeastConnections(t *testing.T) {
+	p, _ := testPool(t, PoolConfig{Balancer: LeastConnections()}, 1, 1, 2)
+
+	// Test: requests go to the least loaded backend for its weight, and
+	// the doubly weighted one takes two before the others take a second
+	var got strings.Builder
+	var held []*Backend
+	for range 8 {
+		b := p.pick(testRequest(t))
+		got.WriteString(strings.TrimSuffix(b.url.Host, ".test"))
+		held = append(held, b)
+	}
+	counts := map[rune]int{}
+	for _, c := range got.String() {
+		counts[c]++
+	}
+	assert.Equal(t, map[rune]int{'a': 2, 'b': 2, 'c': 4}, counts)
+
+	// Test: finishing a's requests makes it the choice
+	for _, b := range held {
+		if b.url.Host == "a.test" {
+			p.release(b, false)
+		}
+	}
+	assert.Equal(t, "a", picks(t, p, 1))
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	p, _ := testPool(t, PoolConfig{Balancer: HashHeader("X-User")}, 1, 1, 1, 1)
+
+	// Test: a key always maps to the same backend, and keys spread over
+	// all of them
+	owner := map[string]*Backend{}
+	used := map[*Backend]bool{}
+	for i := range 200 {
+		key := fmt.Sprintf("user-%d", i)
+		b := p.pick(testRequest(t, "X-User", key))
+		p.release(b, false)
+		owner[key] = b
+		used[b] = true
+		again := p.pick(testRequest(t, "X-User", key))
+		p.release(again, false)
+		assert.Same(t, b, again)
+	}
+	assert.Len(t, used, 4)
+
+	// Test: with a backend gone, only its keys move
+	gone := p.backends[1]
+	gone.healthy = false
+	for key, b := range owner {
+		moved := p.pick(testRequest(t, "X-User", key))
+		p.release(moved, false)
+		if b == gone {
+			assert.NotSame(t, gone, moved)
+		} else {
+			assert.Same(t, b, moved, key)
+		}
+	}
+
+	// Test: requests without the key are balanced round-robin
+	gone.healthy = true
+	assert.Equal(t, "abcd", picks(t, p, 4))
+}
+
+func TestBalancer_HashCookie(t *testing.T) {
+	p, _ := testPool(t, PoolConfig{Balancer: HashCookie("session")}, 1, 1, 1)
+
+	// Test: the cookie's value is the key, wherever it is in the header
+	first := picks(t, p, 1, "Cookie", "theme=dark; session=abc123")
+	assert.Equal(t, strings.Repeat(first, 3), picks(t, p, 3, "Cookie", `session="abc123"`))
+	assert.Equal(t, "abc123", cookieValue(testRequest(t, "Cookie", "a=1", "Cookie", "session=abc123"), "session"))
+	assert.Equal(t, "", cookieValue(testRequest(t, "Cookie", "sessionx=1"), "session"))
+}
+
+func TestPool_OutlierEjection(t *testing.T) {
+	p, now := testPool(t, PoolConfig{
+		Outlier:        OutlierDetection{ConsecutiveFailures: 3, BaseEjectionTime: time.Minute},
+		SlowStart:      time.Minute,
+		CircuitBreaker: CircuitBreaker{Disabled: true},
+	}, 1, 1, 1, 1)
+	a, b := p.backends[0], p.backends[1]
+	fail := func(backend *Backend, n int) {
+		for range n {
+			backend.active++
+			p.release(backend, true)
+		}
+	}
+
+	// Test: a success resets the count of failures in a row
+	fail(a, 2)
+	a.active++
+	p.release(a, false)
+	fail(a, 2)
+	assert.False(t, p.Status()[0].Ejected)
+	assert.Equal(t, 2, p.Status()[0].ConsecutiveFailures)
+
+	// Test: enough failures in a row take a backend out of rotation
+	fail(a, 1)
+	assert.Equal(t, "bcdbcd", picks(t, p, 6))
+
+	// Test: half the pool can be ejected, but no more
+	fail(b, 3)
+	fail(p.backends[2], 3)
+	status := p.Status()
+	assert.True(t, status[0].Ejected)
+	assert.True(t, status[1].Ejected)
+	assert.False(t, status[2].Ejected)
+	assert.Equal(t, 3, status[2].ConsecutiveFailures)
+	assert.Equal(t, "cdcd", picks(t, p, 4))
+
+	// Test: after the ejection time the backend comes back slowly, and
+	// is at full weight at the end of the slow start
+	*now = now.Add(time.Minute + 15*time.Second)
+	assert.InDelta(t, 0.25, a.SlowStartFactor(), 0.001)
+	assert.Equal(t, 1.0, p.backends[3].SlowStartFactor())
+	*now = now.Add(time.Minute)
+	assert.Equal(t, 1.0, a.SlowStartFactor())
+
+	// Test: a second ejection lasts twice as long
+	fail(a, 3)
+	*now = now.Add(time.Minute + time.Second)
+	assert.True(t, p.Status()[0].Ejected)
+	assert.Equal(t, 2, p.Status()[0].Ejections)
+	*now = now.Add(time.Minute)
+	assert.False(t, p.Status()[0].Ejected)
+}
+
+func TestPool_OutlierEjectionSingleBackend(t *testing.T) {
+	p, _ := testPool(t, PoolConfig{CircuitBreaker: CircuitBreaker{Disabled: true}}, 1)
+
+	// Test: a pool of one never ejects its backend
+	for range 20 {
+		b := p.pick(testRequest(t))
+		p.release(b, true)
+	}
+	assert.Equal(t, "aa", picks(t, p, 2))
+}
+
+func TestPool_HealthChecks(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	var checks atomic.Int32
+	health := func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/base/healthz" {
+			checks.Add(1)
+		}
+		status := response.OK
+		if !up.Load() {
+			status = response.ServiceUnavailable
+		}
+		response.WriteStatus(w, status, nil)
+	}
+	healthy := upstream(t, echo)
+	flaky := upstream(t, health)
+	pool, err := NewPool(PoolConfig{
+		Backends: []BackendConfig{{URL: healthy}, {URL: flaky + "/base"}},
+		HealthCheck: HealthCheck{
+			Path:               "/healthz",
+			Interval:           10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+		SlowStart: time.Hour,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+
+	// Test: the check path is joined to the backend's base path
+	require.Eventually(t, func() bool { return checks.Load() > 0 }, 2*time.Second, 5*time.Millisecond)
+
+	// Test: a failing backend goes out of rotation, then back in, in
+	// slow start
+	up.Store(false)
+	require.Eventually(t, func() bool { return !pool.Status()[1].Healthy }, 2*time.Second, 5*time.Millisecond)
+	for range 4 {
+		b := pool.pick(testRequest(t))
+		assert.Same(t, pool.backends[0], b)
+		pool.release(b, false)
+	}
+	up.Store(true)
+	require.Eventually(t, func() bool { return pool.Status()[1].Healthy }, 2*time.Second, 5*time.Millisecond)
+	assert.Less(t, pool.backends[1].SlowStartFactor(), 0.2)
+}
+
+func TestProxy_Pool(t *testing.T) {
+	named := func(name string) func(*response.Writer, *request.Request) {
+		return func(w *response.Writer, req *request.Request) {
+			body := []byte(name + " " + req.RequestLine.RequestTarget)
+			h := headers.NewHeaders()
+			h.Set("Content-Length", fmt.Sprint(len(body)))
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+		}
+	}
+	broken := func(w *response.Writer, _ *request.Request) {
+		response.WriteStatus(w, response.InternalServerError, nil)
+	}
+	pool, err := NewPool(PoolConfig{
+		Backends: []BackendConfig{
+			{URL: upstream(t, named("one")) + "/v1"},
+			{URL: upstream(t, named("two")) + "/v2"},
+			{URL: upstream(t, broken)},
+		},
+		Outlier: OutlierDetection{ConsecutiveFailures: 1},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+	p := newProxy(t, Config{Pool: pool, StripPrefix: "/api"})
+
+	// Test: requests go round the backends, each with its own base path,
+	// and a 5xx ejects the broken one
+	var bodies []string
+	for range 5 {
+		bodies = append(bodies, do(t, p, "GET /api/x HTTP/1.1\r\nHost: proxy.test\r\n\r\n", "203.0.113.7:5555").body)
+	}
+	assert.Equal(t, []string{"one /v1/x", "two /v2/x", "Internal Server Error\n", "one /v1/x", "two /v2/x"}, bodies)
+
+	// Test: the admin view shows each backend's state
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	pool.AdminHandler(w, testRequest(t))
+	require.NoError(t, w.Finish())
+	_, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	var admin struct {
+		Backends []BackendStatus `json:"backends"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &admin))
+	require.Len(t, admin.Backends, 3)
+	assert.Equal(t, int64(2), admin.Backends[0].Requests)
+	assert.True(t, admin.Backends[2].Ejected)
+	assert.Equal(t, int64(1), admin.Backends[2].Failures)
+	assert.NotNil(t, admin.Backends[2].EjectedUntil)
+
+	// Test: with no backend available, the client gets a 503
+	for _, b := range pool.backends {
+		b.healthy = false
+	}
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", do(t, p, "GET /api/x HTTP/1.1\r\nHost: proxy.test\r\n\r\n", "203.0.113.7:5555").statusLine)
+
+	// Test: an upstream and a pool can't both be set
+	_, err = New(Config{Upstream: "http://a.test", Pool: pool})
+	assert.Error(t, err)
+}
@@ -0,0 +1,483 @@
+// Package proxy forwards requests to upstream HTTP servers and relays
+// their responses, as a reverse proxy in front of them.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Config configures a Proxy.
+type Config struct {
+	// Upstream is the base URL requests are forwarded to, like
+	// "http://127.0.0.1:8080" or "https://httpbin.org/api". The request
+	// path, less StripPrefix, is appended to its path, and the query is
+	// passed on as it is.
+	Upstream string
+	// Pool spreads requests across several upstreams instead, which
+	// share StripPrefix and the rest of the config. Exactly one of
+	// Upstream and Pool is set.
+	Pool *Pool
+	// StripPrefix is removed from the start of request paths, for a
+	// proxy mounted at something like "/api/".
+	StripPrefix string
+	// PreserveHost forwards the client's Host header instead of setting
+	// it to the upstream's.
+	PreserveHost bool
+	// Transport sends the requests. Proxies share a default Transport,
+	// and so its idle connections, if this is nil.
+	Transport *Transport
+	// Cache, if set, stores responses to GET requests and answers from
+	// them while they are fresh. Several proxies can share one.
+	Cache *Cache
+}
+
+// DefaultTransport is the Transport used by proxies that don't set one.
+var DefaultTransport = &Transport{}
+
+// Proxy is a handler that forwards each request to its upstream and
+// relays the response.
+//
+// The request goes out with its method, body and end-to-end headers.
+// Hop-by-hop headers, which only describe the client's connection to
+// the proxy, are removed, and the client is identified to the upstream
+// with X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host, and the
+// standard Forwarded header of RFC 7239. X-Forwarded-For and Forwarded
+// are appended to if the request already passed through other proxies;
+// the other two are replaced, as this proxy is where the client's host
+// and scheme were seen.
+//
+// The response is relayed with the upstream's status and end-to-end
+// headers, and streamed as it arrives. Bodies without a length are sent
+// chunked, along with any trailers the upstream declared. An upstream
+// that can't be reached gets a 502 Bad Gateway, or a 504 Gateway
+// Timeout if it is too slow to answer.
+//
+// With a Pool, each request goes to the backend its balancer picks, and
+// the outcome counts towards the backend's outlier detection and
+// circuit breaker. If no backend is available the client gets a 503
+// Service Unavailable. Failed requests are retried as the pool's
+// RetryPolicy allows.
+//
+// Responses the proxy generates instead of relaying, and relayed 5xx
+// responses, carry a Proxy-Status header, RFC 9209, with the error or
+// the status received and the upstream that was tried last. Retried
+// requests carry X-Proxy-Attempts with the number of tries.
+//
+// With a Cache, GET and HEAD requests are answered from it when they
+// can be, as described there, and only go upstream otherwise.
+type Proxy struct {
+	pool      *Pool
+	config    Config
+	transport *Transport
+}
+
+func New(config Config) (*Proxy, error) {
+	pool := config.Pool
+	switch {
+	case pool != nil && config.Upstream != "":
+		return nil, fmt.Errorf("proxy: both an upstream and a pool are set")
+	case pool == nil:
+		var err error
+		pool, err = NewPool(PoolConfig{Backends: []BackendConfig{{URL: config.Upstream}}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport := config.Transport
+	if transport == nil {
+		transport = DefaultTransport
+	}
+	return &Proxy{pool: pool, config: config, transport: transport}, nil
+}
+
+// parseUpstream parses the base URL of an upstream.
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid upstream: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("proxy: upstream %q must be an absolute http or https URL", upstream)
+	}
+	return u, nil
+}
+
+func (p *Proxy) ServeHTTP(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		response.WriteStatus(w, response.BadRequest, nil)
+		return
+	}
+	fetch := func(edit func(h *headers.Headers)) (*Response, error) {
+		return p.forward(req, body, edit)
+	}
+	if p.config.Cache != nil {
+		p.config.Cache.serve(w, req, fetch)
+		return
+	}
+	resp, err := fetch(nil)
+	respond(w, resp, err)
+}
+
+// upstreamError is why forward has no response to relay: the status
+// the client gets instead, with its Proxy-Status if the upstream is to
+// blame, and how many tries were made.
+type upstreamError struct {
+	statusCode response.StatusCode
+	status     string
+	attempts   int
+}
+
+func (e *upstreamError) Error() string {
+	if e.status == "" {
+		return response.StatusText(e.statusCode)
+	}
+	return e.status
+}
+
+// forward sends req with body upstream, retrying as the pool's
+// RetryPolicy allows, and returns the response, with Proxy-Status and
+// X-Proxy-Attempts added as needed. edit, if set, changes the headers
+// that go out. The backend that answered is released when the body is
+// closed. If there is no response the error is an *upstreamError.
+func (p *Proxy) forward(req *request.Request, body []byte, edit func(h *headers.Headers)) (*Response, error) {
+	pool := p.pool
+	policy := pool.config.Retry
+	pool.stats.request(policy, pool.now())
+	retryable := policy.Attempts > 1 && isIdempotent(req.RequestLine.Method)
+
+	var tried []*Backend
+	for attempts := 1; ; attempts++ {
+		backend := pool.pick(req, tried...)
+		if backend == nil {
+			pool.stats.outcome(errDestinationUnavailable)
+			return nil, &upstreamError{response.ServiceUnavailable, proxyStatus(errDestinationUnavailable, "", 0), attempts - 1}
+		}
+		tried = append(tried, backend)
+		upstream := backend.url
+		out, err := p.outRequest(req, upstream, body, edit)
+		if err != nil {
+			pool.release(backend, false)
+			return nil, &upstreamError{statusCode: response.BadRequest}
+		}
+		resp, err := p.transport.RoundTrip(upstream, out)
+		failed := err != nil || resp.StatusCode >= 500
+		if retryable && attempts < policy.Attempts && (err != nil || retryableStatus(resp.StatusCode)) &&
+			pool.stats.retry(policy, pool.now()) {
+			if err != nil {
+				log.Printf("Error proxying to %s, retrying: %v", upstream.Host, err)
+			} else {
+				resp.Body.Close()
+			}
+			pool.release(backend, failed)
+			time.Sleep(policy.backoff(attempts))
+			continue
+		}
+
+		if err != nil {
+			pool.release(backend, true)
+			log.Printf("Error proxying to %s: %v", upstream.Host, err)
+			errType := errorType(err)
+			pool.stats.outcome(errType)
+			statusCode := response.BadGateway
+			if errType == errConnectionTimeout || errType == errResponseTimeout {
+				statusCode = response.GatewayTimeout
+			}
+			return nil, &upstreamError{statusCode, proxyStatus(errType, upstream.Host, 0), attempts}
+		}
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { pool.release(backend, failed) }}
+		if failed {
+			pool.stats.outcome(outcomeUpstream5xx)
+			resp.Headers.Set("Proxy-Status", proxyStatus("", upstream.Host, resp.StatusCode))
+		} else {
+			pool.stats.outcome(outcomeOK)
+		}
+		if attempts > 1 {
+			resp.Headers.Override("X-Proxy-Attempts", strconv.Itoa(attempts))
+		}
+		return resp, nil
+	}
+}
+
+// releasingBody releases the backend a response came from once its
+// body is closed, so the request counts as active while it streams.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+	return err
+}
+
+// respond relays resp to the client, or the error forward returned
+// instead of it.
+func respond(w *response.Writer, resp *Response, err error) {
+	if err != nil {
+		var ue *upstreamError
+		switch {
+		case !errors.As(err, &ue):
+			response.WriteStatus(w, response.BadGateway, nil)
+		case ue.status == "":
+			response.WriteStatus(w, ue.statusCode, nil)
+		default:
+			writeProxyError(w, ue.statusCode, ue.status, ue.attempts)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if err := relay(w, resp); err != nil {
+		log.Printf("Error relaying response: %v", err)
+	}
+}
+
+// outRequest builds the request sent to upstream.
+func (p *Proxy) outRequest(req *request.Request, upstream *url.URL, body []byte, edit func(h *headers.Headers)) (*request.Request, error) {
+	h := req.Headers.Clone()
+	removeHopByHop(h)
+	h.Remove("Content-Length")
+	h.Remove("Expect")
+	addForwarded(h, req)
+	if edit != nil {
+		edit(h)
+	}
+	if !p.config.PreserveHost {
+		h.Override("Host", upstream.Host)
+	}
+	return request.NewRequest(req.RequestLine.Method, p.target(req, upstream), 1, 1, h, body)
+}
+
+// target is the origin-form request-target for upstream: its base path
+// joined with the request's. The request's path is the normalized one
+// it was routed on, escaped again, so dot segments and doubled slashes
+// the router saw through can't take the upstream anywhere else.
+func (p *Proxy) target(req *request.Request, upstream *url.URL) string {
+	if req.URL.Path == "" {
+		// OPTIONS *
+		return req.RequestLine.RequestTarget
+	}
+	reqPath := strings.TrimPrefix(req.URL.Path, p.config.StripPrefix)
+	target := joinPath(upstream.EscapedPath(), escapePath(reqPath))
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	return target
+}
+
+// escapePath escapes each segment of a decoded path.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// joinPath appends reqPath to an upstream's base path, keeping the base
+// as it is when there is nothing to append.
+func joinPath(base, reqPath string) string {
+	if reqPath == "" && base != "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(reqPath, "/")
+}
+
+// hopByHop are the fields that describe a single connection, RFC 9110
+// section 7.6.1, and are never forwarded. Proxy-Connection and
+// Keep-Alive are obsolete but still seen.
+var hopByHop = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop removes the hop-by-hop fields from h, including any
+// named in its Connection header.
+func removeHopByHop(h *headers.Headers) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Remove(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Remove(name)
+	}
+}
+
+// addForwarded identifies the client and how it reached the proxy to
+// the upstream.
+func addForwarded(h *headers.Headers, req *request.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	host := req.Host()
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	if clientIP != "" {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			h.Override("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	h.Override("X-Forwarded-Proto", proto)
+	if host != "" {
+		h.Override("X-Forwarded-Host", host)
+	}
+
+	// RFC 7239 section 4; IPv6 addresses are bracketed and quoted
+	var params []string
+	if clientIP != "" {
+		node := clientIP
+		if strings.Contains(clientIP, ":") {
+			node = `"[` + clientIP + `]"`
+		}
+		params = append(params, "for="+node)
+	}
+	if host != "" {
+		params = append(params, "host="+quoteIfNeeded(host))
+	}
+	params = append(params, "proto="+proto)
+	element := strings.Join(params, ";")
+	if prior := h.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	h.Override("Forwarded", element)
+}
+
+// quoteIfNeeded returns v as a Forwarded parameter value: bare if it
+// is a token, and quoted otherwise, as a host with a port has to be.
+func quoteIfNeeded(v string) string {
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// relay writes the upstream's response to w. A body of known length is
+// copied as it is; anything else is sent chunked, flushing each piece as
+// it arrives, and the upstream's declared trailers follow it.
+func relay(w *response.Writer, resp *Response) error {
+	h := resp.Headers.Clone()
+	declared := h.Values("Trailer")
+	removeHopByHop(h)
+	reason := resp.Reason
+	if reason == "" {
+		reason = response.StatusText(resp.StatusCode)
+	}
+	if err := w.WriteStatusLineWithReason(resp.StatusCode, reason); err != nil {
+		return err
+	}
+
+	if resp.ContentLength >= 0 {
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	h.Remove("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	var trailerNames []string
+	for _, v := range declared {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !isHopByHop(name) {
+				trailerNames = append(trailerNames, name)
+			}
+		}
+	}
+	if len(trailerNames) > 0 {
+		h.Set("Trailer", strings.Join(trailerNames, ", "))
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return werr
+			}
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	trailers := headers.NewHeaders()
+	if resp.Trailers != nil {
+		for _, name := range trailerNames {
+			for _, v := range resp.Trailers.Values(name) {
+				trailers.Set(name, v)
+			}
+		}
+	}
+	return w.WriteTrailers(trailers)
+}
+
+func isHopByHop(name string) bool {
+	for _, hop := range hopByHop {
+		if strings.EqualFold(name, hop) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProxyError sends a response the proxy generated because it
+// couldn't get one from upstream, with its Proxy-Status and, if any
+// upstream was tried, how many times.
+func writeProxyError(w *response.Writer, statusCode response.StatusCode, status string, attempts int) {
+	h := headers.NewHeaders()
+	h.Set("Proxy-Status", status)
+	if attempts > 0 {
+		h.Set("X-Proxy-Attempts", strconv.Itoa(attempts))
+	}
+	response.WriteStatus(w, statusCode, h)
+}
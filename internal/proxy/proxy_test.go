@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// upstream starts a server with h and returns its base URL.
+func upstream(t *testing.T, h server.Handler) string {
+	s, err := server.ServeConfig(server.Config{}, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "http://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+}
+
+// echo answers 201 with the request it got, one line per field after
+// the request line, and the body last.
+func echo(w *response.Writer, req *request.Request) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	for _, name := range req.Headers.Names() {
+		fmt.Fprintf(&b, "%s: %s\n", name, req.Headers.Get(name))
+	}
+	fmt.Fprintf(&b, "\n%s", req.Body)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(b.Len()))
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Upstream", "yes")
+	h.Set("Connection", "X-Hop")
+	h.Set("X-Hop", "secret")
+	w.WriteStatusLineWithReason(response.Created, "Made It")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
+
+type testResponse struct {
+	statusLine string
+	headers    *headers.Headers
+	body       string
+	trailers   *headers.Headers
+}
+
+// do runs a raw request from remoteAddr through p and parses what it
+// writes back, decoding a chunked body.
+func do(t *testing.T, p *Proxy, raw, remoteAddr string) testResponse {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = remoteAddr
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
+	}
+	p.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+
+	br := bufio.NewReader(buf)
+	statusLine, err := readLine(br, maxHeaderBytes)
+	require.NoError(t, err)
+	h, err := readFields(br)
+	require.NoError(t, err)
+	resp := testResponse{statusLine: statusLine, headers: h}
+	var body []byte
+	if hasToken(h, "Transfer-Encoding", "chunked") {
+		resp.trailers = headers.NewHeaders()
+		body, err = io.ReadAll(&chunkedReader{br: br, trailers: resp.trailers})
+	} else {
+		body, err = io.ReadAll(br)
+	}
+	require.NoError(t, err)
+	resp.body = string(body)
+	return resp
+}
+
+func newProxy(t *testing.T, config Config) *Proxy {
+	if config.Transport == nil {
+		config.Transport = &Transport{}
+		t.Cleanup(config.Transport.CloseIdleConnections)
+	}
+	p, err := New(config)
+	require.NoError(t, err)
+	return p
+}
+
+func TestProxy_Forward(t *testing.T) {
+	p := newProxy(t, Config{Upstream: upstream(t, echo) + "/base/", StripPrefix: "/api"})
+
+	// Test: method, body, path and query go through; the upstream's
+	// status, reason and headers come back
+	resp := do(t, p, "PUT /api/items/1?x=1&y=%20 HTTP/1.1\r\nHost: proxy.example:8080\r\nContent-Length: 5\r\nX-Custom: kept\r\n\r\nhello", "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 201 Made It", resp.statusLine)
+	assert.Equal(t, "yes", resp.headers.Get("X-Upstream"))
+	assert.Equal(t, "text/plain", resp.headers.Get("Content-Type"))
+	lines := strings.Split(resp.body, "\n")
+	assert.Equal(t, "PUT /base/items/1?x=1&y=%20", lines[0])
+	assert.Contains(t, lines, "x-custom: kept")
+	assert.Contains(t, lines, "content-length: 5")
+	assert.True(t, strings.HasSuffix(resp.body, "\n\nhello"))
+
+	// Test: the upstream's hop-by-hop headers stay behind
+	assert.False(t, resp.headers.Has("X-Hop"))
+	assert.NotEqual(t, "X-Hop", resp.headers.Get("Connection"))
+
+	// Test: the Host is the upstream's, and the client is identified
+	assert.Regexp(t, `\nhost: 127\.0\.0\.1:\d+\n`, resp.body)
+	assert.Contains(t, lines, "x-forwarded-for: 203.0.113.7")
+	assert.Contains(t, lines, "x-forwarded-proto: http")
+	assert.Contains(t, lines, "x-forwarded-host: proxy.example:8080")
+	assert.Contains(t, lines, `forwarded: for=203.0.113.7;host="proxy.example:8080";proto=http`)
+
+	// Test: every method is forwarded, including ones with no body
+	for _, method := range []string{"GET", "POST", "DELETE", "PATCH", "OPTIONS"} {
+		resp := do(t, p, method+" /api/m HTTP/1.1\r\nHost: localhost\r\n\r\n", "203.0.113.7:5555")
+		assert.True(t, strings.HasPrefix(resp.body, method+" /base/m\n"), resp.body)
+	}
+
+	// Test: HEAD gets the headers alone
+	resp = do(t, p, "HEAD /api/h HTTP/1.1\r\nHost: localhost\r\n\r\n", "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 201 Made It", resp.statusLine)
+	assert.Empty(t, resp.body)
+}
+
+func TestProxy_Target(t *testing.T) {
+	p := newProxy(t, Config{Upstream: upstream(t, echo) + "/api", StripPrefix: "/httpbin"})
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/httpbin/x", "/api/x"},
+		{"/httpbin/a%20b/c%3Fd?q=%20", "/api/a%20b/c%3Fd?q=%20"},
+		// the path the request was routed on is the one sent, so dot
+		// segments can't climb out of the upstream's base path
+		{"/httpbin/a/%2e%2e/%2e%2e/httpbin/z", "/api/z"},
+		// and the prefix is stripped however the slashes were written
+		{"//httpbin/x", "/api/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			resp := do(t, p, "GET "+tt.target+" HTTP/1.1\r\nHost: localhost\r\n\r\n", "203.0.113.7:5555")
+			assert.True(t, strings.HasPrefix(resp.body, "GET "+tt.want+"\n"), resp.body)
+		})
+	}
+}
+
+func TestProxy_HopByHopAndForwarded(t *testing.T) {
+	p := newProxy(t, Config{Upstream: upstream(t, echo), PreserveHost: true})
+	resp := do(t, p, "GET /x HTTP/1.1\r\n"+
+		"Host: site.example\r\n"+
+		"Connection: keep-alive, X-Private\r\n"+
+		"X-Private: 1\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"Proxy-Authorization: Basic abc\r\n"+
+		"TE: trailers\r\n"+
+		"Upgrade: websocket\r\n"+
+		"X-Forwarded-For: 198.51.100.1\r\n"+
+		"X-Forwarded-Proto: https\r\n"+
+		"Forwarded: for=198.51.100.1\r\n"+
+		"\r\n", "[2001:db8::1]:443")
+	lines := strings.Split(resp.body, "\n")
+	for _, name := range []string{"connection", "x-private", "keep-alive", "proxy-authorization", "te", "upgrade"} {
+		for _, line := range lines {
+			assert.False(t, strings.HasPrefix(line, name+":"), line)
+		}
+	}
+
+	// Test: the Host is kept, and prior proxies are appended to
+	assert.Contains(t, lines, "host: site.example")
+	assert.Contains(t, lines, "x-forwarded-for: 198.51.100.1, 2001:db8::1")
+	assert.Contains(t, lines, "x-forwarded-proto: http")
+	assert.Contains(t, lines, `forwarded: for=198.51.100.1, for="[2001:db8::1]";host=site.example;proto=http`)
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	chunks := func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum, Connection")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		w.WriteChunkedBodyDone()
+		tr := headers.NewHeaders()
+		tr.Set("X-Checksum", "abc")
+		tr.Set("Connection", "close")
+		w.WriteTrailers(tr)
+	}
+	p := newProxy(t, Config{Upstream: upstream(t, chunks)})
+
+	// Test: a chunked body is relayed chunked with its declared trailers,
+	// less any hop-by-hop ones
+	resp := do(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "127.0.0.1:1")
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "part one, part two", resp.body)
+	assert.Equal(t, "X-Checksum", resp.headers.Get("Trailer"))
+	assert.Equal(t, "abc", resp.trailers.Get("X-Checksum"))
+	assert.False(t, resp.trailers.Has("Connection"))
+
+	// Test: an HTTP/1.0 client gets the body unchunked
+	resp = do(t, p, "GET / HTTP/1.0\r\n\r\n", "127.0.0.1:1")
+	assert.Equal(t, "part one, part two", resp.body)
+}
+
+func TestProxy_UpstreamErrors(t *testing.T) {
+	// Test: an upstream that refuses connections is a bad gateway
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	p := newProxy(t, Config{Upstream: "http://" + addr})
+	resp := do(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "127.0.0.1:1")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", resp.statusLine)
+
+	// Test: one too slow to answer is a gateway timeout
+	slow := func(w *response.Writer, req *request.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	p = newProxy(t, Config{
+		Upstream:  upstream(t, slow),
+		Transport: &Transport{ResponseHeaderTimeout: 50 * time.Millisecond},
+	})
+	resp = do(t, p, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "127.0.0.1:1")
+	assert.Equal(t, "HTTP/1.1 504 Gateway Timeout", resp.statusLine)
+
+	// Test: bad upstream URLs are refused up front
+	for _, u := range []string{"", "127.0.0.1:80", "ftp://host", "http://"} {
+		_, err := New(Config{Upstream: u})
+		assert.Error(t, err, u)
+	}
+}
+
+func TestTransport_Reuse(t *testing.T) {
+	// a bare upstream that answers each request with its connection
+	// number, and hangs up after its second
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n := accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for i := 0; i < 2; i++ {
+					req, err := request.RequestFromReader(br)
+					if err != nil {
+						return
+					}
+					body := fmt.Sprintf("conn %d %s", n, req.URL.Path)
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}()
+		}
+	}()
+	p := newProxy(t, Config{Upstream: "http://" + l.Addr().String()})
+	get := func(path string) string {
+		return do(t, p, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n", "127.0.0.1:1").body
+	}
+
+	// Test: a connection is reused once its response has been read
+	assert.Equal(t, "conn 1 /a", get("/a"))
+	assert.Equal(t, "conn 1 /b", get("/b"))
+
+	// Test: when the upstream has closed it meanwhile, the request is
+	// retried on a new one
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "conn 2 /c", get("/c"))
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: a POST that was written whole isn't sent again, as the
+	// upstream may have acted on it before the connection closed
+	assert.Equal(t, "conn 2 /d", get("/d"))
+	time.Sleep(50 * time.Millisecond)
+	resp := do(t, p, "POST /e HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\n\r\nx", "127.0.0.1:1")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", resp.statusLine)
+	assert.Equal(t, int32(2), accepted.Load())
+}
+
+func TestChunkedReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		body     string
+		trailers map[string]string
+		err      bool
+	}{
+		{"simple", "3\r\nabc\r\n0\r\n\r\n", "abc", map[string]string{}, false},
+		{"extensions and trailers", "3;ext=1\r\nabc\r\nA\r\n0123456789\r\n0\r\nX-Sum: 1\r\n\r\n", "abc0123456789", map[string]string{"x-sum": "1"}, false},
+		{"bad size", "zz\r\nabc\r\n0\r\n\r\n", "", nil, true},
+		{"whitespace before an extension", "3 ;ext\r\nabc\r\n0\r\n\r\n", "abc", map[string]string{}, false},
+		{"signed size", "+3\r\nabc\r\n0\r\n\r\n", "", nil, true},
+		{"leading whitespace", " 3\r\nabc\r\n0\r\n\r\n", "", nil, true},
+		{"empty size", ";ext\r\nabc\r\n0\r\n\r\n", "", nil, true},
+		{"hex prefix", "0x3\r\nabc\r\n0\r\n\r\n", "", nil, true},
+		{"missing terminator", "3\r\nabcd\r\n0\r\n\r\n", "abc", nil, true},
+		{"truncated", "5\r\nab", "ab", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trailers := headers.NewHeaders()
+			body, err := io.ReadAll(&chunkedReader{br: bufio.NewReader(strings.NewReader(tt.input)), trailers: trailers})
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+			got := map[string]string{}
+			for _, name := range trailers.Names() {
+				got[name] = trailers.Get(name)
+			}
+			assert.Equal(t, tt.trailers, got)
+		})
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   int64
+		err    bool
+	}{
+		{nil, -1, false},
+		{[]string{"5"}, 5, false},
+		{[]string{"5, 5", "5"}, 5, false},
+		{[]string{"5", "6"}, 0, true},
+		{[]string{"+5"}, 0, true},
+		{[]string{"-0"}, 0, true},
+		{[]string{""}, 0, true},
+	}
+	for _, tt := range tests {
+		n, err := contentLength(tt.values)
+		if tt.err {
+			assert.Error(t, err, tt.values)
+			continue
+		}
+		require.NoError(t, err, tt.values)
+		assert.Equal(t, tt.want, n, tt.values)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/response"
+)
+
+// Defaults for the RetryPolicy fields left zero.
+const (
+	DefaultRetryBaseBackoff  = 25 * time.Millisecond
+	DefaultRetryMaxBackoff   = time.Second
+	DefaultRetryBudget       = 0.2
+	DefaultRetryMinRetries   = 10
+	DefaultRetryBudgetWindow = 10 * time.Second
+)
+
+// RetryPolicy configures how a pool's failed requests are retried.
+// Only requests with idempotent methods are, as the failure may have
+// come after the upstream acted on the request, and only when the
+// upstream couldn't be reached, didn't answer, or answered 502, 503 or
+// 504. Each retry goes to a backend not tried yet, if there is one
+// available, after a backoff that doubles from BaseBackoff up to
+// MaxBackoff, with full jitter so that clients that failed together
+// don't retry together.
+//
+// Retries are limited by a budget so that they can't pile onto an
+// upstream that is already struggling: over each BudgetWindow, the pool
+// retries at most Budget times as many requests as it got, plus
+// MinRetries to let a quiet pool retry at all.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried, counting the first;
+	// with fewer than 2, requests aren't retried.
+	Attempts     int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Budget       float64
+	MinRetries   int
+	BudgetWindow time.Duration
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.BaseBackoff == 0 {
+		rp.BaseBackoff = DefaultRetryBaseBackoff
+	}
+	if rp.MaxBackoff == 0 {
+		rp.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if rp.Budget == 0 {
+		rp.Budget = DefaultRetryBudget
+	}
+	if rp.MinRetries == 0 {
+		rp.MinRetries = DefaultRetryMinRetries
+	}
+	if rp.BudgetWindow == 0 {
+		rp.BudgetWindow = DefaultRetryBudgetWindow
+	}
+	return rp
+}
+
+// backoff returns how long to wait before retrying after the given
+// number of attempts: a random duration up to the exponential backoff.
+func (rp RetryPolicy) backoff(attempts int) time.Duration {
+	d := rp.MaxBackoff
+	if shift := attempts - 1; shift < 32 && rp.BaseBackoff<<shift < rp.MaxBackoff {
+		d = rp.BaseBackoff << shift
+	}
+	return rand.N(d + 1)
+}
+
+// isIdempotent reports whether a request with method can be retried
+// without changing its effect, RFC 9110 section 9.2.2.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryableStatus reports whether an upstream's response means it
+// didn't handle the request and another try may do better.
+func retryableStatus(statusCode response.StatusCode) bool {
+	switch statusCode {
+	case response.BadGateway, response.ServiceUnavailable, response.GatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Error types of Proxy-Status, RFC 9209 section 2.3.
+const (
+	errDestinationUnavailable = "destination_unavailable"
+	errDNS                    = "dns_error"
+	errConnectionRefused      = "connection_refused"
+	errConnectionTimeout      = "connection_timeout"
+	errConnectionTerminated   = "connection_terminated"
+	errResponseTimeout        = "http_response_timeout"
+	errResponseIncomplete     = "http_response_incomplete"
+	errProtocol               = "http_protocol_error"
+)
+
+// outcomeOK and outcomeUpstream5xx are the outcomes counted for relayed
+// responses, along with the error types for the rest.
+const (
+	outcomeOK          = "ok"
+	outcomeUpstream5xx = "upstream_5xx"
+)
+
+// errorType classifies a failure to get a response from an upstream.
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return errDNS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return errConnectionTimeout
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return errConnectionRefused
+		}
+		return errDestinationUnavailable
+	case errors.Is(err, ErrResponseHeaderTimeout) || errors.As(err, &netErr) && netErr.Timeout():
+		return errResponseTimeout
+	case errors.Is(err, errNothingRead) || errors.Is(err, syscall.ECONNRESET):
+		return errConnectionTerminated
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errResponseIncomplete
+	}
+	return errProtocol
+}
+
+// proxyName identifies this proxy in Proxy-Status.
+const proxyName = "httpfromtcp"
+
+// proxyStatus returns a Proxy-Status member, RFC 9209, for a response
+// from the backend at nextHop: with the error type if the proxy
+// generated the response, or the status it received if it relayed it.
+func proxyStatus(errType, nextHop string, received response.StatusCode) string {
+	s := proxyName
+	if errType != "" {
+		s += "; error=" + errType
+	}
+	if nextHop != "" {
+		s += `; next-hop="` + nextHop + `"`
+	}
+	if received != 0 {
+		s += "; received-status=" + strconv.Itoa(int(received))
+	}
+	return s
+}
+
+// PoolStats counts what happened to the requests a pool served.
+type PoolStats struct {
+	Requests int64 `json:"requests"`
+	Retries  int64 `json:"retries"`
+	// RetriesOverBudget counts the retries not made because the budget
+	// was spent.
+	RetriesOverBudget int64 `json:"retries_over_budget"`
+	// Outcomes counts responses by how they ended: "ok", "upstream_5xx"
+	// for relayed server errors, or the Proxy-Status error type for
+	// responses the proxy generated.
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+// stats holds a pool's PoolStats and its retry budget.
+type stats struct {
+	mu sync.Mutex
+	PoolStats
+	windowStart    time.Time
+	windowRequests int
+	windowRetries  int
+}
+
+// request counts a request from a client.
+func (s *stats) request(policy RetryPolicy, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Requests++
+	s.rollWindow(policy, now)
+	s.windowRequests++
+}
+
+// retry reports whether the budget allows another retry, and spends it
+// if so.
+func (s *stats) retry(policy RetryPolicy, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollWindow(policy, now)
+	if s.windowRetries >= policy.MinRetries+int(policy.Budget*float64(s.windowRequests)) {
+		s.RetriesOverBudget++
+		return false
+	}
+	s.windowRetries++
+	s.Retries++
+	return true
+}
+
+func (s *stats) rollWindow(policy RetryPolicy, now time.Time) {
+	if now.Sub(s.windowStart) >= policy.BudgetWindow {
+		s.windowStart, s.windowRequests, s.windowRetries = now, 0, 0
+	}
+}
+
+// outcome counts how a response ended.
+func (s *stats) outcome(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Outcomes == nil {
+		s.Outcomes = make(map[string]int64)
+	}
+	s.Outcomes[kind]++
+}
+
+func (s *stats) snapshot() PoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.PoolStats
+	snap.Outcomes = maps.Clone(s.Outcomes)
+	return snap
+}
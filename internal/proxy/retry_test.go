@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+func TestPool_CircuitBreaker(t *testing.T) {
+	p, now := testPool(t, PoolConfig{
+		CircuitBreaker: CircuitBreaker{FailureRatio: 0.5, MinRequests: 4, Window: 10 * time.Second, OpenTimeout: time.Minute, HalfOpenRequests: 2},
+		Outlier:        OutlierDetection{Disabled: true},
+		SlowStart:      time.Minute,
+	}, 1)
+	a := p.backends[0]
+	run := func(failed ...bool) {
+		for _, f := range failed {
+			b := p.pick(testRequest(t))
+			require.NotNil(t, b)
+			p.release(b, f)
+		}
+	}
+
+	// Test: failures spread over windows don't open the breaker
+	run(true, false, false)
+	*now = now.Add(11 * time.Second)
+	run(true, false, true)
+	assert.Equal(t, "closed", p.Status()[0].Circuit)
+
+	// Test: enough failures in a window open it, and no request gets
+	// through
+	run(true)
+	assert.Equal(t, "open", p.Status()[0].Circuit)
+	assert.Nil(t, p.pick(testRequest(t)))
+
+	// Test: after the timeout it lets a few trials through, and a
+	// failed trial opens it again
+	*now = now.Add(time.Minute)
+	assert.Equal(t, "half-open", p.Status()[0].Circuit)
+	first, second := p.pick(testRequest(t)), p.pick(testRequest(t))
+	require.NotNil(t, first)
+	require.NotNil(t, second)
+	assert.Nil(t, p.pick(testRequest(t)))
+	p.release(first, false)
+	p.release(second, true)
+	assert.Equal(t, "open", p.Status()[0].Circuit)
+	assert.Equal(t, int64(2), p.Status()[0].CircuitOpens)
+
+	// Test: trials that all succeed close it, and the backend slow
+	// starts
+	*now = now.Add(time.Minute)
+	run(false, false)
+	assert.Equal(t, "closed", p.Status()[0].Circuit)
+	assert.InDelta(t, slowStartMinFactor, a.SlowStartFactor(), 0.001)
+	run(true, true, false)
+	assert.Equal(t, "closed", p.Status()[0].Circuit)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	rp := RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	// Test: the backoff is jittered up to a bound that doubles, until
+	// the maximum
+	for range 100 {
+		assert.LessOrEqual(t, rp.backoff(1), 10*time.Millisecond)
+		assert.LessOrEqual(t, rp.backoff(3), 40*time.Millisecond)
+		assert.LessOrEqual(t, rp.backoff(100), 50*time.Millisecond)
+		assert.GreaterOrEqual(t, rp.backoff(2), time.Duration(0))
+	}
+}
+
+// refused returns a URL nothing listens on.
+func refused(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestProxy_Retry(t *testing.T) {
+	var badRequests atomic.Int32
+	bad := func(w *response.Writer, _ *request.Request) {
+		badRequests.Add(1)
+		response.WriteStatus(w, response.ServiceUnavailable, nil)
+	}
+	badURL := upstream(t, bad)
+	newPool := func(config PoolConfig, urls ...string) *Pool {
+		for _, u := range urls {
+			config.Backends = append(config.Backends, BackendConfig{URL: u})
+		}
+		config.CircuitBreaker.Disabled = true
+		config.Outlier.Disabled = true
+		config.Retry.BaseBackoff = time.Millisecond
+		pool, err := NewPool(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { pool.Close() })
+		return pool
+	}
+	get := "GET /x HTTP/1.1\r\nHost: proxy.test\r\n\r\n"
+	post := "POST /x HTTP/1.1\r\nHost: proxy.test\r\nContent-Length: 2\r\n\r\nhi"
+
+	// Test: an idempotent request that gets a 503 is retried on another
+	// backend
+	pool := newPool(PoolConfig{Retry: RetryPolicy{Attempts: 3}}, badURL, upstream(t, echo))
+	p := newProxy(t, Config{Pool: pool})
+	resp := do(t, p, get, "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 201 Made It", resp.statusLine)
+	assert.Equal(t, "2", resp.headers.Get("X-Proxy-Attempts"))
+	assert.False(t, resp.headers.Has("Proxy-Status"))
+	assert.Equal(t, int32(1), badRequests.Load())
+
+	// Test: a POST isn't retried, and the relayed 503 says where it came
+	// from
+	p = newProxy(t, Config{Pool: newPool(PoolConfig{Retry: RetryPolicy{Attempts: 3}}, badURL)})
+	resp = do(t, p, post, "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", resp.statusLine)
+	assert.Equal(t, `httpfromtcp; next-hop="`+badURL[len("http://"):]+`"; received-status=503`, resp.headers.Get("Proxy-Status"))
+	assert.False(t, resp.headers.Has("X-Proxy-Attempts"))
+	assert.Equal(t, int32(2), badRequests.Load())
+	stats := pool.Stats()
+	assert.Equal(t, int64(1), stats.Requests)
+	assert.Equal(t, int64(1), stats.Retries)
+	assert.Equal(t, map[string]int64{outcomeOK: 1}, stats.Outcomes)
+
+	// Test: after all its attempts, a request the proxy couldn't send
+	// gets a 502 with the error
+	pool = newPool(PoolConfig{Retry: RetryPolicy{Attempts: 3}}, refused(t))
+	p = newProxy(t, Config{Pool: pool})
+	resp = do(t, p, get, "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", resp.statusLine)
+	assert.Contains(t, resp.headers.Get("Proxy-Status"), "httpfromtcp; error=connection_refused; next-hop=")
+	assert.Equal(t, "3", resp.headers.Get("X-Proxy-Attempts"))
+	assert.Equal(t, int64(1), pool.Stats().Outcomes[errConnectionRefused])
+
+	// Test: retries stop when the budget is spent
+	pool = newPool(PoolConfig{Retry: RetryPolicy{Attempts: 5, MinRetries: 2, Budget: 0.5}}, badURL)
+	p = newProxy(t, Config{Pool: pool})
+	badRequests.Store(0)
+	do(t, p, get, "203.0.113.7:5555")
+	do(t, p, get, "203.0.113.7:5555")
+	assert.Equal(t, int32(5), badRequests.Load())
+	stats = pool.Stats()
+	assert.Equal(t, int64(3), stats.Retries)
+	assert.Equal(t, int64(2), stats.RetriesOverBudget)
+	assert.Equal(t, map[string]int64{outcomeUpstream5xx: 2}, stats.Outcomes)
+}
+
+func TestProxy_CircuitOpen(t *testing.T) {
+	var calls atomic.Int32
+	failing := func(w *response.Writer, _ *request.Request) {
+		calls.Add(1)
+		response.WriteStatus(w, response.InternalServerError, nil)
+	}
+	pool, err := NewPool(PoolConfig{
+		Backends:       []BackendConfig{{URL: upstream(t, failing)}},
+		CircuitBreaker: CircuitBreaker{MinRequests: 3, OpenTimeout: time.Hour},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+	p := newProxy(t, Config{Pool: pool})
+
+	// Test: once the breaker opens the upstream isn't called, and the
+	// client is told why
+	for range 5 {
+		do(t, p, "GET / HTTP/1.1\r\nHost: proxy.test\r\n\r\n", "203.0.113.7:5555")
+	}
+	assert.Equal(t, int32(3), calls.Load())
+	resp := do(t, p, "GET / HTTP/1.1\r\nHost: proxy.test\r\n\r\n", "203.0.113.7:5555")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", resp.statusLine)
+	assert.Equal(t, "httpfromtcp; error=destination_unavailable", resp.headers.Get("Proxy-Status"))
+	assert.Equal(t, int64(3), pool.Stats().Outcomes[errDestinationUnavailable])
+}
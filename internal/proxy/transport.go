@@ -0,0 +1,562 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Defaults for the Transport fields left zero.
+const (
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultIdleConnTimeout       = 90 * time.Second
+	DefaultMaxIdleConnsPerHost   = 8
+)
+
+// maxHeaderBytes caps the size of an upstream's status line and header
+// section, and of a chunked body's trailer section.
+const maxHeaderBytes = 1 << 20
+
+// ErrResponseHeaderTimeout is returned when an upstream accepts a
+// request but doesn't start its response in time.
+var ErrResponseHeaderTimeout = errors.New("proxy: timeout awaiting response headers")
+
+// Transport sends requests to upstream servers over HTTP/1.1, and keeps
+// their connections open to reuse for later requests. Zero values fall
+// back to defaults. A Transport is safe for concurrent use.
+type Transport struct {
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for an upstream's response
+	// headers after the request has been sent.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an unused connection is kept.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is how many unused connections are kept for
+	// each upstream.
+	MaxIdleConnsPerHost int
+	// TLSClientConfig is used for https upstreams. Its ServerName
+	// defaults to the upstream's hostname.
+	TLSClientConfig *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+// Response is an upstream's response. Its Body must be closed, which
+// returns the connection for reuse if the body was read to the end.
+type Response struct {
+	StatusCode response.StatusCode
+	Reason     string
+	Headers    *headers.Headers
+	// ContentLength is the length of the body, or -1 if it is chunked
+	// or runs until the connection closes.
+	ContentLength int64
+	// Chunked reports whether the body came with chunked transfer
+	// coding, so it may be followed by trailers.
+	Chunked bool
+	Body    io.ReadCloser
+	// Trailers holds the fields after a chunked body, filled in once
+	// Body has been read to the end.
+	Trailers *headers.Headers
+}
+
+// persistConn is a connection to an upstream that may serve several
+// requests in turn.
+type persistConn struct {
+	key    string
+	conn   net.Conn
+	br     *bufio.Reader
+	bw     *bufio.Writer
+	reused bool
+	idleAt time.Time
+}
+
+// RoundTrip sends req to the upstream at target's scheme and host, and
+// returns once the response headers have arrived. The request line
+// uses req's method and request-target as they are, and req's headers
+// are sent unchanged apart from Content-Length, which is set from the
+// body. A request that fails on a reused connection before any of the
+// response arrives is tried once more on a new one, since the upstream
+// most likely closed the idle connection just as it was picked up: if
+// it couldn't be written, or if its method is idempotent. Once a whole
+// request went out, the upstream may have acted on it even though the
+// connection then closed, and anything else could happen twice.
+func (t *Transport) RoundTrip(target *url.URL, req *request.Request) (*Response, error) {
+	pc, err := t.getConn(target)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(pc, req)
+	if err != nil && pc.reused && canReplay(req, err) {
+		pc.conn.Close()
+		if pc, err = t.dial(target); err != nil {
+			return nil, err
+		}
+		resp, err = t.send(pc, req)
+	}
+	if err != nil {
+		pc.conn.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes every connection kept for reuse.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+}
+
+// errNothingRead marks a failure before the first byte of the response,
+// and errNotSent one before the whole request was written, which the
+// upstream can't have acted on.
+var (
+	errNothingRead = errors.New("proxy: connection closed before the response")
+	errNotSent     = errors.New("request not sent")
+)
+
+// canReplay reports whether req, which failed with err before any of the
+// response arrived, can be sent again. Its body is held in full, so it
+// can always be written again.
+func canReplay(req *request.Request, err error) bool {
+	return errors.Is(err, errNotSent) || errors.Is(err, errNothingRead) && isIdempotent(req.RequestLine.Method)
+}
+
+func (t *Transport) send(pc *persistConn, req *request.Request) (*Response, error) {
+	if err := writeRequest(pc.bw, req); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", errNothingRead, errNotSent, err)
+	}
+	timeout := t.ResponseHeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultResponseHeaderTimeout
+	}
+	pc.conn.SetReadDeadline(time.Now().Add(timeout))
+	resp, err := readResponse(pc.br, req.RequestLine.Method)
+	pc.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, ErrResponseHeaderTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reusable := (resp.ContentLength >= 0 || resp.Chunked) && !hasToken(resp.Headers, "Connection", "close")
+	if reusable && resp.ContentLength == 0 {
+		// nothing to wait for
+		t.putConn(pc)
+		return resp, nil
+	}
+	resp.Body = &bodyReader{r: resp.Body, done: func(ok bool) {
+		if ok && reusable {
+			t.putConn(pc)
+		} else {
+			pc.conn.Close()
+		}
+	}}
+	return resp, nil
+}
+
+func (t *Transport) getConn(target *url.URL) (*persistConn, error) {
+	key := target.Scheme + "://" + target.Host
+	idleTimeout := t.IdleConnTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleConnTimeout
+	}
+	t.mu.Lock()
+	for conns := t.idle[key]; len(conns) > 0; conns = t.idle[key] {
+		// the most recently used connection is the least likely to have
+		// been closed by the upstream
+		pc := conns[len(conns)-1]
+		t.idle[key] = conns[:len(conns)-1]
+		if time.Since(pc.idleAt) < idleTimeout {
+			t.mu.Unlock()
+			pc.reused = true
+			return pc, nil
+		}
+		pc.conn.Close()
+	}
+	t.mu.Unlock()
+	return t.dial(target)
+}
+
+func (t *Transport) putConn(pc *persistConn) {
+	max := t.MaxIdleConnsPerHost
+	if max == 0 {
+		max = DefaultMaxIdleConnsPerHost
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle == nil {
+		t.idle = map[string][]*persistConn{}
+	}
+	if len(t.idle[pc.key]) >= max {
+		pc.conn.Close()
+		return
+	}
+	pc.idleAt = time.Now()
+	t.idle[pc.key] = append(t.idle[pc.key], pc)
+}
+
+func (t *Transport) dial(target *url.URL) (*persistConn, error) {
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	addr := hostPort(target)
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	switch target.Scheme {
+	case "http":
+		conn, err = dialer.Dial("tcp", addr)
+	case "https":
+		config := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = target.Hostname()
+		}
+		// the responses are read as HTTP/1.1
+		config.NextProtos = []string{"http/1.1"}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	default:
+		return nil, fmt.Errorf("proxy: unsupported upstream scheme %q", target.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persistConn{
+		key:  target.Scheme + "://" + target.Host,
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}, nil
+}
+
+// hostPort returns the address to dial for target, with the scheme's
+// default port if it has none.
+func hostPort(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Hostname(), "443")
+	}
+	return net.JoinHostPort(target.Hostname(), "80")
+}
+
+// writeRequest writes req as an HTTP/1.1 request with a Content-Length
+// framed body.
+func writeRequest(bw *bufio.Writer, req *request.Request) error {
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	for _, name := range req.Headers.Names() {
+		if name == "content-length" || name == "transfer-encoding" {
+			continue
+		}
+		for _, value := range req.Headers.Values(name) {
+			fmt.Fprintf(bw, "%s: %s\r\n", headers.CanonicalName(name), value)
+		}
+	}
+	if len(req.Body) > 0 || bodyExpected(req.RequestLine.Method) {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", len(req.Body))
+	}
+	bw.WriteString("\r\n")
+	bw.Write(req.Body)
+	return bw.Flush()
+}
+
+// bodyExpected reports whether requests with method normally have a
+// body, so an empty one is still given a Content-Length of 0.
+func bodyExpected(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+// readResponse reads a response's status line and headers, skipping
+// interim 1xx responses, and sets up its body according to RFC 9112
+// section 6.3.
+func readResponse(br *bufio.Reader, method string) (*Response, error) {
+	for first := true; ; first = false {
+		line, err := readLine(br, maxHeaderBytes)
+		if err != nil {
+			if first && (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) {
+				return nil, fmt.Errorf("%w: %w", errNothingRead, err)
+			}
+			return nil, err
+		}
+		resp, http10, err := parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Headers, err = readFields(br); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == response.SwitchingProtocols {
+			return nil, errors.New("proxy: upstream switched protocols")
+		}
+		if resp.StatusCode.IsInformational() {
+			continue
+		}
+		if err := setBody(resp, br, method); err != nil {
+			return nil, err
+		}
+		if http10 {
+			// not worth keeping: HTTP/1.0 keep-alive is opt-in and rare
+			resp.Headers.Set("Connection", "close")
+		}
+		return resp, nil
+	}
+}
+
+func parseStatusLine(line string) (*Response, bool, error) {
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok || (version != "HTTP/1.1" && version != "HTTP/1.0") {
+		return nil, false, fmt.Errorf("proxy: malformed status line %q", line)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	n, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || !response.StatusCode(n).Valid() {
+		return nil, false, fmt.Errorf("proxy: malformed status line %q", line)
+	}
+	return &Response{StatusCode: response.StatusCode(n), Reason: reason}, version == "HTTP/1.0", nil
+}
+
+func setBody(resp *Response, br *bufio.Reader, method string) error {
+	resp.ContentLength = -1
+	switch {
+	case method == "HEAD" || resp.StatusCode == response.NoContent || resp.StatusCode == response.NotModified:
+		resp.ContentLength = 0
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+		return nil
+	case resp.Headers.Has("Transfer-Encoding"):
+		codings := strings.Split(resp.Headers.Get("Transfer-Encoding"), ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			// the body runs until the connection closes
+			resp.Body = io.NopCloser(br)
+			return nil
+		}
+		resp.Chunked = true
+		resp.Trailers = headers.NewHeaders()
+		resp.Body = io.NopCloser(&chunkedReader{br: br, trailers: resp.Trailers})
+		return nil
+	case resp.Headers.Has("Content-Length"):
+		n, err := contentLength(resp.Headers.Values("Content-Length"))
+		if err != nil {
+			return err
+		}
+		resp.ContentLength = n
+		resp.Body = io.NopCloser(&fixedReader{r: br, left: n})
+		return nil
+	}
+	resp.Body = io.NopCloser(br)
+	return nil
+}
+
+// contentLength parses Content-Length values, which may repeat but
+// must all agree.
+func contentLength(values []string) (int64, error) {
+	n := int64(-1)
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			m, err := headers.ParseContentLength(strings.TrimSpace(s))
+			if err != nil || n >= 0 && m != n {
+				return 0, fmt.Errorf("proxy: invalid Content-Length %q", v)
+			}
+			n = m
+		}
+	}
+	return n, nil
+}
+
+// readLine reads a line ending in LF, without its CRLF or LF.
+func readLine(br *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		part, err := br.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > limit {
+			return "", errors.New("proxy: header line too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+// readFields reads a header or trailer section up to its blank line.
+func readFields(br *bufio.Reader) (*headers.Headers, error) {
+	h := headers.NewHeaders()
+	total := 0
+	for {
+		line, err := readLine(br, maxHeaderBytes)
+		if err != nil {
+			return nil, err
+		}
+		if total += len(line); total > maxHeaderBytes {
+			return nil, errors.New("proxy: header section too large")
+		}
+		if line == "" {
+			return h, nil
+		}
+		if _, _, err := h.Parse([]byte(line + "\r\n")); err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	}
+}
+
+// chunkedReader decodes a chunked body, RFC 9112 section 7.1, and
+// collects the trailer section after it.
+type chunkedReader struct {
+	br       *bufio.Reader
+	trailers *headers.Headers
+	left     int64
+	done     bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.left == 0 {
+		line, err := readLine(cr.br, 4096)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		// chunk-size is 1*HEXDIG, with whitespace allowed only before
+		// an extension: ParseInt alone would take a sign
+		size, _, _ := strings.Cut(line, ";")
+		size = strings.TrimRight(size, " \t")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || strings.TrimLeft(size, "0123456789abcdefABCDEF") != "" {
+			return 0, fmt.Errorf("proxy: malformed chunk size %q", line)
+		}
+		if n == 0 {
+			trailers, err := readFields(cr.br)
+			if err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			for _, name := range trailers.Names() {
+				for _, v := range trailers.Values(name) {
+					cr.trailers.Set(name, v)
+				}
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.left = n
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.br.Read(p)
+	cr.left -= int64(n)
+	if cr.left == 0 && err == nil {
+		if line, lerr := readLine(cr.br, 2); lerr != nil || line != "" {
+			return n, errors.New("proxy: malformed chunk terminator")
+		}
+	}
+	return n, unexpectedEOF(err)
+}
+
+// fixedReader reads a body of a known length, which the connection
+// ending early cuts short.
+type fixedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (fr *fixedReader) Read(p []byte) (int, error) {
+	if fr.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	fr.left -= int64(n)
+	if fr.left == 0 {
+		// say so now, as a copy bounded by the length won't ask again
+		return n, io.EOF
+	}
+	return n, unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// bodyReader hands a connection back once its response body is done
+// with: for reuse if the body was read to the end, or to be closed if
+// it was abandoned or failed.
+type bodyReader struct {
+	r        io.ReadCloser
+	done     func(ok bool)
+	finished bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.finished {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.finish(err == io.EOF)
+	}
+	return n, err
+}
+
+func (b *bodyReader) Close() error {
+	b.finish(false)
+	return nil
+}
+
+func (b *bodyReader) finish(ok bool) {
+	if !b.finished {
+		b.finished = true
+		b.done(ok)
+	}
+}
+
+// hasToken reports whether the comma-separated list in the name field
+// of h contains token, ignoring case.
+func hasToken(h *headers.Headers, name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+// Package qpack implements QPACK, the header compression format for
+// HTTP/3 from RFC 9204, without a dynamic table.
+//
+// Both ends advertise a dynamic table capacity of zero, which RFC 9204
+// allows, so field sections only ever refer to the static table and no
+// encoder or decoder stream instructions are needed. The integer and
+// string encodings are HPACK's, shared with package hpack.
+package qpack
+
+import (
+	"errors"
+	"fmt"
+
+	"httpfromtcp/internal/hpack"
+)
+
+// ErrDecompression is wrapped by every decoding error. In HTTP/3 it is
+// a connection error of type QPACK_DECOMPRESSION_FAILED.
+var ErrDecompression = errors.New("qpack: decompression failed")
+
+// ErrFieldSectionTooLarge is returned for a field section that decodes
+// to more than the maximum field section size. It isn't a decompression
+// error, so in HTTP/3 only the request stream has to end.
+var ErrFieldSectionTooLarge = errors.New("qpack: field section too large")
+
+// HeaderField is a name-value pair, the same as HPACK's.
+type HeaderField = hpack.HeaderField
+
+const (
+	defaultMaxStringLen   = 1 << 20
+	defaultMaxSectionSize = 1 << 20
+)
+
+// Decoder decodes field sections that only use the static table.
+type Decoder struct {
+	maxStringLen   int
+	maxSectionSize uint64
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{maxStringLen: defaultMaxStringLen, maxSectionSize: defaultMaxSectionSize}
+}
+
+// SetMaxStringLength bounds each decoded name and value.
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLen = n
+}
+
+// SetMaxFieldSectionSize bounds the field section a Decode returns, as
+// the sum of the fields' sizes, RFC 9114 section 4.2.2. It is the value
+// advertised as SETTINGS_MAX_FIELD_SECTION_SIZE.
+func (d *Decoder) SetMaxFieldSectionSize(n uint64) {
+	d.maxSectionSize = n
+}
+
+// Decode decodes one encoded field section, such as the payload of an
+// HTTP/3 HEADERS frame. Without a dynamic table to keep right, decoding
+// stops as soon as the section goes over the maximum size.
+func (d *Decoder) Decode(section []byte) ([]HeaderField, error) {
+	ric, p, err := hpack.ReadInt(section, 8)
+	if err != nil {
+		return nil, decompressionError(err)
+	}
+	if ric != 0 {
+		return nil, fmt.Errorf("%w: reference to the dynamic table", ErrDecompression)
+	}
+	// the base doesn't matter without a dynamic table
+	if _, p, err = hpack.ReadInt(p, 7); err != nil {
+		return nil, decompressionError(err)
+	}
+
+	var fields []HeaderField
+	var sectionSize uint64
+	for len(p) > 0 {
+		var f HeaderField
+		switch b := p[0]; {
+		case b&0x80 != 0:
+			// indexed field line
+			if b&0x40 == 0 {
+				return nil, fmt.Errorf("%w: reference to the dynamic table", ErrDecompression)
+			}
+			var idx uint64
+			if idx, p, err = hpack.ReadInt(p, 6); err != nil {
+				return nil, decompressionError(err)
+			}
+			if f, err = static(idx); err != nil {
+				return nil, err
+			}
+		case b&0x40 != 0:
+			// literal field line with name reference
+			if b&0x10 == 0 {
+				return nil, fmt.Errorf("%w: reference to the dynamic table", ErrDecompression)
+			}
+			var idx uint64
+			if idx, p, err = hpack.ReadInt(p, 4); err != nil {
+				return nil, decompressionError(err)
+			}
+			var name HeaderField
+			if name, err = static(idx); err != nil {
+				return nil, err
+			}
+			f.Name = name.Name
+			f.Sensitive = b&0x20 != 0
+			if f.Value, p, err = hpack.ReadString(p, 7, d.maxStringLen); err != nil {
+				return nil, decompressionError(err)
+			}
+		case b&0x20 != 0:
+			// literal field line with literal name
+			f.Sensitive = b&0x10 != 0
+			if f.Name, p, err = hpack.ReadString(p, 3, d.maxStringLen); err != nil {
+				return nil, decompressionError(err)
+			}
+			if f.Value, p, err = hpack.ReadString(p, 7, d.maxStringLen); err != nil {
+				return nil, decompressionError(err)
+			}
+		default:
+			// the post-base forms only refer to the dynamic table
+			return nil, fmt.Errorf("%w: reference to the dynamic table", ErrDecompression)
+		}
+		if sectionSize += uint64(f.Size()); sectionSize > d.maxSectionSize {
+			return nil, ErrFieldSectionTooLarge
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func static(idx uint64) (HeaderField, error) {
+	if idx >= uint64(len(staticTable)) {
+		return HeaderField{}, fmt.Errorf("%w: static index %d out of range", ErrDecompression, idx)
+	}
+	return staticTable[idx], nil
+}
+
+func decompressionError(err error) error {
+	return fmt.Errorf("%w: %v", ErrDecompression, err)
+}
+
+// Encoder encodes field sections. Like hpack.Encoder it keeps no state,
+// so it is safe to share.
+type Encoder struct{}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// AppendFields appends a field section encoding fields to dst. Names
+// must already be lowercase.
+func (e *Encoder) AppendFields(dst []byte, fields []HeaderField) []byte {
+	// Required Insert Count and Delta Base are both zero
+	dst = append(dst, 0, 0)
+	for _, f := range fields {
+		dst = e.appendField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	if !f.Sensitive {
+		if idx, ok := staticByField[staticKey{f.Name, f.Value}]; ok {
+			return hpack.AppendInt(dst, 0xc0, 6, uint64(idx))
+		}
+	}
+	// the N bit keeps intermediaries from indexing sensitive fields
+	var never byte
+	if f.Sensitive {
+		never = 0x20
+	}
+	if idx, ok := staticByName[f.Name]; ok {
+		dst = hpack.AppendInt(dst, 0x50|never, 4, uint64(idx))
+	} else {
+		dst = hpack.AppendString(dst, 0x20|never>>1, 3, f.Name)
+	}
+	return hpack.AppendString(dst, 0, 7, f.Value)
+}
@@ -0,0 +1,81 @@
+package qpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestDecoder_RFCExample(t *testing.T) {
+	// Test: RFC 9204 B.1, a literal with a static name reference
+	fields, err := NewDecoder().Decode(unhex(t, "0000 510b 2f69 6e64 6578 2e68 746d 6c"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: ":path", Value: "/index.html"}}, fields)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+	}{
+		{"required insert count", "0100 d1"},
+		{"dynamic indexed", "0000 81"},
+		{"post-base indexed", "0000 10"},
+		{"dynamic name reference", "0000 4103 616263"},
+		{"static index out of range", "0000 ff25"},
+		{"truncated value", "0000 5f0a 05 6162"},
+		{"empty section", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder().Decode(unhex(t, tt.section))
+			assert.ErrorIs(t, err, ErrDecompression)
+		})
+	}
+}
+
+func TestDecoder_MaxFieldSectionSize(t *testing.T) {
+	d := NewDecoder()
+	d.SetMaxFieldSectionSize(100)
+	// Test: Empty cookies, each counted with its 32 bytes of overhead
+	fields, err := d.Decode(unhex(t, "0000 c5c5"))
+	require.NoError(t, err)
+	assert.Len(t, fields, 2)
+
+	// Test: Over the limit
+	_, err = d.Decode(unhex(t, "0000 c5c5c5"))
+	require.ErrorIs(t, err, ErrFieldSectionTooLarge)
+	assert.NotErrorIs(t, err, ErrDecompression)
+
+	// Test: One-byte cookie crumbs are stopped by the default limit
+	_, err = NewDecoder().Decode(append([]byte{0, 0}, strings.Repeat("\xc5", 30000)...))
+	require.ErrorIs(t, err, ErrFieldSectionTooLarge)
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "content-length", Value: "1234"},
+		{Name: "x-custom", Value: "some value"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+		{Name: "x-token", Value: "secret", Sensitive: true},
+	}
+	section := NewEncoder().AppendFields(nil, fields)
+
+	// Test: exact static matches take one byte
+	assert.Equal(t, unhex(t, "0000 d9 f5"), section[:4])
+
+	got, err := NewDecoder().Decode(section)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+}
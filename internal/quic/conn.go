@@ -0,0 +1,661 @@
+// Package quic is an experimental implementation of the QUIC transport
+// (RFC 9000), with its TLS 1.3 handshake from crypto/tls (RFC 9001) and
+// loss recovery and congestion control (RFC 9002), enough to carry
+// HTTP/3.
+//
+// It leaves out a good deal: ChaCha20-Poly1305, key updates, Retry,
+// 0-RTT, connection migration and more than one connection ID, path MTU
+// discovery, pacing, delayed ACKs and the draining period after a close.
+// Every datagram is at most 1200 bytes.
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config holds the transport settings for connections. Zero values
+// fall back to defaults.
+type Config struct {
+	// MaxIdleTimeout closes a connection that hears nothing from its
+	// peer for this long.
+	MaxIdleTimeout time.Duration
+	// MaxIncomingStreams and MaxIncomingUniStreams are how many
+	// bidirectional and unidirectional streams the peer may have open
+	// at once.
+	MaxIncomingStreams    int64
+	MaxIncomingUniStreams int64
+}
+
+const (
+	DefaultMaxIdleTimeout        = 30 * time.Second
+	DefaultMaxIncomingStreams    = 100
+	DefaultMaxIncomingUniStreams = 10
+)
+
+func (c *Config) withDefaults() Config {
+	out := Config{}
+	if c != nil {
+		out = *c
+	}
+	if out.MaxIdleTimeout <= 0 {
+		out.MaxIdleTimeout = DefaultMaxIdleTimeout
+	}
+	if out.MaxIncomingStreams <= 0 {
+		out.MaxIncomingStreams = DefaultMaxIncomingStreams
+	}
+	if out.MaxIncomingUniStreams <= 0 {
+		out.MaxIncomingUniStreams = DefaultMaxIncomingUniStreams
+	}
+	return out
+}
+
+// maxUndecryptable bounds the packets kept until the keys to read them
+// arrive, as happens when a datagram is reordered ahead of the one
+// that completes a handshake step.
+const maxUndecryptable = 8
+
+// Conn is a QUIC connection. One goroutine owns the connection state
+// and does all the reading and writing of packets; streams hand it
+// their data under mu.
+type Conn struct {
+	config Config
+	server bool
+	tls    *tls.QUICConn
+	remote net.Addr
+	// send writes a datagram to the peer, and onClose tells the
+	// endpoint the connection is gone
+	send    func([]byte) error
+	onClose func()
+	// onHandshake hands a listener the connection once it is ready, and
+	// reports whether it was taken
+	onHandshake func() bool
+	tlsState    tls.ConnectionState
+
+	recvCh        chan []byte
+	wakeCh        chan struct{}
+	handshakeDone chan struct{}
+	done          chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	scid         []byte // ours
+	dcid         []byte // the peer's
+	originalDCID []byte // the client's first destination ID
+	peerSCID     []byte // the source ID of the peer's first packet
+
+	spaces        [numSpaces]packetSpace
+	undecryptable [][]byte
+	localParams   transportParams
+	peerParams    *transportParams
+
+	handshakeComplete  bool
+	handshakeConfirmed bool
+	addressValidated   bool
+	bytesReceived      int
+	bytesSent          int
+
+	rtt                  rttStats
+	cc                   congestion
+	ptoCount             int
+	lastAckElicitingSent time.Time
+	lastActivity         time.Time
+	idleTimeout          time.Duration
+
+	streams        map[uint64]*Stream
+	localStreams   [2]uint64 // opened by us, by kind
+	peerMaxStreams [2]uint64 // how many the peer lets us open
+	peerStreams    [2]uint64 // opened by the peer
+	maxPeerStreams [2]uint64 // how many we let the peer open
+	acceptQueue    [2][]*Stream
+	sendQueue      []*Stream
+	control        []sentFrame // 1-RTT frames waiting to be sent
+
+	peerMaxData  uint64
+	dataSent     uint64
+	maxData      uint64
+	dataReceived uint64
+	dataRead     uint64
+
+	// closeErr is set when the connection is done; closeFrame, if set,
+	// still has to be sent
+	closeErr   error
+	closeFrame *frame
+}
+
+// packetSpace is the state of one packet number space.
+type packetSpace struct {
+	read, write *keys
+	discarded   bool
+
+	nextPN      uint64
+	largestRecv int64
+	recvRanges  []ackRange
+	ackPending  bool
+
+	sent                 []*sentPacket
+	largestAcked         int64
+	lossTime             time.Time
+	lastAckElicitingSent time.Time
+	retransmit           []sentFrame
+	probes               int
+
+	cryptoSend       []byte
+	cryptoSendOffset uint64
+	cryptoRecv       recvBuffer
+}
+
+func newConn(server bool, config Config, tlsConfig *tls.Config, remote net.Addr, send func([]byte) error) *Conn {
+	c := &Conn{
+		config:        config,
+		server:        server,
+		remote:        remote,
+		send:          send,
+		recvCh:        make(chan []byte, 64),
+		wakeCh:        make(chan struct{}, 1),
+		handshakeDone: make(chan struct{}),
+		done:          make(chan struct{}),
+		scid:          newConnID(),
+		rtt:           newRTTStats(),
+		cc:            newCongestion(),
+		idleTimeout:   config.MaxIdleTimeout,
+		streams:       map[uint64]*Stream{},
+		maxData:       connWindow,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.maxPeerStreams = [2]uint64{uint64(config.MaxIncomingStreams), uint64(config.MaxIncomingUniStreams)}
+	for s := range c.spaces {
+		c.spaces[s].largestRecv = -1
+		c.spaces[s].largestAcked = -1
+	}
+	c.localParams = transportParams{
+		initialSCID:           c.scid,
+		maxIdleTimeout:        config.MaxIdleTimeout,
+		maxUDPPayloadSize:     maxDatagramSize,
+		initialMaxData:        connWindow,
+		maxStreamDataBidiLoc:  streamWindow,
+		maxStreamDataBidiRem:  streamWindow,
+		maxStreamDataUni:      streamWindow,
+		initialMaxStreamsBidi: uint64(config.MaxIncomingStreams),
+		initialMaxStreamsUni:  uint64(config.MaxIncomingUniStreams),
+	}
+	qc := &tls.QUICConfig{TLSConfig: tlsConfig}
+	if server {
+		c.tls = tls.QUICServer(qc)
+	} else {
+		c.tls = tls.QUICClient(qc)
+	}
+	return c
+}
+
+func newConnID() []byte {
+	id := make([]byte, connIDLen)
+	rand.Read(id)
+	return id
+}
+
+// start sets up the Initial keys and begins the handshake. A client
+// picks the destination ID the keys derive from; a server takes it
+// from the client's first packet, whose source ID it answers to.
+func (c *Conn) start(originalDCID, peerSCID []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.originalDCID = originalDCID
+	if c.server {
+		c.dcid = peerSCID
+		c.peerSCID = peerSCID
+		c.localParams.originalDCID = originalDCID
+	} else {
+		c.dcid = originalDCID
+	}
+	read, write := initialKeys(originalDCID, c.server)
+	c.spaces[spaceInitial].read, c.spaces[spaceInitial].write = read, write
+	c.lastActivity = time.Now()
+	c.tls.SetTransportParameters(c.localParams.marshal(c.server))
+	if err := c.tls.Start(context.Background()); err != nil {
+		return err
+	}
+	if err := c.handleTLSEvents(); err != nil {
+		return err
+	}
+	go c.run()
+	return nil
+}
+
+// deliver hands a datagram to the connection's goroutine, dropping it
+// if the connection is falling behind.
+func (c *Conn) deliver(b []byte) {
+	select {
+	case c.recvCh <- b:
+	default:
+	}
+}
+
+func (c *Conn) wake() {
+	select {
+	case c.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		select {
+		case b := <-c.recvCh:
+			c.mu.Lock()
+			c.handleDatagram(b, time.Now())
+		case <-c.wakeCh:
+			c.mu.Lock()
+		case <-timer.C:
+			c.mu.Lock()
+			c.onTimer(time.Now())
+		}
+		c.flush(time.Now())
+		if c.closeErr != nil && c.closeFrame == nil {
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			c.tls.Close()
+			close(c.done)
+			if c.onClose != nil {
+				c.onClose()
+			}
+			return
+		}
+		deadline := c.nextTimeout()
+		c.mu.Unlock()
+		timer.Reset(time.Until(deadline))
+	}
+}
+
+// nextTimeout returns when the loss, probe or idle timer fires next.
+func (c *Conn) nextTimeout() time.Time {
+	deadline := c.lastActivity.Add(c.idleTimeout)
+	for s := range c.spaces {
+		if lt := c.spaces[s].lossTime; !lt.IsZero() && lt.Before(deadline) {
+			deadline = lt
+		}
+	}
+	if pto, _ := c.ptoTime(); !pto.IsZero() && pto.Before(deadline) {
+		deadline = pto
+	}
+	return deadline
+}
+
+func (c *Conn) onTimer(now time.Time) {
+	if !now.Before(c.lastActivity.Add(c.idleTimeout)) {
+		c.closeErr = ErrIdleTimeout
+		return
+	}
+	for s := spaceInitial; s < numSpaces; s++ {
+		if lt := c.spaces[s].lossTime; !lt.IsZero() && !now.Before(lt) {
+			c.detectLoss(s, now)
+			return
+		}
+	}
+	if pto, s := c.ptoTime(); !pto.IsZero() && !now.Before(pto) {
+		c.onPTO(s)
+	}
+}
+
+// handleDatagram processes every packet coalesced in a datagram.
+func (c *Conn) handleDatagram(b []byte, now time.Time) {
+	if c.closeErr != nil {
+		return
+	}
+	c.bytesReceived += len(b)
+	for len(b) > 0 {
+		h, err := parseHeader(b)
+		if err != nil || h.version != version1 && h.typ != packetType1RTT {
+			return
+		}
+		pkt := b[:h.length]
+		b = b[h.length:]
+		if err := c.handlePacket(h, pkt, now); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) handlePacket(h header, pkt []byte, now time.Time) error {
+	var s space
+	switch h.typ {
+	case packetTypeInitial:
+		s = spaceInitial
+	case packetTypeHandshake:
+		s = spaceHandshake
+	case packetType1RTT:
+		s = spaceApp
+	default:
+		// 0-RTT isn't accepted, and Retry is never asked for
+		return nil
+	}
+	if !bytes.Equal(h.dcid, c.scid) && !(c.server && h.typ != packetType1RTT && bytes.Equal(h.dcid, c.originalDCID)) {
+		return nil
+	}
+	sp := &c.spaces[s]
+	if sp.discarded {
+		return nil
+	}
+	if sp.read == nil {
+		if len(c.undecryptable) < maxUndecryptable {
+			c.undecryptable = append(c.undecryptable, bytes.Clone(pkt))
+		}
+		return nil
+	}
+	pn, payload, err := sp.read.open(pkt, h.pnOffset, sp.largestRecv)
+	if errors.Is(err, errDecrypt) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if s == spaceInitial && !c.server && c.peerSCID == nil {
+		// the client switches to the ID the server picked
+		c.peerSCID = bytes.Clone(h.scid)
+		c.dcid = c.peerSCID
+	}
+	if s == spaceHandshake && c.server && !c.addressValidated {
+		// only the real client could have read our Initial keys' reply
+		c.addressValidated = true
+		c.discardSpace(spaceInitial)
+	}
+	if sp.recordReceived(pn) {
+		return nil
+	}
+	c.lastActivity = now
+
+	keysBefore := c.keyCount()
+	ackEliciting := false
+	for len(payload) > 0 {
+		var f frame
+		f, payload, err = parseFrame(payload)
+		if err != nil {
+			return err
+		}
+		if !f.allowedIn(s) {
+			return transportError(ErrCodeProtocolViolation, "frame 0x%x in a %s packet", f.typ, s)
+		}
+		ackEliciting = ackEliciting || f.ackEliciting()
+		if err := c.handleFrame(s, f, now); err != nil {
+			return err
+		}
+		if c.closeErr != nil {
+			return nil
+		}
+	}
+	if ackEliciting {
+		sp.ackPending = true
+	}
+	if c.keyCount() > keysBefore && len(c.undecryptable) > 0 {
+		pending := c.undecryptable
+		c.undecryptable = nil
+		for _, p := range pending {
+			c.handleDatagram(p, now)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) keyCount() int {
+	n := 0
+	for s := range c.spaces {
+		if c.spaces[s].read != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Conn) handleFrame(s space, f frame, now time.Time) error {
+	switch f.typ {
+	case framePadding, framePing:
+	case frameAck, frameAckECN:
+		return c.onAck(s, f, now)
+	case frameCrypto:
+		return c.onCrypto(s, f)
+	case frameStream:
+		return c.onStreamFrame(f)
+	case frameResetStream:
+		return c.onResetStream(f)
+	case frameStopSending:
+		return c.onStopSending(f)
+	case frameMaxStreamData:
+		return c.onMaxStreamData(f)
+	case frameMaxData:
+		if f.value > c.peerMaxData {
+			c.peerMaxData = f.value
+			c.wake()
+		}
+	case frameMaxStreamsBidi, frameMaxStreamsUni:
+		if f.value > 1<<60 {
+			return transportError(ErrCodeFrameEncoding, "stream limit over 2^60")
+		}
+		i := streamKind(f.typ == frameMaxStreamsUni)
+		c.peerMaxStreams[i] = max(c.peerMaxStreams[i], f.value)
+	case frameDataBlocked, frameStreamDataBlocked, frameStreamsBlockedBidi, frameStreamsBlockedUni:
+		// limits are raised as data is read, not on request
+	case frameNewToken:
+		if c.server {
+			return transportError(ErrCodeProtocolViolation, "NEW_TOKEN from a client")
+		}
+	case frameNewConnectionID, frameRetireConnectionID:
+		// the connection never migrates, so one ID each way is enough
+	case framePathChallenge:
+		c.queueControl(append([]byte{framePathResponse}, f.data...))
+	case framePathResponse:
+	case frameHandshakeDone:
+		if c.server {
+			return transportError(ErrCodeProtocolViolation, "HANDSHAKE_DONE from a client")
+		}
+		c.handshakeConfirmed = true
+		c.discardSpace(spaceHandshake)
+	case frameConnectionClose:
+		c.closeErr = &TransportError{Code: ErrCode(f.code), Reason: f.reason, Remote: true}
+	case frameConnectionCloseApp:
+		c.closeErr = &ApplicationError{Code: f.code, Reason: f.reason, Remote: true}
+	}
+	return nil
+}
+
+// onCrypto feeds handshake data to TLS in order.
+func (c *Conn) onCrypto(s space, f frame) error {
+	sp := &c.spaces[s]
+	data := sp.cryptoRecv.push(f.offset, f.data)
+	if sp.cryptoRecv.buffered > maxCryptoBuffer {
+		return transportError(ErrCodeCryptoBufferExceeded, "too much out-of-order CRYPTO data")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := c.tls.HandleData(tlsLevel(s), data); err != nil {
+		return cryptoError(err)
+	}
+	return c.handleTLSEvents()
+}
+
+func tlsLevel(s space) tls.QUICEncryptionLevel {
+	return [...]tls.QUICEncryptionLevel{
+		tls.QUICEncryptionLevelInitial,
+		tls.QUICEncryptionLevelHandshake,
+		tls.QUICEncryptionLevelApplication,
+	}[s]
+}
+
+func spaceOf(level tls.QUICEncryptionLevel) (space, bool) {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return spaceInitial, true
+	case tls.QUICEncryptionLevelHandshake:
+		return spaceHandshake, true
+	case tls.QUICEncryptionLevelApplication:
+		return spaceApp, true
+	}
+	return 0, false
+}
+
+func cryptoError(err error) error {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return &TransportError{Code: ErrCodeCrypto + ErrCode(alert), Reason: err.Error()}
+	}
+	return transportError(ErrCodeInternal, "%v", err)
+}
+
+// handleTLSEvents acts on what the TLS handshake produced: keys, data
+// to send, and the peer's transport parameters.
+func (c *Conn) handleTLSEvents() error {
+	for {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			s, ok := spaceOf(e.Level)
+			if !ok {
+				continue
+			}
+			k, err := newKeys(e.Suite, e.Data)
+			if err != nil {
+				return transportError(ErrCodeCrypto+ErrCode(40), "%v", err) // handshake_failure
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				c.spaces[s].read = k
+			} else {
+				c.spaces[s].write = k
+			}
+		case tls.QUICWriteData:
+			if s, ok := spaceOf(e.Level); ok {
+				c.spaces[s].cryptoSend = append(c.spaces[s].cryptoSend, e.Data...)
+			}
+		case tls.QUICTransportParameters:
+			if err := c.setPeerParams(e.Data); err != nil {
+				return err
+			}
+		case tls.QUICTransportParametersRequired:
+			c.tls.SetTransportParameters(c.localParams.marshal(c.server))
+		case tls.QUICHandshakeDone:
+			c.handshakeComplete = true
+			c.tlsState = c.tls.ConnectionState()
+			if c.server {
+				c.handshakeConfirmed = true
+				c.discardSpace(spaceHandshake)
+				c.queueControl([]byte{frameHandshakeDone})
+				if c.onHandshake != nil && !c.onHandshake() {
+					return transportError(ErrCodeConnectionRefused, "too many connections waiting to be accepted")
+				}
+			}
+			close(c.handshakeDone)
+		}
+	}
+}
+
+// setPeerParams checks the peer's transport parameters, including the
+// connection IDs that prove nobody on the path tampered with them.
+func (c *Conn) setPeerParams(b []byte) error {
+	p, err := parseTransportParams(b, !c.server)
+	if err != nil {
+		return err
+	}
+	if !p.haveInitialSCID || !bytes.Equal(p.initialSCID, c.peerSCID) {
+		return transportError(ErrCodeTransportParameter, "initial_source_connection_id doesn't match")
+	}
+	if !c.server && (!p.haveOriginalDCID || !bytes.Equal(p.originalDCID, c.originalDCID) || p.haveRetrySCID) {
+		return transportError(ErrCodeTransportParameter, "original_destination_connection_id doesn't match")
+	}
+	c.peerParams = p
+	c.peerMaxData = p.initialMaxData
+	c.peerMaxStreams = [2]uint64{p.initialMaxStreamsBidi, p.initialMaxStreamsUni}
+	if p.maxIdleTimeout > 0 && p.maxIdleTimeout < c.idleTimeout {
+		c.idleTimeout = p.maxIdleTimeout
+	}
+	return nil
+}
+
+// discardSpace drops the keys and state of a space once the handshake
+// has moved past it.
+func (c *Conn) discardSpace(s space) {
+	sp := &c.spaces[s]
+	if sp.discarded {
+		return
+	}
+	for _, p := range sp.sent {
+		c.cc.bytesInFlight -= p.size
+	}
+	*sp = packetSpace{discarded: true, largestRecv: -1, largestAcked: -1}
+	c.ptoCount = 0
+}
+
+// queueControl queues a 1-RTT frame other than STREAM data.
+func (c *Conn) queueControl(b []byte) {
+	c.control = append(c.control, sentFrame{b: b})
+	c.wake()
+}
+
+// fail closes the connection because of err, telling the peer why.
+func (c *Conn) fail(err error) {
+	if c.closeErr != nil {
+		return
+	}
+	var te *TransportError
+	if !errors.As(err, &te) {
+		te = transportError(ErrCodeInternal, "%v", err)
+	}
+	c.closeErr = te
+	c.closeFrame = &frame{typ: frameConnectionClose, code: uint64(te.Code), reason: te.Reason}
+}
+
+// CloseWithError closes the connection with an application error code
+// and waits for the close to be sent.
+func (c *Conn) CloseWithError(code uint64, reason string) error {
+	c.mu.Lock()
+	if c.closeErr == nil {
+		c.closeErr = &ApplicationError{Code: code, Reason: reason}
+		c.closeFrame = &frame{typ: frameConnectionCloseApp, code: code, reason: reason}
+		c.cond.Broadcast()
+		c.wake()
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+// Close closes the connection with application error code 0.
+func (c *Conn) Close() error {
+	return c.CloseWithError(0, "")
+}
+
+// Done is closed once the connection is gone.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection closed, or nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+// ConnectionState returns the TLS state once the handshake is done,
+// including the negotiated application protocol.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tlsState
+}
+
+// RemoteAddr returns the peer's address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,265 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTLSConfigs returns matching server and client configs for a
+// self-signed certificate for 127.0.0.1.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"test"},
+	}
+	client = &tls.Config{RootCAs: pool, NextProtos: []string{"test"}}
+	return server, client
+}
+
+// echoServer listens on loopback and echoes every bidirectional stream
+// back to its sender.
+func echoServer(t *testing.T, tlsConfig *tls.Config) *Listener {
+	l, err := Listen("127.0.0.1:0", tlsConfig, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					s, err := c.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(s, s)
+						s.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func dialTest(t *testing.T, addr string, tlsConfig *tls.Config) *Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, addr, tlsConfig, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// echo sends data on a new stream and returns what comes back.
+func echo(t *testing.T, c *Conn, data []byte) []byte {
+	s, err := c.OpenStream()
+	require.NoError(t, err)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Write(data)
+		s.Close()
+		errc <- err
+	}()
+	got, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.NoError(t, <-errc)
+	return got
+}
+
+func TestConn_Echo(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l := echoServer(t, serverTLS)
+	c := dialTest(t, l.Addr().String(), clientTLS)
+	assert.Equal(t, "test", c.ConnectionState().NegotiatedProtocol)
+
+	// Test: small and large payloads, several streams at once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1)*(i+1)*(i+1))
+			assert.Equal(t, data, echo(t, c, data))
+		}()
+	}
+	wg.Wait()
+
+	// Test: more streams than the peer allows open at once get through
+	// as earlier ones finish
+	for i := 0; i < 2*DefaultMaxIncomingStreams; i++ {
+		require.Equal(t, []byte("x"), echo(t, c, []byte("x")))
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l, err := Listen("127.0.0.1:0", serverTLS, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	c := dialTest(t, l.Addr().String(), clientTLS)
+	sc, err := l.Accept(context.Background())
+	require.NoError(t, err)
+
+	// Test: the peer sees the application's code and reason
+	require.NoError(t, c.CloseWithError(0x42, "done"))
+	select {
+	case <-sc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server connection didn't close")
+	}
+	var appErr *ApplicationError
+	require.ErrorAs(t, sc.Err(), &appErr)
+	assert.Equal(t, uint64(0x42), appErr.Code)
+	assert.Equal(t, "done", appErr.Reason)
+	assert.True(t, appErr.Remote)
+
+	_, err = sc.AcceptStream(context.Background())
+	assert.ErrorAs(t, err, &appErr)
+}
+
+func TestConn_StreamReset(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l, err := Listen("127.0.0.1:0", serverTLS, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	c := dialTest(t, l.Addr().String(), clientTLS)
+	sc, err := l.Accept(context.Background())
+	require.NoError(t, err)
+
+	s, err := c.OpenStream()
+	require.NoError(t, err)
+	_, err = s.Write([]byte("partial"))
+	require.NoError(t, err)
+	ss, err := sc.AcceptStream(context.Background())
+	require.NoError(t, err)
+
+	// Test: the reader sees the data then the reset code
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(ss, buf)
+	require.NoError(t, err)
+	s.Reset(0x10c)
+	_, err = ss.Read(buf)
+	var streamErr *StreamError
+	require.ErrorAs(t, err, &streamErr)
+	assert.Equal(t, uint64(0x10c), streamErr.Code)
+}
+
+func TestDial_NoServer(t *testing.T) {
+	_, clientTLS := testTLSConfigs(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// Test: a silent server leaves the dial to the context
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = Dial(ctx, pc.LocalAddr().String(), clientTLS, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// lossyRelay forwards datagrams between one client and a server,
+// dropping every dropEvery-th datagram in each direction.
+type lossyRelay struct {
+	pc        net.PacketConn
+	server    net.Addr
+	dropEvery int
+
+	mu      sync.Mutex
+	client  net.Addr
+	count   map[bool]int
+	dropped int
+}
+
+func newLossyRelay(t *testing.T, server net.Addr, dropEvery int) *lossyRelay {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	r := &lossyRelay{pc: pc, server: server, dropEvery: dropEvery, count: map[bool]int{}}
+	go r.run()
+	return r
+}
+
+func (r *lossyRelay) run() {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		fromServer := addr.String() == r.server.String()
+		if !fromServer {
+			r.client = addr
+		}
+		to := r.server
+		if fromServer {
+			to = r.client
+		}
+		r.count[fromServer]++
+		drop := r.count[fromServer]%r.dropEvery == 0
+		if drop {
+			r.dropped++
+		}
+		r.mu.Unlock()
+		if !drop && to != nil {
+			r.pc.WriteTo(buf[:n], to)
+		}
+	}
+}
+
+func TestConn_LossRecovery(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l := echoServer(t, serverTLS)
+	relay := newLossyRelay(t, l.Addr(), 5)
+	c := dialTest(t, relay.pc.LocalAddr().String(), clientTLS)
+
+	// Test: everything arrives intact despite one datagram in five
+	// going missing, handshake included
+	data := make([]byte, 2<<20)
+	rand.Read(data)
+	got := echo(t, c, data)
+	require.Equal(t, len(data), len(got))
+	assert.True(t, bytes.Equal(data, got))
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	assert.Positive(t, relay.dropped)
+}
@@ -0,0 +1,185 @@
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// initialSalt derives the Initial secrets of QUIC version 1, from
+// RFC 9001 section 5.2.
+var initialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// errDecrypt is returned for packets that fail authentication. They are
+// dropped without closing the connection.
+var errDecrypt = errors.New("quic: packet failed authentication")
+
+// keys protect the packets of one encryption level in one direction.
+// Only the AES-GCM cipher suites are supported; a handshake that picks
+// ChaCha20-Poly1305 fails, since the standard library doesn't export it.
+type keys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// initialKeys derives the Initial keys from the client's first
+// destination connection ID, returning the ones the endpoint reads
+// with and the ones it writes with.
+func initialKeys(dcid []byte, server bool) (read, write *keys) {
+	secret, err := hkdf.Extract(sha256.New, dcid, initialSalt)
+	if err != nil {
+		panic(err)
+	}
+	client := expandLabel(sha256.New, secret, "client in", 32)
+	srv := expandLabel(sha256.New, secret, "server in", 32)
+	clientKeys, _ := newKeys(tls.TLS_AES_128_GCM_SHA256, client)
+	serverKeys, _ := newKeys(tls.TLS_AES_128_GCM_SHA256, srv)
+	if server {
+		return clientKeys, serverKeys
+	}
+	return serverKeys, clientKeys
+}
+
+// newKeys derives packet protection keys from a TLS traffic secret.
+func newKeys(suite uint16, secret []byte) (*keys, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("quic: unsupported cipher suite %s", tls.CipherSuiteName(suite))
+	}
+	block, err := aes.NewCipher(expandLabel(h, secret, "quic key", keyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(expandLabel(h, secret, "quic hp", keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &keys{aead: aead, iv: expandLabel(h, secret, "quic iv", aead.NonceSize()), hp: hp}, nil
+}
+
+// expandLabel is HKDF-Expand-Label from RFC 8446 section 7.1, with an
+// empty context.
+func expandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len("tls13 ")+len(label)))
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, 0)
+	out, err := hkdf.Expand(h, secret, string(info), length)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func (k *keys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// mask computes the header protection mask from the 16-byte sample of
+// the ciphertext.
+func (k *keys) mask(sample []byte) []byte {
+	out := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(out, sample)
+	return out[:5]
+}
+
+// seal encrypts the packet in pkt, whose header (packet number
+// included) is pkt[:hdrLen] and whose payload is the rest, then applies
+// header protection. The packet number is always pnLen bytes long and
+// ends the header.
+func (k *keys) seal(pkt []byte, hdrLen int, pn uint64) []byte {
+	hdr, payload := pkt[:hdrLen], pkt[hdrLen:]
+	out := k.aead.Seal(hdr, k.nonce(pn), payload, hdr)
+	pnOffset := hdrLen - pnLen
+	m := k.mask(out[pnOffset+4 : pnOffset+4+16])
+	if out[0]&0x80 != 0 {
+		out[0] ^= m[0] & 0x0f
+	} else {
+		out[0] ^= m[0] & 0x1f
+	}
+	for i := 0; i < pnLen; i++ {
+		out[pnOffset+i] ^= m[1+i]
+	}
+	return out
+}
+
+// open removes header protection and decrypts the packet in pkt, whose
+// packet number starts at pnOffset, in place. largest is the largest
+// packet number received so far in the space, or -1.
+func (k *keys) open(pkt []byte, pnOffset int, largest int64) (pn uint64, payload []byte, err error) {
+	if len(pkt) < pnOffset+4+16 {
+		return 0, nil, errDecrypt
+	}
+	m := k.mask(pkt[pnOffset+4 : pnOffset+4+16])
+	long := pkt[0]&0x80 != 0
+	if long {
+		pkt[0] ^= m[0] & 0x0f
+	} else {
+		pkt[0] ^= m[0] & 0x1f
+	}
+	n := int(pkt[0]&0x03) + 1
+	var truncated uint64
+	for i := 0; i < n; i++ {
+		pkt[pnOffset+i] ^= m[1+i]
+		truncated = truncated<<8 | uint64(pkt[pnOffset+i])
+	}
+	pn = decodePacketNumber(largest, truncated, n*8)
+	hdrLen := pnOffset + n
+	payload, err = k.aead.Open(pkt[hdrLen:hdrLen], k.nonce(pn), pkt[hdrLen:], pkt[:hdrLen])
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	// the reserved bits are only checked once the packet is known to be
+	// genuine, per RFC 9000 section 17.2
+	reserved := pkt[0] & 0x18
+	if long {
+		reserved = pkt[0] & 0x0c
+	}
+	if reserved != 0 {
+		return 0, nil, transportError(ErrCodeProtocolViolation, "reserved header bits set")
+	}
+	return pn, payload, nil
+}
+
+// decodePacketNumber recovers a full packet number from its truncated
+// form, as in RFC 9000 appendix A.3.
+func decodePacketNumber(largest int64, truncated uint64, bits int) uint64 {
+	expected := uint64(largest + 1)
+	win := uint64(1) << bits
+	hwin := win / 2
+	candidate := (expected &^ (win - 1)) | truncated
+	switch {
+	case candidate+hwin <= expected && candidate < (1<<62)-win:
+		return candidate + win
+	case candidate > expected+hwin && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
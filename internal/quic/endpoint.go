@@ -0,0 +1,225 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// maxUDPSize is the largest datagram read.
+const maxUDPSize = 65535
+
+// acceptBacklog is how many handshaken connections may wait for Accept
+// before new ones are refused.
+const acceptBacklog = 64
+
+// Listener accepts QUIC connections on a UDP socket. Datagrams are
+// routed to connections by the destination connection ID.
+type Listener struct {
+	pc        net.PacketConn
+	tlsConfig *tls.Config
+	config    Config
+
+	acceptCh chan *Conn
+	closed   chan struct{}
+	done     chan struct{}
+
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// Listen listens for QUIC connections on the UDP address addr. The TLS
+// config needs a certificate and the application protocols to offer,
+// since QUIC requires ALPN.
+func Listen(addr string, tlsConfig *tls.Config, config *Config) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		pc:        pc,
+		tlsConfig: tls13(tlsConfig),
+		config:    config.withDefaults(),
+		acceptCh:  make(chan *Conn, acceptBacklog),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+		conns:     map[string]*Conn{},
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func tls13(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	return config
+}
+
+// Addr returns the address the listener is bound to.
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// Accept waits for a connection that has completed its handshake.
+func (l *Listener) Accept(ctx context.Context) (*Conn, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes every connection and then the socket.
+func (l *Listener) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+	close(l.closed)
+	l.mu.Lock()
+	var conns []*Conn
+	seen := map[*Conn]bool{}
+	for _, c := range l.conns {
+		if !seen[c] {
+			seen[c] = true
+			conns = append(conns, c)
+		}
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	err := l.pc.Close()
+	<-l.done
+	return err
+}
+
+func (l *Listener) readLoop() {
+	defer close(l.done)
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		l.handleDatagram(bytes.Clone(buf[:n]), addr)
+	}
+}
+
+func (l *Listener) handleDatagram(b []byte, addr net.Addr) {
+	h, err := parseHeader(b)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	c := l.conns[string(h.dcid)]
+	l.mu.Unlock()
+	if c != nil {
+		c.deliver(b)
+		return
+	}
+	if h.typ == packetType1RTT || len(b) < maxDatagramSize {
+		// too small to be a client's first flight, which is always
+		// padded, so not worth answering
+		return
+	}
+	if h.version != version1 {
+		l.pc.WriteTo(appendVersionNegotiation(nil, h.dcid, h.scid), addr)
+		return
+	}
+	if h.typ != packetTypeInitial || len(h.dcid) < 8 {
+		return
+	}
+	select {
+	case <-l.closed:
+		return
+	default:
+	}
+
+	c = newConn(true, l.config, l.tlsConfig, addr, func(b []byte) error {
+		_, err := l.pc.WriteTo(b, addr)
+		return err
+	})
+	originalDCID := bytes.Clone(h.dcid)
+	c.onHandshake = func() bool {
+		select {
+		case l.acceptCh <- c:
+			return true
+		default:
+			return false
+		}
+	}
+	c.onClose = func() {
+		l.mu.Lock()
+		delete(l.conns, string(originalDCID))
+		delete(l.conns, string(c.scid))
+		l.mu.Unlock()
+	}
+	l.mu.Lock()
+	// the client's retransmitted Initials still carry the ID it picked
+	l.conns[string(originalDCID)] = c
+	l.conns[string(c.scid)] = c
+	l.mu.Unlock()
+	if err := c.start(originalDCID, bytes.Clone(h.scid)); err != nil {
+		c.onClose()
+		return
+	}
+	c.deliver(b)
+}
+
+// Dial opens a QUIC connection to the UDP address addr and waits for
+// the handshake. The TLS config must offer application protocols; its
+// ServerName defaults to the host in addr.
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tls13(tlsConfig)
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig.ServerName = host
+	}
+	c := newConn(false, config.withDefaults(), tlsConfig, raddr, func(b []byte) error {
+		_, err := udp.Write(b)
+		return err
+	})
+	c.onClose = func() { udp.Close() }
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			c.deliver(bytes.Clone(buf[:n]))
+		}
+	}()
+	if err := c.start(newConnID(), nil); err != nil {
+		udp.Close()
+		return nil, err
+	}
+	c.wake()
+	select {
+	case <-c.handshakeDone:
+		return c, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		c.CloseWithError(0, "")
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,122 @@
+package quic
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCode is a QUIC transport error code, sent in a CONNECTION_CLOSE
+// frame of type 0x1c.
+type ErrCode uint64
+
+const (
+	ErrCodeNo                   ErrCode = 0x0
+	ErrCodeInternal             ErrCode = 0x1
+	ErrCodeConnectionRefused    ErrCode = 0x2
+	ErrCodeFlowControl          ErrCode = 0x3
+	ErrCodeStreamLimit          ErrCode = 0x4
+	ErrCodeStreamState          ErrCode = 0x5
+	ErrCodeFinalSize            ErrCode = 0x6
+	ErrCodeFrameEncoding        ErrCode = 0x7
+	ErrCodeTransportParameter   ErrCode = 0x8
+	ErrCodeConnectionIDLimit    ErrCode = 0x9
+	ErrCodeProtocolViolation    ErrCode = 0xa
+	ErrCodeInvalidToken         ErrCode = 0xb
+	ErrCodeApplication          ErrCode = 0xc
+	ErrCodeCryptoBufferExceeded ErrCode = 0xd
+	ErrCodeKeyUpdate            ErrCode = 0xe
+	ErrCodeAEADLimitReached     ErrCode = 0xf
+	ErrCodeNoViablePath         ErrCode = 0x10
+	// ErrCodeCrypto is added to a TLS alert to make its error code.
+	ErrCodeCrypto ErrCode = 0x100
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                   "NO_ERROR",
+	ErrCodeInternal:             "INTERNAL_ERROR",
+	ErrCodeConnectionRefused:    "CONNECTION_REFUSED",
+	ErrCodeFlowControl:          "FLOW_CONTROL_ERROR",
+	ErrCodeStreamLimit:          "STREAM_LIMIT_ERROR",
+	ErrCodeStreamState:          "STREAM_STATE_ERROR",
+	ErrCodeFinalSize:            "FINAL_SIZE_ERROR",
+	ErrCodeFrameEncoding:        "FRAME_ENCODING_ERROR",
+	ErrCodeTransportParameter:   "TRANSPORT_PARAMETER_ERROR",
+	ErrCodeConnectionIDLimit:    "CONNECTION_ID_LIMIT_ERROR",
+	ErrCodeProtocolViolation:    "PROTOCOL_VIOLATION",
+	ErrCodeInvalidToken:         "INVALID_TOKEN",
+	ErrCodeApplication:          "APPLICATION_ERROR",
+	ErrCodeCryptoBufferExceeded: "CRYPTO_BUFFER_EXCEEDED",
+	ErrCodeKeyUpdate:            "KEY_UPDATE_ERROR",
+	ErrCodeAEADLimitReached:     "AEAD_LIMIT_REACHED",
+	ErrCodeNoViablePath:         "NO_VIABLE_PATH",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	if c >= ErrCodeCrypto && c < ErrCodeCrypto+0x100 {
+		return fmt.Sprintf("CRYPTO_ERROR(alert %d)", uint64(c-ErrCodeCrypto))
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint64(c))
+}
+
+// TransportError is an error that closes the connection at the QUIC
+// layer, either because we found a problem or because the peer said so.
+type TransportError struct {
+	Code   ErrCode
+	Reason string
+	// Remote is set when the peer closed the connection.
+	Remote bool
+}
+
+func (e *TransportError) Error() string {
+	who := "local"
+	if e.Remote {
+		who = "peer"
+	}
+	return fmt.Sprintf("quic: connection closed by %s: %s: %s", who, e.Code, e.Reason)
+}
+
+// ApplicationError is an error code of the protocol running over QUIC,
+// used to close a connection or reset a stream.
+type ApplicationError struct {
+	Code   uint64
+	Reason string
+	Remote bool
+}
+
+func (e *ApplicationError) Error() string {
+	who := "local"
+	if e.Remote {
+		who = "peer"
+	}
+	return fmt.Sprintf("quic: application error 0x%x from %s: %s", e.Code, who, e.Reason)
+}
+
+// StreamError is returned from a stream the peer reset or stopped
+// reading.
+type StreamError struct {
+	StreamID uint64
+	Code     uint64
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("quic: stream %d aborted with code 0x%x", e.StreamID, e.Code)
+}
+
+var (
+	// ErrClosed is returned by a listener or connection that was closed
+	// locally without an error.
+	ErrClosed = errors.New("quic: closed")
+	// ErrStreamLimit is returned when the peer doesn't allow another
+	// stream yet.
+	ErrStreamLimit = errors.New("quic: stream limit reached")
+	// ErrIdleTimeout closes a connection that heard nothing from its
+	// peer for the idle timeout.
+	ErrIdleTimeout = errors.New("quic: idle timeout")
+)
+
+func transportError(code ErrCode, format string, args ...any) *TransportError {
+	return &TransportError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,262 @@
+package quic
+
+const (
+	framePadding            = 0x00
+	framePing               = 0x01
+	frameAck                = 0x02
+	frameAckECN             = 0x03
+	frameResetStream        = 0x04
+	frameStopSending        = 0x05
+	frameCrypto             = 0x06
+	frameNewToken           = 0x07
+	frameStream             = 0x08 // through 0x0f, with the flags below
+	frameMaxData            = 0x10
+	frameMaxStreamData      = 0x11
+	frameMaxStreamsBidi     = 0x12
+	frameMaxStreamsUni      = 0x13
+	frameDataBlocked        = 0x14
+	frameStreamDataBlocked  = 0x15
+	frameStreamsBlockedBidi = 0x16
+	frameStreamsBlockedUni  = 0x17
+	frameNewConnectionID    = 0x18
+	frameRetireConnectionID = 0x19
+	framePathChallenge      = 0x1a
+	framePathResponse       = 0x1b
+	frameConnectionClose    = 0x1c
+	frameConnectionCloseApp = 0x1d
+	frameHandshakeDone      = 0x1e
+
+	streamFlagFin = 0x01
+	streamFlagLen = 0x02
+	streamFlagOff = 0x04
+)
+
+// ackRange is an inclusive range of acknowledged packet numbers.
+type ackRange struct {
+	lo, hi uint64
+}
+
+// frame is any parsed frame. Which fields are set depends on the type.
+type frame struct {
+	typ      uint64
+	streamID uint64
+	offset   uint64
+	data     []byte
+	fin      bool
+	// code is an error code, and value a limit, a final size, or the
+	// frame type a CONNECTION_CLOSE blames
+	code   uint64
+	value  uint64
+	reason string
+	// ranges are in descending order
+	ranges []ackRange
+}
+
+// frameReader reads the fields of a frame, remembering whether it ran
+// out of bytes.
+type frameReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *frameReader) varint() uint64 {
+	v, n := ReadVarint(r.b)
+	if n < 0 {
+		r.bad = true
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *frameReader) bytes(n uint64) []byte {
+	if r.bad || n > uint64(len(r.b)) {
+		r.bad = true
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// parseFrame parses the frame at the front of b and returns the rest.
+func parseFrame(b []byte) (frame, []byte, error) {
+	r := &frameReader{b: b}
+	f := frame{typ: r.varint()}
+	switch t := f.typ; {
+	case t == framePadding:
+		// runs of padding are consumed in one go
+		for len(r.b) > 0 && r.b[0] == 0 {
+			r.b = r.b[1:]
+		}
+	case t == framePing, t == frameHandshakeDone:
+	case t == frameAck, t == frameAckECN:
+		largest := r.varint()
+		r.varint() // ACK delay, which RTT estimates leave out
+		count := r.varint()
+		first := r.varint()
+		if first > largest {
+			return f, nil, transportError(ErrCodeFrameEncoding, "ACK range below zero")
+		}
+		f.ranges = append(f.ranges, ackRange{largest - first, largest})
+		for i := uint64(0); i < count && !r.bad; i++ {
+			gap, length := r.varint(), r.varint()
+			prev := f.ranges[len(f.ranges)-1].lo
+			if prev < gap+2+length {
+				return f, nil, transportError(ErrCodeFrameEncoding, "ACK range below zero")
+			}
+			hi := prev - gap - 2
+			f.ranges = append(f.ranges, ackRange{hi - length, hi})
+		}
+		if t == frameAckECN {
+			r.varint()
+			r.varint()
+			r.varint()
+		}
+	case t == frameResetStream:
+		f.streamID, f.code, f.value = r.varint(), r.varint(), r.varint()
+	case t == frameStopSending:
+		f.streamID, f.code = r.varint(), r.varint()
+	case t == frameCrypto:
+		f.offset = r.varint()
+		f.data = r.bytes(r.varint())
+	case t == frameNewToken:
+		if len(r.bytes(r.varint())) == 0 && !r.bad {
+			return f, nil, transportError(ErrCodeFrameEncoding, "empty NEW_TOKEN")
+		}
+	case t >= frameStream && t <= frameStream|0x07:
+		f.streamID = r.varint()
+		if t&streamFlagOff != 0 {
+			f.offset = r.varint()
+		}
+		if t&streamFlagLen != 0 {
+			f.data = r.bytes(r.varint())
+		} else {
+			f.data, r.b = r.b, nil
+		}
+		f.fin = t&streamFlagFin != 0
+		f.typ = frameStream
+	case t == frameMaxData, t == frameDataBlocked,
+		t == frameMaxStreamsBidi, t == frameMaxStreamsUni,
+		t == frameStreamsBlockedBidi, t == frameStreamsBlockedUni:
+		f.value = r.varint()
+	case t == frameMaxStreamData, t == frameStreamDataBlocked:
+		f.streamID, f.value = r.varint(), r.varint()
+	case t == frameNewConnectionID:
+		r.varint() // sequence number
+		r.varint() // retire prior to
+		if l := r.bytes(1); len(l) == 1 {
+			r.bytes(uint64(l[0]))
+		}
+		r.bytes(16) // stateless reset token
+	case t == frameRetireConnectionID:
+		r.varint()
+	case t == framePathChallenge, t == framePathResponse:
+		f.data = r.bytes(8)
+	case t == frameConnectionClose, t == frameConnectionCloseApp:
+		f.code = r.varint()
+		if t == frameConnectionClose {
+			f.value = r.varint()
+		}
+		f.reason = string(r.bytes(r.varint()))
+	default:
+		return f, nil, transportError(ErrCodeFrameEncoding, "unknown frame type 0x%x", t)
+	}
+	if r.bad {
+		return f, nil, transportError(ErrCodeFrameEncoding, "truncated frame of type 0x%x", f.typ)
+	}
+	if f.offset+uint64(len(f.data)) > maxVarint {
+		return f, nil, transportError(ErrCodeFrameEncoding, "data beyond the largest offset")
+	}
+	return f, r.b, nil
+}
+
+// ackEliciting reports whether a packet with this frame must be
+// acknowledged.
+func (f *frame) ackEliciting() bool {
+	switch f.typ {
+	case framePadding, frameAck, frameAckECN, frameConnectionClose, frameConnectionCloseApp:
+		return false
+	}
+	return true
+}
+
+// allowedIn reports whether the frame may appear in a packet of space s,
+// per RFC 9000 section 12.4.
+func (f *frame) allowedIn(s space) bool {
+	if s == spaceApp {
+		return true
+	}
+	switch f.typ {
+	case framePadding, framePing, frameAck, frameAckECN, frameCrypto, frameConnectionClose:
+		return true
+	}
+	return false
+}
+
+// appendAck appends an ACK frame for ranges, which are in descending
+// order. The delay is always sent as zero since ACKs aren't delayed.
+func appendAck(dst []byte, ranges []ackRange) []byte {
+	dst = AppendVarint(dst, frameAck)
+	dst = AppendVarint(dst, ranges[0].hi)
+	dst = AppendVarint(dst, 0)
+	dst = AppendVarint(dst, uint64(len(ranges)-1))
+	dst = AppendVarint(dst, ranges[0].hi-ranges[0].lo)
+	for i := 1; i < len(ranges); i++ {
+		dst = AppendVarint(dst, ranges[i-1].lo-ranges[i].hi-2)
+		dst = AppendVarint(dst, ranges[i].hi-ranges[i].lo)
+	}
+	return dst
+}
+
+func appendCrypto(dst []byte, offset uint64, data []byte) []byte {
+	dst = AppendVarint(dst, frameCrypto)
+	dst = AppendVarint(dst, offset)
+	dst = AppendVarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+func appendStream(dst []byte, id, offset uint64, data []byte, fin bool) []byte {
+	t := uint64(frameStream | streamFlagLen)
+	if offset > 0 {
+		t |= streamFlagOff
+	}
+	if fin {
+		t |= streamFlagFin
+	}
+	dst = AppendVarint(dst, t)
+	dst = AppendVarint(dst, id)
+	if offset > 0 {
+		dst = AppendVarint(dst, offset)
+	}
+	dst = AppendVarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+// dataFrameOverhead is the most a CRYPTO or STREAM frame adds to
+// n bytes of data at offset.
+func dataFrameOverhead(id, offset uint64, n int) int {
+	return 1 + VarintLen(id) + VarintLen(offset) + VarintLen(uint64(n))
+}
+
+func appendConnectionClose(dst []byte, app bool, code uint64, reason string) []byte {
+	if app {
+		dst = AppendVarint(dst, frameConnectionCloseApp)
+		dst = AppendVarint(dst, code)
+	} else {
+		dst = AppendVarint(dst, frameConnectionClose)
+		dst = AppendVarint(dst, code)
+		dst = AppendVarint(dst, 0)
+	}
+	dst = AppendVarint(dst, uint64(len(reason)))
+	return append(dst, reason...)
+}
+
+// appendFrame appends a frame made of a type and varint fields.
+func appendFrame(dst []byte, typ uint64, fields ...uint64) []byte {
+	dst = AppendVarint(dst, typ)
+	for _, v := range fields {
+		dst = AppendVarint(dst, v)
+	}
+	return dst
+}
@@ -0,0 +1,181 @@
+package quic
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// version1 is the only QUIC version spoken, RFC 9000.
+const version1 = 0x00000001
+
+const (
+	// maxDatagramSize is the size of every datagram sent. It is the
+	// smallest size QUIC allows, so path MTU discovery isn't needed.
+	maxDatagramSize = 1200
+	// connIDLen is the length of the connection IDs this end picks.
+	connIDLen = 8
+	// pnLen is the length every packet number is sent with. Four bytes
+	// cost a little space but never need the payload padded to leave
+	// room for the header protection sample.
+	pnLen = 4
+	// aeadOverhead is the tag the AEAD adds to every payload.
+	aeadOverhead = 16
+)
+
+// packetType is the type of a long header packet, or packetType1RTT
+// for short header packets.
+type packetType byte
+
+const (
+	packetTypeInitial   packetType = 0x0
+	packetType0RTT      packetType = 0x1
+	packetTypeHandshake packetType = 0x2
+	packetTypeRetry     packetType = 0x3
+	packetType1RTT      packetType = 0xff
+)
+
+// space is a packet number space. Each has its own keys, packet
+// numbers and acknowledgements.
+type space int
+
+const (
+	spaceInitial space = iota
+	spaceHandshake
+	spaceApp
+	numSpaces
+)
+
+func (s space) String() string {
+	return [...]string{"Initial", "Handshake", "1-RTT"}[s]
+}
+
+func (s space) packetType() packetType {
+	return [...]packetType{packetTypeInitial, packetTypeHandshake, packetType1RTT}[s]
+}
+
+var errShortPacket = errors.New("quic: truncated packet")
+
+// header is the unprotected part of a packet header.
+type header struct {
+	typ     packetType
+	version uint32
+	dcid    []byte
+	scid    []byte
+	token   []byte
+	// pnOffset is where the protected packet number starts, and length
+	// is the whole packet's length within the datagram.
+	pnOffset int
+	length   int
+}
+
+// parseHeader parses the packet at the front of b. Short header
+// packets carry no length, so they run to the end of the datagram, and
+// their connection ID is assumed to be connIDLen bytes. Long header
+// packets of other versions are returned with only the version and
+// connection IDs set.
+func parseHeader(b []byte) (header, error) {
+	if len(b) < 1 {
+		return header{}, errShortPacket
+	}
+	if b[0]&0x80 == 0 {
+		if len(b) < 1+connIDLen {
+			return header{}, errShortPacket
+		}
+		return header{typ: packetType1RTT, dcid: b[1 : 1+connIDLen], pnOffset: 1 + connIDLen, length: len(b)}, nil
+	}
+
+	var h header
+	if len(b) < 6 {
+		return h, errShortPacket
+	}
+	h.version = binary.BigEndian.Uint32(b[1:5])
+	p := b[5:]
+	var ok bool
+	if h.dcid, p, ok = readConnID(p); !ok {
+		return h, errShortPacket
+	}
+	if h.scid, p, ok = readConnID(p); !ok {
+		return h, errShortPacket
+	}
+	if h.version != version1 {
+		return h, nil
+	}
+	h.typ = packetType(b[0]>>4) & 0x3
+	if h.typ == packetTypeRetry {
+		h.length = len(b)
+		return h, nil
+	}
+	if h.typ == packetTypeInitial {
+		n, l := ReadVarint(p)
+		if l < 0 || uint64(len(p)-l) < n {
+			return h, errShortPacket
+		}
+		h.token, p = p[l:l+int(n)], p[l+int(n):]
+	}
+	n, l := ReadVarint(p)
+	if l < 0 || uint64(len(p)-l) < n {
+		return h, errShortPacket
+	}
+	h.pnOffset = len(b) - len(p) + l
+	h.length = h.pnOffset + int(n)
+	return h, nil
+}
+
+func readConnID(p []byte) (id, rest []byte, ok bool) {
+	if len(p) < 1 || int(p[0]) > 20 || len(p) < 1+int(p[0]) {
+		return nil, nil, false
+	}
+	return p[1 : 1+p[0]], p[1+p[0]:], true
+}
+
+// appendLongHeader appends a long header up to and including the packet
+// number, with a two-byte length field covering payloadLen bytes of
+// payload plus the AEAD tag.
+func appendLongHeader(dst []byte, typ packetType, dcid, scid, token []byte, pn uint64, payloadLen int) []byte {
+	dst = append(dst, 0xc0|byte(typ)<<4|(pnLen-1))
+	dst = binary.BigEndian.AppendUint32(dst, version1)
+	dst = append(dst, byte(len(dcid)))
+	dst = append(dst, dcid...)
+	dst = append(dst, byte(len(scid)))
+	dst = append(dst, scid...)
+	if typ == packetTypeInitial {
+		dst = AppendVarint(dst, uint64(len(token)))
+		dst = append(dst, token...)
+	}
+	length := uint64(pnLen + payloadLen + aeadOverhead)
+	dst = append(dst, 0x40|byte(length>>8), byte(length))
+	return binary.BigEndian.AppendUint32(dst, uint32(pn))
+}
+
+// appendShortHeader appends a 1-RTT header, with the key phase always
+// zero since key updates aren't supported.
+func appendShortHeader(dst []byte, dcid []byte, pn uint64) []byte {
+	dst = append(dst, 0x40|(pnLen-1))
+	dst = append(dst, dcid...)
+	return binary.BigEndian.AppendUint32(dst, uint32(pn))
+}
+
+// headerLen returns the length of the header appendLongHeader or
+// appendShortHeader would write.
+func headerLen(typ packetType, dcid, scid, token []byte) int {
+	if typ == packetType1RTT {
+		return 1 + len(dcid) + pnLen
+	}
+	n := 1 + 4 + 1 + len(dcid) + 1 + len(scid) + 2 + pnLen
+	if typ == packetTypeInitial {
+		n += VarintLen(uint64(len(token))) + len(token)
+	}
+	return n
+}
+
+// appendVersionNegotiation appends a Version Negotiation packet in
+// answer to a long header packet with connection IDs dcid and scid.
+func appendVersionNegotiation(dst []byte, dcid, scid []byte) []byte {
+	dst = append(dst, 0x80|0x40)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = append(dst, byte(len(scid)))
+	dst = append(dst, scid...)
+	dst = append(dst, byte(len(dcid)))
+	dst = append(dst, dcid...)
+	return binary.BigEndian.AppendUint32(dst, version1)
+}
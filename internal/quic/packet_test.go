@@ -0,0 +1,237 @@
+package quic
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestVarint_RoundTrip(t *testing.T) {
+	tests := []struct {
+		v   uint64
+		len int
+	}{
+		{0, 1},
+		{63, 1},
+		{64, 2},
+		{16383, 2},
+		{16384, 4},
+		{1<<30 - 1, 4},
+		{1 << 30, 8},
+		{maxVarint, 8},
+	}
+	for _, tt := range tests {
+		b := AppendVarint(nil, tt.v)
+		assert.Len(t, b, tt.len, "%d", tt.v)
+		assert.Equal(t, tt.len, VarintLen(tt.v))
+		v, n := ReadVarint(b)
+		assert.Equal(t, tt.v, v)
+		assert.Equal(t, tt.len, n)
+
+		_, n = ReadVarint(b[:len(b)-1])
+		assert.Negative(t, n, "truncated %d", tt.v)
+	}
+
+	// Test: the example from RFC 9000 appendix A.1
+	v, n := ReadVarint(unhex(t, "c2197c5eff14e88c"))
+	assert.Equal(t, uint64(151288809941952652), v)
+	assert.Equal(t, 8, n)
+}
+
+// The sample packets of RFC 9001 appendix A.
+const testDCID = "8394c8f03e515708"
+
+func TestInitialKeys_RFC9001(t *testing.T) {
+	// Test: the server's Initial from appendix A.3 opens with the keys
+	// the client derives
+	read, _ := initialKeys(unhex(t, testDCID), false)
+	pkt := unhex(t, "cf000000010008f067a5502a4262b5004075c0d95a482cd0991cd25b0aac406a"+
+		"5816b6394100f37a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3"+
+		"dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3bded74b562bfb19fb84"+
+		"022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc4"+
+		"2158407dd074ee")
+	h, err := parseHeader(pkt)
+	require.NoError(t, err)
+	assert.Equal(t, packetTypeInitial, h.typ)
+	assert.Equal(t, unhex(t, "f067a5502a4262b5"), h.scid)
+	assert.Equal(t, len(pkt), h.length)
+
+	pn, payload, err := read.open(pkt, h.pnOffset, -1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), pn)
+	assert.Equal(t, unhex(t, "02000000000600405a020000560303eefce7f7b37ba1d1632e96677825ddf739"+
+		"88cfc79825df566dc5430b9a045a1200130100002e00330024001d00209d3c94"+
+		"0d89690b84d08a60993c144eca684d1081287c834d5311bcf32bb9da1a002b00"+
+		"020304"), payload)
+
+	// Test: the payload starts with an ACK of packet 0, then the
+	// ServerHello in a CRYPTO frame
+	f, rest, err := parseFrame(payload)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(frameAck), f.typ)
+	assert.Equal(t, []ackRange{{0, 0}}, f.ranges)
+	f, _, err = parseFrame(rest)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(frameCrypto), f.typ)
+	assert.Len(t, f.data, 90)
+}
+
+func TestKeys_SealOpen(t *testing.T) {
+	serverRead, serverWrite := initialKeys(unhex(t, testDCID), true)
+	clientRead, clientWrite := initialKeys(unhex(t, testDCID), false)
+	dcid := unhex(t, testDCID)
+
+	for _, tt := range []struct {
+		name  string
+		write *keys
+		read  *keys
+		typ   packetType
+	}{
+		{"client long header", clientWrite, serverRead, packetTypeInitial},
+		{"server long header", serverWrite, clientRead, packetTypeInitial},
+		{"short header", clientWrite, serverRead, packetType1RTT},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := appendCrypto(nil, 0, []byte("hello"))
+			var pkt []byte
+			if tt.typ == packetType1RTT {
+				pkt = appendShortHeader(nil, dcid, 70000)
+			} else {
+				pkt = appendLongHeader(nil, tt.typ, dcid, nil, nil, 70000, len(payload))
+			}
+			hdrLen := len(pkt)
+			pkt = tt.write.seal(append(pkt, payload...), hdrLen, 70000)
+
+			h, err := parseHeader(pkt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.typ, h.typ)
+			assert.Equal(t, len(pkt), h.length)
+			pn, got, err := tt.read.open(pkt, h.pnOffset, 69999)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(70000), pn)
+			assert.Equal(t, payload, got)
+		})
+	}
+
+	// Test: a flipped bit fails authentication
+	pkt := appendShortHeader(nil, dcid, 1)
+	pkt = clientWrite.seal(append(pkt, framePing, 0, 0, 0), len(pkt), 1)
+	pkt[len(pkt)-1] ^= 1
+	_, _, err := serverRead.open(pkt, 1+len(dcid), 0)
+	assert.ErrorIs(t, err, errDecrypt)
+}
+
+func TestDecodePacketNumber(t *testing.T) {
+	// Test: the example from RFC 9000 appendix A.3
+	assert.Equal(t, uint64(0xa82f9b32), decodePacketNumber(0xa82f30ea, 0x9b32, 16))
+	assert.Equal(t, uint64(0), decodePacketNumber(-1, 0, 32))
+	assert.Equal(t, uint64(1<<32), decodePacketNumber(1<<32-2, 0, 32))
+}
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want frame
+	}{
+		{
+			name: "ack with gaps",
+			b:    appendAck(nil, []ackRange{{10, 12}, {5, 7}, {1, 1}}),
+			want: frame{typ: frameAck, ranges: []ackRange{{10, 12}, {5, 7}, {1, 1}}},
+		},
+		{
+			name: "stream with offset and fin",
+			b:    appendStream(nil, 4, 100, []byte("abc"), true),
+			want: frame{typ: frameStream, streamID: 4, offset: 100, data: []byte("abc"), fin: true},
+		},
+		{
+			name: "reset stream",
+			b:    appendFrame(nil, frameResetStream, 8, 0x10c, 3),
+			want: frame{typ: frameResetStream, streamID: 8, code: 0x10c, value: 3},
+		},
+		{
+			name: "application close",
+			b:    appendConnectionClose(nil, true, 0x100, "bye"),
+			want: frame{typ: frameConnectionCloseApp, code: 0x100, reason: "bye"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, rest, err := parseFrame(append(tt.b, framePing))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, f)
+			assert.Equal(t, []byte{framePing}, rest)
+		})
+	}
+
+	errTests := []struct {
+		name string
+		b    []byte
+		code ErrCode
+	}{
+		{"unknown type", []byte{0x40, 0x30}, ErrCodeFrameEncoding},
+		{"truncated stream", []byte{frameStream | streamFlagLen, 0, 5, 'a'}, ErrCodeFrameEncoding},
+		{"ack below zero", []byte{frameAck, 2, 0, 0, 3}, ErrCodeFrameEncoding},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseFrame(tt.b)
+			var te *TransportError
+			require.ErrorAs(t, err, &te)
+			assert.Equal(t, tt.code, te.Code)
+		})
+	}
+}
+
+func TestTransportParams_RoundTrip(t *testing.T) {
+	p := transportParams{
+		originalDCID:          []byte{1, 2, 3},
+		initialSCID:           []byte{4, 5},
+		maxUDPPayloadSize:     1200,
+		initialMaxData:        1000,
+		maxStreamDataBidiLoc:  10,
+		maxStreamDataBidiRem:  20,
+		maxStreamDataUni:      30,
+		initialMaxStreamsBidi: 100,
+		initialMaxStreamsUni:  3,
+	}
+	got, err := parseTransportParams(p.marshal(true), true)
+	require.NoError(t, err)
+	assert.Equal(t, p.originalDCID, got.originalDCID)
+	assert.Equal(t, p.initialSCID, got.initialSCID)
+	assert.Equal(t, p.initialMaxData, got.initialMaxData)
+	assert.Equal(t, p.maxStreamDataBidiRem, got.maxStreamDataBidiRem)
+	assert.Equal(t, p.initialMaxStreamsUni, got.initialMaxStreamsUni)
+
+	// Test: a client may not send server-only parameters
+	_, err = parseTransportParams(p.marshal(true), false)
+	assert.Error(t, err)
+}
+
+func TestRecvBuffer_Push(t *testing.T) {
+	var rb recvBuffer
+	assert.Nil(t, rb.push(3, []byte("def")))
+	assert.Equal(t, 3, rb.buffered)
+	assert.Equal(t, []byte("abcdef"), rb.push(0, []byte("abc")))
+	assert.Equal(t, 0, rb.buffered)
+	assert.Nil(t, rb.push(2, []byte("cd")))
+	assert.Equal(t, []byte("gh"), rb.push(5, []byte("fgh")))
+}
+
+func TestRecordReceived(t *testing.T) {
+	sp := packetSpace{largestRecv: -1}
+	for _, pn := range []uint64{0, 1, 5, 3, 4} {
+		assert.False(t, sp.recordReceived(pn))
+	}
+	assert.True(t, sp.recordReceived(4))
+	assert.Equal(t, []ackRange{{3, 5}, {0, 1}}, sp.recvRanges)
+	assert.Equal(t, int64(5), sp.largestRecv)
+}
@@ -0,0 +1,264 @@
+package quic
+
+import (
+	"time"
+)
+
+// Loss recovery and congestion control follow RFC 9002, simplified:
+// ACKs are never delayed, lost frames are resent as they were, and
+// congestion control is NewReno without pacing.
+
+const (
+	initialRTT        = 333 * time.Millisecond
+	granularity       = time.Millisecond
+	packetThreshold   = 3
+	initialWindow     = 10 * maxDatagramSize
+	minimumWindow     = 2 * maxDatagramSize
+	maxAckRanges      = 32
+	probePacketsOnPTO = 2
+)
+
+// sentPacket is an ack-eliciting packet waiting to be acknowledged.
+type sentPacket struct {
+	pn     uint64
+	sent   time.Time
+	size   int
+	frames []sentFrame
+}
+
+// sentFrame is a frame as it was sent, to be sent again if its packet
+// is lost. Frames of a stream that has since been reset are dropped
+// instead.
+type sentFrame struct {
+	b      []byte
+	stream *Stream
+}
+
+type rttStats struct {
+	latest, smoothed, rttvar, min time.Duration
+	hasSample                     bool
+}
+
+func newRTTStats() rttStats {
+	return rttStats{smoothed: initialRTT, rttvar: initialRTT / 2}
+}
+
+func (r *rttStats) update(sample time.Duration) {
+	r.latest = sample
+	if !r.hasSample {
+		r.hasSample = true
+		r.min, r.smoothed, r.rttvar = sample, sample, sample/2
+		return
+	}
+	r.min = min(r.min, sample)
+	diff := r.smoothed - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	r.rttvar = (3*r.rttvar + diff) / 4
+	r.smoothed = (7*r.smoothed + sample) / 8
+}
+
+// pto is the probe timeout before backoff.
+func (r *rttStats) pto() time.Duration {
+	return r.smoothed + max(4*r.rttvar, granularity)
+}
+
+// lossDelay is how long after a later packet was acknowledged an
+// earlier one is declared lost.
+func (r *rttStats) lossDelay() time.Duration {
+	return max(max(r.latest, r.smoothed)*9/8, granularity)
+}
+
+// congestion is NewReno congestion control over bytes in flight.
+type congestion struct {
+	window        int
+	ssthresh      int
+	bytesInFlight int
+	recoveryStart time.Time
+}
+
+func newCongestion() congestion {
+	return congestion{window: initialWindow, ssthresh: 1<<31 - 1}
+}
+
+func (cc *congestion) canSend() bool {
+	return cc.bytesInFlight+maxDatagramSize <= cc.window
+}
+
+func (cc *congestion) onAcked(p *sentPacket) {
+	cc.bytesInFlight -= p.size
+	if !p.sent.After(cc.recoveryStart) {
+		return
+	}
+	if cc.window < cc.ssthresh {
+		cc.window += p.size
+	} else {
+		cc.window += maxDatagramSize * p.size / cc.window
+	}
+}
+
+func (cc *congestion) onLost(p *sentPacket, now time.Time) {
+	cc.bytesInFlight -= p.size
+	if !p.sent.After(cc.recoveryStart) {
+		// one reduction per round trip
+		return
+	}
+	cc.recoveryStart = now
+	cc.ssthresh = max(cc.window/2, minimumWindow)
+	cc.window = cc.ssthresh
+}
+
+// onAck processes an ACK frame received in space s.
+func (c *Conn) onAck(s space, f frame, now time.Time) error {
+	sp := &c.spaces[s]
+	largest := f.ranges[0].hi
+	if largest >= sp.nextPN {
+		return transportError(ErrCodeProtocolViolation, "ACK of unsent packet %d in %s", largest, s)
+	}
+	acked := func(pn uint64) bool {
+		for _, r := range f.ranges {
+			if pn >= r.lo && pn <= r.hi {
+				return true
+			}
+		}
+		return false
+	}
+	kept := sp.sent[:0]
+	var newest *sentPacket
+	ackedAny := false
+	for _, p := range sp.sent {
+		if !acked(p.pn) {
+			kept = append(kept, p)
+			continue
+		}
+		ackedAny = true
+		if p.pn == largest {
+			newest = p
+		}
+		c.cc.onAcked(p)
+	}
+	clear(sp.sent[len(kept):])
+	sp.sent = kept
+	if int64(largest) > sp.largestAcked {
+		sp.largestAcked = int64(largest)
+	}
+	if newest != nil {
+		c.rtt.update(now.Sub(newest.sent))
+	}
+	if !ackedAny {
+		return nil
+	}
+	c.ptoCount = 0
+	c.detectLoss(s, now)
+	return nil
+}
+
+// detectLoss declares packets lost that were sent well before one that
+// was acknowledged, and schedules the loss timer for the ones that
+// might still arrive.
+func (c *Conn) detectLoss(s space, now time.Time) {
+	sp := &c.spaces[s]
+	sp.lossTime = time.Time{}
+	if sp.largestAcked < 0 {
+		return
+	}
+	delay := c.rtt.lossDelay()
+	kept := sp.sent[:0]
+	for _, p := range sp.sent {
+		if int64(p.pn) > sp.largestAcked {
+			kept = append(kept, p)
+			continue
+		}
+		if int64(p.pn)+packetThreshold <= sp.largestAcked || !p.sent.After(now.Add(-delay)) {
+			sp.retransmit = append(sp.retransmit, p.frames...)
+			c.cc.onLost(p, now)
+			continue
+		}
+		kept = append(kept, p)
+		if lt := p.sent.Add(delay); sp.lossTime.IsZero() || lt.Before(sp.lossTime) {
+			sp.lossTime = lt
+		}
+	}
+	clear(sp.sent[len(kept):])
+	sp.sent = kept
+}
+
+// ptoTime returns when the probe timeout fires and for which space, or
+// a zero time when no probe is needed.
+func (c *Conn) ptoTime() (time.Time, space) {
+	backoff := time.Duration(1) << min(c.ptoCount, 16)
+	var when time.Time
+	var which space
+	for s := spaceInitial; s < numSpaces; s++ {
+		sp := &c.spaces[s]
+		if len(sp.sent) == 0 || sp.discarded {
+			continue
+		}
+		if s == spaceApp && !c.handshakeComplete {
+			continue
+		}
+		d := c.rtt.pto() * backoff
+		if s == spaceApp && c.peerParams != nil {
+			d += c.peerParams.maxAckDelay * backoff
+		}
+		t := sp.lastAckElicitingSent.Add(d)
+		if when.IsZero() || t.Before(when) {
+			when, which = t, s
+		}
+	}
+	if when.IsZero() && !c.server && !c.handshakeConfirmed {
+		// a client keeps probing so the server, held back by the
+		// anti-amplification limit, can't deadlock the handshake
+		which = spaceInitial
+		if c.spaces[spaceHandshake].write != nil {
+			which = spaceHandshake
+		}
+		when = c.lastAckElicitingSent.Add(c.rtt.pto() * backoff)
+	}
+	return when, which
+}
+
+// onPTO sends probes in space s: whatever it has waiting to be
+// acknowledged is queued again, or a PING when there is nothing.
+func (c *Conn) onPTO(s space) {
+	c.ptoCount++
+	sp := &c.spaces[s]
+	for _, p := range sp.sent {
+		sp.retransmit = append(sp.retransmit, p.frames...)
+		p.frames = nil
+	}
+	sp.probes = probePacketsOnPTO
+}
+
+// recordReceived adds pn to the packets to acknowledge in space s and
+// reports whether it was a duplicate.
+func (sp *packetSpace) recordReceived(pn uint64) bool {
+	for _, r := range sp.recvRanges {
+		if pn >= r.lo && pn <= r.hi {
+			return true
+		}
+	}
+	if int64(pn) > sp.largestRecv {
+		sp.largestRecv = int64(pn)
+	}
+	// insert keeping descending order, then merge neighbours
+	i := 0
+	for i < len(sp.recvRanges) && sp.recvRanges[i].hi > pn {
+		i++
+	}
+	sp.recvRanges = append(sp.recvRanges, ackRange{})
+	copy(sp.recvRanges[i+1:], sp.recvRanges[i:])
+	sp.recvRanges[i] = ackRange{pn, pn}
+	merged := sp.recvRanges[:1]
+	for _, r := range sp.recvRanges[1:] {
+		last := &merged[len(merged)-1]
+		if r.hi+1 >= last.lo {
+			last.lo = min(last.lo, r.lo)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	sp.recvRanges = merged[:min(len(merged), maxAckRanges)]
+	return false
+}
@@ -0,0 +1,265 @@
+package quic
+
+import "time"
+
+// maxDatagramsPerFlush bounds how many datagrams one flush sends, so a
+// connection with a lot to send still gets round to reading.
+const maxDatagramsPerFlush = 64
+
+// minPacketRoom is the least payload room worth starting another
+// coalesced packet for.
+const minPacketRoom = 32
+
+// outPacket is a packet being put together, before it is sealed.
+type outPacket struct {
+	space        space
+	pn           uint64
+	payload      []byte
+	frames       []sentFrame
+	ackEliciting bool
+}
+
+// flush sends everything that is ready and allowed to go.
+func (c *Conn) flush(now time.Time) {
+	if c.closeErr != nil && c.closeFrame == nil {
+		return
+	}
+	// what was written before a close still goes out first, as far as
+	// congestion control allows, so a final GOAWAY or response isn't
+	// lost to it
+	for i := 0; i < maxDatagramsPerFlush; i++ {
+		d := c.buildDatagram(now)
+		if d == nil {
+			break
+		}
+		c.bytesSent += len(d)
+		if err := c.send(d); err != nil {
+			c.closeErr, c.closeFrame = err, nil
+			return
+		}
+		if i == maxDatagramsPerFlush-1 && c.closeErr == nil {
+			c.wake()
+		}
+	}
+	if c.closeFrame != nil {
+		c.sendClose()
+	}
+}
+
+// buildDatagram coalesces packets of each space with keys into one
+// datagram, or returns nil if there is nothing to send.
+func (c *Conn) buildDatagram(now time.Time) []byte {
+	limit := maxDatagramSize
+	if c.server && !c.addressValidated {
+		// until the client proves its address, a server sends at most
+		// three times what it received, per RFC 9000 section 8.1
+		if 3*c.bytesReceived-c.bytesSent < maxDatagramSize {
+			return nil
+		}
+	}
+
+	var pkts []outPacket
+	size := 0
+	padInitial := false
+	for s := spaceInitial; s < numSpaces; s++ {
+		sp := &c.spaces[s]
+		if sp.write == nil || sp.discarded {
+			continue
+		}
+		room := limit - size - headerLen(s.packetType(), c.dcid, c.scid, nil) - aeadOverhead
+		if room < minPacketRoom {
+			break
+		}
+		p, ok := c.buildPacket(s, room)
+		if !ok {
+			continue
+		}
+		size += headerLen(s.packetType(), c.dcid, c.scid, nil) + len(p.payload) + aeadOverhead
+		if s == spaceInitial && (!c.server || p.ackEliciting) {
+			padInitial = true
+		}
+		pkts = append(pkts, p)
+	}
+	if len(pkts) == 0 {
+		return nil
+	}
+	if padInitial && size < maxDatagramSize {
+		// padding the last packet pads the datagram; PADDING frames are
+		// zero bytes
+		last := &pkts[len(pkts)-1]
+		last.payload = append(last.payload, make([]byte, maxDatagramSize-size)...)
+	}
+
+	var d []byte
+	sentHandshake := false
+	for _, p := range pkts {
+		sp := &c.spaces[p.space]
+		start := len(d)
+		if p.space == spaceApp {
+			d = appendShortHeader(d, c.dcid, p.pn)
+		} else {
+			d = appendLongHeader(d, p.space.packetType(), c.dcid, c.scid, nil, p.pn, len(p.payload))
+		}
+		hdrLen := len(d) - start
+		d = append(d, p.payload...)
+		d = append(d[:start], sp.write.seal(d[start:], hdrLen, p.pn)...)
+		if p.ackEliciting {
+			sp.sent = append(sp.sent, &sentPacket{pn: p.pn, sent: now, size: len(d) - start, frames: p.frames})
+			c.cc.bytesInFlight += len(d) - start
+			sp.lastAckElicitingSent = now
+			c.lastAckElicitingSent = now
+		}
+		sentHandshake = sentHandshake || p.space == spaceHandshake
+	}
+	if sentHandshake && !c.server {
+		// the client is done with Initial keys once it sends a
+		// Handshake packet, per RFC 9001 section 4.9.1
+		c.discardSpace(spaceInitial)
+	}
+	return d
+}
+
+// buildPacket fills a packet for space s with at most room bytes of
+// frames: an ACK, then frames to resend, handshake data, and in 1-RTT
+// packets control frames and stream data.
+func (c *Conn) buildPacket(s space, room int) (outPacket, bool) {
+	sp := &c.spaces[s]
+	p := outPacket{space: s, pn: sp.nextPN}
+	if sp.ackPending && len(sp.recvRanges) > 0 {
+		p.payload = appendAck(p.payload, sp.recvRanges)
+		sp.ackPending = false
+	}
+	probing := sp.probes > 0
+	if probing || c.cc.canSend() {
+		add := func(f sentFrame) {
+			p.payload = append(p.payload, f.b...)
+			p.frames = append(p.frames, f)
+			p.ackEliciting = true
+		}
+		for len(sp.retransmit) > 0 {
+			f := sp.retransmit[0]
+			if f.stream != nil && f.stream.resetSent {
+				sp.retransmit = sp.retransmit[1:]
+				continue
+			}
+			if len(p.payload)+len(f.b) > room {
+				break
+			}
+			sp.retransmit = sp.retransmit[1:]
+			add(f)
+		}
+		if n := min(len(sp.cryptoSend), room-len(p.payload)-dataFrameOverhead(0, sp.cryptoSendOffset, len(sp.cryptoSend))); n > 0 {
+			add(sentFrame{b: appendCrypto(nil, sp.cryptoSendOffset, sp.cryptoSend[:n])})
+			sp.cryptoSend = sp.cryptoSend[n:]
+			sp.cryptoSendOffset += uint64(n)
+		}
+		if s == spaceApp {
+			for len(c.control) > 0 && len(p.payload)+len(c.control[0].b) <= room {
+				add(c.control[0])
+				c.control = c.control[1:]
+			}
+			c.appendStreamFrames(room-len(p.payload), add)
+		}
+		if probing && !p.ackEliciting {
+			add(sentFrame{b: []byte{framePing}})
+		}
+	}
+	if len(p.payload) == 0 {
+		return p, false
+	}
+	if probing && p.ackEliciting {
+		sp.probes--
+	}
+	sp.nextPN++
+	return p, true
+}
+
+// appendStreamFrames adds STREAM frames from the streams waiting to send,
+// taking turns between them, within room bytes.
+func (c *Conn) appendStreamFrames(room int, add func(sentFrame)) {
+	wrote := false
+	for n := len(c.sendQueue); n > 0 && room > minPacketRoom; n-- {
+		s := c.sendQueue[0]
+		c.sendQueue = c.sendQueue[1:]
+		if s.sendErr != nil || s.finSent {
+			s.queued = false
+			continue
+		}
+		avail := uint64(len(s.sendBuf))
+		avail = min(avail, s.sendMax-s.sendOffset, c.peerMaxData-c.dataSent)
+		overhead := dataFrameOverhead(s.id, s.sendOffset, int(avail))
+		avail = min(avail, uint64(max(room-overhead, 0)))
+		fin := s.finQueued && avail == uint64(len(s.sendBuf))
+		if avail == 0 && !fin {
+			if c.peerMaxData == c.dataSent {
+				// blocked on the connection: keep its place in line
+				c.sendQueue = append(c.sendQueue, s)
+				return
+			}
+			// blocked on its own limit until MAX_STREAM_DATA
+			s.queued = false
+			continue
+		}
+		b := appendStream(nil, s.id, s.sendOffset, s.sendBuf[:avail], fin)
+		add(sentFrame{b: b, stream: s})
+		room -= len(b)
+		s.sendBuf = s.sendBuf[avail:]
+		s.sendOffset += avail
+		c.dataSent += avail
+		wrote = true
+		if fin {
+			s.finSent = true
+			s.queued = false
+			c.maybeRelease(s)
+			continue
+		}
+		if len(s.sendBuf) > 0 || s.finQueued {
+			c.sendQueue = append(c.sendQueue, s)
+		} else {
+			s.queued = false
+		}
+	}
+	if wrote {
+		// writers blocked on a full buffer can go on
+		c.cond.Broadcast()
+	}
+}
+
+// sendClose sends CONNECTION_CLOSE in every space the peer might be
+// able to read. An application close is only sent as such in 1-RTT
+// packets; earlier ones carry a plain APPLICATION_ERROR instead, since
+// they would reveal the application's reason before the handshake
+// authenticates the peer.
+func (c *Conn) sendClose() {
+	f := c.closeFrame
+	c.closeFrame = nil
+	var d []byte
+	for s := spaceInitial; s < numSpaces; s++ {
+		sp := &c.spaces[s]
+		if sp.write == nil || sp.discarded {
+			continue
+		}
+		var payload []byte
+		switch {
+		case f.typ == frameConnectionClose:
+			payload = appendConnectionClose(nil, false, f.code, f.reason)
+		case s == spaceApp:
+			payload = appendConnectionClose(nil, true, f.code, f.reason)
+		default:
+			payload = appendConnectionClose(nil, false, uint64(ErrCodeApplication), "")
+		}
+		start := len(d)
+		if s == spaceApp {
+			d = appendShortHeader(d, c.dcid, sp.nextPN)
+		} else {
+			d = appendLongHeader(d, s.packetType(), c.dcid, c.scid, nil, sp.nextPN, len(payload))
+		}
+		hdrLen := len(d) - start
+		d = append(d, payload...)
+		d = append(d[:start], sp.write.seal(d[start:], hdrLen, sp.nextPN)...)
+		sp.nextPN++
+	}
+	if len(d) > 0 {
+		c.send(d)
+	}
+}
@@ -0,0 +1,505 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+const (
+	// streamWindow and connWindow are the receive windows advertised
+	// for each stream and for the connection as a whole.
+	streamWindow = 1 << 20
+	connWindow   = 4 << 20
+	// maxSendBuffer bounds what a stream buffers before Write blocks.
+	maxSendBuffer = 256 << 10
+	// maxCryptoBuffer bounds out-of-order handshake data.
+	maxCryptoBuffer = 64 << 10
+)
+
+var errWriteClosed = errors.New("quic: write to closed stream")
+
+// Stream is a QUIC stream. Bidirectional streams can be read and
+// written; unidirectional ones only in the direction they were opened.
+// Read, Write and Close may be called from different goroutines.
+type Stream struct {
+	conn *Conn
+	id   uint64
+
+	// receiving part, guarded by conn.mu
+	canRead     bool
+	recv        recvBuffer
+	readBuf     []byte
+	readOffset  uint64 // bytes handed to Read
+	recvHighest uint64 // the highest offset received
+	recvMax     uint64 // the flow-control limit advertised
+	finalSize   int64  // -1 until known
+	recvErr     error  // set by RESET_STREAM or CloseRead
+
+	// sending part, guarded by conn.mu
+	canWrite   bool
+	sendBuf    []byte // written but not yet sent
+	sendOffset uint64 // the offset of sendBuf[0]
+	sendMax    uint64 // the peer's flow-control limit
+	finQueued  bool
+	finSent    bool
+	sendErr    error // set by STOP_SENDING or Reset
+	resetSent  bool
+	queued     bool // in conn.sendQueue
+}
+
+// ID returns the stream ID. Its low bits say who opened the stream
+// and whether it is unidirectional.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Read reads data the peer sent, returning io.EOF after the last of
+// it.
+func (s *Stream) Read(p []byte) (int, error) {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.canRead {
+		return 0, errors.New("quic: read from send-only stream")
+	}
+	for len(s.readBuf) == 0 && s.recvErr == nil && !s.recvDone() && c.closeErr == nil {
+		c.cond.Wait()
+	}
+	switch {
+	case len(s.readBuf) > 0:
+	case s.recvErr != nil:
+		return 0, s.recvErr
+	case s.recvDone():
+		return 0, io.EOF
+	default:
+		return 0, c.closeErr
+	}
+	n := copy(p, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	s.readOffset += uint64(n)
+	c.onRead(s, n)
+	c.maybeRelease(s)
+	return n, nil
+}
+
+// recvDone reports whether everything up to the final size has been
+// read.
+func (s *Stream) recvDone() bool {
+	return s.finalSize >= 0 && s.readOffset == uint64(s.finalSize)
+}
+
+// Write queues p to be sent, blocking while too much is already
+// waiting.
+func (s *Stream) Write(p []byte) (int, error) {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.canWrite {
+		return 0, errors.New("quic: write to receive-only stream")
+	}
+	n := 0
+	for len(p) > 0 {
+		for len(s.sendBuf) >= maxSendBuffer && s.sendErr == nil && c.closeErr == nil {
+			c.cond.Wait()
+		}
+		switch {
+		case s.sendErr != nil:
+			return n, s.sendErr
+		case c.closeErr != nil:
+			return n, c.closeErr
+		case s.finQueued:
+			return n, errWriteClosed
+		}
+		chunk := min(len(p), maxSendBuffer-len(s.sendBuf))
+		s.sendBuf = append(s.sendBuf, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+		c.queueStream(s)
+	}
+	return n, nil
+}
+
+// Close ends the sending part of the stream once everything written
+// has been sent. It does nothing to a receive-only stream.
+func (s *Stream) Close() error {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.canWrite || s.finQueued || s.sendErr != nil {
+		return nil
+	}
+	s.finQueued = true
+	c.queueStream(s)
+	return nil
+}
+
+// Reset abandons the sending part of the stream with an application
+// error code, discarding anything not yet sent.
+func (s *Stream) Reset(code uint64) {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.canWrite || s.sendErr != nil || s.finSent || c.closeErr != nil {
+		return
+	}
+	s.sendErr = &StreamError{StreamID: s.id, Code: code}
+	c.resetStream(s, code)
+}
+
+// CloseRead tells the peer to stop sending, with an application error
+// code, and discards whatever it already sent.
+func (s *Stream) CloseRead(code uint64) {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.canRead || s.recvErr != nil || s.recvDone() || c.closeErr != nil {
+		return
+	}
+	s.recvErr = &StreamError{StreamID: s.id, Code: code}
+	if s.finalSize < 0 {
+		c.queueControl(appendFrame(nil, frameStopSending, s.id, code))
+	}
+	// data already received still counts against the connection window,
+	// but nobody will read it now
+	c.onRead(s, int(s.recvHighest-s.readOffset))
+	s.readBuf = nil
+	c.maybeRelease(s)
+	c.cond.Broadcast()
+}
+
+// AcceptStream waits for the peer to open a bidirectional stream.
+func (c *Conn) AcceptStream(ctx context.Context) (*Stream, error) {
+	return c.accept(ctx, false)
+}
+
+// AcceptUniStream waits for the peer to open a unidirectional stream.
+func (c *Conn) AcceptUniStream(ctx context.Context) (*Stream, error) {
+	return c.accept(ctx, true)
+}
+
+func (c *Conn) accept(ctx context.Context, uni bool) (*Stream, error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := streamKind(uni)
+	for len(c.acceptQueue[i]) == 0 && c.closeErr == nil && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	switch {
+	case len(c.acceptQueue[i]) > 0:
+		s := c.acceptQueue[i][0]
+		c.acceptQueue[i] = c.acceptQueue[i][1:]
+		return s, nil
+	case c.closeErr != nil:
+		return nil, c.closeErr
+	default:
+		return nil, ctx.Err()
+	}
+}
+
+// OpenStream opens a bidirectional stream, or fails with
+// ErrStreamLimit if the peer doesn't allow another one yet.
+func (c *Conn) OpenStream() (*Stream, error) {
+	return c.open(false)
+}
+
+// OpenUniStream opens a unidirectional stream for sending.
+func (c *Conn) OpenUniStream() (*Stream, error) {
+	return c.open(true)
+}
+
+func (c *Conn) open(uni bool) (*Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return nil, c.closeErr
+	}
+	i := streamKind(uni)
+	if c.localStreams[i] >= c.peerMaxStreams[i] {
+		return nil, ErrStreamLimit
+	}
+	id := c.localStreams[i]<<2 | uint64(i)<<1
+	if c.server {
+		id |= 1
+	}
+	c.localStreams[i]++
+	s := c.newStream(id)
+	c.streams[id] = s
+	return s, nil
+}
+
+func streamKind(uni bool) int {
+	if uni {
+		return 1
+	}
+	return 0
+}
+
+// newStream creates a stream with its flow-control limits from the
+// transport parameters.
+func (c *Conn) newStream(id uint64) *Stream {
+	local := id&1 == 1 == c.server
+	uni := id&2 != 0
+	s := &Stream{
+		conn:      c,
+		id:        id,
+		canRead:   !local || !uni,
+		canWrite:  local || !uni,
+		finalSize: -1,
+	}
+	if s.canRead {
+		s.recvMax = streamWindow
+	}
+	if s.canWrite {
+		switch {
+		case uni:
+			s.sendMax = c.peerParams.maxStreamDataUni
+		case local:
+			s.sendMax = c.peerParams.maxStreamDataBidiRem
+		default:
+			s.sendMax = c.peerParams.maxStreamDataBidiLoc
+		}
+	}
+	return s
+}
+
+// streamFor finds the stream a frame refers to, opening peer streams up
+// to and including id. It returns nil for streams that are already
+// closed. sending is set for frames about the peer's sending part.
+func (c *Conn) streamFor(id uint64, sending bool) (*Stream, error) {
+	local := id&1 == 1 == c.server
+	uni := id&2 != 0
+	i := streamKind(uni)
+	if local {
+		if id>>2 >= c.localStreams[i] {
+			return nil, transportError(ErrCodeStreamState, "frame for unopened stream %d", id)
+		}
+		if uni && sending {
+			return nil, transportError(ErrCodeStreamState, "peer can't send on stream %d", id)
+		}
+		return c.streams[id], nil
+	}
+	if uni && !sending {
+		return nil, transportError(ErrCodeStreamState, "peer can't receive on stream %d", id)
+	}
+	if id>>2 >= c.maxPeerStreams[i] {
+		return nil, transportError(ErrCodeStreamLimit, "stream %d over the limit", id)
+	}
+	for c.peerStreams[i] <= id>>2 {
+		next := c.peerStreams[i]<<2 | uint64(i)<<1
+		if !c.server {
+			next |= 1
+		}
+		c.peerStreams[i]++
+		s := c.newStream(next)
+		c.streams[next] = s
+		c.acceptQueue[i] = append(c.acceptQueue[i], s)
+		c.cond.Broadcast()
+	}
+	return c.streams[id], nil
+}
+
+// onStreamFrame takes in the data of a STREAM frame.
+func (c *Conn) onStreamFrame(f frame) error {
+	s, err := c.streamFor(f.streamID, true)
+	if err != nil || s == nil {
+		return err
+	}
+	end := f.offset + uint64(len(f.data))
+	if s.finalSize >= 0 && (end > uint64(s.finalSize) || f.fin && end != uint64(s.finalSize)) {
+		return transportError(ErrCodeFinalSize, "stream %d data past its final size", s.id)
+	}
+	if f.fin {
+		if end < s.recvHighest {
+			return transportError(ErrCodeFinalSize, "stream %d final size below data received", s.id)
+		}
+		s.finalSize = int64(end)
+	}
+	if end > s.recvMax {
+		return transportError(ErrCodeFlowControl, "stream %d over its flow-control limit", s.id)
+	}
+	before := s.recvHighest
+	if err := c.onReceived(s, end); err != nil {
+		return err
+	}
+	if s.recvErr != nil {
+		c.onRead(s, int(s.recvHighest-before))
+		return nil
+	}
+	if data := s.recv.push(f.offset, f.data); len(data) > 0 {
+		s.readBuf = append(s.readBuf, data...)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// onReceived accounts for the highest offset received on s against the
+// connection's flow-control limit.
+func (c *Conn) onReceived(s *Stream, end uint64) error {
+	if end <= s.recvHighest {
+		return nil
+	}
+	c.dataReceived += end - s.recvHighest
+	s.recvHighest = end
+	if c.dataReceived > c.maxData {
+		return transportError(ErrCodeFlowControl, "connection over its flow-control limit")
+	}
+	return nil
+}
+
+// onRead raises the flow-control limits once the application has read
+// half a window.
+func (c *Conn) onRead(s *Stream, n int) {
+	c.dataRead += uint64(n)
+	if s.finalSize < 0 && s.recvErr == nil && s.recvMax-s.readOffset < streamWindow/2 {
+		s.recvMax = s.readOffset + streamWindow
+		c.queueControl(appendFrame(nil, frameMaxStreamData, s.id, s.recvMax))
+	}
+	if c.maxData-c.dataRead < connWindow/2 {
+		c.maxData = c.dataRead + connWindow
+		c.queueControl(appendFrame(nil, frameMaxData, c.maxData))
+	}
+}
+
+func (c *Conn) onResetStream(f frame) error {
+	s, err := c.streamFor(f.streamID, true)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.finalSize >= 0 && uint64(s.finalSize) != f.value || f.value < s.recvHighest {
+		return transportError(ErrCodeFinalSize, "stream %d reset with a different final size", s.id)
+	}
+	if err := c.onReceived(s, f.value); err != nil {
+		return err
+	}
+	s.finalSize = int64(f.value)
+	if s.recvErr == nil {
+		s.recvErr = &StreamError{StreamID: s.id, Code: f.code}
+		c.onRead(s, int(f.value-s.readOffset))
+		s.readBuf = nil
+	}
+	c.maybeRelease(s)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) onStopSending(f frame) error {
+	s, err := c.streamFor(f.streamID, false)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.sendErr == nil && !s.finSent {
+		s.sendErr = &StreamError{StreamID: s.id, Code: f.code}
+		c.resetStream(s, f.code)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) onMaxStreamData(f frame) error {
+	s, err := c.streamFor(f.streamID, false)
+	if err != nil || s == nil {
+		return err
+	}
+	if f.value > s.sendMax {
+		s.sendMax = f.value
+		if len(s.sendBuf) > 0 {
+			c.queueStream(s)
+		}
+	}
+	return nil
+}
+
+// resetStream sends RESET_STREAM and drops what was waiting to be
+// sent.
+func (c *Conn) resetStream(s *Stream, code uint64) {
+	c.queueControl(appendFrame(nil, frameResetStream, s.id, code, s.sendOffset))
+	s.sendBuf = nil
+	s.resetSent = true
+	c.maybeRelease(s)
+	c.cond.Broadcast()
+}
+
+// queueStream puts s in line to send data.
+func (c *Conn) queueStream(s *Stream) {
+	if !s.queued {
+		s.queued = true
+		c.sendQueue = append(c.sendQueue, s)
+	}
+	c.wake()
+}
+
+// maybeRelease forgets a stream once both its parts are finished, and
+// lets the peer open another if it opened this one.
+func (c *Conn) maybeRelease(s *Stream) {
+	recvDone := !s.canRead || s.recvErr != nil || s.recvDone()
+	sendDone := !s.canWrite || s.resetSent || s.finSent
+	if !recvDone || !sendDone || c.streams[s.id] == nil {
+		return
+	}
+	delete(c.streams, s.id)
+	if local := s.id&1 == 1 == c.server; local {
+		return
+	}
+	uni := s.id&2 != 0
+	i := streamKind(uni)
+	c.maxPeerStreams[i]++
+	t := uint64(frameMaxStreamsBidi)
+	if uni {
+		t = frameMaxStreamsUni
+	}
+	c.queueControl(appendFrame(nil, t, c.maxPeerStreams[i]))
+}
+
+// recvBuffer reassembles data that may arrive out of order.
+type recvBuffer struct {
+	offset   uint64
+	segments map[uint64][]byte
+	buffered int
+}
+
+// push adds data at off and returns whatever is now contiguous with
+// the data returned before.
+func (rb *recvBuffer) push(off uint64, data []byte) []byte {
+	end := off + uint64(len(data))
+	if end <= rb.offset {
+		return nil
+	}
+	if off < rb.offset {
+		data, off = data[rb.offset-off:], rb.offset
+	}
+	if off > rb.offset {
+		if old, ok := rb.segments[off]; !ok || len(old) < len(data) {
+			if rb.segments == nil {
+				rb.segments = map[uint64][]byte{}
+			}
+			rb.buffered += len(data) - len(old)
+			rb.segments[off] = append([]byte(nil), data...)
+		}
+		return nil
+	}
+	out := append([]byte(nil), data...)
+	rb.offset = end
+	for progress := true; progress; {
+		progress = false
+		for segOff, seg := range rb.segments {
+			if segOff > rb.offset {
+				continue
+			}
+			delete(rb.segments, segOff)
+			rb.buffered -= len(seg)
+			if segEnd := segOff + uint64(len(seg)); segEnd > rb.offset {
+				out = append(out, seg[rb.offset-segOff:]...)
+				rb.offset = segEnd
+			}
+			progress = true
+		}
+	}
+	return out
+}
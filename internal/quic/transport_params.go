@@ -0,0 +1,165 @@
+package quic
+
+import (
+	"bytes"
+	"time"
+)
+
+// Transport parameter IDs from RFC 9000 section 18.2.
+const (
+	paramOriginalDCID          = 0x00
+	paramMaxIdleTimeout        = 0x01
+	paramStatelessResetToken   = 0x02
+	paramMaxUDPPayloadSize     = 0x03
+	paramInitialMaxData        = 0x04
+	paramMaxStreamDataBidiLoc  = 0x05
+	paramMaxStreamDataBidiRem  = 0x06
+	paramMaxStreamDataUni      = 0x07
+	paramInitialMaxStreamsBidi = 0x08
+	paramInitialMaxStreamsUni  = 0x09
+	paramAckDelayExponent      = 0x0a
+	paramMaxAckDelay           = 0x0b
+	paramDisableMigration      = 0x0c
+	paramPreferredAddress      = 0x0d
+	paramActiveConnIDLimit     = 0x0e
+	paramInitialSCID           = 0x0f
+	paramRetrySCID             = 0x10
+)
+
+// transportParams are the parameters either end declares in its TLS
+// handshake. Only the ones this implementation acts on are kept.
+type transportParams struct {
+	originalDCID          []byte
+	initialSCID           []byte
+	maxIdleTimeout        time.Duration
+	maxUDPPayloadSize     uint64
+	initialMaxData        uint64
+	maxStreamDataBidiLoc  uint64
+	maxStreamDataBidiRem  uint64
+	maxStreamDataUni      uint64
+	initialMaxStreamsBidi uint64
+	initialMaxStreamsUni  uint64
+	maxAckDelay           time.Duration
+	haveOriginalDCID      bool
+	haveInitialSCID       bool
+	haveRetrySCID         bool
+}
+
+func (p *transportParams) marshal(server bool) []byte {
+	var b []byte
+	addBytes := func(id uint64, v []byte) {
+		b = AppendVarint(b, id)
+		b = AppendVarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	addInt := func(id, v uint64) {
+		addBytes(id, AppendVarint(nil, v))
+	}
+	if server {
+		addBytes(paramOriginalDCID, p.originalDCID)
+	}
+	addBytes(paramInitialSCID, p.initialSCID)
+	addInt(paramMaxIdleTimeout, uint64(p.maxIdleTimeout/time.Millisecond))
+	addInt(paramMaxUDPPayloadSize, p.maxUDPPayloadSize)
+	addInt(paramInitialMaxData, p.initialMaxData)
+	addInt(paramMaxStreamDataBidiLoc, p.maxStreamDataBidiLoc)
+	addInt(paramMaxStreamDataBidiRem, p.maxStreamDataBidiRem)
+	addInt(paramMaxStreamDataUni, p.maxStreamDataUni)
+	addInt(paramInitialMaxStreamsBidi, p.initialMaxStreamsBidi)
+	addInt(paramInitialMaxStreamsUni, p.initialMaxStreamsUni)
+	// connection migration would need more connection IDs than the one
+	// this end hands out
+	addBytes(paramDisableMigration, nil)
+	return b
+}
+
+// parseTransportParams parses the peer's parameters, applying the
+// defaults for the ones it leaves out.
+func parseTransportParams(b []byte, fromServer bool) (*transportParams, error) {
+	p := &transportParams{
+		maxUDPPayloadSize: 65527,
+		maxAckDelay:       25 * time.Millisecond,
+	}
+	seen := map[uint64]bool{}
+	for len(b) > 0 {
+		r := &frameReader{b: b}
+		id := r.varint()
+		v := r.bytes(r.varint())
+		if r.bad {
+			return nil, transportError(ErrCodeTransportParameter, "truncated transport parameters")
+		}
+		b = r.b
+		if seen[id] {
+			return nil, transportError(ErrCodeTransportParameter, "transport parameter 0x%x repeated", id)
+		}
+		seen[id] = true
+
+		var n uint64
+		switch id {
+		case paramOriginalDCID, paramInitialSCID, paramRetrySCID, paramStatelessResetToken,
+			paramPreferredAddress, paramDisableMigration:
+		default:
+			vr := &frameReader{b: v}
+			n = vr.varint()
+			if vr.bad || len(vr.b) != 0 {
+				// unknown parameters might not be integers
+				if id <= paramRetrySCID {
+					return nil, transportError(ErrCodeTransportParameter, "malformed transport parameter 0x%x", id)
+				}
+				continue
+			}
+		}
+		switch id {
+		case paramOriginalDCID, paramStatelessResetToken, paramPreferredAddress, paramRetrySCID:
+			if !fromServer {
+				return nil, transportError(ErrCodeTransportParameter, "client sent server-only transport parameter 0x%x", id)
+			}
+			switch id {
+			case paramOriginalDCID:
+				p.originalDCID, p.haveOriginalDCID = bytes.Clone(v), true
+			case paramRetrySCID:
+				p.haveRetrySCID = true
+			}
+		case paramInitialSCID:
+			p.initialSCID, p.haveInitialSCID = bytes.Clone(v), true
+		case paramMaxIdleTimeout:
+			p.maxIdleTimeout = time.Duration(n) * time.Millisecond
+		case paramMaxUDPPayloadSize:
+			if n < 1200 {
+				return nil, transportError(ErrCodeTransportParameter, "max_udp_payload_size below 1200")
+			}
+			p.maxUDPPayloadSize = n
+		case paramInitialMaxData:
+			p.initialMaxData = n
+		case paramMaxStreamDataBidiLoc:
+			p.maxStreamDataBidiLoc = n
+		case paramMaxStreamDataBidiRem:
+			p.maxStreamDataBidiRem = n
+		case paramMaxStreamDataUni:
+			p.maxStreamDataUni = n
+		case paramInitialMaxStreamsBidi, paramInitialMaxStreamsUni:
+			if n > 1<<60 {
+				return nil, transportError(ErrCodeTransportParameter, "stream limit over 2^60")
+			}
+			if id == paramInitialMaxStreamsBidi {
+				p.initialMaxStreamsBidi = n
+			} else {
+				p.initialMaxStreamsUni = n
+			}
+		case paramAckDelayExponent:
+			if n > 20 {
+				return nil, transportError(ErrCodeTransportParameter, "ack_delay_exponent over 20")
+			}
+		case paramMaxAckDelay:
+			if n >= 1<<14 {
+				return nil, transportError(ErrCodeTransportParameter, "max_ack_delay too large")
+			}
+			p.maxAckDelay = time.Duration(n) * time.Millisecond
+		case paramActiveConnIDLimit:
+			if n < 2 {
+				return nil, transportError(ErrCodeTransportParameter, "active_connection_id_limit below 2")
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,52 @@
+package quic
+
+// maxVarint is the largest value a variable-length integer can hold.
+const maxVarint = 1<<62 - 1
+
+// AppendVarint appends v in the shortest variable-length encoding of
+// RFC 9000 section 16. HTTP/3 frames use the same encoding.
+func AppendVarint(dst []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(dst, byte(v))
+	case v < 1<<14:
+		return append(dst, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(dst, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(dst, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// VarintLen returns the length of v's shortest encoding.
+func VarintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// ReadVarint reads a variable-length integer from the front of b and
+// returns it with the number of bytes it took, or n < 0 if b is too
+// short.
+func ReadVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, -1
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, -1
+	}
+	v = uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
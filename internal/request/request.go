@@ -2,6 +2,7 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -13,11 +14,41 @@ import (
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
+	// URL is the parsed RequestLine.RequestTarget.
+	URL     *URL
+	Headers *headers.Headers
+	Body    []byte
+	// Trailers holds the fields sent after the body, in the trailer
+	// section of a chunked body or its HTTP/2 and HTTP/3 equivalents,
+	// or is nil if there were none.
+	Trailers *headers.Headers
+	// RemoteAddr is the network address of the client, filled in by the
+	// server that received the request.
+	RemoteAddr string
+	// TLS is the state of the connection the request arrived on, or
+	// nil if it came in cleartext.
+	TLS *tls.ConnectionState
 
 	state          requestState
 	bodyLengthRead int
+	// chunked is set when the body has chunked transfer coding;
+	// chunkState and chunkLeft track where in it parsing is
+	chunked    bool
+	chunkState chunkState
+	chunkLeft  int64
+	protoMajor int
+	protoMinor int
+
+	// reader and buf hold the connection and any bytes read past the
+	// headers while the body is deferred behind a 100-continue.
+	reader       io.Reader
+	buf          []byte
+	readToIndex  int
+	sendContinue func() error
+	// maxBodySize caps the body, or is 0 for no cap
+	maxBodySize int64
+
+	pathValues map[string]string
 }
 
 type RequestLine struct {
@@ -31,49 +62,260 @@ type requestState int
 const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
+	requestStateAwaitingContinue
 	requestStateParsingBody
 	requestStateDone
 )
 
+type chunkState int
+
+const (
+	chunkStateSize chunkState = iota
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailers
+)
+
+// maxChunkLine caps the chunk-size line, chunk extensions included.
+const maxChunkLine = 4096
+
 const crlf = "\r\n"
 const bufferSize = 8
 
+// ErrUnsupportedExpectation is returned when a request carries an Expect
+// header with anything other than 100-continue. Servers should answer
+// with 417 Expectation Failed.
+var ErrUnsupportedExpectation = errors.New("unsupported expectation")
+
+// ErrUnsupportedVersion is returned for a well-formed HTTP-version with
+// a major version other than 1. Servers should answer with 505 HTTP
+// Version Not Supported.
+var ErrUnsupportedVersion = errors.New("unsupported HTTP version")
+
+// ErrInvalidHost is returned when an HTTP/1.1 request does not carry
+// exactly one valid Host header, or when the Host disagrees with an
+// absolute-form request-target.
+var ErrInvalidHost = errors.New("invalid Host header")
+
+// ErrUnsupportedTransferCoding is returned for a request body with a
+// transfer coding other than chunked. Servers should answer with 501
+// Not Implemented.
+var ErrUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+
+// ErrBodyTooLarge is returned when the body is larger than the
+// request's maximum body size. Servers should answer with 413 Content
+// Too Large.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// RequestFromReader parses a request from reader. If the client sent
+// "Expect: 100-continue", parsing stops after the headers and the body
+// is only read once ReadBody is called. If reader ends before the first
+// byte of a request, the error is io.EOF.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
+	return RequestFromReaderLimit(reader, 0)
+}
+
+// RequestFromReaderLimit is like RequestFromReader, but fails with
+// ErrBodyTooLarge as soon as the body turns out to be larger than
+// maxBodySize bytes, from its Content-Length or as chunks arrive, rather
+// than after buffering it. A maxBodySize of 0 means no limit.
+func RequestFromReaderLimit(reader io.Reader, maxBodySize int64) (*Request, error) {
 	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
+		state:       requestStateInitialized,
+		Headers:     headers.NewHeaders(),
+		Body:        make([]byte, 0),
+		reader:      reader,
+		buf:         make([]byte, bufferSize, bufferSize),
+		maxBodySize: maxBodySize,
+	}
+	if err := req.read(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// NewRequest builds a request that arrived as something other than
+// HTTP/1.x text, such as an HTTP/2 stream, from its parts. The target
+// and Host header are checked as RequestFromReader checks them, and the
+// body is complete.
+func NewRequest(method, target string, major, minor int, h *headers.Headers, body []byte) (*Request, error) {
+	u, err := ParseRequestTarget(method, target)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = make([]byte, 0)
+	}
+	r := &Request{
+		RequestLine: RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   fmt.Sprintf("%d.%d", major, minor),
+		},
+		URL:        u,
+		Headers:    h,
+		Body:       body,
+		state:      requestStateDone,
+		protoMajor: major,
+		protoMinor: minor,
+	}
+	if err := r.validateHost(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ExpectsContinue reports whether the client is waiting for a
+// 100 Continue before sending the body.
+func (r *Request) ExpectsContinue() bool {
+	return r.state == requestStateAwaitingContinue
+}
+
+// Complete reports whether the whole request, body included, has been
+// read, so whatever follows on the connection is the next request.
+func (r *Request) Complete() bool {
+	return r.state == requestStateDone
+}
+
+// SetContinueHook registers the function ReadBody calls to send the
+// interim 100 Continue response before it reads a deferred body.
+func (r *Request) SetContinueHook(fn func() error) {
+	r.sendContinue = fn
+}
+
+// SetMaxBodySize caps the body at n bytes, for a body still to be read
+// by ReadBody. A cap above one the request already has is ignored, and
+// n of 0 leaves it as it is.
+func (r *Request) SetMaxBodySize(n int64) {
+	if n > 0 && (r.maxBodySize == 0 || n < r.maxBodySize) {
+		r.maxBodySize = n
+	}
+}
+
+// ReadBody returns the request body. If the body was deferred behind
+// "Expect: 100-continue", the continue hook is called first and the
+// body is then read from the connection. A declared Content-Length over
+// the maximum body size fails with ErrBodyTooLarge without the client
+// being told to continue.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.state != requestStateAwaitingContinue {
+		return r.Body, nil
+	}
+	if err := r.checkContentLength(); err != nil {
+		return nil, err
 	}
-	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	if r.sendContinue != nil {
+		if err := r.sendContinue(); err != nil {
+			return nil, err
+		}
+	}
+	r.state = requestStateParsingBody
+
+	// the client may have sent some of the body without waiting
+	numBytesParsed, err := r.parse(r.buf[:r.readToIndex])
+	if err != nil {
+		return nil, err
+	}
+	copy(r.buf, r.buf[numBytesParsed:r.readToIndex])
+	r.readToIndex -= numBytesParsed
+
+	if err := r.read(); err != nil {
+		return nil, err
+	}
+	return r.Body, nil
+}
+
+// ProtoAtLeast reports whether the request's HTTP version is at least
+// major.minor.
+func (r *Request) ProtoAtLeast(major, minor int) bool {
+	return r.protoMajor > major || r.protoMajor == major && r.protoMinor >= minor
+}
+
+// KeepAlive reports whether the client wants the connection kept open
+// after this request: by default in HTTP/1.1 unless it sent
+// "Connection: close", and in HTTP/1.0 only if it sent
+// "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	if r.hasConnectionOption("close") {
+		return false
+	}
+	return r.ProtoAtLeast(1, 1) || r.hasConnectionOption("keep-alive")
+}
+
+func (r *Request) hasConnectionOption(option string) bool {
+	for _, v := range r.Headers.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), option) {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+// Buffered returns the bytes that were read from the connection past
+// the end of the request, which are the start of the next pipelined
+// request, if any. It is only meaningful once the body has been read.
+func (r *Request) Buffered() []byte {
+	return r.buf[:r.readToIndex]
+}
+
+// Host returns the host the request is for, lowercased and with any
+// port still attached. It comes from the request-target when that names
+// one, and from the Host header otherwise.
+func (r *Request) Host() string {
+	if r.URL != nil && r.URL.Host != "" {
+		return r.URL.Host
+	}
+	return strings.ToLower(r.Headers.Get("Host"))
+}
+
+// PathValue returns the value of the named path parameter matched by a
+// router, or the empty string if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets a path parameter so that PathValue returns it.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+func (r *Request) read() error {
+	for r.state != requestStateDone && r.state != requestStateAwaitingContinue {
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
+		}
+
+		numBytesRead, err := r.reader.Read(r.buf[r.readToIndex:])
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
+				if r.state == requestStateInitialized && r.readToIndex == 0 {
+					return io.EOF
+				}
+				if r.state != requestStateDone {
+					return fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", r.state, numBytesRead)
 				}
 				break
 			}
-			return nil, err
+			return err
 		}
-		readToIndex += numBytesRead
+		r.readToIndex += numBytesRead
 
-		numBytesParsed, err := req.parse(buf[:readToIndex])
+		numBytesParsed, err := r.parse(r.buf[:r.readToIndex])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+		copy(r.buf, r.buf[numBytesParsed:r.readToIndex])
+		r.readToIndex -= numBytesParsed
 	}
-	return req, nil
+	return nil
 }
 
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
@@ -113,9 +355,8 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	if httpPart != "HTTP" {
 		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
 	}
-	version := versionParts[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+	if _, _, err := parseVersion(versionParts[1]); err != nil {
+		return nil, err
 	}
 
 	return &RequestLine{
@@ -125,6 +366,24 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}, nil
 }
 
+// parseVersion parses the DIGIT "." DIGIT after "HTTP/". Any HTTP/1.x
+// is accepted, since a server speaking 1.1 can answer every 1.x client;
+// other major versions get ErrUnsupportedVersion.
+func parseVersion(version string) (major, minor int, err error) {
+	if len(version) != 3 || version[1] != '.' || !isDigit(version[0]) || !isDigit(version[2]) {
+		return 0, 0, fmt.Errorf("unrecognized HTTP-version: %s", version)
+	}
+	major, minor = int(version[0]-'0'), int(version[2]-'0')
+	if major != 1 {
+		return 0, 0, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, version)
+	}
+	return major, minor, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.state != requestStateDone {
@@ -152,7 +411,13 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			// just need more data
 			return 0, nil
 		}
+		u, err := ParseRequestTarget(requestLine.Method, requestLine.RequestTarget)
+		if err != nil {
+			return 0, err
+		}
 		r.RequestLine = *requestLine
+		r.URL = u
+		r.protoMajor, r.protoMinor, _ = parseVersion(requestLine.HttpVersion)
 		r.state = requestStateParsingHeaders
 		return n, nil
 	case requestStateParsingHeaders:
@@ -161,32 +426,218 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 		if done {
-			r.state = requestStateParsingBody
+			if err := r.validateHost(); err != nil {
+				return 0, err
+			}
+			if r.chunked, err = r.transferCoding(); err != nil {
+				return 0, err
+			}
+			if err := r.checkContentLength(); err != nil {
+				return 0, err
+			}
+			expect, err := r.expectation()
+			if err != nil {
+				return 0, err
+			}
+			if expect {
+				r.state = requestStateAwaitingContinue
+			} else {
+				r.state = requestStateParsingBody
+			}
 		}
 		return n, nil
+	case requestStateAwaitingContinue:
+		// wait for ReadBody before consuming anything else
+		return 0, nil
 	case requestStateParsingBody:
-		contentLenStr, ok := r.Headers.Get("Content-Length")
-		if !ok {
-			// assume that if no content-length header is present, there is no body
+		if r.chunked {
+			return r.parseChunked(data)
+		}
+		if !r.Headers.Has("Content-Length") {
+			// assume that if no content-length header is present, there is
+			// no body; anything left over belongs to the next request
 			r.state = requestStateDone
-			return len(data), nil
+			return 0, nil
 		}
-		contentLen, err := strconv.Atoi(contentLenStr)
+		contentLen, err := headers.ParseContentLength(r.Headers.Get("Content-Length"))
 		if err != nil {
-			return 0, fmt.Errorf("malformed Content-Length: %s", err)
-		}
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
-		if r.bodyLengthRead > contentLen {
-			return 0, fmt.Errorf("Content-Length too large")
+			return 0, err
 		}
-		if r.bodyLengthRead == contentLen {
+		// bytes past Content-Length are the start of the next request
+		n := int(min(int64(len(data)), contentLen-int64(r.bodyLengthRead)))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLengthRead += n
+		if int64(r.bodyLengthRead) == contentLen {
 			r.state = requestStateDone
 		}
-		return len(data), nil
+		return n, nil
 	case requestStateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
 		return 0, fmt.Errorf("unknown state")
 	}
 }
+
+// expectation reports whether the body should be deferred until the
+// client is told to continue. Only 100-continue is understood, and it
+// only matters when there is a body to wait for. HTTP/1.0 clients can't
+// expect anything, so the header is ignored for them.
+func (r *Request) expectation() (bool, error) {
+	if !r.Headers.Has("Expect") || !r.ProtoAtLeast(1, 1) {
+		return false, nil
+	}
+	expect := r.Headers.Get("Expect")
+	if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		return false, fmt.Errorf("%w: %s", ErrUnsupportedExpectation, expect)
+	}
+	if r.chunked {
+		return true, nil
+	}
+	if !r.Headers.Has("Content-Length") {
+		return false, nil
+	}
+	contentLen, err := headers.ParseContentLength(r.Headers.Get("Content-Length"))
+	if err != nil {
+		return false, err
+	}
+	return contentLen > 0, nil
+}
+
+// checkContentLength fails with ErrBodyTooLarge if the declared
+// Content-Length is over the maximum body size, so a body that is too
+// large is turned away before it is read.
+func (r *Request) checkContentLength() error {
+	if r.maxBodySize == 0 || r.chunked || !r.Headers.Has("Content-Length") {
+		return nil
+	}
+	contentLen, err := headers.ParseContentLength(r.Headers.Get("Content-Length"))
+	if err != nil {
+		return err
+	}
+	if contentLen > r.maxBodySize {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+// transferCoding reports whether the body is chunked, RFC 9112 section
+// 6.1. Chunked is the only coding understood, and has to come last so
+// the body's end can be found. A request with both Transfer-Encoding
+// and Content-Length is rejected rather than guessed at, as the two
+// disagreeing is how requests are smuggled past proxies.
+func (r *Request) transferCoding() (bool, error) {
+	if !r.Headers.Has("Transfer-Encoding") {
+		return false, nil
+	}
+	if r.Headers.Has("Content-Length") {
+		return false, errors.New("both Transfer-Encoding and Content-Length")
+	}
+	var codings []string
+	for _, coding := range strings.Split(r.Headers.Get("Transfer-Encoding"), ",") {
+		if coding = strings.TrimSpace(coding); coding != "" {
+			codings = append(codings, strings.ToLower(coding))
+		}
+	}
+	if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+		return false, fmt.Errorf("transfer codings %q don't end in chunked", r.Headers.Get("Transfer-Encoding"))
+	}
+	if len(codings) > 1 {
+		return false, fmt.Errorf("%w: %s", ErrUnsupportedTransferCoding, strings.Join(codings[:len(codings)-1], ", "))
+	}
+	return true, nil
+}
+
+// parseChunked parses the next part of a chunked body, RFC 9112
+// section 7.1: a chunk-size line, its data and CRLF, and after the last
+// chunk, the trailer section. Chunk extensions are ignored.
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.chunkState {
+	case chunkStateSize:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			if len(data) > maxChunkLine {
+				return 0, errors.New("chunk size line too long")
+			}
+			return 0, nil
+		}
+		sizeStr, _, _ := strings.Cut(string(data[:idx]), ";")
+		sizeStr = strings.TrimRight(sizeStr, " \t")
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 || sizeStr == "" || strings.ContainsAny(sizeStr, "+-xX") {
+			return 0, fmt.Errorf("malformed chunk size %q", sizeStr)
+		}
+		if r.maxBodySize > 0 && size > r.maxBodySize-int64(len(r.Body)) {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.chunkState = chunkStateTrailers
+		} else {
+			r.chunkState = chunkStateData
+			r.chunkLeft = size
+		}
+		return idx + len(crlf), nil
+	case chunkStateData:
+		n := int(min(int64(len(data)), r.chunkLeft))
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkLeft -= int64(n)
+		if r.chunkLeft == 0 {
+			r.chunkState = chunkStateDataEnd
+		}
+		return n, nil
+	case chunkStateDataEnd:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, errors.New("chunk data not followed by CRLF")
+		}
+		r.chunkState = chunkStateSize
+		return len(crlf), nil
+	default:
+		if r.Trailers == nil {
+			r.Trailers = headers.NewHeaders()
+		}
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			if r.Trailers.Len() == 0 {
+				r.Trailers = nil
+			}
+			r.state = requestStateDone
+		}
+		return n, nil
+	}
+}
+
+// validateHost enforces RFC 9112 section 3.2: an HTTP/1.1 request has
+// exactly one Host field with a valid uri-host and optional port, or
+// empty if the target has no authority, as in origin-form, and when the
+// target is in absolute-form the two must name the same host.
+// HTTP/1.0 requests may leave Host out, but one that is sent is held to
+// the same rules.
+func (r *Request) validateHost() error {
+	values := r.Headers.Values("Host")
+	switch {
+	case len(values) == 0 && !r.ProtoAtLeast(1, 1):
+		return nil
+	case len(values) == 0:
+		return fmt.Errorf("%w: missing", ErrInvalidHost)
+	case len(values) > 1:
+		return fmt.Errorf("%w: %d values", ErrInvalidHost, len(values))
+	}
+	host := strings.ToLower(values[0])
+	if host == "" && (r.URL.Form == OriginForm || r.URL.Form == AsteriskForm) {
+		// the target has no authority for Host to name, so a client
+		// sends it empty
+		return nil
+	}
+	if !validAuthority(host, false) {
+		return fmt.Errorf("%w: %q", ErrInvalidHost, values[0])
+	}
+	if r.URL.Form == AbsoluteForm && !sameAuthority(r.URL.Scheme, r.URL.Host, host) {
+		return fmt.Errorf("%w: %q does not match target host %q", ErrInvalidHost, values[0], r.URL.Host)
+	}
+	return nil
+}
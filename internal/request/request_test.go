@@ -1,11 +1,14 @@
 package request
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
 )
 
 func TestBodyParse(t *testing.T) {
@@ -60,6 +63,89 @@ func TestBodyParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
+
+	// Test: Content-Length is digits only, with no sign
+	for _, cl := range []string{"+5", "-0", "0x5", "5, 5"} {
+		_, err = RequestFromReader(&chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: a\r\nContent-Length: " + cl + "\r\n\r\nhello",
+			numBytesPerRead: 3,
+		})
+		require.Error(t, err, cl)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Chunks are joined, extensions ignored, trailers kept, and
+	// the bytes after the body left for the next request
+	for _, n := range []int{1, 3, 1024} {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Trailer: Content-Digest\r\n" +
+				"\r\n" +
+				"6;name=value\r\nhello \r\n" +
+				"A\r\nchunked!!\n\r\n" +
+				"0\r\n" +
+				"Content-Digest: sha-256=:AAA=:\r\n" +
+				"\r\n" +
+				"GET / HTTP/1.1\r\n",
+			numBytesPerRead: n,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello chunked!!\n", string(r.Body))
+		require.NotNil(t, r.Trailers)
+		assert.Equal(t, "sha-256=:AAA=:", r.Trailers.Get("Content-Digest"))
+		if n == 1024 {
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(r.Buffered()))
+		}
+	}
+
+	// Test: No trailers
+	r, err := RequestFromReader(&chunkReader{
+		data:            "PUT / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.Nil(t, r.Trailers)
+
+	// Test: Deferred behind 100-continue like any other body
+	r, err = RequestFromReader(&chunkReader{
+		data:            "PUT / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+
+	// Test: Malformed and unsupported framing
+	for _, tt := range []struct {
+		framing string
+		body    string
+		err     error
+	}{
+		{"Transfer-Encoding: gzip, chunked\r\n", "0\r\n\r\n", ErrUnsupportedTransferCoding},
+		{"Transfer-Encoding: chunked, gzip\r\n", "0\r\n\r\n", nil},
+		{"Transfer-Encoding: chunked\r\nContent-Length: 3\r\n", "0\r\n\r\n", nil},
+		{"Transfer-Encoding: chunked\r\n", "zz\r\nabc\r\n0\r\n\r\n", nil},
+		{"Transfer-Encoding: chunked\r\n", "-3\r\nabc\r\n0\r\n\r\n", nil},
+		{"Transfer-Encoding: chunked\r\n", "3\r\nabcd\r\n0\r\n\r\n", nil},
+		{"Transfer-Encoding: chunked\r\n", "3\r\nabc\r\n", nil},
+		{"Transfer-Encoding: chunked\r\n", "0\r\nno colon\r\n\r\n", nil},
+	} {
+		_, err := RequestFromReader(&chunkReader{
+			data:            "POST / HTTP/1.1\r\nHost: a\r\n" + tt.framing + "\r\n" + tt.body,
+			numBytesPerRead: 4,
+		})
+		require.Error(t, err, tt.framing+tt.body)
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err)
+		}
+	}
 }
 
 func TestHeadersParse(t *testing.T) {
@@ -71,9 +157,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -81,9 +167,7 @@ func TestHeadersParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
-	require.NoError(t, err)
-	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	require.ErrorIs(t, err, ErrInvalidHost)
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -95,13 +179,13 @@ func TestHeadersParse(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: duplicate:8080\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: text/plain\r\nAccept: text/html\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, duplicate:8080", r.Headers["host"])
+	assert.Equal(t, "text/plain, text/html", r.Headers.Get("accept"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -111,8 +195,8 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -185,6 +269,274 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestExpectContinue(t *testing.T) {
+	// Test: Body is deferred until ReadBody
+	reader := &chunkReader{
+		data: "PUT /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.True(t, r.ExpectsContinue())
+	assert.Equal(t, "", string(r.Body))
+
+	continued := 0
+	r.SetContinueHook(func() error {
+		continued++
+		return nil
+	})
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, 1, continued)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Reading the body again does not send another 100 Continue
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, continued)
+
+	// Test: Body already buffered with the headers
+	reader = &chunkReader{
+		data: "PUT /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-Continue\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 100,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Nothing to wait for without a body
+	reader = &chunkReader{
+		data: "GET / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Unknown expectation
+	reader = &chunkReader{
+		data: "PUT /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 200-ok\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedExpectation)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	// Test: A body within the limit
+	r, err := RequestFromReaderLimit(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: A Content-Length over the limit fails before the body is read
+	_, err = RequestFromReaderLimit(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\n",
+		numBytesPerRead: 3,
+	}, 5)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A chunked body fails at the chunk that goes over the limit
+	_, err = RequestFromReaderLimit(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\nfffffff\r\n",
+		numBytesPerRead: 3,
+	}, 5)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A deferred body is checked by ReadBody, and the client is
+	// never told to continue
+	r, err = RequestFromReader(&chunkReader{
+		data:            "PUT / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	continued := false
+	r.SetContinueHook(func() error {
+		continued = true
+		return nil
+	})
+	r.SetMaxBodySize(5)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.False(t, continued)
+	assert.False(t, r.Complete())
+
+	// Test: A deferred chunked body is cut off partway
+	r, err = RequestFromReader(&chunkReader{
+		data: "PUT / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"4\r\nhell\r\n4\r\no wo\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	r.SetMaxBodySize(5)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.False(t, r.Complete())
+}
+
+func TestHostValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		host string
+		err  bool
+	}{
+		{"origin-form", "GET / HTTP/1.1\r\nHost: Example.COM:8080\r\n\r\n", "example.com:8080", false},
+		{"ipv6", "GET / HTTP/1.1\r\nHost: [::1]:42069\r\n\r\n", "[::1]:42069", false},
+		{"absolute-form", "GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", false},
+		{"absolute-form default port", "GET http://example.com:80/a HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:80", false},
+		{"authority-form", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443", false},
+		{"missing", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", "", true},
+		{"empty", "GET / HTTP/1.1\r\nHost: \r\n\r\n", "", false},
+		{"empty asterisk-form", "OPTIONS * HTTP/1.1\r\nHost:\r\n\r\n", "", false},
+		{"empty absolute-form", "GET http://example.com/ HTTP/1.1\r\nHost: \r\n\r\n", "", true},
+		{"empty authority-form", "CONNECT example.com:443 HTTP/1.1\r\nHost: \r\n\r\n", "", true},
+		{"repeated", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: a.example\r\n\r\n", "", true},
+		{"list", "GET / HTTP/1.1\r\nHost: a.example, b.example\r\n\r\n", "", true},
+		{"userinfo", "GET / HTTP/1.1\r\nHost: user@example.com\r\n\r\n", "", true},
+		{"bad port", "GET / HTTP/1.1\r\nHost: example.com:http\r\n\r\n", "", true},
+		{"mismatch", "GET http://example.com/ HTTP/1.1\r\nHost: other.example\r\n\r\n", "", true},
+		{"port mismatch", "GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := RequestFromReader(&chunkReader{data: tt.data, numBytesPerRead: 3})
+			if tt.err {
+				require.ErrorIs(t, err, ErrInvalidHost)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.host, r.Host())
+		})
+	}
+}
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		err       error
+		http11    bool
+		keepAlive bool
+	}{
+		{"1.1", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", nil, true, true},
+		{"1.1 close", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Close\r\n\r\n", nil, true, false},
+		{"1.1 close in list", "GET / HTTP/1.1\r\nHost: a\r\nConnection: upgrade, close\r\n\r\n", nil, true, false},
+		{"1.0", "GET / HTTP/1.0\r\n\r\n", nil, false, false},
+		{"1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", nil, false, true},
+		{"1.0 with Host", "GET / HTTP/1.0\r\nHost: a\r\n\r\n", nil, false, false},
+		{"1.2 is answered as 1.1", "GET / HTTP/1.2\r\nHost: a\r\n\r\n", nil, true, true},
+		{"1.0 bad Host", "GET / HTTP/1.0\r\nHost: a\r\nHost: b\r\n\r\n", ErrInvalidHost, false, false},
+		{"2.0", "GET / HTTP/2.0\r\nHost: a\r\n\r\n", ErrUnsupportedVersion, false, false},
+		{"0.9", "GET / HTTP/0.9\r\n\r\n", ErrUnsupportedVersion, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := RequestFromReader(&chunkReader{data: tt.data, numBytesPerRead: 3})
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.http11, r.ProtoAtLeast(1, 1))
+			assert.True(t, r.ProtoAtLeast(1, 0))
+			assert.Equal(t, tt.keepAlive, r.KeepAlive())
+		})
+	}
+
+	// Test: Malformed versions are not mistaken for unsupported ones
+	for _, version := range []string{"HTTP/1", "HTTP/1.10", "HTTP/a.b", "HTTP/11"} {
+		_, err := RequestFromReader(&chunkReader{data: "GET / " + version + "\r\nHost: a\r\n\r\n", numBytesPerRead: 3})
+		require.Error(t, err, version)
+		assert.NotErrorIs(t, err, ErrUnsupportedVersion, version)
+	}
+
+	// Test: HTTP/1.0 ignores Expect
+	r, err := RequestFromReader(&chunkReader{
+		data:            "PUT / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+	assert.Equal(t, "hello", string(r.Body))
+}
+
+func TestPipelining(t *testing.T) {
+	data := "POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /b HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: a\r\n\r\n"
+
+	// Test: Bytes past each request are kept for the next one
+	reader := io.Reader(&chunkReader{data: data, numBytesPerRead: 1024})
+	var paths []string
+	for {
+		r, err := RequestFromReader(reader)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/a" {
+			assert.Equal(t, "hello", string(r.Body))
+		}
+		reader = io.MultiReader(bytes.NewReader(bytes.Clone(r.Buffered())), reader)
+	}
+	assert.Equal(t, []string{"/a", "/b", "/c"}, paths)
+
+	// Test: EOF in the middle of a request is not io.EOF
+	_, err := RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\n", numBytesPerRead: 3})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestNewRequest(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Host", "example.com")
+	r, err := NewRequest("POST", "/a/../b?x=1", 2, 0, h, []byte("body"))
+	require.NoError(t, err)
+	assert.Equal(t, "2.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, "/b", r.URL.Path)
+	assert.True(t, r.ProtoAtLeast(1, 1))
+	assert.True(t, r.KeepAlive())
+	assert.False(t, r.ExpectsContinue())
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+
+	// Test: Same checks as parsed requests
+	_, err = NewRequest("GET", "/../x", 2, 0, h, nil)
+	require.ErrorIs(t, err, ErrMalformedTarget)
+	_, err = NewRequest("GET", "/", 2, 0, headers.NewHeaders(), nil)
+	require.ErrorIs(t, err, ErrInvalidHost)
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
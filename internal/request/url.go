@@ -0,0 +1,322 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TargetForm is one of the four request-target forms in RFC 9112
+// section 3.2.
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query: "/a/b?c".
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, as sent to proxies: "http://host/a".
+	AbsoluteForm
+	// AuthorityForm is a host and port, only used with CONNECT.
+	AuthorityForm
+	// AsteriskForm is "*", only used with server-wide OPTIONS.
+	AsteriskForm
+)
+
+// ErrMalformedTarget is wrapped by every error from ParseRequestTarget.
+var ErrMalformedTarget = errors.New("malformed request-target")
+
+// URL is a parsed request-target. Path is percent-decoded once and
+// normalized; RawPath keeps the path exactly as it was sent.
+type URL struct {
+	Form     TargetForm
+	Scheme   string
+	Host     string
+	Path     string
+	RawPath  string
+	RawQuery string
+	Query    Values
+}
+
+// Values maps query parameter names to their values, in the order they
+// appeared.
+type Values map[string][]string
+
+// Get returns the first value for key, or the empty string.
+func (v Values) Get(key string) string {
+	if vs := v[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Has reports whether key appeared in the query, even without a value.
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// ParseRequestTarget parses the request-target of a request with the
+// given method. Fragments, invalid percent-encodings, control
+// characters and paths that climb above the root are all rejected.
+func ParseRequestTarget(method, target string) (*URL, error) {
+	if target == "" {
+		return nil, targetError(target, "empty")
+	}
+	for i := 0; i < len(target); i++ {
+		if c := target[i]; c <= ' ' || c >= 0x7f {
+			return nil, targetError(target, "invalid character")
+		}
+	}
+	if strings.Contains(target, "#") {
+		return nil, targetError(target, "fragment not allowed")
+	}
+
+	switch {
+	case method == "CONNECT":
+		return parseAuthorityForm(target)
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, targetError(target, "asterisk-form is only allowed with OPTIONS")
+		}
+		return &URL{Form: AsteriskForm, Path: "*", RawPath: "*", Query: Values{}}, nil
+	case strings.HasPrefix(target, "/"):
+		return parseOriginForm(target)
+	default:
+		return parseAbsoluteForm(target)
+	}
+}
+
+func parseOriginForm(target string) (*URL, error) {
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	u := &URL{Form: OriginForm, RawPath: rawPath, RawQuery: rawQuery}
+	if err := u.parsePathAndQuery(target); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func parseAbsoluteForm(target string) (*URL, error) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !validScheme(scheme) {
+		return nil, targetError(target, "invalid scheme")
+	}
+	authority, pathAndQuery := rest, ""
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		authority, pathAndQuery = rest[:i], rest[i:]
+	}
+	if strings.Contains(authority, "@") {
+		return nil, targetError(target, "userinfo not allowed")
+	}
+	if !validAuthority(authority, false) {
+		return nil, targetError(target, "invalid host")
+	}
+	rawPath, rawQuery, _ := strings.Cut(pathAndQuery, "?")
+	if rawPath == "" {
+		rawPath = "/"
+	}
+	u := &URL{
+		Form:     AbsoluteForm,
+		Scheme:   strings.ToLower(scheme),
+		Host:     strings.ToLower(authority),
+		RawPath:  rawPath,
+		RawQuery: rawQuery,
+	}
+	if err := u.parsePathAndQuery(target); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func parseAuthorityForm(target string) (*URL, error) {
+	if !validAuthority(target, true) {
+		return nil, targetError(target, "CONNECT needs a host and port")
+	}
+	return &URL{Form: AuthorityForm, Host: strings.ToLower(target), Query: Values{}}, nil
+}
+
+func (u *URL) parsePathAndQuery(target string) error {
+	path, err := unescape(u.RawPath, false)
+	if err != nil {
+		return targetError(target, err.Error())
+	}
+	if strings.ContainsAny(path, "\x00\\") {
+		return targetError(target, "invalid character in path")
+	}
+	u.Path, err = normalizePath(path)
+	if err != nil {
+		return targetError(target, err.Error())
+	}
+	u.Query, err = parseQuery(u.RawQuery)
+	if err != nil {
+		return targetError(target, err.Error())
+	}
+	return nil
+}
+
+// normalizePath collapses duplicate slashes and resolves "." and ".."
+// segments. A ".." that would climb above the root is an error rather
+// than being silently dropped. A trailing slash is kept.
+func normalizePath(path string) (string, error) {
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			if len(out) == 0 {
+				return "", fmt.Errorf("path escapes root")
+			}
+			out = out[:len(out)-1]
+		default:
+			out = append(out, seg)
+		}
+	}
+	normalized := "/" + strings.Join(out, "/")
+	last := segments[len(segments)-1]
+	if len(out) > 0 && (last == "" || last == "." || last == "..") {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
+func parseQuery(rawQuery string) (Values, error) {
+	values := Values{}
+	if rawQuery == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = append(values[key], value)
+	}
+	return values, nil
+}
+
+// unescape decodes %XX sequences in s, and "+" as a space when
+// plusAsSpace is set (for query strings).
+func unescape(s string, plusAsSpace bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", fmt.Errorf("invalid percent-encoding")
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && plusAsSpace:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func validScheme(scheme string) bool {
+	if scheme == "" || !isAlpha(scheme[0]) {
+		return false
+	}
+	for i := 1; i < len(scheme); i++ {
+		c := scheme[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// validAuthority checks a host with an optional port (required when
+// needPort is set). IPv6 literals must be in brackets.
+func validAuthority(authority string, needPort bool) bool {
+	host, port := authority, ""
+	if strings.HasPrefix(authority, "[") {
+		end := strings.Index(authority, "]")
+		if end == -1 {
+			return false
+		}
+		host, port = authority[:end+1], authority[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return false
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if i := strings.LastIndex(authority, ":"); i != -1 {
+		host, port = authority[:i], authority[i+1:]
+		if port == "" {
+			return false
+		}
+	}
+	if host == "" || (needPort && port == "") {
+		return false
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	if strings.HasPrefix(host, "[") {
+		return len(host) > 2
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && !strings.ContainsRune("-._~!$&'()*+,;=%", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAuthority compares two lowercased authorities, treating an
+// omitted port as the default port for scheme.
+func sameAuthority(scheme, a, b string) bool {
+	return withDefaultPort(scheme, a) == withDefaultPort(scheme, b)
+}
+
+func withDefaultPort(scheme, authority string) string {
+	if i := strings.LastIndex(authority, ":"); i != -1 && !strings.HasSuffix(authority, "]") {
+		return authority
+	}
+	switch scheme {
+	case "http":
+		return authority + ":80"
+	case "https":
+		return authority + ":443"
+	}
+	return authority
+}
+
+func targetError(target, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrMalformedTarget, target, reason)
+}
@@ -0,0 +1,110 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestTarget(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		form     TargetForm
+		scheme   string
+		host     string
+		path     string
+		rawQuery string
+	}{
+		{"GET", "/", OriginForm, "", "", "/", ""},
+		{"GET", "/coffee", OriginForm, "", "", "/coffee", ""},
+		{"GET", "/a/b/?x=1&y=2", OriginForm, "", "", "/a/b/", "x=1&y=2"},
+		{"GET", "//a///b", OriginForm, "", "", "/a/b", ""},
+		{"GET", "/a/./b/../c", OriginForm, "", "", "/a/c", ""},
+		{"GET", "/a/b/..", OriginForm, "", "", "/a/", ""},
+		{"GET", "/hello%20world", OriginForm, "", "", "/hello world", ""},
+		{"GET", "/a/%2e%2e/b", OriginForm, "", "", "/b", ""},
+		{"GET", "/100%25", OriginForm, "", "", "/100%", ""},
+		{"GET", "http://Example.com:8080/x?q", AbsoluteForm, "http", "example.com:8080", "/x", "q"},
+		{"GET", "https://example.com", AbsoluteForm, "https", "example.com", "/", ""},
+		{"GET", "http://[::1]:80/", AbsoluteForm, "http", "[::1]:80", "/", ""},
+		{"CONNECT", "example.com:443", AuthorityForm, "", "example.com:443", "", ""},
+		{"OPTIONS", "*", AsteriskForm, "", "", "*", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			u, err := ParseRequestTarget(tt.method, tt.target)
+			require.NoError(t, err)
+			assert.Equal(t, tt.form, u.Form)
+			assert.Equal(t, tt.scheme, u.Scheme)
+			assert.Equal(t, tt.host, u.Host)
+			assert.Equal(t, tt.path, u.Path)
+			assert.Equal(t, tt.rawQuery, u.RawQuery)
+		})
+	}
+}
+
+func TestParseRequestTarget_Query(t *testing.T) {
+	u, err := ParseRequestTarget("GET", "/search?q=go+lang&tag=a&tag=b%26c&flag&=x")
+	require.NoError(t, err)
+	assert.Equal(t, "go lang", u.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, u.Query["tag"])
+	assert.True(t, u.Query.Has("flag"))
+	assert.Equal(t, "", u.Query.Get("flag"))
+	assert.Equal(t, "", u.Query.Get("missing"))
+	assert.Equal(t, "/search", u.RawPath)
+}
+
+func TestParseRequestTarget_Malformed(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+	}{
+		{"GET", ""},
+		{"GET", "/a#frag"},
+		{"GET", "/bad%2"},
+		{"GET", "/bad%zz"},
+		{"GET", "/?q=%g0"},
+		{"GET", "/.."},
+		{"GET", "/a/../../etc/passwd"},
+		{"GET", "/%2e%2e/etc/passwd"},
+		{"GET", "/a%00b"},
+		{"GET", "/a%5c..%5c"},
+		{"GET", "/caf\xc3\xa9"},
+		{"GET", "*"},
+		{"GET", "coffee"},
+		{"GET", "1http://example.com/"},
+		{"GET", "http://user@example.com/"},
+		{"GET", "http:///path"},
+		{"GET", "http://example.com:port/"},
+		{"CONNECT", "example.com"},
+		{"CONNECT", "/path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			_, err := ParseRequestTarget(tt.method, tt.target)
+			require.ErrorIs(t, err, ErrMalformedTarget)
+		})
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET /a//b/../c?x=1 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/a//b/../c?x=1", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/a/c", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+
+	// Test: Traversal is rejected while parsing
+	reader = &chunkReader{
+		data:            "GET /../secret HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedTarget)
+}
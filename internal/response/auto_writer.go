@@ -0,0 +1,145 @@
+package response
+
+import (
+	"fmt"
+
+	"httpfromtcp/internal/headers"
+)
+
+// DefaultAutoThreshold is how many body bytes an AutoWriter buffers
+// before it gives up on Content-Length and switches to chunked encoding.
+const DefaultAutoThreshold = 4096
+
+// AutoWriter writes a response body and picks its framing. The body is
+// buffered until it grows past the threshold: a response that finishes
+// under it goes out with Content-Length, anything larger (or anything
+// flushed early) is sent with Transfer-Encoding: chunked.
+type AutoWriter struct {
+	w          *Writer
+	statusCode StatusCode
+	headers    *headers.Headers
+	threshold  int
+	buf        []byte
+	chunked    bool
+	closed     bool
+}
+
+// NewAutoWriter starts a response on w with the given status and
+// headers. Content-Length and Transfer-Encoding in h are replaced by
+// whatever framing the AutoWriter settles on; a nil h gets the default
+// headers. The response is finished by Close, or by w.Finish once the
+// handler returns.
+func NewAutoWriter(w *Writer, statusCode StatusCode, h *headers.Headers) *AutoWriter {
+	if h == nil {
+		h = GetDefaultHeaders(0)
+	}
+	aw := &AutoWriter{
+		w:          w,
+		statusCode: statusCode,
+		headers:    h,
+		threshold:  DefaultAutoThreshold,
+	}
+	w.auto = aw
+	return aw
+}
+
+// SetThreshold changes how many bytes are buffered before switching to
+// chunked encoding. It has no effect once the headers have been sent.
+func (aw *AutoWriter) SetThreshold(n int) {
+	aw.threshold = n
+}
+
+func (aw *AutoWriter) Write(p []byte) (int, error) {
+	if aw.closed {
+		return 0, fmt.Errorf("write on closed AutoWriter")
+	}
+	if aw.chunked {
+		return aw.writeChunk(p)
+	}
+	aw.buf = append(aw.buf, p...)
+	if len(aw.buf) > aw.threshold {
+		if err := aw.startChunked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends everything buffered so far. The length of the body is not
+// known yet, so flushing commits the response to chunked encoding.
+func (aw *AutoWriter) Flush() error {
+	if aw.closed {
+		return fmt.Errorf("flush on closed AutoWriter")
+	}
+	if !aw.chunked {
+		if err := aw.startChunked(); err != nil {
+			return err
+		}
+	}
+	return aw.w.Flush()
+}
+
+// Close finishes the response, sending Content-Length framing if the
+// whole body fit under the threshold, or the terminating chunk if not.
+// Closing more than once is a no-op.
+func (aw *AutoWriter) Close() error {
+	if aw.closed {
+		return nil
+	}
+	aw.closed = true
+	if err := aw.finish(); err != nil {
+		return err
+	}
+	return aw.w.Flush()
+}
+
+func (aw *AutoWriter) finish() error {
+	if aw.chunked {
+		if _, err := aw.w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return aw.w.WriteTrailers(headers.NewHeaders())
+	}
+
+	aw.headers.Remove("Transfer-Encoding")
+	aw.headers.Override("Content-Length", fmt.Sprintf("%d", len(aw.buf)))
+	if err := aw.w.WriteStatusLine(aw.statusCode); err != nil {
+		return err
+	}
+	if err := aw.w.WriteHeaders(aw.headers); err != nil {
+		return err
+	}
+	_, err := aw.w.WriteBody(aw.buf)
+	aw.buf = nil
+	return err
+}
+
+func (aw *AutoWriter) startChunked() error {
+	aw.chunked = true
+	aw.headers.Remove("Content-Length")
+	aw.headers.Override("Transfer-Encoding", "chunked")
+	if err := aw.w.WriteStatusLine(aw.statusCode); err != nil {
+		return err
+	}
+	if err := aw.w.WriteHeaders(aw.headers); err != nil {
+		return err
+	}
+	buf := aw.buf
+	aw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := aw.writeChunk(buf)
+	return err
+}
+
+func (aw *AutoWriter) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		// an empty chunk would terminate the body
+		return 0, nil
+	}
+	if _, err := aw.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,67 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoWriter_ContentLength(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	aw := NewAutoWriter(w, OK, nil)
+	_, err := aw.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = aw.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+
+	// Test: Finishing again is a no-op
+	require.NoError(t, w.Finish())
+	assert.Equal(t, out, buf.String())
+}
+
+func TestAutoWriter_SwitchesToChunked(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	aw := NewAutoWriter(w, OK, nil)
+	aw.SetThreshold(8)
+	_, err := aw.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+	_, err = aw.Write([]byte(" world"))
+	require.NoError(t, err)
+	_, err = aw.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, aw.Close())
+
+	out := buf.String()
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out, "content-length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nb\r\nhello world\r\n1\r\n!\r\n0\r\n\r\n"), out)
+
+	_, err = aw.Write([]byte("late"))
+	require.Error(t, err)
+}
+
+func TestAutoWriter_FlushCommitsChunked(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	aw := NewAutoWriter(w, OK, nil)
+	require.NoError(t, aw.Flush())
+	assert.Contains(t, buf.String(), "transfer-encoding: chunked\r\n")
+	_, err := aw.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n2\r\nhi\r\n0\r\n\r\n"))
+}
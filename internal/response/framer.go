@@ -0,0 +1,41 @@
+package response
+
+import (
+	"io"
+
+	"httpfromtcp/internal/headers"
+)
+
+// Framer carries a response over a protocol that frames messages
+// itself, such as HTTP/2, in place of HTTP/1.1's status line, header
+// section and chunked coding. A Writer built on a Framer keeps its usual
+// checks (state order, Content-Length, declared trailers) and hands the
+// framer each part as it is finished.
+type Framer interface {
+	// Write sends body bytes. The Writer buffers them first, so calls
+	// are already coalesced.
+	io.Writer
+	// WriteHeaders sends a status code with its header fields. It is
+	// called once for any interim 100 Continue and once for the final
+	// response.
+	WriteHeaders(statusCode StatusCode, h *headers.Headers) error
+	// WriteTrailers sends the trailer fields, which end the response.
+	WriteTrailers(h *headers.Headers) error
+	// Flush pushes out anything the framer itself has buffered.
+	Flush() error
+	// Close ends the response if WriteTrailers hasn't already.
+	Close() error
+}
+
+// NewFramedWriter returns a Writer that sends its response through f.
+func NewFramedWriter(f Framer) *Writer {
+	return NewFramedWriterSize(f, DefaultBufferSize)
+}
+
+// NewFramedWriterSize is NewFramedWriter with a body buffer of size
+// bytes.
+func NewFramedWriterSize(f Framer, size int) *Writer {
+	w := NewWriterSize(f, size)
+	w.framer = f
+	return w
+}
@@ -0,0 +1,36 @@
+package response
+
+import (
+	"fmt"
+
+	"httpfromtcp/internal/headers"
+)
+
+// HeaderError is returned by WriteHeaders and WriteTrailers when a field
+// could corrupt the response, e.g. a value with an embedded CRLF that
+// would let a client split it. Nothing is written when it is returned.
+type HeaderError struct {
+	Name   string
+	Value  string
+	Reason string
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("invalid header %q: %s", e.Name, e.Reason)
+}
+
+// validateFields checks every field in h before any of them are written,
+// so a bad field can't leave a partial header section on the wire.
+func validateFields(h *headers.Headers) error {
+	for _, name := range h.Names() {
+		if !headers.ValidName(name) {
+			return &HeaderError{Name: name, Reason: "name is not a valid token"}
+		}
+		for _, v := range h.Values(name) {
+			if !headers.ValidValue(v) {
+				return &HeaderError{Name: name, Value: v, Reason: "value contains CR, LF or NUL"}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+)
+
+// StatusLineFunc, HeadersFunc and BodyFunc are the next step in an
+// interceptor chain, ending at the writer itself.
+type StatusLineFunc func(statusCode StatusCode, reasonPhrase string) error
+type HeadersFunc func(h *headers.Headers) error
+type BodyFunc func(p []byte) (int, error)
+
+type StatusLineHook func(next StatusLineFunc, statusCode StatusCode, reasonPhrase string) error
+type HeadersHook func(next HeadersFunc, h *headers.Headers) error
+type BodyHook func(next BodyFunc, p []byte) (int, error)
+
+// Interceptor wraps the phases of a response so middleware can observe
+// or change what a handler writes. Each hook receives the value the
+// handler is writing and the next function in the chain; it can pass
+// the value on as-is, change it, or not call next at all. Nil hooks are
+// skipped. Body sees the payload of both WriteBody and WriteChunkedBody.
+type Interceptor struct {
+	StatusLine StatusLineHook
+	Headers    HeadersHook
+	Body       BodyHook
+	Trailers   HeadersHook
+}
+
+// Intercept installs i around the writer. Interceptors installed later
+// wrap the ones installed earlier, so the last one sees each write first.
+func (w *Writer) Intercept(i Interceptor) {
+	w.interceptors = append(w.interceptors, i)
+}
+
+func (w *Writer) interceptStatusLine(next StatusLineFunc) StatusLineFunc {
+	for _, i := range w.interceptors {
+		if i.StatusLine == nil {
+			continue
+		}
+		hook, inner := i.StatusLine, next
+		next = func(statusCode StatusCode, reasonPhrase string) error {
+			return hook(inner, statusCode, reasonPhrase)
+		}
+	}
+	return next
+}
+
+func (w *Writer) interceptHeaders(next HeadersFunc, pick func(Interceptor) HeadersHook) HeadersFunc {
+	for _, i := range w.interceptors {
+		hook := pick(i)
+		if hook == nil {
+			continue
+		}
+		inner := next
+		next = func(h *headers.Headers) error {
+			return hook(inner, h)
+		}
+	}
+	return next
+}
+
+func (w *Writer) interceptBody(next BodyFunc) BodyFunc {
+	for _, i := range w.interceptors {
+		if i.Body == nil {
+			continue
+		}
+		hook, inner := i.Body, next
+		next = func(p []byte) (int, error) {
+			return hook(inner, p)
+		}
+	}
+	return next
+}
@@ -0,0 +1,107 @@
+package response
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const copyBufferSize = 32 * 1024
+
+// ReadFrom copies r into the body until EOF, implementing io.ReaderFrom.
+// Files should be passed to it directly: io.Copy prefers os.File's
+// WriteTo, which hides the file from it. In fixed-length mode at
+// most the rest of the Content-Length is copied. If the body is being
+// discarded, r is not read at all.
+//
+// When r is a file (or socket), the response is fixed-length, no body
+// interceptors are installed and the writer sits directly on a TCP
+// connection, the copy is left to net.TCPConn.ReadFrom, which uses
+// sendfile(2) or splice(2) on Linux so the bytes never pass through user
+// space. Anything else falls back to a buffered copy through Write.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if err := w.checkState(writerStateBody, "body"); err != nil {
+		return 0, err
+	}
+	if w.discardBody {
+		// nothing would be sent, so don't read anything either
+		return 0, nil
+	}
+	r = w.limit(r)
+	if conn, ok := w.zeroCopyConn(r); ok {
+		return w.zeroCopy(conn, r)
+	}
+	return w.copyBody(r)
+}
+
+// limit bounds r to the rest of the Content-Length in fixed-length
+// mode. A reader that is already limited, as a range of a file is, gets
+// the tighter of the two limits rather than a second wrapper, so the
+// file underneath can still be found for a zero-copy send.
+func (w *Writer) limit(r io.Reader) io.Reader {
+	if w.mode != bodyModeFixed {
+		return r
+	}
+	n := w.contentLength - w.bodyWritten
+	if lr, ok := r.(*io.LimitedReader); ok {
+		return &io.LimitedReader{R: lr.R, N: min(lr.N, n)}
+	}
+	return io.LimitReader(r, n)
+}
+
+func (w *Writer) zeroCopyConn(r io.Reader) (*net.TCPConn, bool) {
+	if w.mode != bodyModeFixed {
+		return nil, false
+	}
+	for _, i := range w.interceptors {
+		if i.Body != nil {
+			return nil, false
+		}
+	}
+	conn, ok := w.writer.(*net.TCPConn)
+	if !ok {
+		return nil, false
+	}
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	switch r.(type) {
+	case *os.File, *net.TCPConn, *net.UnixConn:
+		return conn, true
+	}
+	return nil, false
+}
+
+func (w *Writer) zeroCopy(conn *net.TCPConn, r io.Reader) (int64, error) {
+	// the status line and headers are still in the write buffer
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+	n, err := conn.ReadFrom(r)
+	w.bodyWritten += n
+	return n, err
+}
+
+func (w *Writer) copyBody(r io.Reader) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
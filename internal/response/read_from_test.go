@@ -0,0 +1,147 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server.(*net.TCPConn), client.(*net.TCPConn)
+}
+
+func tempFile(t testing.TB, size int) *os.File {
+	path := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("0123456789abcdef"), size/16), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func fixedHeaders(n int) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", fmt.Sprintf("%d", n))
+	return h
+}
+
+func TestWriter_ReadFrom(t *testing.T) {
+	// Test: File over TCP in fixed-length mode
+	server, client := tcpPair(t)
+	f := tempFile(t, 64*1024)
+	w := NewWriter(server)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(64*1024)))
+	_, ok := w.zeroCopyConn(w.limit(f))
+	assert.True(t, ok)
+	n, err := w.ReadFrom(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(64*1024), n)
+	assert.Equal(t, int64(64*1024), w.BytesWritten())
+	require.NoError(t, w.Finish())
+	server.Close()
+
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 65536\r\n\r\n", string(out[:len(out)-64*1024]))
+	assert.Equal(t, bytes.Repeat([]byte("0123456789abcdef"), 4096), out[len(out)-64*1024:])
+
+	// Test: Copy stops at the Content-Length
+	buf := &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(5)))
+	n, err = w.ReadFrom(bytes.NewReader([]byte("hello world")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\nhello", buf.String())
+
+	// Test: A reader that is already limited keeps the tighter limit,
+	// and a file under it is still sent with zero copies
+	w = NewWriter(server)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(10)))
+	r := w.limit(io.LimitReader(f, 4))
+	assert.Equal(t, &io.LimitedReader{R: f, N: 4}, r)
+	_, ok = w.zeroCopyConn(r)
+	assert.True(t, ok)
+	assert.Equal(t, &io.LimitedReader{R: f, N: 10}, w.limit(io.LimitReader(f, 20)))
+
+	// Test: Chunked mode falls back to chunks
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	n, err = w.ReadFrom(bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", buf.String())
+
+	// Test: Not before the headers
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.ReadFrom(bytes.NewReader([]byte("hello")))
+	require.Error(t, err)
+}
+
+func benchmarkReadFrom(b *testing.B, wrap func(f *os.File) io.Reader) {
+	const size = 8 << 20
+	server, client := tcpPair(b)
+	go io.Copy(io.Discard, client)
+	f := tempFile(b, size)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(b, err)
+		w := NewWriter(server)
+		w.writerState = writerStateBody
+		w.mode = bodyModeFixed
+		w.contentLength = size
+		n, err := w.ReadFrom(wrap(f))
+		require.NoError(b, err)
+		require.Equal(b, int64(size), n)
+	}
+}
+
+// BenchmarkWriter_ReadFrom_Sendfile sends a file with sendfile(2).
+func BenchmarkWriter_ReadFrom_Sendfile(b *testing.B) {
+	benchmarkReadFrom(b, func(f *os.File) io.Reader { return f })
+}
+
+// BenchmarkWriter_ReadFrom_Copy hides the file's type to force the
+// buffered copy path for comparison.
+func BenchmarkWriter_ReadFrom_Copy(b *testing.B) {
+	benchmarkReadFrom(b, func(f *os.File) io.Reader { return struct{ io.Reader }{f} })
+}
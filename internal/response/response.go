@@ -3,12 +3,34 @@ package response
 import (
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"strings"
 )
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
+
+// WriteStatus sends a plain-text response with the standard reason
+// phrase as its body, followed by detail, if any, to say what went wrong.
+// The fields in h, which may be nil, are sent along with the defaults.
+func WriteStatus(w *Writer, statusCode StatusCode, h *headers.Headers, detail ...string) {
+	body := []byte(strings.Join(append([]string{StatusText(statusCode)}, detail...), ": ") + "\n")
+	fields := GetDefaultHeaders(len(body))
+	if h != nil {
+		for _, name := range h.Names() {
+			if name == "content-length" {
+				continue
+			}
+			fields.Remove(name)
+			for _, value := range h.Values(name) {
+				fields.Set(name, value)
+			}
+		}
+	}
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(fields)
+	w.WriteBody(body)
+}
@@ -4,23 +4,22 @@ import (
 	"fmt"
 )
 
-type StatusCode int
-
-const (
-	OK                  StatusCode = 200
-	BadRequest          StatusCode = 400
-	InternalServerError StatusCode = 500
-)
+func getStatusLine(major, minor int, statusCode StatusCode, reasonPhrase string) []byte {
+	return []byte(fmt.Sprintf("HTTP/%d.%d %d %s\r\n", major, minor, statusCode, reasonPhrase))
+}
 
-func getStatusLine(statusCode StatusCode) []byte {
-	reasonPhrase := ""
-	switch statusCode {
-	case OK:
-		reasonPhrase = "OK"
-	case BadRequest:
-		reasonPhrase = "Bad Request"
-	case InternalServerError:
-		reasonPhrase = "Internal Server Error"
+// validateStatusLine checks that a status line built from statusCode
+// and reasonPhrase is well formed: a three digit code, and a reason of
+// only tabs, spaces and visible characters.
+func validateStatusLine(statusCode StatusCode, reasonPhrase string) error {
+	if !statusCode.Valid() {
+		return fmt.Errorf("invalid status code: %d", statusCode)
+	}
+	for i := 0; i < len(reasonPhrase); i++ {
+		c := reasonPhrase[i]
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return fmt.Errorf("invalid reason phrase: %q", reasonPhrase)
+		}
 	}
-	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase))
+	return nil
 }
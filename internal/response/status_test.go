@@ -0,0 +1,86 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(OK))
+	assert.Equal(t, "Not Found", StatusText(NotFound))
+	assert.Equal(t, "Content Too Large", StatusText(ContentTooLarge))
+	assert.Equal(t, "Network Authentication Required", StatusText(NetworkAuthenticationRequired))
+	assert.Equal(t, "", StatusText(299))
+}
+
+func TestStatusCode_Classes(t *testing.T) {
+	assert.True(t, Continue.IsInformational())
+	assert.True(t, NoContent.IsSuccess())
+	assert.True(t, PermanentRedirect.IsRedirect())
+	assert.True(t, NotFound.IsClientError())
+	assert.False(t, NotFound.IsServerError())
+	assert.True(t, BadGateway.IsServerError())
+	assert.True(t, StatusCode(599).Valid())
+	assert.False(t, StatusCode(99).Valid())
+	assert.False(t, StatusCode(600).Valid())
+}
+
+func TestWriter_WriteStatusLine(t *testing.T) {
+	// Test: Standard reason phrase
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+
+	// Test: Unregistered code has an empty reason phrase
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(299))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+	// Test: Custom reason phrase
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLineWithReason(OK, "All Good"))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 All Good\r\n", buf.String())
+
+	// Test: Out of range code
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.Error(t, w.WriteStatusLine(1000))
+	require.Error(t, w.WriteStatusLine(42))
+	assert.Empty(t, buf.String())
+
+	// Test: Reason phrase cannot split the response
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.Error(t, w.WriteStatusLineWithReason(OK, "OK\r\nSet-Cookie: a=b"))
+	assert.Empty(t, buf.String())
+}
+
+func TestWriteStatus(t *testing.T) {
+	// Test: The reason phrase is the body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	WriteStatus(w, NotFound, nil)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\ncontent-length: 10\r\ncontent-type: text/plain\r\n\r\nNot Found\n", buf.String())
+
+	// Test: Extra fields and a detail
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Set("Allow", "GET")
+	h.Set("Content-Length", "0")
+	WriteStatus(w, MethodNotAllowed, h, "try GET")
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\ncontent-length: 28\r\ncontent-type: text/plain\r\nallow: GET\r\n\r\nMethod Not Allowed: try GET\n", buf.String())
+}
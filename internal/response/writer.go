@@ -1,8 +1,12 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	"httpfromtcp/internal/headers"
 )
@@ -14,71 +18,414 @@ const (
 	writerStateHeaders
 	writerStateBody
 	writerStateTrailers
+	writerStateDone
 )
 
+func (s writerState) String() string {
+	switch s {
+	case writerStateStatusLine:
+		return "status line"
+	case writerStateHeaders:
+		return "headers"
+	case writerStateBody:
+		return "body"
+	case writerStateTrailers:
+		return "trailers"
+	case writerStateDone:
+		return "done"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(s))
+	}
+}
+
+// bodyMode is how the body is framed, decided by the headers that were
+// sent: a Content-Length, chunked transfer coding, or neither, in which
+// case the body runs until the connection is closed.
+type bodyMode int
+
+const (
+	bodyModeUnknown bodyMode = iota
+	bodyModeFixed
+	bodyModeChunked
+	bodyModeUntilClose
+)
+
+// ErrDone is returned for any write after the response has finished.
+var ErrDone = errors.New("response already finished")
+
+// DefaultBufferSize is the size of the write buffer used by NewWriter.
+const DefaultBufferSize = 4096
+
 type Writer struct {
-	writerState writerState
-	writer      io.Writer
+	writerState      writerState
+	writer           io.Writer
+	buf              *bufio.Writer
+	framer           Framer
+	auto             *AutoWriter
+	canonicalHeaders bool
+	protoMajor       int
+	protoMinor       int
+
+	mode          bodyMode
+	contentLength int64
+	bodyWritten   int64
+	trailers      map[string]bool
+	discardBody   bool
+	// unchunked is set when the headers asked for chunked transfer
+	// coding but it can't be used, so chunks go out bare: either the
+	// client speaks HTTP/1.0 and the body ends when the connection
+	// closes, or a Framer frames the body itself
+	unchunked bool
+	// handlerChunked is set when the handler's own headers, before any
+	// interceptor saw them, asked for chunked transfer coding
+	handlerChunked bool
+
+	interceptors []Interceptor
+	onFinish     []func()
+	finished     bool
+	statusCode   StatusCode
+	headers      *headers.Headers
+	start        time.Time
+	firstByte    time.Time
+	completed    time.Time
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{
+	return NewWriterSize(w, DefaultBufferSize)
+}
+
+// NewWriterSize returns a Writer whose output is buffered in size bytes.
+// The status line, headers and small bodies are coalesced into as few
+// writes to w as possible; nothing reaches w until the buffer fills or
+// the response is flushed or finished.
+func NewWriterSize(w io.Writer, size int) *Writer {
+	rw := &Writer{
 		writerState: writerStateStatusLine,
 		writer:      w,
+		protoMajor:  1,
+		protoMinor:  1,
+		start:       time.Now(),
+	}
+	rw.buf = bufio.NewWriterSize(connWriter{rw}, size)
+	return rw
+}
+
+// Flush sends anything buffered to the underlying writer. Streaming
+// handlers call it to push out what they have written so far.
+func (w *Writer) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.framer != nil {
+		return w.framer.Flush()
+	}
+	return nil
+}
+
+// StatusCode returns the status code that was sent, or 0 if the status
+// line hasn't been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// Headers returns a copy of the header section as it was sent, or nil
+// if the headers haven't been written yet.
+func (w *Writer) Headers() *headers.Headers {
+	if w.headers == nil {
+		return nil
+	}
+	return w.headers.Clone()
+}
+
+// BytesWritten returns the number of body bytes sent so far, not
+// counting chunked framing.
+func (w *Writer) BytesWritten() int64 {
+	return w.bodyWritten
+}
+
+// TimeToFirstByte returns how long after the writer was created the
+// first byte of the response went out, or 0 if nothing has been sent.
+func (w *Writer) TimeToFirstByte() time.Duration {
+	if w.firstByte.IsZero() {
+		return 0
+	}
+	return w.firstByte.Sub(w.start)
+}
+
+// TimeToComplete returns how long after the writer was created the
+// response finished, or 0 if it is still in progress.
+func (w *Writer) TimeToComplete() time.Duration {
+	if w.completed.IsZero() {
+		return 0
+	}
+	return w.completed.Sub(w.start)
+}
+
+// DiscardBody marks the response as one without a body on the wire, as
+// for a HEAD request. The status line and headers (Content-Length
+// included) go out as written, while body writes are accepted and
+// dropped, and no chunked framing or trailers are sent.
+func (w *Writer) DiscardBody() {
+	w.discardBody = true
+}
+
+// SetVersion sets the HTTP version in the status line, which defaults
+// to 1.1. Servers set it to 1.0 for HTTP/1.0 clients, which can't take
+// chunked transfer coding: a response whose headers ask for it is sent
+// close-delimited instead, with Transfer-Encoding and Trailer removed,
+// "Connection: close" set, and any trailers dropped. Handlers keep using
+// the chunked methods as usual.
+func (w *Writer) SetVersion(major, minor int) {
+	w.protoMajor, w.protoMinor = major, minor
+}
+
+// CloseDelimited reports whether the body, as framed by the headers
+// written so far, ends when the connection closes, so the connection
+// can't be reused for another response.
+func (w *Writer) CloseDelimited() bool {
+	if w.framer != nil {
+		return false
+	}
+	return w.mode == bodyModeUntilClose || w.unchunked
+}
+
+// SetCanonicalHeaders makes WriteHeaders and WriteTrailers send field
+// names in Title-Case ("Content-Type") instead of lowercase.
+func (w *Writer) SetCanonicalHeaders(canonical bool) {
+	w.canonicalHeaders = canonical
+}
+
+// Finish completes the response once the handler is done with it. If
+// the handler used an AutoWriter that was never closed, its framing is
+// finalized here. A chunked body is terminated, a missing trailer
+// section is ended, and a fixed-length body shorter than its
+// Content-Length is reported as an error. Afterwards the writer is done
+// and refuses further writes; finishing again is a no-op.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if w.framer != nil && !w.finished {
+		if closeErr := w.framer.Close(); err == nil {
+			err = closeErr
+		}
 	}
+	if !w.finished {
+		w.finished = true
+		for _, fn := range w.onFinish {
+			fn()
+		}
+	}
+	return err
+}
+
+// OnFinish registers fn to run once the first time Finish is called,
+// after the response has been flushed. Middleware uses it to see the
+// final status and size of a response.
+func (w *Writer) OnFinish(fn func()) {
+	w.onFinish = append(w.onFinish, fn)
 }
 
+func (w *Writer) finish() error {
+	if w.auto != nil {
+		if err := w.auto.Close(); err != nil {
+			return err
+		}
+	}
+
+	switch w.writerState {
+	case writerStateDone:
+		return nil
+	case writerStateStatusLine, writerStateHeaders:
+		state := w.writerState
+		w.done()
+		return fmt.Errorf("response finished in state %s", state)
+	case writerStateBody:
+		switch w.mode {
+		case bodyModeChunked:
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			return w.WriteTrailers(headers.NewHeaders())
+		case bodyModeFixed:
+			w.done()
+			if !w.discardBody && w.bodyWritten < w.contentLength {
+				return fmt.Errorf("short body: wrote %d of %d bytes", w.bodyWritten, w.contentLength)
+			}
+		default:
+			w.done()
+		}
+		return nil
+	case writerStateTrailers:
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	return nil
+}
+
+// WriteStatusLine writes the status line with the standard reason
+// phrase for statusCode.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.writerState != writerStateStatusLine {
-		return fmt.Errorf("cannot write status line in state %d", w.writerState)
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes the status line with a custom reason
+// phrase in place of the standard one.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reasonPhrase string) error {
+	return w.interceptStatusLine(w.writeStatusLine)(statusCode, reasonPhrase)
+}
+
+func (w *Writer) writeStatusLine(statusCode StatusCode, reasonPhrase string) error {
+	if err := w.checkState(writerStateStatusLine, "status line"); err != nil {
+		return err
+	}
+	if err := validateStatusLine(statusCode, reasonPhrase); err != nil {
+		return err
 	}
 	defer func() { w.writerState = writerStateHeaders }()
-	_, err := w.writer.Write(getStatusLine(statusCode))
+	w.statusCode = statusCode
+	if w.framer != nil {
+		// the status goes out with the headers
+		return nil
+	}
+	_, err := w.write(getStatusLine(w.protoMajor, w.protoMinor, statusCode, reasonPhrase))
 	return err
 }
 
-func (w *Writer) WriteHeaders(h headers.Headers) error {
-	if w.writerState != writerStateHeaders {
-		return fmt.Errorf("cannot write headers in state %d", w.writerState)
+// WriteContinue sends an interim 100 Continue response. It must come
+// before the final status line, which is still expected afterwards.
+func (w *Writer) WriteContinue() error {
+	if err := w.checkState(writerStateStatusLine, "100 Continue"); err != nil {
+		return err
+	}
+	if w.framer != nil {
+		return w.framer.WriteHeaders(Continue, headers.NewHeaders())
+	}
+	if _, err := w.write(append(getStatusLine(w.protoMajor, w.protoMinor, Continue, StatusText(Continue)), "\r\n"...)); err != nil {
+		return err
+	}
+	// the client is waiting on this before it sends the body
+	return w.Flush()
+}
+
+// WriteHeaders writes the header section and picks how the body is
+// framed from it: chunked if Transfer-Encoding is chunked, fixed-length
+// if there is a Content-Length, and until the connection closes
+// otherwise. Names listed in a Trailer header are the only ones
+// WriteTrailers will accept.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	w.handlerChunked = isChunked(h)
+	return w.interceptHeaders(w.writeHeaders, func(i Interceptor) HeadersHook { return i.Headers })(h)
+}
+
+func (w *Writer) writeHeaders(h *headers.Headers) error {
+	if err := w.checkState(writerStateHeaders, "headers"); err != nil {
+		return err
+	}
+	if err := validateFields(h); err != nil {
+		return err
+	}
+	if err := w.setBodyMode(h); err != nil {
+		return err
+	}
+	if w.unchunked && w.framer == nil {
+		h = unchunkedHeaders(h)
 	}
 	defer func() { w.writerState = writerStateBody }()
-	for k, v := range h {
-		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
-		if err != nil {
-			return err
-		}
+	w.headers = h.Clone()
+	if w.framer != nil {
+		w.firstByte = time.Now()
+		return w.framer.WriteHeaders(w.statusCode, h)
 	}
-	_, err := w.writer.Write([]byte("\r\n"))
-	return err
+	return w.writeFields(h)
+}
+
+// Write writes p to the body using whatever framing the headers chose,
+// so the writer can be used as an io.Writer (and, through ReadFrom, as
+// the destination of io.Copy).
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.mode != bodyModeChunked {
+		return w.WriteBody(p)
+	}
+	if _, err := w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
+// WriteBody writes p as-is to a fixed-length or close-delimited body.
+// Writing past the Content-Length is an error and writes nothing. If
+// the handler's headers didn't ask for chunked coding but an
+// interceptor switched to it, to add trailers say, p goes out as a
+// chunk.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	if w.writerState != writerStateBody {
-		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
+	return w.interceptBody(w.writeBody)(p)
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if err := w.checkState(writerStateBody, "body"); err != nil {
+		return 0, err
+	}
+	if w.mode == bodyModeChunked {
+		if w.handlerChunked {
+			return 0, fmt.Errorf("cannot write unframed body in chunked mode")
+		}
+		if _, err := w.writeChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.discardBody {
+		return len(p), nil
+	}
+	if w.mode == bodyModeFixed && w.bodyWritten+int64(len(p)) > w.contentLength {
+		return 0, fmt.Errorf("body exceeds Content-Length of %d bytes", w.contentLength)
 	}
-	return w.writer.Write(p)
+	n, err := w.write(p)
+	w.bodyWritten += int64(n)
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	if w.writerState != writerStateBody {
-		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
+	return w.interceptBody(w.writeChunkedBody)(p)
+}
+
+func (w *Writer) writeChunkedBody(p []byte) (int, error) {
+	if err := w.checkState(writerStateBody, "body"); err != nil {
+		return 0, err
+	}
+	if w.mode != bodyModeChunked {
+		return 0, fmt.Errorf("cannot write chunked body without Transfer-Encoding: chunked")
+	}
+	if len(p) == 0 {
+		// an empty chunk would end the body
+		return 0, nil
+	}
+	if w.discardBody {
+		return len(p), nil
+	}
+	if w.unchunked {
+		n, err := w.write(p)
+		w.bodyWritten += int64(n)
+		return n, err
 	}
 	chunkSize := len(p)
 
 	nTotal := 0
-	n, err := fmt.Fprintf(w.writer, "%x\r\n", chunkSize)
+	n, err := w.write([]byte(fmt.Sprintf("%x\r\n", chunkSize)))
 	if err != nil {
 		return nTotal, err
 	}
 	nTotal += n
 
-	n, err = w.writer.Write(p)
+	n, err = w.write(p)
+	w.bodyWritten += int64(n)
 	if err != nil {
 		return nTotal, err
 	}
 	nTotal += n
 
-	n, err = w.writer.Write([]byte("\r\n"))
+	n, err = w.write([]byte("\r\n"))
 	if err != nil {
 		return nTotal, err
 	}
@@ -87,10 +434,17 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	if w.writerState != writerStateBody {
-		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
+	if err := w.checkState(writerStateBody, "body"); err != nil {
+		return 0, err
+	}
+	if w.mode != bodyModeChunked {
+		return 0, fmt.Errorf("cannot end chunked body without Transfer-Encoding: chunked")
+	}
+	if w.discardBody || w.unchunked {
+		w.writerState = writerStateTrailers
+		return 0, nil
 	}
-	n, err := w.writer.Write([]byte("0\r\n"))
+	n, err := w.write([]byte("0\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -98,17 +452,154 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	return n, nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	if w.writerState != writerStateTrailers {
-		return fmt.Errorf("cannot write trailers in state %d", w.writerState)
+// WriteTrailers writes the trailer section that ends a chunked body.
+// Every field must have been declared in the Trailer header. The
+// response is done afterwards.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	return w.interceptHeaders(w.writeTrailers, func(i Interceptor) HeadersHook { return i.Trailers })(h)
+}
+
+func (w *Writer) writeTrailers(h *headers.Headers) error {
+	if err := w.checkState(writerStateTrailers, "trailers"); err != nil {
+		return err
 	}
-	defer func() { w.writerState = writerStateBody }()
-	for k, v := range h {
-		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
+	if err := validateFields(h); err != nil {
+		return err
+	}
+	for _, name := range h.Names() {
+		if !w.trailers[name] {
+			return &HeaderError{Name: name, Reason: "trailer not declared in Trailer header"}
+		}
+	}
+	defer w.done()
+	if w.framer != nil && !w.discardBody && h.Len() > 0 {
+		// trailers must follow the body the buffer still holds
+		if err := w.buf.Flush(); err != nil {
+			return err
+		}
+		return w.framer.WriteTrailers(h)
+	}
+	if w.discardBody || w.unchunked {
+		return nil
+	}
+	return w.writeFields(h)
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// connWriter is what the write buffer flushes into. It notes when the
+// first byte of the response actually went out.
+type connWriter struct {
+	w *Writer
+}
+
+func (c connWriter) Write(p []byte) (int, error) {
+	if c.w.firstByte.IsZero() && len(p) > 0 {
+		c.w.firstByte = time.Now()
+	}
+	return c.w.writer.Write(p)
+}
+
+func (w *Writer) done() {
+	w.writerState = writerStateDone
+	w.completed = time.Now()
+}
+
+// checkState returns an error unless the writer is in want.
+func (w *Writer) checkState(want writerState, what string) error {
+	if w.writerState == want {
+		return nil
+	}
+	if w.writerState == writerStateDone {
+		return fmt.Errorf("cannot write %s: %w", what, ErrDone)
+	}
+	return fmt.Errorf("cannot write %s in state %s", what, w.writerState)
+}
+
+// isChunked reports whether h asks for chunked transfer coding.
+func isChunked(h *headers.Headers) bool {
+	for _, coding := range strings.Split(h.Get("Transfer-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(coding), "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Writer) setBodyMode(h *headers.Headers) error {
+	chunked := isChunked(h)
+	switch {
+	case w.statusCode == NoContent || w.statusCode == NotModified:
+		// these never have a body, whatever the headers say; a 304's
+		// Content-Length describes the representation it stands in for
+		w.mode = bodyModeFixed
+		w.contentLength = 0
+	case chunked && h.Has("Content-Length"):
+		return fmt.Errorf("cannot send both Content-Length and Transfer-Encoding: chunked")
+	case chunked:
+		w.mode = bodyModeChunked
+		w.unchunked = w.framer != nil || w.protoMajor == 1 && w.protoMinor == 0
+	case h.Has("Content-Length"):
+		// a sign would be sent on to the client, where it is invalid
+		contentLength, err := headers.ParseContentLength(h.Get("Content-Length"))
 		if err != nil {
 			return err
 		}
+		w.mode = bodyModeFixed
+		w.contentLength = contentLength
+	default:
+		w.mode = bodyModeUntilClose
+	}
+
+	w.trailers = map[string]bool{}
+	for _, name := range strings.Split(h.Get("Trailer"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			w.trailers[strings.ToLower(name)] = true
+		}
+	}
+	return nil
+}
+
+// unchunkedHeaders returns a copy of h for a chunked body sent bare to
+// an HTTP/1.0 client, which ends when the connection closes.
+func unchunkedHeaders(h *headers.Headers) *headers.Headers {
+	h = h.Clone()
+	var codings []string
+	for _, coding := range strings.Split(h.Get("Transfer-Encoding"), ",") {
+		if coding = strings.TrimSpace(coding); coding != "" && !strings.EqualFold(coding, "chunked") {
+			codings = append(codings, coding)
+		}
+	}
+	h.Remove("Transfer-Encoding")
+	if len(codings) > 0 {
+		h.Set("Transfer-Encoding", strings.Join(codings, ", "))
+	}
+	h.Remove("Trailer")
+	h.Override("Connection", "close")
+	return h
+}
+
+// writeFields writes h in the order the fields were set, followed by the
+// blank line that ends the section. Repeated fields are combined onto one
+// line, except Set-Cookie which can't be comma-joined.
+func (w *Writer) writeFields(h *headers.Headers) error {
+	for _, name := range h.Names() {
+		values := h.Values(name)
+		if name != "set-cookie" {
+			values = []string{strings.Join(values, ", ")}
+		}
+		if w.canonicalHeaders {
+			name = headers.CanonicalName(name)
+		}
+		for _, v := range values {
+			_, err := w.write([]byte(fmt.Sprintf("%s: %s\r\n", name, v)))
+			if err != nil {
+				return err
+			}
+		}
 	}
-	_, err := w.writer.Write([]byte("\r\n"))
+	_, err := w.write([]byte("\r\n"))
 	return err
 }
@@ -0,0 +1,604 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+)
+
+func TestWriter_WriteHeaders_Order(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Set-Cookie", "a=1")
+	h.Set("Vary", "Accept")
+	h.Set("Set-Cookie", "b=2")
+	h.Set("Vary", "Accept-Encoding")
+
+	// Test: Insertion order, lowercase names
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"content-type: text/plain\r\n"+
+		"set-cookie: a=1\r\n"+
+		"set-cookie: b=2\r\n"+
+		"vary: Accept, Accept-Encoding\r\n"+
+		"\r\n", buf.String())
+
+	// Test: Canonical names
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetCanonicalHeaders(true)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Vary: Accept, Accept-Encoding\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestWriter_WriteHeaders_Injection(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{name: "CRLF in value", key: "Location", value: "/next\r\nSet-Cookie: admin=1"},
+		{name: "bare LF in value", key: "Location", value: "/next\nX: y"},
+		{name: "bare CR in value", key: "Location", value: "/next\rX: y"},
+		{name: "NUL in value", key: "X-Name", value: "a\x00b"},
+		{name: "space in name", key: "X Name", value: "ok"},
+		{name: "colon in name", key: "X-Name:", value: "ok"},
+		{name: "CRLF in name", key: "X-Name\r\nX-Other", value: "ok"},
+		{name: "empty name", key: "", value: "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.NewHeaders()
+			h.Set("Content-Type", "text/plain")
+			h.Set(tt.key, tt.value)
+
+			buf := &bytes.Buffer{}
+			w := NewWriter(buf)
+			require.NoError(t, w.WriteStatusLine(OK))
+			buf.Reset()
+			err := w.WriteHeaders(h)
+			var headerErr *HeaderError
+			require.ErrorAs(t, err, &headerErr)
+			assert.Empty(t, buf.String())
+
+			// the same checks apply to trailers
+			w = NewWriter(buf)
+			require.NoError(t, w.WriteStatusLine(OK))
+			th := headers.NewHeaders()
+			th.Set("Transfer-Encoding", "chunked")
+			require.NoError(t, w.WriteHeaders(th))
+			_, err = w.WriteChunkedBodyDone()
+			require.NoError(t, err)
+			buf.Reset()
+			err = w.WriteTrailers(h)
+			require.ErrorAs(t, err, &headerErr)
+			assert.Empty(t, buf.String())
+		})
+	}
+
+	// Test: Token characters beyond letters and digits are allowed
+	h := headers.NewHeaders()
+	h.Set("X_Custom.Header~1", "fine\tvalue")
+	w := NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+}
+
+func TestWriter_Lifecycle(t *testing.T) {
+	fixed := func(n string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", n)
+		return h
+	}
+	chunked := func(trailers string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		if trailers != "" {
+			h.Set("Trailer", trailers)
+		}
+		return h
+	}
+	trailer := func(name, value string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set(name, value)
+		return h
+	}
+
+	type step struct {
+		name    string
+		do      func(w *Writer) error
+		wantErr bool
+	}
+	status := step{"status line", func(w *Writer) error { return w.WriteStatusLine(OK) }, false}
+	statusErr := step{"status line", func(w *Writer) error { return w.WriteStatusLine(OK) }, true}
+	hdrs := func(h *headers.Headers, wantErr bool) step {
+		return step{"headers", func(w *Writer) error { return w.WriteHeaders(h) }, wantErr}
+	}
+	body := func(p string, wantErr bool) step {
+		return step{"body " + p, func(w *Writer) error { _, err := w.WriteBody([]byte(p)); return err }, wantErr}
+	}
+	chunk := func(p string, wantErr bool) step {
+		return step{"chunk " + p, func(w *Writer) error { _, err := w.WriteChunkedBody([]byte(p)); return err }, wantErr}
+	}
+	chunkDone := func(wantErr bool) step {
+		return step{"chunk done", func(w *Writer) error { _, err := w.WriteChunkedBodyDone(); return err }, wantErr}
+	}
+	trailers := func(h *headers.Headers, wantErr bool) step {
+		return step{"trailers", func(w *Writer) error { return w.WriteTrailers(h) }, wantErr}
+	}
+	finish := func(wantErr bool) step {
+		return step{"finish", func(w *Writer) error { return w.Finish() }, wantErr}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  string
+	}{
+		{
+			name:  "fixed length body",
+			steps: []step{status, hdrs(fixed("5"), false), body("he", false), body("llo", false), finish(false)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\nhello",
+		},
+		{
+			name:  "fixed length body overflow",
+			steps: []step{status, hdrs(fixed("3"), false), body("he", false), body("llo", true), body("l", false), finish(false)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 3\r\n\r\nhel",
+		},
+		{
+			name:  "fixed length body short",
+			steps: []step{status, hdrs(fixed("5"), false), body("he", false), finish(true), body("llo", true)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\nhe",
+		},
+		{
+			name:  "fixed length rejects chunks",
+			steps: []step{status, hdrs(fixed("5"), false), chunk("hello", true), chunkDone(true)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\n",
+		},
+		{
+			name:  "invalid content length",
+			steps: []step{status, hdrs(fixed("-1"), true), hdrs(fixed("abc"), true), hdrs(fixed("+5"), true), hdrs(fixed("0"), false), finish(false)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 0\r\n\r\n",
+		},
+		{
+			name: "content length and chunked",
+			steps: []step{status, hdrs(func() *headers.Headers {
+				h := chunked("")
+				h.Set("Content-Length", "5")
+				return h
+			}(), true)},
+			want: "HTTP/1.1 200 OK\r\n",
+		},
+		{
+			name:  "close delimited body",
+			steps: []step{status, hdrs(headers.NewHeaders(), false), body("any", false), body("thing", false), finish(false), body("more", true)},
+			want:  "HTTP/1.1 200 OK\r\n\r\nanything",
+		},
+		{
+			name: "chunked body with declared trailer",
+			steps: []step{status, hdrs(chunked("X-Sum"), false), chunk("hello", false), body("raw", true),
+				chunkDone(false), chunk("late", true), trailers(trailer("X-Sum", "1"), false), finish(false)},
+			want: "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\ntrailer: X-Sum\r\n\r\n5\r\nhello\r\n0\r\nx-sum: 1\r\n\r\n",
+		},
+		{
+			name: "chunked body with undeclared trailer",
+			steps: []step{status, hdrs(chunked("X-Sum"), false), chunkDone(false),
+				trailers(trailer("X-Other", "1"), true), trailers(trailer("x-sum", "1"), false)},
+			want: "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\ntrailer: X-Sum\r\n\r\n0\r\nx-sum: 1\r\n\r\n",
+		},
+		{
+			name:  "chunked body finished without trailers",
+			steps: []step{status, hdrs(chunked(""), false), chunk("hi", false), finish(false), chunk("again", true)},
+			want:  "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n",
+		},
+		{
+			name:  "finish in trailers state",
+			steps: []step{status, hdrs(chunked(""), false), chunkDone(false), finish(false), trailers(headers.NewHeaders(), true)},
+			want:  "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name:  "done refuses everything",
+			steps: []step{status, hdrs(fixed("0"), false), finish(false), statusErr, hdrs(fixed("0"), true), body("", true), finish(false)},
+			want:  "HTTP/1.1 200 OK\r\ncontent-length: 0\r\n\r\n",
+		},
+		{
+			name:  "out of order",
+			steps: []step{hdrs(fixed("0"), true), body("x", true), chunkDone(true), trailers(headers.NewHeaders(), true), status, statusErr},
+			want:  "HTTP/1.1 200 OK\r\n",
+		},
+		{
+			name:  "finish before headers",
+			steps: []step{status, finish(true), hdrs(fixed("0"), true)},
+			want:  "HTTP/1.1 200 OK\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := NewWriter(buf)
+			for i, s := range tt.steps {
+				err := s.do(w)
+				if s.wantErr {
+					assert.Error(t, err, "step %d (%s)", i, s.name)
+				} else {
+					assert.NoError(t, err, "step %d (%s)", i, s.name)
+				}
+			}
+			require.NoError(t, w.Flush())
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestWriter_ErrDone(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	_, err := w.WriteBody([]byte("x"))
+	assert.ErrorIs(t, err, ErrDone)
+}
+
+func TestWriter_Observability(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.Equal(t, StatusCode(0), w.StatusCode())
+	assert.Nil(t, w.Headers())
+	assert.Zero(t, w.TimeToFirstByte())
+
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	assert.Equal(t, NotFound, w.StatusCode())
+	assert.Zero(t, w.TimeToFirstByte(), "nothing has left the buffer yet")
+	require.NoError(t, w.Flush())
+	assert.NotZero(t, w.TimeToFirstByte())
+
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	h.Set("X-Changed-Later", "1")
+	assert.Equal(t, []string{"transfer-encoding"}, w.Headers().Names())
+
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte(" world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), w.BytesWritten())
+	assert.Zero(t, w.TimeToComplete())
+
+	require.NoError(t, w.Finish())
+	assert.GreaterOrEqual(t, w.TimeToComplete(), w.TimeToFirstByte())
+}
+
+func TestWriter_Intercept(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	var phases []string
+	w.Intercept(Interceptor{
+		StatusLine: func(next StatusLineFunc, statusCode StatusCode, reasonPhrase string) error {
+			phases = append(phases, "inner status")
+			return next(statusCode, reasonPhrase)
+		},
+		Body: func(next BodyFunc, p []byte) (int, error) {
+			phases = append(phases, "inner body")
+			return next(bytes.ToUpper(p))
+		},
+	})
+	w.Intercept(Interceptor{
+		StatusLine: func(next StatusLineFunc, statusCode StatusCode, reasonPhrase string) error {
+			phases = append(phases, "outer status")
+			return next(Created, StatusText(Created))
+		},
+		Headers: func(next HeadersFunc, h *headers.Headers) error {
+			phases = append(phases, "outer headers")
+			h.Set("X-Request-Id", "abc")
+			return next(h)
+		},
+		Trailers: func(next HeadersFunc, h *headers.Headers) error {
+			phases = append(phases, "outer trailers")
+			return next(h)
+		},
+	})
+
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	assert.Equal(t, []string{"outer status", "inner status", "outer headers", "inner body", "outer trailers"}, phases)
+	assert.Equal(t, Created, w.StatusCode())
+	assert.Equal(t, "HTTP/1.1 201 Created\r\n"+
+		"transfer-encoding: chunked\r\n"+
+		"x-request-id: abc\r\n"+
+		"\r\n"+
+		"2\r\nHI\r\n"+
+		"0\r\n\r\n", buf.String())
+}
+
+func TestWriter_InterceptReframe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Intercept(Interceptor{
+		Headers: func(next HeadersFunc, h *headers.Headers) error {
+			h = h.Clone()
+			h.Remove("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Sum")
+			return next(h)
+		},
+		Trailers: func(next HeadersFunc, h *headers.Headers) error {
+			h = h.Clone()
+			h.Set("X-Sum", "1")
+			return next(h)
+		},
+	})
+
+	// Test: a handler writing a fixed-length body still can when an
+	// interceptor makes it chunked
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"content-type: text/plain\r\n"+
+		"transfer-encoding: chunked\r\n"+
+		"trailer: X-Sum\r\n"+
+		"\r\n"+
+		"5\r\nhello\r\n"+
+		"0\r\nx-sum: 1\r\n\r\n", buf.String())
+}
+
+type countingWriter struct {
+	writes int
+	bytes.Buffer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestWriter_CoalescesWrites(t *testing.T) {
+	// Test: Status line, headers and a small body go out in one write
+	out := &countingWriter{}
+	w := NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	h.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, out.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, out.writes)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\ncontent-type: text/plain\r\n\r\nhello", out.String())
+
+	// Test: Flush pushes out each chunk of a streamed body
+	out = &countingWriter{}
+	w = NewWriterSize(out, 64)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	for _, chunk := range []string{"one", "two", "three"} {
+		_, err := w.WriteChunkedBody([]byte(chunk))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+	}
+	assert.Equal(t, 3, out.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 4, out.writes)
+
+	// Test: 100 Continue is sent immediately
+	out = &countingWriter{}
+	w = NewWriter(out)
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", out.String())
+}
+
+func TestWriter_DiscardBody(t *testing.T) {
+	// Test: Fixed-length body is dropped but Content-Length is kept
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(5)))
+	n, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\n", buf.String())
+
+	// Test: No chunk framing or trailers
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailerHeaders("X-Sum", "1")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\ntrailer: X-Sum\r\n\r\n", buf.String())
+}
+
+func TestWriter_NotModified(t *testing.T) {
+	// Test: A 304 has no body even with a Content-Length, so the
+	// connection isn't left waiting for one
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(NotModified))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(5)))
+	_, err := w.Write([]byte("hello"))
+	assert.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.False(t, w.CloseDelimited())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\ncontent-length: 5\r\n\r\n", buf.String())
+}
+
+func trailerHeaders(name, value string) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set(name, value)
+	return h
+}
+
+func TestWriter_HTTP10(t *testing.T) {
+	// Test: Status line mirrors the version
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetVersion(1, 0)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(5)))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\ncontent-length: 5\r\n\r\nhello", buf.String())
+	assert.False(t, w.CloseDelimited())
+
+	// Test: Chunked body falls back to close-delimited
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetVersion(1, 0)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	h.Set("Connection", "keep-alive")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailerHeaders("X-Sum", "1")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nconnection: close\r\n\r\nhello world", buf.String())
+	assert.True(t, w.CloseDelimited())
+	assert.Equal(t, int64(11), w.BytesWritten())
+	assert.False(t, w.Headers().Has("Transfer-Encoding"))
+
+	// Test: Undeclared trailers are still rejected
+	w = NewWriter(&bytes.Buffer{})
+	w.SetVersion(1, 0)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "gzip, chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "gzip", w.Headers().Get("Transfer-Encoding"))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	var headerErr *HeaderError
+	require.ErrorAs(t, w.WriteTrailers(trailerHeaders("X-Sum", "1")), &headerErr)
+
+	// Test: HTTP/1.1 chunked body is not close-delimited
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.False(t, w.CloseDelimited())
+}
+
+// recordingFramer records what a framed Writer hands it.
+type recordingFramer struct {
+	events []string
+}
+
+func (f *recordingFramer) Write(p []byte) (int, error) {
+	f.events = append(f.events, "data "+string(p))
+	return len(p), nil
+}
+
+func (f *recordingFramer) WriteHeaders(statusCode StatusCode, h *headers.Headers) error {
+	f.events = append(f.events, fmt.Sprintf("headers %d %s", statusCode, strings.Join(h.Names(), ",")))
+	return nil
+}
+
+func (f *recordingFramer) WriteTrailers(h *headers.Headers) error {
+	f.events = append(f.events, "trailers "+strings.Join(h.Names(), ","))
+	return nil
+}
+
+func (f *recordingFramer) Flush() error {
+	return nil
+}
+
+func (f *recordingFramer) Close() error {
+	f.events = append(f.events, "close")
+	return nil
+}
+
+func TestWriter_Framer(t *testing.T) {
+	// Test: Chunked body with trailers
+	f := &recordingFramer{}
+	w := NewFramedWriter(f)
+	require.NoError(t, w.WriteContinue())
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailerHeaders("X-Sum", "1")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{
+		"headers 100 ",
+		"headers 200 transfer-encoding,trailer",
+		"data hello world",
+		"trailers x-sum",
+		"close",
+	}, f.events)
+	assert.Equal(t, int64(11), w.BytesWritten())
+	assert.False(t, w.CloseDelimited())
+
+	// Test: Fixed-length body is ended by Close
+	f = &recordingFramer{}
+	w = NewFramedWriter(f)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(4)))
+	_, err = w.Write([]byte("gone"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{"headers 404 content-length", "data gone", "close"}, f.events)
+
+	// Test: Content-Length is still enforced
+	w = NewFramedWriter(&recordingFramer{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(fixedHeaders(2)))
+	_, err = w.Write([]byte("toolong"))
+	require.Error(t, err)
+}
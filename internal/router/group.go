@@ -0,0 +1,71 @@
+package router
+
+import (
+	"strings"
+
+	"httpfromtcp/internal/server"
+)
+
+// Group registers routes under a shared path prefix and wraps them in
+// shared middleware. Middleware added with Use only applies to routes
+// registered after it.
+type Group struct {
+	router     *Router
+	prefix     string
+	middleware []server.Middleware
+}
+
+// Group returns a subgroup whose routes are prefixed with prefix and
+// wrapped in this group's middleware followed by mw.
+func (g *Group) Group(prefix string, mw ...server.Middleware) *Group {
+	middleware := append([]server.Middleware(nil), g.middleware...)
+	return &Group{
+		router:     g.router,
+		prefix:     g.prefix + strings.TrimSuffix(prefix, "/"),
+		middleware: append(middleware, mw...),
+	}
+}
+
+// Use adds middleware to every route registered on the group from now on.
+func (g *Group) Use(mw ...server.Middleware) {
+	g.middleware = append(g.middleware, mw...)
+}
+
+// Handle registers h for method and pattern. An empty method matches
+// any method.
+func (g *Group) Handle(method, pattern string, h server.Handler) {
+	g.router.add(method, g.prefix+pattern, server.Chain(g.middleware...)(h))
+}
+
+func (g *Group) Get(pattern string, h server.Handler) {
+	g.Handle("GET", pattern, h)
+}
+
+func (g *Group) Head(pattern string, h server.Handler) {
+	g.Handle("HEAD", pattern, h)
+}
+
+func (g *Group) Post(pattern string, h server.Handler) {
+	g.Handle("POST", pattern, h)
+}
+
+func (g *Group) Put(pattern string, h server.Handler) {
+	g.Handle("PUT", pattern, h)
+}
+
+func (g *Group) Patch(pattern string, h server.Handler) {
+	g.Handle("PATCH", pattern, h)
+}
+
+func (g *Group) Delete(pattern string, h server.Handler) {
+	g.Handle("DELETE", pattern, h)
+}
+
+func (g *Group) Options(pattern string, h server.Handler) {
+	g.Handle("OPTIONS", pattern, h)
+}
+
+// Any registers h for every method.
+func (g *Group) Any(pattern string, h server.Handler) {
+	g.Handle("", pattern, h)
+}
@@ -0,0 +1,239 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Router dispatches requests to handlers by method and path. Patterns
+// are made of "/"-separated segments, each of which is a literal, a
+// parameter like "{id}" that matches one segment, or, as the last
+// segment only, a wildcard like "{path...}" that matches the rest of the
+// path. Matched values are available from request.PathValue.
+//
+// When several patterns match, literals win over parameters and
+// parameters over wildcards. A path that matches a pattern registered
+// for other methods only gets a 405 with an Allow header; anything else
+// gets a 404. HEAD requests fall back to the GET handler.
+type Router struct {
+	*rootGroup
+	root       *node
+	middleware []server.Middleware
+	notFound   server.Handler
+}
+
+func New() *Router {
+	rt := &Router{
+		root:     &node{},
+		notFound: notFound,
+	}
+	rt.rootGroup = &Group{router: rt}
+	return rt
+}
+
+// rootGroup lets Router embed a Group without the embedded field's name
+// hiding the promoted Group method.
+type rootGroup = Group
+
+// Use adds middleware that wraps every request the router sees,
+// including the ones that end in a 404 or 405. Unlike Group.Use it
+// applies to routes registered before it was called.
+func (rt *Router) Use(mw ...server.Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+// SetNotFound replaces the handler used when no route matches.
+func (rt *Router) SetNotFound(h server.Handler) {
+	rt.notFound = h
+}
+
+// ServeHTTP is a server.Handler that dispatches req to the matching route.
+func (rt *Router) ServeHTTP(w *response.Writer, req *request.Request) {
+	server.Chain(rt.middleware...)(rt.dispatch)(w, req)
+}
+
+func (rt *Router) dispatch(w *response.Writer, req *request.Request) {
+	path := req.URL.Path
+	if req.URL.Form != request.OriginForm && req.URL.Form != request.AbsoluteForm {
+		rt.notFound(w, req)
+		return
+	}
+
+	method := req.RequestLine.Method
+	var found *route
+	var values []string
+	var allowed []string
+	rt.root.match(strings.Split(path[1:], "/"), nil, func(n *node, matched []string) bool {
+		if r := n.lookup(method); r != nil {
+			found = r
+			values = append([]string(nil), matched...)
+			return true
+		}
+		allowed = append(allowed, n.methods()...)
+		return false
+	})
+
+	switch {
+	case found != nil:
+		for i, name := range found.names {
+			req.SetPathValue(name, values[i])
+		}
+		found.handler(w, req)
+	case len(allowed) > 0:
+		methodNotAllowed(w, allowed)
+	default:
+		rt.notFound(w, req)
+	}
+}
+
+func (rt *Router) add(method, pattern string, h server.Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("router: pattern %q must start with /", pattern))
+	}
+	n := rt.root
+	var names []string
+	segments := strings.Split(pattern[1:], "/")
+	for i, seg := range segments {
+		name, wildcard, isParam := parseSegment(seg)
+		switch {
+		case wildcard:
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: wildcard in %q must be the last segment", pattern))
+			}
+			if n.wildcard == nil {
+				n.wildcard = &node{}
+			}
+			n = n.wildcard
+			names = append(names, name)
+		case isParam:
+			if n.param == nil {
+				n.param = &node{}
+			}
+			n = n.param
+			names = append(names, name)
+		default:
+			if n.literal == nil {
+				n.literal = map[string]*node{}
+			}
+			if n.literal[seg] == nil {
+				n.literal[seg] = &node{}
+			}
+			n = n.literal[seg]
+		}
+	}
+	if n.routes == nil {
+		n.routes = map[string]*route{}
+	}
+	if _, ok := n.routes[method]; ok {
+		panic(fmt.Sprintf("router: %s %s registered twice", methodName(method), pattern))
+	}
+	n.routes[method] = &route{handler: h, names: names}
+}
+
+// parseSegment reports whether seg is a "{name}" parameter or a
+// "{name...}" wildcard, and its name.
+func parseSegment(seg string) (name string, wildcard bool, isParam bool) {
+	if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+		return "", false, false
+	}
+	name = seg[1 : len(seg)-1]
+	name, wildcard = strings.CutSuffix(name, "...")
+	if name == "" {
+		panic(fmt.Sprintf("router: empty parameter name in segment %q", seg))
+	}
+	return name, wildcard, true
+}
+
+type route struct {
+	handler server.Handler
+	names   []string
+}
+
+type node struct {
+	literal  map[string]*node
+	param    *node
+	wildcard *node
+	// routes is keyed by method, with "" for routes that take any method
+	routes map[string]*route
+}
+
+// match walks the tree for segs in priority order, calling fn for every
+// node with routes that the whole path matches, along with the values
+// captured on the way. It stops as soon as fn returns true.
+func (n *node) match(segs []string, values []string, fn func(n *node, values []string) bool) bool {
+	if len(segs) == 0 {
+		return n.routes != nil && fn(n, values)
+	}
+	seg, rest := segs[0], segs[1:]
+	if child := n.literal[seg]; child != nil {
+		if child.match(rest, values, fn) {
+			return true
+		}
+	}
+	if n.param != nil && seg != "" {
+		if n.param.match(rest, append(values, seg), fn) {
+			return true
+		}
+	}
+	if n.wildcard != nil && n.wildcard.routes != nil {
+		if fn(n.wildcard, append(values, strings.Join(segs, "/"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the route for method, falling back from HEAD to GET
+// and then to a route that takes any method.
+func (n *node) lookup(method string) *route {
+	if r := n.routes[method]; r != nil {
+		return r
+	}
+	if method == "HEAD" {
+		if r := n.routes["GET"]; r != nil {
+			return r
+		}
+	}
+	return n.routes[""]
+}
+
+func (n *node) methods() []string {
+	var methods []string
+	for method := range n.routes {
+		methods = append(methods, method)
+		if method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+	}
+	return methods
+}
+
+func methodName(method string) string {
+	if method == "" {
+		return "ANY"
+	}
+	return method
+}
+
+func notFound(w *response.Writer, _ *request.Request) {
+	response.WriteStatus(w, response.NotFound, nil)
+}
+
+func methodNotAllowed(w *response.Writer, allowed []string) {
+	sort.Strings(allowed)
+	var methods []string
+	for i, method := range allowed {
+		if i == 0 || method != allowed[i-1] {
+			methods = append(methods, method)
+		}
+	}
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(methods, ", "))
+	response.WriteStatus(w, response.MethodNotAllowed, h)
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+func newRequest(t *testing.T, method, target string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// serve runs a request through rt and returns the raw response.
+func serve(t *testing.T, rt *Router, method, target string) string {
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	req := newRequest(t, method, target)
+	if method == "HEAD" {
+		w.DiscardBody()
+	}
+	rt.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+// text replies with 200 and the given body, followed by any path values
+// named in params.
+func text(body string, params ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		out := body
+		for _, p := range params {
+			out += " " + p + "=" + req.PathValue(p)
+		}
+		response.NewAutoWriter(w, response.OK, nil).Write([]byte(out))
+	}
+}
+
+func bodyOf(resp string) string {
+	_, body, _ := strings.Cut(resp, "\r\n\r\n")
+	return body
+}
+
+func TestRouter_Match(t *testing.T) {
+	rt := New()
+	rt.Get("/", text("root"))
+	rt.Get("/users", text("list"))
+	rt.Get("/users/new", text("new"))
+	rt.Get("/users/{id}", text("show", "id"))
+	rt.Get("/users/{id}/posts/{post}", text("post", "id", "post"))
+	rt.Get("/static/{path...}", text("static", "path"))
+	rt.Get("/files/{name}", text("file", "name"))
+	rt.Get("/files/{rest...}", text("files", "rest"))
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/", "root"},
+		{"/users", "list"},
+		{"/users/new", "new"},
+		{"/users/42", "show id=42"},
+		{"/users/42?verbose=1", "show id=42"},
+		{"/users/a%20b", "show id=a b"},
+		{"//users///42", "show id=42"},
+		{"/static/css/../js/app.js", "static path=js/app.js"},
+		{"http://localhost/users/7", "show id=7"},
+		{"/users/42/posts/7", "post id=42 post=7"},
+		{"/static/css/site.css", "static path=css/site.css"},
+		{"/static/", "static path="},
+		{"/files/a.txt", "file name=a.txt"},
+		{"/files/a/b.txt", "files rest=a/b.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			resp := serve(t, rt, "GET", tt.target)
+			assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+			assert.Equal(t, tt.want, bodyOf(resp))
+		})
+	}
+
+	// Test: No match
+	for _, target := range []string{"/nope", "/users/42/posts", "/static", "/users/"} {
+		resp := serve(t, rt, "GET", target)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), "%s: %s", target, resp)
+	}
+	resp := serve(t, rt, "OPTIONS", "*")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), resp)
+}
+
+func TestRouter_Methods(t *testing.T) {
+	rt := New()
+	rt.Get("/items/{id}", text("get", "id"))
+	rt.Put("/items/{id}", text("put", "id"))
+	rt.Delete("/items/{id}", text("delete", "id"))
+	rt.Head("/explicit", text("head"))
+	rt.Get("/explicit", text("get"))
+	rt.Post("/search", text("search"))
+	rt.Any("/ping", text("pong"))
+
+	assert.Equal(t, "put id=1", bodyOf(serve(t, rt, "PUT", "/items/1")))
+	assert.Equal(t, "pong", bodyOf(serve(t, rt, "PATCH", "/ping")))
+
+	// Test: 405 lists the allowed methods, with HEAD implied by GET
+	resp := serve(t, rt, "POST", "/items/1")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"), resp)
+	assert.Contains(t, resp, "allow: DELETE, GET, HEAD, PUT\r\n")
+
+	resp = serve(t, rt, "GET", "/search")
+	assert.Contains(t, resp, "allow: POST\r\n")
+
+	// Test: HEAD falls back to GET without a body
+	resp = serve(t, rt, "HEAD", "/items/1")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-length: 8\r\n")
+	assert.Equal(t, "", bodyOf(resp))
+
+	// Test: An explicit HEAD route wins
+	resp = serve(t, rt, "HEAD", "/explicit")
+	assert.Contains(t, resp, "content-length: 4\r\n")
+}
+
+func TestRouter_GroupsAndMiddleware(t *testing.T) {
+	var calls []string
+	tag := func(name string) func(server.Handler) server.Handler {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name)
+				next(w, req)
+			}
+		}
+	}
+
+	rt := New()
+	rt.Use(tag("router"))
+	api := rt.Group("/api", tag("api"))
+	v1 := api.Group("/v1/", tag("v1"))
+	v1.Get("/users/{id}", text("user", "id"))
+	api.Use(tag("late"))
+	api.Get("/health", text("ok"))
+	rt.Get("/public", text("public"))
+
+	assert.Equal(t, "user id=3", bodyOf(serve(t, rt, "GET", "/api/v1/users/3")))
+	assert.Equal(t, []string{"router", "api", "v1"}, calls)
+
+	calls = nil
+	assert.Equal(t, "ok", bodyOf(serve(t, rt, "GET", "/api/health")))
+	assert.Equal(t, []string{"router", "api", "late"}, calls)
+
+	calls = nil
+	assert.Equal(t, "public", bodyOf(serve(t, rt, "GET", "/public")))
+	assert.Equal(t, []string{"router"}, calls)
+
+	// Test: Router middleware sees 404s too
+	calls = nil
+	rt.SetNotFound(text("custom not found"))
+	assert.Equal(t, "custom not found", bodyOf(serve(t, rt, "GET", "/api/missing")))
+	assert.Equal(t, []string{"router"}, calls)
+}
+
+func TestRouter_InvalidPatterns(t *testing.T) {
+	rt := New()
+	assert.Panics(t, func() { rt.Get("users", text("")) })
+	assert.Panics(t, func() { rt.Get("/a/{rest...}/b", text("")) })
+	assert.Panics(t, func() { rt.Get("/a/{}", text("")) })
+	rt.Get("/dup", text(""))
+	assert.Panics(t, func() { rt.Get("/dup", text("")) })
+}
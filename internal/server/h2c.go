@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"net"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// sniffPreface reads from the start of a connection for as long as it
+// matches the HTTP/2 client preface, and reports whether all of it
+// arrived. Whatever was read is left in r for the next reader either
+// way. An HTTP/1.x request line differs from the preface within its
+// first few bytes.
+func sniffPreface(r *connReader) bool {
+	buf := make([]byte, len(http2.ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := r.conn.Read(buf[n:])
+		n += m
+		if !strings.HasPrefix(http2.ClientPreface, string(buf[:n])) || err != nil {
+			r.pending = buf[:n]
+			return false
+		}
+	}
+	r.pending = buf[:n]
+	return true
+}
+
+// h2cUpgrade reports whether req asks to upgrade to HTTP/2 over
+// cleartext, per RFC 7540 section 3.2, and returns the settings from
+// its HTTP2-Settings header.
+func h2cUpgrade(req *request.Request) ([]http2.Setting, bool) {
+	if !req.ProtoAtLeast(1, 1) || !hasToken(req.Headers, "Upgrade", "h2c") ||
+		!hasToken(req.Headers, "Connection", "upgrade") || !hasToken(req.Headers, "Connection", "http2-settings") {
+		return nil, false
+	}
+	values := req.Headers.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, false
+	}
+	settings, err := http2.ParseSettings(payload)
+	if err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// serveUpgrade switches the connection to HTTP/2 and serves req as its
+// first stream. The body has to be read first, since everything after
+// the 101 response is HTTP/2.
+func (s *Server) serveUpgrade(conn net.Conn, r *connReader, req *request.Request, settings []http2.Setting) {
+	setConnInfo(req, conn)
+	w := response.NewWriterSize(conn, s.config.WriteBufferSize)
+	req.SetContinueHook(w.WriteContinue)
+	if _, err := req.ReadBody(); err != nil {
+		log.Printf("Error reading upgrade request body: %v", err)
+		return
+	}
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	w.WriteStatusLine(response.SwitchingProtocols)
+	w.WriteHeaders(h)
+	if err := w.Finish(); err != nil {
+		log.Printf("Error switching protocols: %v", err)
+		return
+	}
+	r.pending = req.Buffered()
+	s.h2.ServeConn(conn, http2.ServeConnOpts{Reader: r, Upgrade: req, Settings: settings})
+}
+
+func hasToken(h *headers.Headers, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,38 +1,231 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/http3"
+	"httpfromtcp/internal/quic"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
-// Server is an HTTP 1.1 server
+// Middleware wraps a Handler to add behavior before or after it runs.
+type Middleware func(Handler) Handler
+
+// Chain combines middleware into one, with the first wrapping the rest:
+// Chain(a, b)(h) runs a, then b, then h.
+func Chain(mw ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		return h
+	}
+}
+
+// Config holds the settings for a Server. Zero values fall back to
+// defaults.
+type Config struct {
+	Port int
+	// Host is the address to listen on, such as "127.0.0.1" to take
+	// connections only from this machine. Empty means every interface.
+	Host string
+	// WriteBufferSize is the size of each response's write buffer.
+	WriteBufferSize int
+	// IdleTimeout is how long a connection may take to send each
+	// request, and how long a kept-alive one may wait for its next
+	// request, before it is closed. It also bounds the TLS handshake and
+	// the HTTP/2 preface.
+	IdleTimeout time.Duration
+	// MaxBodyBytes caps the body of a request. An HTTP/1.x request
+	// that is larger is answered with 413 as soon as that is known,
+	// before it is buffered, and an HTTP/2 stream is reset. 0 means no
+	// limit for HTTP/1.x and http2.DefaultMaxBodyBytes for HTTP/2.
+	MaxBodyBytes int64
+	// MaxConcurrentStreams is how many requests an HTTP/2 client may
+	// have in flight on one connection.
+	MaxConcurrentStreams uint32
+	// TLSConfig is the base configuration for ServeTLS. It is cloned,
+	// and "h2" and "http/1.1" are offered over ALPN unless it sets its
+	// own NextProtos.
+	TLSConfig *tls.Config
+	// EnableHTTP3 makes ServeTLS also serve HTTP/3 over QUIC on the same
+	// port number over UDP, and advertise it to HTTP/1.1 and HTTP/2
+	// clients with an Alt-Svc header. HTTP/3 support is experimental.
+	EnableHTTP3 bool
+}
+
+// altSvcMaxAge is how long, in seconds, clients may remember the
+// HTTP/3 endpoint an Alt-Svc header advertises.
+const altSvcMaxAge = 86400
+
+// DefaultIdleTimeout is the IdleTimeout used when Config leaves it zero.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// Server is an HTTP/1.1 server that also answers HTTP/1.0 clients, and
+// HTTP/2 clients over cleartext (h2c) that either start with the
+// HTTP/2 preface or upgrade from HTTP/1.1. Over TLS, ALPN picks
+// HTTP/2 or HTTP/1.1 for each connection, and HTTP/3 can be served
+// alongside over QUIC. HTTP/1.x connections are kept open for further
+// requests when both the client and the response allow it.
 type Server struct {
 	handler  Handler
+	config   Config
 	listener net.Listener
 	closed   atomic.Bool
+	h2       *http2.Server
+	// h3 and h3Listener are set when HTTP/3 is enabled
+	h3         *http3.Server
+	h3Listener *quic.Listener
+
+	// conns maps each open connection to whether it is idle, waiting
+	// for a request, so Shutdown can close it straight away
+	mu           sync.Mutex
+	conns        map[net.Conn]bool
+	wg           sync.WaitGroup
+	shuttingDown bool
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return ServeConfig(Config{Port: port}, handler)
+}
+
+func ServeConfig(config Config, handler Handler) (*Server, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
 	if err != nil {
 		return nil, err
 	}
+	return newServer(config, listener, nil, handler), nil
+}
+
+// ServeTLS is like ServeConfig but serves HTTPS with the certificate
+// and key in the given PEM files. Clients that offer "h2" over ALPN
+// get HTTP/2, and the rest HTTP/1.x. With Config.EnableHTTP3, HTTP/3
+// is served on the same port number over UDP.
+func ServeTLS(config Config, certFile, keyFile string, handler Handler) (*Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	// RFC 9113 section 9.2 rules out anything older for HTTP/2
+	if tlsConfig.MinVersion < tls.VersionTLS12 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if !config.EnableHTTP3 {
+		return newServer(config, tls.NewListener(listener, tlsConfig), nil, handler), nil
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	h3TLSConfig := tlsConfig.Clone()
+	h3TLSConfig.NextProtos = []string{http3.NextProto}
+	h3Listener, err := quic.Listen(net.JoinHostPort(config.Host, strconv.Itoa(port)), h3TLSConfig, &quic.Config{
+		MaxIdleTimeout:     config.IdleTimeout,
+		MaxIncomingStreams: int64(config.MaxConcurrentStreams),
+	})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return newServer(config, tls.NewListener(listener, tlsConfig), h3Listener, handler), nil
+}
+
+// newServer serves handler on listener, and on h3Listener too unless
+// it is nil.
+func newServer(config Config, listener net.Listener, h3Listener *quic.Listener, handler Handler) *Server {
+	if config.WriteBufferSize <= 0 {
+		config.WriteBufferSize = response.DefaultBufferSize
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
 	s := &Server{
 		handler:  handler,
+		config:   config,
 		listener: listener,
+		conns:    map[net.Conn]bool{},
+		h2: &http2.Server{
+			Handler:              handler,
+			MaxConcurrentStreams: config.MaxConcurrentStreams,
+			IdleTimeout:          config.IdleTimeout,
+			WriteBufferSize:      config.WriteBufferSize,
+			MaxBodyBytes:         config.MaxBodyBytes,
+		},
+	}
+	if h3Listener != nil {
+		s.h3 = &http3.Server{Handler: handler, WriteBufferSize: config.WriteBufferSize}
+		s.h3Listener = h3Listener
+		// clients that came over TCP learn where to find HTTP/3
+		port := h3Listener.Addr().(*net.UDPAddr).Port
+		s.handler = advertiseHTTP3(port)(handler)
+		s.h2.Handler = s.handler
+		go s.listenHTTP3()
 	}
 	go s.listen()
-	return s, nil
+	return s
 }
 
+// advertiseHTTP3 adds an Alt-Svc header naming the HTTP/3 port to
+// responses that don't set one themselves.
+func advertiseHTTP3(port int) Middleware {
+	value := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.Intercept(response.Interceptor{
+				Headers: func(next response.HeadersFunc, h *headers.Headers) error {
+					if !h.Has("Alt-Svc") {
+						h = h.Clone()
+						h.Set("Alt-Svc", value)
+					}
+					return next(h)
+				},
+			})
+			next(w, req)
+		}
+	}
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections. It also closes every HTTP/3
+// connection, which share the one UDP socket.
 func (s *Server) Close() error {
+	err := s.stopAccepting()
+	if s.h3Listener != nil {
+		s.h3Listener.Close()
+	}
+	return err
+}
+
+func (s *Server) stopAccepting() error {
 	s.closed.Store(true)
 	if s.listener != nil {
 		return s.listener.Close()
@@ -40,6 +233,48 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown stops accepting connections and waits for the open ones to
+// finish. Idle HTTP/1.x connections are closed at once and busy ones
+// after their current response, which says "Connection: close". HTTP/2
+// and HTTP/3 connections get a GOAWAY and close once their streams are
+// done. If ctx ends first, the remaining connections are closed and its
+// error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopAccepting()
+	if s.h3Listener != nil {
+		defer s.h3Listener.Close()
+	}
+	s.mu.Lock()
+	s.shuttingDown = true
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	s.h2.Shutdown()
+	if s.h3 != nil {
+		s.h3.Shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
@@ -50,21 +285,237 @@ func (s *Server) listen() {
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
+		if !s.setIdle(conn, true) {
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
 		go s.handle(conn)
 	}
 }
 
+// listenHTTP3 serves each HTTP/3 connection, counting them with the
+// TCP ones so Shutdown waits for both.
+func (s *Server) listenHTTP3() {
+	for {
+		c, err := s.h3Listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.h3.ServeConn(c)
+		}()
+	}
+}
+
+// setIdle records whether conn is waiting for a request. It reports
+// false, leaving conn alone, once Shutdown has started and conn is
+// about to go idle or has just been accepted.
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown && idle {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
 func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
 	defer conn.Close()
-	w := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		w.WriteStatusLine(response.BadRequest)
-		body := []byte(fmt.Sprintf("Error parsing request: %v", err))
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		w.WriteBody(body)
-		return
+	r := &connReader{conn: conn}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(s.config.IdleTimeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			return
+		}
+		s.setIdle(conn, false)
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			s.h2.ServeConn(conn, http2.ServeConnOpts{})
+			return
+		}
+	} else {
+		conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		preface := sniffPreface(r)
+		conn.SetReadDeadline(time.Time{})
+		s.setIdle(conn, false)
+		if preface {
+			s.h2.ServeConn(conn, http2.ServeConnOpts{Reader: r})
+			return
+		}
+	}
+	for first := true; ; first = false {
+		if !first && !s.setIdle(conn, true) {
+			return
+		}
+		// a client that trickles its request in holds the connection
+		// open, so the first request is bounded as well as the rest
+		conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		req, err := request.RequestFromReaderLimit(r, s.config.MaxBodyBytes)
+		s.setIdle(conn, false)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || errors.As(err, &netErr) && netErr.Timeout() {
+				// the client closed or went idle between requests
+				return
+			}
+			w := response.NewWriterSize(conn, s.config.WriteBufferSize)
+			statusCode := response.BadRequest
+			switch {
+			case errors.Is(err, request.ErrUnsupportedExpectation):
+				statusCode = response.ExpectationFailed
+			case errors.Is(err, request.ErrUnsupportedVersion):
+				statusCode = response.HTTPVersionNotSupported
+			case errors.Is(err, request.ErrUnsupportedTransferCoding):
+				statusCode = response.NotImplemented
+			case errors.Is(err, request.ErrBodyTooLarge):
+				statusCode = response.ContentTooLarge
+			}
+			writeError(w, statusCode, err)
+			lingerClose(conn)
+			return
+		}
+		if settings, ok := h2cUpgrade(req); ok {
+			s.serveUpgrade(conn, r, req, settings)
+			return
+		}
+		if !s.serve(conn, req) {
+			return
+		}
+		r.pending = req.Buffered()
+	}
+}
+
+// serve runs the handler for one request and reports whether the
+// connection can be used for another.
+func (s *Server) serve(conn net.Conn, req *request.Request) bool {
+	setConnInfo(req, conn)
+	w := response.NewWriterSize(conn, s.config.WriteBufferSize)
+	if !req.ProtoAtLeast(1, 1) {
+		w.SetVersion(1, 0)
+	}
+	// a shutdown that starts while the handler runs still gets to say
+	// "Connection: close" in the response
+	keepAlive := func() bool { return req.KeepAlive() && !s.isShuttingDown() }
+	w.Intercept(connectionHeader(req, keepAlive))
+	// a handler that rejects the request from its headers alone never
+	// calls ReadBody, so the client is never told to send the body
+	req.SetContinueHook(w.WriteContinue)
+	if req.RequestLine.Method == "HEAD" {
+		w.DiscardBody()
 	}
 	s.handler(w, req)
-	return
+	if err := w.Finish(); err != nil {
+		log.Printf("Error finishing response: %v", err)
+		return false
+	}
+	switch {
+	case hasToken(w.Headers(), "Connection", "close"):
+		// checked first: a handler that closes the connection may have
+		// left req in use on another goroutine
+		return false
+	case !keepAlive(), w.CloseDelimited():
+		return false
+	case !req.Complete():
+		// the body was never read, or was given up on partway, so the
+		// next request can't be found
+		return false
+	}
+	return true
+}
+
+// setConnInfo records the client address and TLS state of the
+// connection a request arrived on.
+func setConnInfo(req *request.Request, conn net.Conn) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+}
+
+// connectionHeader adds a Connection header to responses that don't
+// set one themselves: "close" when the client asked for it, and
+// "keep-alive" for HTTP/1.0 clients that asked to keep a connection
+// whose response has a known length.
+func connectionHeader(req *request.Request, keepAlive func() bool) response.Interceptor {
+	return response.Interceptor{
+		Headers: func(next response.HeadersFunc, h *headers.Headers) error {
+			if h.Has("Connection") {
+				return next(h)
+			}
+			switch {
+			case !keepAlive():
+				h = h.Clone()
+				h.Set("Connection", "close")
+			case !req.ProtoAtLeast(1, 1) && h.Has("Content-Length"):
+				h = h.Clone()
+				h.Set("Connection", "keep-alive")
+			}
+			return next(h)
+		},
+	}
+}
+
+// lingerClose stops writing and discards whatever the client is still
+// sending for a while before the connection is closed. Closing with
+// unread data makes the kernel send a reset, which can destroy the
+// error response before the client reads it.
+func lingerClose(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcp.CloseWrite()
+	tcp.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, tcp, maxLingerBytes)
+}
+
+const (
+	lingerTimeout  = 500 * time.Millisecond
+	maxLingerBytes = 256 << 10
+)
+
+// connReader reads from the connection after first returning any bytes
+// the previous request read past its end.
+type connReader struct {
+	conn    net.Conn
+	pending []byte
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.conn.Read(p)
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, err error) {
+	w.WriteStatusLine(statusCode)
+	body := []byte(fmt.Sprintf("Error parsing request: %v", err))
+	h := response.GetDefaultHeaders(len(body))
+	// the connection is closed after an unparsable request
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+	w.Finish()
 }
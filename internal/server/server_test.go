@@ -0,0 +1,558 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/http3"
+	"httpfromtcp/internal/qpack"
+	"httpfromtcp/internal/quic"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// echoPath replies with the request path and a Content-Length, without
+// asking for the connection to be closed.
+func echoPath(w *response.Writer, req *request.Request) {
+	body := []byte(req.URL.Path)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// dial starts a server with h and connects to it.
+func dial(t *testing.T, config Config, h Handler) (net.Conn, *bufio.Reader) {
+	s, err := ServeConfig(config, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+type testResponse struct {
+	statusLine string
+	headers    *headers.Headers
+	body       string
+}
+
+// readResponse reads one response, using Content-Length to find the end
+// of the body if there is one and reading to EOF otherwise.
+func readResponse(t *testing.T, br *bufio.Reader) testResponse {
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	resp := testResponse{statusLine: strings.TrimSuffix(statusLine, "\r\n"), headers: headers.NewHeaders()}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		name, value, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), ":")
+		resp.headers.Set(name, strings.TrimSpace(value))
+	}
+	var body []byte
+	if cl := resp.headers.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		require.NoError(t, err)
+		body = make([]byte, n)
+		_, err = io.ReadFull(br, body)
+		require.NoError(t, err)
+	} else {
+		body, err = io.ReadAll(br)
+		require.NoError(t, err)
+	}
+	resp.body = string(body)
+	return resp
+}
+
+// assertClosed checks that the server closed the connection.
+func assertClosed(t *testing.T, br *bufio.Reader) {
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	conn, br := dial(t, Config{}, echoPath)
+
+	// Test: HTTP/1.1 connections stay open
+	for _, path := range []string{"/one", "/two"} {
+		_, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp := readResponse(t, br)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.False(t, resp.headers.Has("Connection"))
+		assert.Equal(t, path, resp.body)
+	}
+
+	// Test: Connection: close is honored and echoed
+	_, err := io.WriteString(conn, "GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, br)
+	assert.Equal(t, "close", resp.headers.Get("Connection"))
+	assert.Equal(t, "/three", resp.body)
+	assertClosed(t, br)
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	conn, br := dial(t, Config{}, echoPath)
+	_, err := io.WriteString(conn,
+		"POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"+
+			"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+			"POST /chunked HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-T: 1\r\n\r\n"+
+			"GET /c HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	for _, path := range []string{"/a", "/b", "/chunked", "/c"} {
+		assert.Equal(t, path, readResponse(t, br).body)
+	}
+	assertClosed(t, br)
+}
+
+func TestServer_HTTP10(t *testing.T) {
+	// Test: Closed by default
+	conn, br := dial(t, Config{}, echoPath)
+	_, err := io.WriteString(conn, "GET /old HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.0 200 OK", resp.statusLine)
+	assert.Equal(t, "close", resp.headers.Get("Connection"))
+	assert.Equal(t, "/old", resp.body)
+	assertClosed(t, br)
+
+	// Test: Keep-alive on request
+	conn, br = dial(t, Config{}, echoPath)
+	_, err = io.WriteString(conn, "GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, br)
+	assert.Equal(t, "keep-alive", resp.headers.Get("Connection"))
+	_, err = io.WriteString(conn, "GET /b HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, br)
+	assert.Equal(t, "/b", resp.body)
+	assertClosed(t, br)
+
+	// Test: Chunked responses are sent close-delimited
+	conn, br = dial(t, Config{}, func(w *response.Writer, req *request.Request) {
+		response.NewAutoWriter(w, response.OK, nil).Flush()
+		w.Write([]byte("streamed"))
+	})
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, br)
+	assert.Equal(t, "HTTP/1.0 200 OK", resp.statusLine)
+	assert.False(t, resp.headers.Has("Transfer-Encoding"))
+	assert.Equal(t, "close", resp.headers.Get("Connection"))
+	assert.Equal(t, "streamed", resp.body)
+}
+
+func TestServer_Errors(t *testing.T) {
+	tests := []struct {
+		request    string
+		statusLine string
+	}{
+		{"GET / HTTP/2.0\r\nHost: localhost\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported"},
+		{"GET / HTTP/1.1\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nExpect: teapot\r\n\r\n", "HTTP/1.1 417 Expectation Failed"},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 501 Not Implemented"},
+	}
+	for _, tt := range tests {
+		conn, br := dial(t, Config{}, echoPath)
+		_, err := io.WriteString(conn, tt.request)
+		require.NoError(t, err)
+		assert.Equal(t, tt.statusLine, readResponse(t, br).statusLine)
+		assertClosed(t, br)
+	}
+}
+
+func TestServer_MaxBodyBytes(t *testing.T) {
+	for _, req := range []string{
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n6\r\n",
+	} {
+		conn, br := dial(t, Config{MaxBodyBytes: 5}, echoPath)
+		_, err := io.WriteString(conn, req)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 413 Content Too Large", readResponse(t, br).statusLine)
+		assertClosed(t, br)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	conn, br := dial(t, Config{IdleTimeout: 50 * time.Millisecond}, echoPath)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, br)
+	assertClosed(t, br)
+
+	// Test: A first request, or HTTP/2 preface, that never finishes
+	// arriving is cut off too
+	for _, partial := range []string{"", "GET / HTTP/1.1\r\nHost: local", "PRI * HTTP/2"} {
+		conn, br := dial(t, Config{IdleTimeout: 50 * time.Millisecond}, echoPath)
+		_, err := io.WriteString(conn, partial)
+		require.NoError(t, err)
+		assertClosed(t, br)
+	}
+}
+
+func TestServer_H2CPriorKnowledge(t *testing.T) {
+	s, err := ServeConfig(Config{}, echoPath)
+	require.NoError(t, err)
+	defer s.Close()
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	for _, path := range []string{"/one", "/two"} {
+		resp, err := client.Get("http://" + s.Addr().String() + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, path, string(body))
+	}
+}
+
+func TestServer_H2CUpgrade(t *testing.T) {
+	conn, br := dial(t, Config{}, echoPath)
+	settings := base64.RawURLEncoding.EncodeToString(http2.AppendSettings(nil, http2.Setting{ID: http2.SettingInitialWindowSize, Value: 1 << 20}))
+	_, err := io.WriteString(conn, "POST /upgraded HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: "+settings+"\r\n"+
+		"Content-Length: 4\r\n\r\nbody")
+	require.NoError(t, err)
+
+	resp := readResponseHeaders(t, br)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", resp.statusLine)
+	assert.Equal(t, "h2c", resp.headers.Get("Upgrade"))
+
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	_, err = conn.Write(http2.AppendFrame(nil, http2.FrameSettings, 0, 0, nil))
+	require.NoError(t, err)
+
+	// the response to the upgrade request comes on stream 1
+	dec := hpack.NewDecoder(hpack.DefaultTableSize)
+	var status, body string
+	for {
+		f, err := http2.ReadFrame(br, 1<<14)
+		require.NoError(t, err)
+		if f.StreamID != 1 {
+			continue
+		}
+		if f.Type == http2.FrameHeaders {
+			fields, err := dec.Decode(f.Payload)
+			require.NoError(t, err)
+			status = fields[0].Value
+		}
+		if f.Type == http2.FrameData {
+			body += string(f.Payload)
+			if f.Flags.Has(http2.FlagEndStream) {
+				break
+			}
+		}
+	}
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/upgraded", body)
+}
+
+// readResponseHeaders reads a status line and header section only.
+func readResponseHeaders(t *testing.T, br *bufio.Reader) testResponse {
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	resp := testResponse{statusLine: strings.TrimSuffix(statusLine, "\r\n"), headers: headers.NewHeaders()}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return resp
+		}
+		name, value, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), ":")
+		resp.headers.Set(name, strings.TrimSpace(value))
+	}
+}
+
+func TestH2CUpgrade_Detection(t *testing.T) {
+	settings := "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n"
+	tests := []struct {
+		name string
+		raw  string
+		ok   bool
+	}{
+		{"upgrade", "GET / HTTP/1.1\r\nHost: a\r\n" + settings + "\r\n", true},
+		{"HTTP/1.0", "GET / HTTP/1.0\r\n" + settings + "\r\n", false},
+		{"no settings", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n", false},
+		{"websocket", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: websocket\r\nHTTP2-Settings: \r\n\r\n", false},
+		{"bad settings", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAM\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := request.RequestFromReader(strings.NewReader(tt.raw))
+			require.NoError(t, err)
+			_, ok := h2cUpgrade(req)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its
+// key to PEM files, and returns a pool that trusts it.
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS_ALPN(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	s, err := ServeTLS(Config{}, certFile, keyFile, echoPath)
+	require.NoError(t, err)
+	defer s.Close()
+	url := "https://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name  string
+		http2 bool
+		proto string
+	}{
+		{"h2", true, "HTTP/2.0"},
+		{"http/1.1", false, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool},
+				ForceAttemptHTTP2: tt.http2,
+			}
+			defer tr.CloseIdleConnections()
+			client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+			for _, path := range []string{"/one", "/two"} {
+				resp, err := client.Get(url + path)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, tt.proto, resp.Proto)
+				assert.Equal(t, path, string(body))
+			}
+		})
+	}
+}
+
+func TestServer_ConnInfo(t *testing.T) {
+	connInfo := func(w *response.Writer, req *request.Request) {
+		body := []byte(fmt.Sprintf("%s tls=%t", req.RemoteAddr, req.TLS != nil))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+
+	// Test: cleartext requests know the client's address
+	conn, br := dial(t, Config{}, connInfo)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().String()+" tls=false", readResponse(t, br).body)
+
+	// Test: and so do HTTP/2 requests over TLS, which see its state
+	certFile, keyFile, pool := writeTestCert(t)
+	s, err := ServeTLS(Config{}, certFile, keyFile, connInfo)
+	require.NoError(t, err)
+	defer s.Close()
+	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get("https://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Regexp(t, `^127\.0\.0\.1:\d+ tls=true$`, string(body))
+}
+
+func TestServeTLS_HTTP3(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	s, err := ServeTLS(Config{EnableHTTP3: true}, certFile, keyFile, echoPath)
+	require.NoError(t, err)
+	defer s.Close()
+	port := s.Addr().(*net.TCPAddr).Port
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	// Test: HTTP/1.1 and HTTP/2 responses advertise HTTP/3 on the same
+	// port
+	for _, h2 := range []bool{false, true} {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: h2}
+		client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+		resp, err := client.Get("https://" + addr + "/alt")
+		require.NoError(t, err)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+		assert.Equal(t, fmt.Sprintf(`h3=":%d"; ma=86400`, port), resp.Header.Get("Alt-Svc"), resp.Proto)
+	}
+
+	// Test: the same handler answers over HTTP/3, without Alt-Svc
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.Dial(ctx, addr, &tls.Config{RootCAs: pool, NextProtos: []string{http3.NextProto}}, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	st, err := conn.OpenStream()
+	require.NoError(t, err)
+	fields := []qpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: addr},
+		{Name: ":path", Value: "/three"},
+	}
+	_, err = st.Write(http3.AppendFrame(nil, http3.FrameHeaders, qpack.NewEncoder().AppendFields(nil, fields)))
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	resp := map[string]string{}
+	var body []byte
+	br := bufio.NewReader(st)
+	for {
+		typ, err := http3.ReadVarint(br)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		length, err := http3.ReadVarint(br)
+		require.NoError(t, err)
+		p := make([]byte, length)
+		_, err = io.ReadFull(br, p)
+		require.NoError(t, err)
+		switch http3.FrameType(typ) {
+		case http3.FrameHeaders:
+			fs, err := qpack.NewDecoder().Decode(p)
+			require.NoError(t, err)
+			for _, f := range fs {
+				resp[f.Name] = f.Value
+			}
+		case http3.FrameData:
+			body = append(body, p...)
+		}
+	}
+	assert.Equal(t, "200", resp[":status"])
+	assert.Empty(t, resp["alt-svc"])
+	assert.Equal(t, "/three", string(body))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	s, err := ServeConfig(Config{}, func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		echoPath(w, req)
+	})
+	require.NoError(t, err)
+	connect := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// one connection sits idle after a response, another is mid-request
+	idle, idleBR := connect()
+	_, err = io.WriteString(idle, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, idleBR)
+	busy, busyBR := connect()
+	_, err = io.WriteString(busy, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	// Test: Idle connections are closed straight away
+	assertClosed(t, idleBR)
+
+	// Test: The request in flight finishes, and the connection closes
+	close(release)
+	resp := readResponse(t, busyBR)
+	assert.Equal(t, "/slow", resp.body)
+	assert.Equal(t, "close", resp.headers.Get("Connection"))
+	assertClosed(t, busyBR)
+	require.NoError(t, <-done)
+
+	// Test: New connections are refused
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, err := ServeConfig(Config{}, func(w *response.Writer, req *request.Request) {
+		<-release
+	})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	// Test: Connections still busy when the context ends are closed
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assertClosed(t, bufio.NewReader(conn))
+}
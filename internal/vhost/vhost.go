@@ -0,0 +1,129 @@
+// Package vhost dispatches requests to different handlers by the host
+// they are addressed to.
+package vhost
+
+import (
+	"fmt"
+	"strings"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Dispatcher routes requests by hostname. Hosts are registered either
+// exactly, like "api.example.com", or as a wildcard like
+// "*.example.com", which matches any subdomain at any depth but not
+// example.com itself. Exact hosts win over wildcards, and longer
+// wildcards win over shorter ones. Ports are ignored when matching.
+//
+// Requests for a host nothing matches go to the default handler, or get
+// a 421 Misdirected Request if there is none.
+type Dispatcher struct {
+	exact map[string]server.Handler
+	// wildcard is keyed by the suffix after the "*", like ".example.com"
+	wildcard map[string]server.Handler
+	fallback server.Handler
+}
+
+func New() *Dispatcher {
+	return &Dispatcher{
+		exact:    map[string]server.Handler{},
+		wildcard: map[string]server.Handler{},
+	}
+}
+
+// Handle registers h for host, which is a hostname without a port,
+// optionally prefixed with "*." to match its subdomains.
+func (d *Dispatcher) Handle(host string, h server.Handler) {
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	hosts := d.exact
+	if suffix, ok := strings.CutPrefix(name, "*"); ok {
+		if !strings.HasPrefix(suffix, ".") {
+			panic(fmt.Sprintf("vhost: wildcard %q must be of the form *.domain", host))
+		}
+		name, hosts = suffix, d.wildcard
+	}
+	if !validHostname(strings.TrimPrefix(name, ".")) {
+		panic(fmt.Sprintf("vhost: invalid host %q", host))
+	}
+	if _, ok := hosts[name]; ok {
+		panic(fmt.Sprintf("vhost: host %q registered twice", host))
+	}
+	hosts[name] = h
+}
+
+// SetDefault sets the handler for requests whose host matches nothing.
+func (d *Dispatcher) SetDefault(h server.Handler) {
+	d.fallback = h
+}
+
+// ServeHTTP is a server.Handler that dispatches req by its host.
+func (d *Dispatcher) ServeHTTP(w *response.Writer, req *request.Request) {
+	if h := d.lookup(Hostname(req.Host())); h != nil {
+		h(w, req)
+		return
+	}
+	if d.fallback != nil {
+		d.fallback(w, req)
+		return
+	}
+	response.WriteStatus(w, response.MisdirectedRequest, nil)
+}
+
+func (d *Dispatcher) lookup(host string) server.Handler {
+	if host == "" {
+		return nil
+	}
+	if h, ok := d.exact[host]; ok {
+		return h
+	}
+	// try ".b.example.com", then ".example.com", then ".com"
+	for i := strings.IndexByte(host, '.'); i != -1; {
+		if h, ok := d.wildcard[host[i:]]; ok {
+			return h
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return nil
+}
+
+// Hostname strips the port and any trailing dot from a host as returned
+// by request.Request.Host.
+func Hostname(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.IndexByte(host, ']'); end != -1 {
+			return host[:end+1]
+		}
+		return host
+	}
+	if i := strings.LastIndexByte(host, ':'); i != -1 {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+func validHostname(name string) bool {
+	if strings.HasPrefix(name, "[") {
+		return strings.HasSuffix(name, "]") && len(name) > 2
+	}
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package vhost
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// serve runs a request for host through d and returns the raw response.
+func serve(t *testing.T, d *Dispatcher, host string) string {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	d.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func text(body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		response.NewAutoWriter(w, response.OK, nil).Write([]byte(body))
+	}
+}
+
+func bodyOf(resp string) string {
+	_, body, _ := strings.Cut(resp, "\r\n\r\n")
+	return body
+}
+
+func TestDispatcher_Match(t *testing.T) {
+	d := New()
+	d.Handle("example.com", text("apex"))
+	d.Handle("API.example.com", text("api"))
+	d.Handle("*.example.com", text("any"))
+	d.Handle("*.eu.example.com", text("eu"))
+	d.Handle("[::1]", text("loopback"))
+	d.SetDefault(text("default"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "apex"},
+		{"example.com:8080", "apex"},
+		{"example.com.", "apex"},
+		{"api.example.com", "api"},
+		{"Api.Example.Com:443", "api"},
+		{"www.example.com", "any"},
+		{"a.b.example.com", "any"},
+		{"eu.example.com", "any"},
+		{"paris.eu.example.com", "eu"},
+		{"[::1]:42069", "loopback"},
+		{"example.org", "default"},
+		{"notexample.com", "default"},
+		{"localhost", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.want, bodyOf(serve(t, d, tt.host)))
+		})
+	}
+}
+
+func TestDispatcher_NoDefault(t *testing.T) {
+	d := New()
+	d.Handle("example.com", text("apex"))
+	resp := serve(t, d, "other.example")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 421 Misdirected Request\r\n"), resp)
+}
+
+func TestDispatcher_AbsoluteForm(t *testing.T) {
+	d := New()
+	d.Handle("example.com", text("apex"))
+	req, err := request.RequestFromReader(strings.NewReader("GET http://EXAMPLE.com/x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	d.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "apex", bodyOf(buf.String()))
+}
+
+func TestDispatcher_HandlePanics(t *testing.T) {
+	d := New()
+	d.Handle("example.com", text("apex"))
+	assert.Panics(t, func() { d.Handle("example.com", text("again")) })
+	assert.Panics(t, func() { d.Handle("Example.COM.", text("again")) })
+	assert.Panics(t, func() { d.Handle("", text("empty")) })
+	assert.Panics(t, func() { d.Handle("example.com:80", text("port")) })
+	assert.Panics(t, func() { d.Handle("*example.com", text("bad wildcard")) })
+	assert.Panics(t, func() { d.Handle("a.*.example.com", text("inner wildcard")) })
+	assert.Panics(t, func() { d.Handle("a..example.com", text("empty label")) })
+	assert.NotPanics(t, func() { d.Handle("*.example.com", text("wildcard")) })
+}